@@ -0,0 +1,510 @@
+package zmachine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"unicode"
+)
+
+// How a routine or string was found.
+const (
+	FOUND_ENTRY     = "entry"        // The routine holding the initial PC
+	FOUND_CALL      = "call"         // Called with a constant address
+	FOUND_REFERENCE = "reference"    // A packed address in an instruction's operands
+	FOUND_PROPERTY  = "property"     // A packed address in an object's properties
+	FOUND_ABBREV    = "abbreviation" // In the abbreviations table
+	FOUND_SCAN      = "scan"         // Lying between others, but never referred to
+)
+
+// A routine found by Analyze.
+type AnalyzedRoutine struct {
+	Routine    Routine `json:"-"`
+	Address    int     `json:"address"`
+	End        int     `json:"end"`
+	Name       string  `json:"name,omitempty"`
+	Found      string  `json:"found"`
+	Reachable  bool    `json:"reachable"` // Whether it can be reached from the entry point or an object
+	Calls      []int   `json:"calls"`     // Routines called with a constant address
+	Callers    []int   `json:"callers"`
+	References []int   `json:"references,omitempty"` // Other routines and strings given by packed addresses
+	Indirect   int     `json:"indirectCalls"`        // Calls to a routine held in a variable
+	Unreached  []int   `json:"unreachedCode,omitempty"`
+}
+
+// A string found by Analyze.
+type AnalyzedString struct {
+	Address int    `json:"address"`
+	Length  int    `json:"length"` // In bytes
+	Found   string `json:"found"`
+	Text    string `json:"text"`
+}
+
+// Something wrong found in the story, such as an illegal opcode.
+type AnalysisProblem struct {
+	Address int    `json:"address"`
+	Problem string `json:"problem"`
+}
+
+// What can be learned about a story without running it: its routines and
+// strings, how they refer to each other, and anything illegal in its code.
+type Analysis struct {
+	Version  byte               `json:"version"`
+	Entry    int                `json:"entry"`
+	Routines []*AnalyzedRoutine `json:"routines"` // In address order
+	Strings  []*AnalyzedString  `json:"strings"`  // In address order
+	Problems []AnalysisProblem  `json:"problems"`
+
+	routines map[int]*AnalyzedRoutine
+}
+
+// Analyses a story. Routines are found from the initial PC by following calls
+// and packed addresses in code and object properties, then, as txd does, by
+// looking for more where each known one ends. Strings are found from packed
+// addresses, abbreviations, and by reading the strings which follow the code.
+// With debugging information, routines are given their names.
+func Analyze(story []byte, symbols *DebugInfo) (*Analysis, error) {
+	if _, err := storyMachine(story); err != nil {
+		return nil, err
+	}
+	a := &analyzer{
+		story:    story,
+		version:  story[0],
+		high:     int(story[0x04])<<8 | int(story[0x05]),
+		analysis: &Analysis{Version: story[0], Entry: EntryRoutine(story), routines: make(map[int]*AnalyzedRoutine)},
+		strings:  make(map[int]*AnalyzedString),
+		rejected: make(map[int]bool),
+	}
+	a.addRoutine(a.analysis.Entry, FOUND_ENTRY, true)
+	a.values = a.propertyValues()
+	for _, value := range a.values {
+		a.addRoutine(a.unpackRoutine(value), FOUND_PROPERTY, false)
+	}
+	a.followReferences()
+	a.scanRoutines()
+	a.findStrings()
+	a.link()
+
+	analysis := a.analysis
+	for _, routine := range analysis.routines {
+		if r := symbols.routineStarting(routine.Address); r != nil {
+			routine.Name = r.Name
+		}
+		analysis.Routines = append(analysis.Routines, routine)
+	}
+	sort.Slice(analysis.Routines, func(i, j int) bool {
+		return analysis.Routines[i].Address < analysis.Routines[j].Address
+	})
+	for _, s := range a.strings {
+		analysis.Strings = append(analysis.Strings, s)
+	}
+	sort.Slice(analysis.Strings, func(i, j int) bool {
+		return analysis.Strings[i].Address < analysis.Strings[j].Address
+	})
+	sort.Slice(analysis.Problems, func(i, j int) bool {
+		return analysis.Problems[i].Address < analysis.Problems[j].Address
+	})
+	return analysis, nil
+}
+
+// Returns the routine starting at address, or nil.
+func (this *Analysis) Routine(address int) *AnalyzedRoutine {
+	return this.routines[address]
+}
+
+type analyzer struct {
+	story    []byte
+	version  byte
+	high     int // The start of high memory, where code and strings live
+	analysis *Analysis
+	strings  map[int]*AnalyzedString
+	rejected map[int]bool // Addresses which aren't routines
+	pending  []*AnalyzedRoutine
+	values   []uint16 // The words of every property, read once
+}
+
+// The unit in which routines and strings are aligned, by their packing.
+func (this *analyzer) alignment() int {
+	switch {
+	case this.version <= 3:
+		return 2
+	case this.version <= 7:
+		return 4
+	default:
+		return 8
+	}
+}
+
+func (this *analyzer) unpackRoutine(packed uint16) int {
+	return unpackRoutineAddress(packed, this.version, 8*(int(this.story[0x28])<<8|int(this.story[0x29])))
+}
+
+func (this *analyzer) unpackString(packed uint16) int {
+	if this.version == 6 || this.version == 7 {
+		return 4*int(packed) + 8*(int(this.story[0x2A])<<8|int(this.story[0x2B]))
+	}
+	return this.unpackRoutine(packed)
+}
+
+// Adds the routine at address, if there is one. Where the story must have a
+// routine, such as the target of a call, anything wrong is a problem; packed
+// addresses found elsewhere might be anything, and are just dismissed.
+func (this *analyzer) addRoutine(address int, found string, certain bool) bool {
+	if _, known := this.analysis.routines[address]; known {
+		return true
+	}
+	if this.rejected[address] || (!certain && (address < this.high || this.inRoutine(address))) {
+		return false
+	}
+	routine, err := DisassembleRoutine(this.story, address, this.version)
+	if err != nil {
+		this.rejected[address] = true
+		if certain {
+			this.problem(address, fmt.Sprintf("Routine %04x: %v", address, err))
+		}
+		if !certain || len(routine.Instructions) == 0 {
+			return false
+		}
+		// Keep what could be read, so that its calls are still followed.
+		last := routine.Instructions[len(routine.Instructions)-1]
+		routine.End = last.Address + last.Length
+	}
+	analyzed := &AnalyzedRoutine{Routine: routine, Address: address, End: routine.End, Found: found}
+	this.analysis.routines[address] = analyzed
+	this.pending = append(this.pending, analyzed)
+	return true
+}
+
+func (this *analyzer) problem(address int, problem string) {
+	this.analysis.Problems = append(this.analysis.Problems, AnalysisProblem{address, problem})
+}
+
+// Reports whether address lies inside a known routine.
+func (this *analyzer) inRoutine(address int) bool {
+	for _, routine := range this.analysis.routines {
+		if address >= routine.Address && address < routine.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Follows the calls and packed addresses in each new routine.
+func (this *analyzer) followReferences() {
+	for len(this.pending) > 0 {
+		routine := this.pending[0]
+		this.pending = this.pending[1:]
+		for _, instruction := range routine.Routine.Instructions {
+			if target, ok := instruction.CallTarget(); ok {
+				if target != 0 {
+					this.addRoutine(target, FOUND_CALL, true)
+				}
+				continue
+			}
+			if info := findOpcode(instruction.Count, instruction.Opcode, this.version); info != nil && info.flags&opcodeCalls != 0 {
+				routine.Indirect++
+				continue
+			}
+			if instruction.Name == "print_paddr" && instruction.OperandTypes[0] == OPERAND_TYPE_LARGE {
+				this.addString(this.unpackString(instruction.Operands[0]), FOUND_REFERENCE, true)
+				continue
+			}
+			if _, jumps := instruction.JumpTarget(); jumps {
+				continue
+			}
+			for i, t := range instruction.OperandTypes {
+				if t == OPERAND_TYPE_LARGE {
+					this.addRoutine(this.unpackRoutine(instruction.Operands[i]), FOUND_REFERENCE, false)
+				}
+			}
+		}
+	}
+}
+
+// Looks for routines following the end of each known one, until no more turn up.
+func (this *analyzer) scanRoutines() {
+	for {
+		found := false
+		for _, routine := range this.analysis.routines {
+			next := this.align(routine.End)
+			// Allow for a little padding between routines.
+			for _, address := range []int{next, next + this.alignment()} {
+				if address < len(this.story) && !this.inRoutine(address) && this.addRoutine(address, FOUND_SCAN, false) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return
+		}
+		this.followReferences()
+	}
+}
+
+func (this *analyzer) align(address int) int {
+	unit := this.alignment()
+	return (address + unit - 1) / unit * unit
+}
+
+// Decodes a string, returning its text and length.
+func (this *analyzer) readString(address int) (string, int, error) {
+	if address <= 0 || address >= len(this.story) {
+		return "", 0, fmt.Errorf("No string at 0x%x", address)
+	}
+	text, err := decodeText(this.story, address, this.version)
+	if err != nil {
+		return "", 0, err
+	}
+	end := address
+	for end+1 < len(this.story) && this.story[end]&0x80 == 0 {
+		end += 2
+	}
+	return text, end + 2 - address, nil
+}
+
+// Adds the string at address, if there is one, as for addRoutine.
+func (this *analyzer) addString(address int, found string, certain bool) bool {
+	if _, known := this.strings[address]; known {
+		return true
+	}
+	if !certain && (address < this.high || this.inRoutine(address)) {
+		return false
+	}
+	text, length, err := this.readString(address)
+	if err == nil && !certain && !printable(text) {
+		err = errors.New("unprintable")
+	}
+	if err != nil {
+		if certain {
+			this.problem(address, fmt.Sprintf("String %04x: %v", address, err))
+		}
+		return false
+	}
+	this.strings[address] = &AnalyzedString{address, length, found, text}
+	return true
+}
+
+func printable(text string) bool {
+	for _, r := range text {
+		if r != '\n' && !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Finds strings from abbreviations, properties, and those following the code.
+func (this *analyzer) findStrings() {
+	if this.version >= 2 {
+		table := int(this.story[0x18])<<8 | int(this.story[0x19])
+		for i := 0; i < 96 && table+2*i+1 < len(this.story); i++ {
+			address := 2 * (int(this.story[table+2*i])<<8 | int(this.story[table+2*i+1]))
+			if address != 0 {
+				this.addString(address, FOUND_ABBREV, true)
+			}
+		}
+	}
+	for _, value := range this.values {
+		address := this.unpackString(value)
+		if _, routine := this.analysis.routines[this.unpackRoutine(value)]; !routine {
+			this.addString(address, FOUND_PROPERTY, false)
+		}
+	}
+
+	// Compilers put the strings together after the last routine.
+	end := 0
+	for _, routine := range this.analysis.routines {
+		if routine.End > end {
+			end = routine.End
+		}
+	}
+	for address := this.align(end); address < len(this.story); {
+		if _, known := this.strings[address]; !known && !this.addString(address, FOUND_SCAN, false) {
+			break
+		}
+		address = this.align(address + this.strings[address].Length)
+	}
+}
+
+// Returns every word in the objects' property values, as candidate packed
+// addresses of routines and strings. Property tables which run off the end
+// of the story are problems.
+func (this *analyzer) propertyValues() []uint16 {
+	var values []uint16
+	story := this.story
+	for i, table := range objectPropertyTables(story) {
+		p := table + 1 + 2*int(story[table])
+		for p+1 < len(story) && story[p] != 0 {
+			size, header := propertySize(story, p)
+			if p+header+size > len(story) {
+				break
+			}
+			for j := 0; j+1 < size; j += 2 {
+				values = append(values, uint16(story[p+header+j])<<8|uint16(story[p+header+j+1]))
+			}
+			p += header + size
+		}
+		if p >= len(story) || story[p] != 0 {
+			this.problem(table, fmt.Sprintf("Object %d's properties run past the end of the story", i+1))
+		}
+	}
+	return values
+}
+
+// Fills in the call graph, which routines can be reached, and which of their
+// instructions can't.
+func (this *analyzer) link() {
+	routines := this.analysis.routines
+	for _, routine := range routines {
+		calls := make(map[int]bool)
+		references := make(map[int]bool)
+		for _, instruction := range routine.Routine.Instructions {
+			if target, ok := instruction.CallTarget(); ok {
+				if _, known := routines[target]; known {
+					calls[target] = true
+				}
+				continue
+			}
+			if instruction.Name == "print_paddr" && instruction.OperandTypes[0] == OPERAND_TYPE_LARGE {
+				references[this.unpackString(instruction.Operands[0])] = true
+				continue
+			}
+			if _, jumps := instruction.JumpTarget(); jumps {
+				continue
+			}
+			for i, t := range instruction.OperandTypes {
+				if t != OPERAND_TYPE_LARGE {
+					continue
+				}
+				if target := this.unpackRoutine(instruction.Operands[i]); routines[target] != nil && target != routine.Address {
+					references[target] = true
+				} else if address := this.unpackString(instruction.Operands[i]); this.strings[address] != nil {
+					references[address] = true
+				}
+			}
+		}
+		routine.Calls = sortedKeys(calls)
+		routine.References = sortedKeys(references)
+		for _, target := range routine.Calls {
+			routines[target].Callers = append(routines[target].Callers, routine.Address)
+		}
+		routine.Unreached = unreachedCode(routine.Routine)
+	}
+	for _, routine := range routines {
+		sort.Ints(routine.Callers)
+		if routine.Calls == nil {
+			routine.Calls = []int{}
+		}
+		if routine.Callers == nil {
+			routine.Callers = []int{}
+		}
+	}
+
+	// The story starts at the entry point, and the library can run any routine
+	// in a property.
+	var queue []*AnalyzedRoutine
+	for _, routine := range routines {
+		if routine.Found == FOUND_ENTRY || routine.Found == FOUND_PROPERTY {
+			routine.Reachable = true
+			queue = append(queue, routine)
+		}
+	}
+	for len(queue) > 0 {
+		routine := queue[0]
+		queue = queue[1:]
+		for _, targets := range [][]int{routine.Calls, routine.References} {
+			for _, target := range targets {
+				if next := routines[target]; next != nil && !next.Reachable {
+					next.Reachable = true
+					queue = append(queue, next)
+				}
+			}
+		}
+	}
+}
+
+// Returns the addresses of the instructions in a routine which no path from
+// its first instruction reaches.
+func unreachedCode(routine Routine) []int {
+	if len(routine.Instructions) == 0 {
+		return nil
+	}
+	index := make(map[int]int)
+	for i, instruction := range routine.Instructions {
+		index[instruction.Address] = i
+	}
+	reached := make([]bool, len(routine.Instructions))
+	queue := []int{0}
+	reached[0] = true
+	for len(queue) > 0 {
+		instruction := routine.Instructions[queue[0]]
+		queue = queue[1:]
+		var next []int
+		if !instruction.Returns() {
+			next = append(next, instruction.Address+instruction.Length)
+		}
+		if instruction.Branches && instruction.BranchOffset > 1 {
+			next = append(next, instruction.BranchTarget)
+		}
+		if target, ok := instruction.JumpTarget(); ok {
+			next = append(next, target)
+		}
+		for _, address := range next {
+			if i, ok := index[address]; ok && !reached[i] {
+				reached[i] = true
+				queue = append(queue, i)
+			}
+		}
+	}
+	var unreached []int
+	for i, instruction := range routine.Instructions {
+		if !reached[i] {
+			unreached = append(unreached, instruction.Address)
+		}
+	}
+	return unreached
+}
+
+// Writes the analysis as JSON. Addresses are numbers.
+func (this *Analysis) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Writes the call graph for Graphviz. Routines which can't be reached are
+// drawn dashed, and references other than calls as dotted edges.
+func (this *Analysis) WriteDOT(w io.Writer) error {
+	fmt.Fprintln(w, "digraph calls {")
+	fmt.Fprintln(w, "\tnode [shape=box, fontname=monospace];")
+	for _, routine := range this.Routines {
+		label := fmt.Sprintf("%04x", routine.Address)
+		if routine.Name != "" {
+			label = routine.Name + "\n" + label
+		}
+		style := ""
+		if !routine.Reachable {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(w, "\tr%x [label=%s%s];\n", routine.Address, strconv.Quote(label), style)
+	}
+	for _, routine := range this.Routines {
+		for _, target := range routine.Calls {
+			fmt.Fprintf(w, "\tr%x -> r%x;\n", routine.Address, target)
+		}
+		for _, target := range routine.References {
+			if this.routines[target] != nil {
+				fmt.Fprintf(w, "\tr%x -> r%x [style=dotted];\n", routine.Address, target)
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
@@ -0,0 +1,116 @@
+package zmachine
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns tracingStory with a routine after the code which is never called,
+// a routine given by an object's property, and a string after them all.
+func analysedStory() []byte {
+	story := tracingStory()
+	copy(story[0x608:], []byte{
+		0x00,             // No locals
+		0x8C, 0x00, 0x04, // jump 0x60E
+		0xB1, // rfalse, which is never reached
+		0xB1, // rfalse, which is never reached
+		0xB0, // rtrue
+	})
+	story[0x610], story[0x611] = 0x00, 0xB0 // No locals; rtrue
+	copy(story[0x612:], encodeTestText("hello"))
+	addTestObjects(story, testObject{name: "box", properties: []testProperty{{5, []byte{0x03, 0x08}}}})
+	return story
+}
+
+func TestAnalyze(t *testing.T) {
+	analysis, err := Analyze(analysedStory(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if analysis.Entry != testRoutines || len(analysis.Routines) != 4 || len(analysis.Problems) != 0 {
+		t.Fatalf("entry %04x, routines %+v, problems %v", analysis.Entry, analysis.Routines, analysis.Problems)
+	}
+
+	main, add := analysis.Routine(testRoutines), analysis.Routine(0x600)
+	if main.Found != FOUND_ENTRY || !main.Reachable || !reflect.DeepEqual(main.Calls, []int{0x600}) || main.End != 0x50C {
+		t.Errorf("main routine %+v", main)
+	}
+	if add.Found != FOUND_CALL || !add.Reachable || !reflect.DeepEqual(add.Callers, []int{testRoutines}) {
+		t.Errorf("called routine %+v", add)
+	}
+	if unused := analysis.Routine(0x608); unused.Found != FOUND_SCAN || unused.Reachable || !reflect.DeepEqual(unused.Unreached, []int{0x60C, 0x60D}) {
+		t.Errorf("unused routine %+v", unused)
+	}
+	if property := analysis.Routine(0x610); property.Found != FOUND_PROPERTY || !property.Reachable {
+		t.Errorf("property routine %+v", property)
+	}
+
+	if len(analysis.Strings) != 1 || *analysis.Strings[0] != (AnalyzedString{0x612, 4, FOUND_SCAN, "hello"}) {
+		t.Errorf("strings %+v", analysis.Strings)
+	}
+}
+
+func TestAnalyzeProblems(t *testing.T) {
+	story := testStory(3)
+	copy(story[testRoutines+1:], []byte{
+		0xE0, 0x3F, 0x03, 0x80, 0x00, // call 0x700 -> sp
+		0xBA, // quit
+	})
+	story[0x700] = 16 // Too many locals
+	analysis, err := Analyze(story, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(analysis.Problems) != 1 || analysis.Problems[0].Address != 0x700 {
+		t.Errorf("problems %v", analysis.Problems)
+	}
+
+	if _, err := Analyze([]byte("FORM"), nil); err == nil {
+		t.Error("analysed a file which isn't a story")
+	}
+
+	// A property whose data is past the end of the story.
+	story = testStory(3)
+	entry := testObjects + 62
+	story[entry+7], story[entry+8] = 0x07, 0xFE
+	story[0x7FF] = 0x21 // Two bytes of property 1
+	if analysis, err = Analyze(story, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(analysis.Problems) != 1 || analysis.Problems[0].Address != 0x7FE {
+		t.Errorf("problems %v", analysis.Problems)
+	}
+}
+
+func TestAnalysisOutput(t *testing.T) {
+	analysis, err := Analyze(analysedStory(), &DebugInfo{Routines: []*DebugRoutine{{Name: "Main", Address: testRoutines}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := analysis.WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Routines []struct {
+			Address int
+			Name    string
+		}
+	}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded.Routines) != 4 || decoded.Routines[0].Name != "Main" {
+		t.Errorf("JSON routines %+v, %v", decoded.Routines, err)
+	}
+
+	out.Reset()
+	if err := analysis.WriteDOT(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"r500 [label=\"Main\\n0500\"];", "r608 [label=\"0608\", style=dashed];", "r500 -> r600;"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("graph doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
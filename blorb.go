@@ -0,0 +1,193 @@
+package zmachine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+import "github.com/Katharine/chunk.go"
+
+const BLORB_USAGE_PICTURE = "Pict"
+const BLORB_USAGE_SOUND = "Snd "
+const BLORB_USAGE_DATA = "Data"
+const BLORB_USAGE_EXECUTABLE = "Exec"
+
+// An entry in a Blorb file's resource index.
+type BlorbResource struct {
+	Usage  string // One of the BLORB_USAGE constants
+	Number int
+	Type   string // The chunk type, e.g. "ZCOD", "PNG " or "OGGV"
+	Size   int
+
+	offset int // Offset of the chunk header from the start of the file
+}
+
+// A Blorb (IFRS) resource collection, as used to package .zblorb games.
+type Blorb struct {
+	Resources    []BlorbResource
+	Metadata     string // iFiction XML from the IFmd chunk, if any
+	Frontispiece int    // Picture resource number, or -1 if there isn't one
+
+	data []byte
+}
+
+// The bibliographic part of a Blorb's iFiction metadata.
+type BlorbBibliographic struct {
+	IFID           string `xml:"story>identification>ifid"`
+	Format         string `xml:"story>identification>format"`
+	Title          string `xml:"story>bibliographic>title"`
+	Author         string `xml:"story>bibliographic>author"`
+	Headline       string `xml:"story>bibliographic>headline"`
+	FirstPublished string `xml:"story>bibliographic>firstpublished"`
+	Genre          string `xml:"story>bibliographic>genre"`
+	Description    string `xml:"story>bibliographic>description"`
+}
+
+// Reports whether data starts with a Blorb FORM header.
+func isBlorb(data []byte) bool {
+	return len(data) >= 12 && string(data[0:4]) == "FORM" && string(data[8:12]) == "IFRS"
+}
+
+// Parses a Blorb file held in memory.
+func ReadBlorb(data []byte) (*Blorb, error) {
+	if !isBlorb(data) {
+		return nil, errors.New("File is not a blorb file")
+	}
+
+	blorb := &Blorb{Frontispiece: -1, data: data}
+	seenIndex := false
+	for offset := 12; offset+8 <= len(data); {
+		c, err := chunk.New(bytes.NewReader(data[offset:]))
+		if err != nil {
+			return nil, err
+		}
+		if offset+8+int(c.Size()) > len(data) {
+			return nil, errors.New(fmt.Sprintf("Chunk %s at 0x%x runs past the end of the file", c.Name(), offset))
+		}
+
+		switch c.Name() {
+		case "RIdx":
+			if blorb.Resources, err = readBlorbIndex(c, data); err != nil {
+				return nil, err
+			}
+			seenIndex = true
+		case "IFmd":
+			metadata := make([]byte, c.Size())
+			io.ReadFull(c, metadata)
+			blorb.Metadata = string(metadata)
+		case "Fspc":
+			var number uint32
+			if err := binary.Read(c, binary.BigEndian, &number); err != nil {
+				return nil, err
+			}
+			blorb.Frontispiece = int(number)
+		}
+
+		offset += 8 + int(c.Size())
+		offset += offset & 1
+	}
+
+	if !seenIndex {
+		return nil, errors.New("Blorb file has no resource index")
+	}
+	return blorb, nil
+}
+
+// Reads and parses a Blorb file.
+func ReadBlorbFile(filename string) (*Blorb, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ReadBlorb(data)
+}
+
+func readBlorbIndex(c *chunk.Chunk, data []byte) ([]BlorbResource, error) {
+	var count uint32
+	if err := binary.Read(c, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	// Each entry takes 12 bytes, so a count which doesn't fit is a damaged index.
+	if c.Size() < 4 || count > (c.Size()-4)/12 {
+		return nil, errors.New(fmt.Sprintf("Resource index of %d bytes can't hold %d resources", c.Size(), count))
+	}
+	resources := make([]BlorbResource, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var entry struct {
+			Usage  [4]byte
+			Number uint32
+			Start  uint32
+		}
+		if err := binary.Read(c, binary.BigEndian, &entry); err != nil {
+			return nil, errors.New(fmt.Sprintf("Error while reading resource index: %s", err))
+		}
+
+		start := int(entry.Start)
+		if start+8 > len(data) {
+			return nil, errors.New(fmt.Sprintf("Resource %s %d starts past the end of the file", entry.Usage, entry.Number))
+		}
+		resources = append(resources, BlorbResource{
+			Usage:  string(entry.Usage[:]),
+			Number: int(entry.Number),
+			Type:   string(data[start : start+4]),
+			Size:   int(binary.BigEndian.Uint32(data[start+4 : start+8])),
+			offset: start,
+		})
+	}
+	return resources, nil
+}
+
+// Finds a resource by its usage and number.
+func (this *Blorb) Resource(usage string, number int) (BlorbResource, bool) {
+	for _, resource := range this.Resources {
+		if resource.Usage == usage && resource.Number == number {
+			return resource, true
+		}
+	}
+	return BlorbResource{}, false
+}
+
+// Returns the contents of a resource. Resources which are themselves IFF
+// forms, such as AIFF sounds, include their FORM header so they can be used
+// as files in their own right.
+func (this *Blorb) ResourceData(usage string, number int) ([]byte, error) {
+	resource, ok := this.Resource(usage, number)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No %s resource %d", usage, number))
+	}
+	start, end := resource.offset+8, resource.offset+8+resource.Size
+	if resource.Type == "FORM" {
+		start -= 8
+	}
+	if end > len(this.data) {
+		return nil, errors.New(fmt.Sprintf("%s resource %d runs past the end of the file", usage, number))
+	}
+	return this.data[start:end], nil
+}
+
+// Returns the Z-code story packaged in the Blorb.
+func (this *Blorb) Executable() ([]byte, error) {
+	resource, ok := this.Resource(BLORB_USAGE_EXECUTABLE, 0)
+	if !ok {
+		return nil, errors.New("Blorb file does not contain a story")
+	}
+	if resource.Type != "ZCOD" {
+		return nil, errors.New(fmt.Sprintf("Blorb file contains a %s story, not Z-code", resource.Type))
+	}
+	return this.ResourceData(BLORB_USAGE_EXECUTABLE, 0)
+}
+
+// Parses the bibliographic fields of the iFiction metadata.
+func (this *Blorb) Bibliographic() (BlorbBibliographic, error) {
+	var bibliographic BlorbBibliographic
+	if this.Metadata == "" {
+		return bibliographic, errors.New("Blorb file has no metadata")
+	}
+	err := xml.Unmarshal([]byte(this.Metadata), &bibliographic)
+	return bibliographic, err
+}
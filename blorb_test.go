@@ -0,0 +1,128 @@
+package zmachine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A chunk for testBlorb.
+type testChunk struct {
+	name string
+	data []byte
+}
+
+func (this testChunk) bytes() []byte {
+	header := make([]byte, 8)
+	copy(header, this.name)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(this.data)))
+	data := append(header, this.data...)
+	if len(this.data)&1 == 1 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// Packages a story in a Blorb as Exec resource 0, with an AIFF sound as Snd
+// resource 3, followed by any other chunks.
+func testBlorb(story []byte, others ...testChunk) []byte {
+	resources := []struct {
+		usage  string
+		number int
+		chunk  testChunk
+	}{
+		{BLORB_USAGE_EXECUTABLE, 0, testChunk{"ZCOD", story}},
+		{BLORB_USAGE_SOUND, 3, testChunk{"FORM", []byte("AIFF\x01\x02\x03")}},
+	}
+	index := make([]byte, 4+12*len(resources))
+	binary.BigEndian.PutUint32(index, uint32(len(resources)))
+	offset := 12 + 8 + len(index)
+	var contents []byte
+	for i, resource := range resources {
+		entry := index[4+12*i:]
+		copy(entry, resource.usage)
+		binary.BigEndian.PutUint32(entry[4:], uint32(resource.number))
+		binary.BigEndian.PutUint32(entry[8:], uint32(offset+len(contents)))
+		contents = append(contents, resource.chunk.bytes()...)
+	}
+	for _, other := range others {
+		contents = append(contents, other.bytes()...)
+	}
+	form := append([]byte("IFRS"), testChunk{"RIdx", index}.bytes()...)
+	return testChunk{"FORM", append(form, contents...)}.bytes()
+}
+
+func TestReadBlorb(t *testing.T) {
+	story := testStory(3)
+	metadata := `<?xml version="1.0"?><ifindex version="1.0"><story><identification><ifid>ZCODE-1-010101</ifid><format>zcode</format></identification><bibliographic><title>Test</title><author>Someone</author></bibliographic></story></ifindex>`
+	blorb, err := ReadBlorb(testBlorb(story, testChunk{"IFmd", []byte(metadata)}, testChunk{"Fspc", []byte{0, 0, 0, 2}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blorb.Resources) != 2 || blorb.Frontispiece != 2 {
+		t.Errorf("resources %+v, frontispiece %d", blorb.Resources, blorb.Frontispiece)
+	}
+
+	executable, err := blorb.Executable()
+	if err != nil || !bytes.Equal(executable, story) {
+		t.Errorf("executable of %d bytes, %v", len(executable), err)
+	}
+	// Sounds keep their FORM header.
+	sound, err := blorb.ResourceData(BLORB_USAGE_SOUND, 3)
+	if err != nil || string(sound) != "FORM\x00\x00\x00\x07AIFF\x01\x02\x03" {
+		t.Errorf("sound %q, %v", sound, err)
+	}
+	if _, ok := blorb.Resource(BLORB_USAGE_PICTURE, 2); ok {
+		t.Error("found a picture that isn't there")
+	}
+
+	bibliographic, err := blorb.Bibliographic()
+	if err != nil || bibliographic.IFID != "ZCODE-1-010101" || bibliographic.Title != "Test" || bibliographic.Author != "Someone" {
+		t.Errorf("bibliographic %+v, %v", bibliographic, err)
+	}
+}
+
+func TestReadBlorbRejectsBadIndexes(t *testing.T) {
+	if _, err := ReadBlorb(testStory(3)); err == nil {
+		t.Error("read a bare story as a blorb")
+	}
+
+	data := testBlorb(testStory(3))
+	// The first resource's start, past the end of the file.
+	binary.BigEndian.PutUint32(data[12+8+4+8:], uint32(len(data)))
+	if _, err := ReadBlorb(data); err == nil {
+		t.Error("read a resource starting past the end of the file")
+	}
+
+	data = testBlorb(testStory(3))
+	data = append(data[:12], testChunk{"RIdx", []byte{0, 0, 0, 1}}.bytes()...)
+	if _, err := ReadBlorb(data); err == nil {
+		t.Error("read an index with a missing entry")
+	}
+
+	// Far more resources than the chunk has room for are refused before any
+	// room is made for them.
+	data = testBlorb(testStory(3))
+	data = append(data[:12], testChunk{"RIdx", []byte{0xFF, 0xFF, 0xFF, 0xFF}}.bytes()...)
+	if _, err := ReadBlorb(data); err == nil || !strings.Contains(err.Error(), "can't hold") {
+		t.Errorf("read an index of 4294967295 resources: %v", err)
+	}
+}
+
+func TestLoadStoryFromBlorb(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "story.zblorb")
+	if err := ioutil.WriteFile(file, testBlorb(testStory(3)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	machine := New(file, nil, nil, nil)
+	if err := machine.LoadStory(); err != nil {
+		t.Fatal(err)
+	}
+	machine.CompleteSetup()
+	if machine.pc != testRoutines+1 || machine.Blorb() == nil {
+		t.Errorf("pc 0x%x, blorb %v", machine.pc, machine.Blorb())
+	}
+}
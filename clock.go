@@ -0,0 +1,100 @@
+package zmachine
+
+import (
+	"sync"
+	"time"
+)
+
+// The source of time for timed input. It can be replaced with a ManualClock to
+// make timed games deterministic.
+type Clock interface {
+	// Returns a channel which receives the time once d has passed, and a
+	// function which stops the timer if it's no longer wanted.
+	After(d time.Duration) (<-chan time.Time, func())
+}
+
+type realClock struct{}
+
+func (realClock) After(d time.Duration) (<-chan time.Time, func()) {
+	timer := time.NewTimer(d)
+	return timer.C, func() { timer.Stop() }
+}
+
+// Sets the clock used for timed input. Without one, real time is used.
+func (this *ZMachine) SetClock(clock Clock) {
+	this.clock = clock
+}
+
+// A Clock which only moves when told to.
+type ManualClock struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	now     time.Duration
+	timers  []*manualTimer
+}
+
+type manualTimer struct {
+	deadline time.Duration
+	c        chan time.Time
+}
+
+func NewManualClock() *ManualClock {
+	clock := &ManualClock{}
+	clock.changed = sync.NewCond(&clock.lock)
+	return clock
+}
+
+func (this *ManualClock) After(d time.Duration) (<-chan time.Time, func()) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- time.Unix(0, int64(this.now))
+		return c, func() {}
+	}
+	timer := &manualTimer{this.now + d, c}
+	this.timers = append(this.timers, timer)
+	this.changed.Broadcast()
+	return c, func() { this.stop(timer) }
+}
+
+// Removes a timer which hasn't fired, so that it's no longer waiting.
+func (this *ManualClock) stop(timer *manualTimer) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for i, t := range this.timers {
+		if t == timer {
+			this.timers = append(this.timers[:i], this.timers[i+1:]...)
+			break
+		}
+	}
+	this.changed.Broadcast()
+}
+
+// Moves the clock forward, firing any timers which are now due.
+func (this *ManualClock) Advance(d time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.now += d
+	pending := this.timers[:0]
+	for _, timer := range this.timers {
+		if timer.deadline <= this.now {
+			timer.c <- time.Unix(0, int64(this.now))
+		} else {
+			pending = append(pending, timer)
+		}
+	}
+	this.timers = pending
+	this.changed.Broadcast()
+}
+
+// Waits until at least n timers are waiting to fire, so that a test can be
+// sure the machine is waiting for input before advancing the clock. Timers
+// which have fired or been stopped aren't waiting.
+func (this *ManualClock) BlockUntil(n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for len(this.timers) < n {
+		this.changed.Wait()
+	}
+}
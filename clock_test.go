@@ -0,0 +1,139 @@
+package zmachine
+
+import (
+	"testing"
+	"time"
+)
+
+func (this *ManualClock) waiting() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.timers)
+}
+
+func TestManualClockFires(t *testing.T) {
+	clock := NewManualClock()
+	c, _ := clock.After(time.Second)
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-c:
+		t.Fatal("fired early")
+	default:
+	}
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case now := <-c:
+		if now != time.Unix(0, int64(time.Second)) {
+			t.Errorf("fired at %v", now)
+		}
+	default:
+		t.Fatal("didn't fire")
+	}
+	if n := clock.waiting(); n != 0 {
+		t.Errorf("%d timers waiting after firing", n)
+	}
+
+	// A timer for no time at all has already fired.
+	c, _ = clock.After(0)
+	select {
+	case <-c:
+	default:
+		t.Error("timer for 0 didn't fire")
+	}
+}
+
+func TestManualClockStop(t *testing.T) {
+	clock := NewManualClock()
+	c, stop := clock.After(time.Second)
+	_, other := clock.After(2 * time.Second)
+	stop()
+	if n := clock.waiting(); n != 1 {
+		t.Fatalf("%d timers waiting after stopping one of two", n)
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-c:
+		t.Error("stopped timer fired")
+	default:
+	}
+	// Stopping twice, or after firing, does nothing.
+	stop()
+	clock.Advance(time.Second)
+	other()
+	if n := clock.waiting(); n != 0 {
+		t.Errorf("%d timers waiting", n)
+	}
+}
+
+// Returns a version 5 machine whose routine at packed address 0x180 returns
+// true.
+func timedMachine(t *testing.T, clock Clock) *ZMachine {
+	story := testStory(5)
+	story[0x600], story[0x601] = 0, 0xB0 // No locals; rtrue
+	machine := testMachine(t, story)
+	machine.SetClock(clock)
+	machine.SetKeyInput(make(chan Key))
+	machine.running = true
+	return machine
+}
+
+func TestTimedInputStopsTimer(t *testing.T) {
+	clock := NewManualClock()
+	machine := timedMachine(t, clock)
+	for i := 0; i < 3; i++ {
+		lines := make(chan string)
+		go func() {
+			line, _ := machine.waitForLine(5, 0x180)
+			lines <- line
+		}()
+		// Only the current wait's timer is counted, not those of earlier
+		// waits which input ended before they fired.
+		clock.BlockUntil(1)
+		if n := clock.waiting(); n != 1 {
+			t.Fatalf("wait %d: %d timers waiting", i, n)
+		}
+		machine.input <- "look"
+		if line := <-lines; line != "look" {
+			t.Fatalf("wait %d: read %q", i, line)
+		}
+		if n := clock.waiting(); n != 0 {
+			t.Fatalf("wait %d: %d timers left after input", i, n)
+		}
+	}
+}
+
+func TestTimedKeyStopsTimer(t *testing.T) {
+	clock := NewManualClock()
+	machine := timedMachine(t, clock)
+	keys := make(chan Key)
+	go func() {
+		key, _ := machine.waitForKey(5, 0x180)
+		keys <- key
+	}()
+	clock.BlockUntil(1)
+	machine.keys <- Key{Rune: 'y'}
+	if key := <-keys; key.Rune != 'y' {
+		t.Fatalf("read %+v", key)
+	}
+	if n := clock.waiting(); n != 0 {
+		t.Fatalf("%d timers left after a key", n)
+	}
+}
+
+func TestTimedInputTimesOut(t *testing.T) {
+	clock := NewManualClock()
+	machine := timedMachine(t, clock)
+	done := make(chan bool)
+	go func() {
+		_, ok := machine.waitForLine(5, 0x180)
+		done <- ok
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(500 * time.Millisecond)
+	if ok := <-done; ok {
+		t.Fatal("input wasn't abandoned")
+	}
+	if n := clock.waiting(); n != 0 {
+		t.Fatalf("%d timers left after timing out", n)
+	}
+}
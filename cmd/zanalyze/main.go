@@ -0,0 +1,125 @@
+// zanalyze examines a story file without running it, finding its routines and
+// strings, the calls between them, code which can never run, and illegal
+// opcodes.
+//
+//	zanalyze [-debug gameinfo.dbg] [-format text|json|dot] game.z3
+//
+// The text format summarises the findings. JSON gives everything, and DOT
+// draws the call graph with Graphviz, as in
+//
+//	zanalyze -format dot game.z3 | dot -Tsvg > calls.svg
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+import "github.com/Katharine/zmachine.go"
+
+func main() {
+	debugFile := flag.String("debug", "", "Inform debugging information for the story")
+	format := flag.String("format", "text", "the output format: text, json or dot")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: zanalyze [-debug file] [-format text|json|dot] story")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	story, _, err := zmachine.ReadStoryFile(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	var symbols *zmachine.DebugInfo
+	if *debugFile != "" {
+		if symbols, err = zmachine.ReadDebugInfoFile(*debugFile); err != nil {
+			fail(err)
+		}
+		if !symbols.Matches(story) {
+			fmt.Fprintf(os.Stderr, "zanalyze: warning: %s doesn't match %s\n", *debugFile, flag.Arg(0))
+		}
+	}
+	analysis, err := zmachine.Analyze(story, symbols)
+	if err != nil {
+		fail(err)
+	}
+
+	switch *format {
+	case "text":
+		summarise(analysis)
+	case "json":
+		err = analysis.WriteJSON(os.Stdout)
+	case "dot":
+		err = analysis.WriteDOT(os.Stdout)
+	default:
+		fail(fmt.Errorf("Unknown format %q", *format))
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func summarise(analysis *zmachine.Analysis) {
+	found := make(map[string]int)
+	unreachable, calls := 0, 0
+	for _, routine := range analysis.Routines {
+		found[routine.Found]++
+		calls += len(routine.Calls)
+		if !routine.Reachable {
+			unreachable++
+		}
+	}
+	fmt.Printf("Version %d, entry point in routine %s\n", analysis.Version, name(analysis, analysis.Entry))
+	fmt.Printf("%d routines: %d called, %d in properties, %d referred to in code, %d found by scanning\n",
+		len(analysis.Routines), found[zmachine.FOUND_CALL]+found[zmachine.FOUND_ENTRY], found[zmachine.FOUND_PROPERTY],
+		found[zmachine.FOUND_REFERENCE], found[zmachine.FOUND_SCAN])
+	fmt.Printf("%d calls between them\n", calls)
+	fmt.Printf("%d strings\n", len(analysis.Strings))
+
+	if unreachable > 0 {
+		fmt.Printf("\nUnreachable routines:\n")
+		for _, routine := range analysis.Routines {
+			if !routine.Reachable {
+				fmt.Printf("  %s\n", name(analysis, routine.Address))
+			}
+		}
+	}
+	header := false
+	for _, routine := range analysis.Routines {
+		if len(routine.Unreached) == 0 {
+			continue
+		}
+		if !header {
+			fmt.Printf("\nUnreachable code:\n")
+			header = true
+		}
+		fmt.Printf("  %s:", name(analysis, routine.Address))
+		for _, address := range routine.Unreached {
+			fmt.Printf(" %04x", address)
+		}
+		fmt.Println()
+	}
+	if len(analysis.Problems) > 0 {
+		fmt.Printf("\nProblems:\n")
+		for _, problem := range analysis.Problems {
+			fmt.Printf("  %s\n", problem.Problem)
+		}
+	}
+}
+
+func name(analysis *zmachine.Analysis, address int) string {
+	if routine := analysis.Routine(address); routine != nil && routine.Name != "" {
+		return fmt.Sprintf("%04x %s", address, routine.Name)
+	}
+	return fmt.Sprintf("%04x", address)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "zanalyze:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,171 @@
+// zcov measures how much of a story's code its walkthroughs exercise.
+//
+//	zcov [-debug gameinfo.dbg] [-merge old.zcov]... [-o all.zcov] [-annotate] [-lcov out.info] game.z3 [walkthrough.txt...]
+//
+// Each walkthrough, a file of commands one per line, is played from the start
+// of the story, and the coverage of all of them, along with any merged from
+// earlier runs, is reported: the percentage of each routine's instructions
+// executed and branch directions followed. With -annotate, the disassembly
+// follows, showing how often each instruction ran. With Inform debugging
+// information, routines are named, and -lcov writes coverage of the source
+// lines for tools such as genhtml.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+import "github.com/Katharine/zmachine.go"
+
+type fileList []string
+
+func (this *fileList) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *fileList) Set(s string) error {
+	*this = append(*this, s)
+	return nil
+}
+
+func main() {
+	var merges fileList
+	flag.Var(&merges, "merge", "add the coverage saved in this file (repeatable)")
+	debugFile := flag.String("debug", "", "Inform debugging information for the story")
+	out := flag.String("o", "", "save the combined coverage to this file")
+	annotate := flag.Bool("annotate", false, "show the disassembly with execution counts")
+	lcov := flag.String("lcov", "", "write LCOV source coverage to this file")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: zcov [-debug file] [-merge file]... [-o file] [-annotate] [-lcov file] story [walkthrough...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	story, _, err := zmachine.ReadStoryFile(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	if len(story) < 0x40 {
+		fail(fmt.Errorf("%s is too short to be a story file", flag.Arg(0)))
+	}
+	var symbols *zmachine.DebugInfo
+	if *debugFile != "" {
+		if symbols, err = zmachine.ReadDebugInfoFile(*debugFile); err != nil {
+			fail(err)
+		}
+		if !symbols.Matches(story) {
+			fmt.Fprintf(os.Stderr, "zcov: warning: %s doesn't match %s\n", *debugFile, flag.Arg(0))
+		}
+	}
+
+	coverage := zmachine.NewCoverage(story)
+	for _, filename := range merges {
+		saved, err := zmachine.ReadCoverageFile(filename)
+		if err != nil {
+			fail(fmt.Errorf("%s: %v", filename, err))
+		}
+		if err := coverage.Merge(saved); err != nil {
+			fail(fmt.Errorf("%s: %v", filename, err))
+		}
+	}
+	for _, walkthrough := range flag.Args()[1:] {
+		if err := play(flag.Arg(0), walkthrough, coverage); err != nil {
+			fail(fmt.Errorf("%s: %v", walkthrough, err))
+		}
+	}
+
+	if *out != "" {
+		if err := writeFile(*out, coverage.Save); err != nil {
+			fail(err)
+		}
+	}
+	if *lcov != "" {
+		err := writeFile(*lcov, func(w io.Writer) error {
+			return coverage.WriteLCOV(w, story, symbols)
+		})
+		if err != nil {
+			fail(err)
+		}
+	}
+	if err := coverage.WriteSummary(os.Stdout, story, symbols); err != nil {
+		fail(err)
+	}
+	if *annotate {
+		fmt.Println()
+		if err := coverage.WriteAnnotated(os.Stdout, story, symbols); err != nil {
+			fail(err)
+		}
+	}
+}
+
+// Plays the story from the start with the commands in walkthrough, until it
+// quits or they run out.
+func play(filename, walkthrough string, coverage *zmachine.Coverage) error {
+	f, err := os.Open(walkthrough)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	input := make(chan string)
+	output := make(chan string)
+	machine := zmachine.New(filename, input, output, make(chan error, 1))
+	if err := machine.LoadStory(); err != nil {
+		return err
+	}
+	machine.CompleteSetup()
+	debugger := zmachine.NewDebugger(&machine)
+	machine.SetTracer(coverage)
+	go func() {
+		for range output {
+		}
+	}()
+
+	// Once the commands run out, the story stops when it next asks for one.
+	ended := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			input <- scanner.Text()
+		}
+		ended <- scanner.Err()
+		machine.EndInput()
+	}()
+
+	stop := debugger.Continue()
+	if stop.Reason != zmachine.DEBUG_STOP_QUIT {
+		return fmt.Errorf("%s", stop)
+	}
+	select {
+	case err := <-ended:
+		return err
+	default:
+		return nil
+	}
+}
+
+func writeFile(filename string, write func(w io.Writer) error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "zcov:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,54 @@
+// zdap serves the Debug Adapter Protocol, so that editors such as VS Code can
+// debug stories. It speaks over stdin and stdout, or with -listen, waits for a
+// single connection on a TCP address.
+//
+//	zdap [-listen 127.0.0.1:4711]
+//
+// The story is given by the "program" attribute of the launch request, and
+// "stopOnEntry" stops before the first instruction. Instruction breakpoints
+// take addresses, and function breakpoints take routine addresses, both in
+// hex. Lines typed into the debug console are sent to the game as input.
+//
+// Inform debugging information named by "debugInfo", or else a matching
+// gameinfo.dbg beside the story, gives source breakpoints, source locations
+// in stack traces, and variable names.
+//
+// With "record", everything the story does is recorded, so that the client
+// can step back and run backwards to breakpoints and watched values.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+)
+
+func main() {
+	listen := flag.String("listen", "", "TCP address to accept a connection on, instead of using stdio")
+	flag.Parse()
+	log.SetPrefix("zdap: ")
+
+	var reader io.Reader = os.Stdin
+	var writer io.Writer = os.Stdout
+	if *listen != "" {
+		listener, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Listening on %s", listener.Addr())
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+		reader, writer = conn, conn
+	}
+
+	session := &session{conn: newConnection(reader, writer)}
+	if err := session.serve(); err != nil && err != io.EOF {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// The parts of the Debug Adapter Protocol's messages that we use. Arguments and
+// bodies are left to the individual requests.
+type message struct {
+	Seq     int    `json:"seq"`
+	Type    string `json:"type"`
+	Command string `json:"command,omitempty"`
+	Event   string `json:"event,omitempty"`
+
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+
+	RequestSeq int         `json:"request_seq,omitempty"`
+	Success    *bool       `json:"success,omitempty"` // Only for responses, which need it even when false
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+// Reads and writes messages, each sent as a Content-Length header and a JSON body.
+type connection struct {
+	reader *textproto.Reader
+	writer io.Writer
+
+	lock sync.Mutex // Guards seq and writes
+	seq  int
+}
+
+func newConnection(r io.Reader, w io.Writer) *connection {
+	return &connection{reader: textproto.NewReader(bufio.NewReader(r)), writer: w}
+}
+
+func (this *connection) read() (*message, error) {
+	header, err := this.reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("Bad Content-Length %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(this.reader.R, body); err != nil {
+		return nil, err
+	}
+	m := &message{}
+	if err := json.Unmarshal(body, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (this *connection) write(m *message) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.seq++
+	m.Seq = this.seq
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(this.writer, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = this.writer.Write(body)
+	return err
+}
+
+func (this *connection) respond(request *message, body interface{}) error {
+	return this.write(&message{
+		Type:       "response",
+		Command:    request.Command,
+		RequestSeq: request.Seq,
+		Success:    success(true),
+		Body:       body,
+	})
+}
+
+func (this *connection) fail(request *message, err error) error {
+	return this.write(&message{
+		Type:       "response",
+		Command:    request.Command,
+		RequestSeq: request.Seq,
+		Success:    success(false),
+		Message:    err.Error(),
+		Body:       map[string]interface{}{"error": map[string]interface{}{"id": 1, "format": err.Error()}},
+	})
+}
+
+func (this *connection) event(name string, body interface{}) error {
+	return this.write(&message{Type: "event", Event: name, Body: body})
+}
+
+func success(ok bool) *bool {
+	return &ok
+}
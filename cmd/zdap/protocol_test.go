@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestConnectionRoundTrip(t *testing.T) {
+	var buffer bytes.Buffer
+	conn := newConnection(&buffer, &buffer)
+	request := &message{Seq: 4, Type: "request", Command: "threads"}
+	if err := conn.respond(request, map[string]int{"threads": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.fail(request, errors.New("No story")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buffer.String(), "Content-Length: ") {
+		t.Fatalf("wrote %q", buffer.String())
+	}
+
+	response, err := conn.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Seq != 1 || response.Type != "response" || response.Command != "threads" || response.RequestSeq != 4 || response.Success == nil || !*response.Success {
+		t.Errorf("response %+v", response)
+	}
+	failure, err := conn.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failure.Seq != 2 || failure.Success == nil || *failure.Success || failure.Message != "No story" {
+		t.Errorf("failure %+v", failure)
+	}
+}
+
+func TestEventsHaveNoSuccess(t *testing.T) {
+	var buffer bytes.Buffer
+	conn := newConnection(nil, &buffer)
+	if err := conn.event("initialized", nil); err != nil {
+		t.Fatal(err)
+	}
+	if body := buffer.String(); strings.Contains(body, "success") || !strings.Contains(body, `"event":"initialized"`) {
+		t.Errorf("wrote %q", body)
+	}
+}
+
+func TestConnectionReadsArguments(t *testing.T) {
+	body := `{"seq":1,"type":"request","command":"launch","arguments":{"program":"game.z5"}}`
+	conn := newConnection(strings.NewReader(fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)), nil)
+	request, err := conn.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Command != "launch" || string(request.Arguments) != `{"program":"game.z5"}` {
+		t.Errorf("request %+v", request)
+	}
+}
+
+func TestConnectionRejectsBadLength(t *testing.T) {
+	for _, header := range []string{"Content-Length: -1\r\n\r\n", "Content-Type: text/plain\r\n\r\n"} {
+		conn := newConnection(strings.NewReader(header+"{}"), nil)
+		if _, err := conn.read(); err == nil {
+			t.Errorf("read a message with the header %q", header)
+		}
+	}
+}
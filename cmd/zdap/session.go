@@ -0,0 +1,601 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import "github.com/Katharine/zmachine.go"
+
+// The machine has only the one thread.
+const threadID = 1
+
+// Variable references: globals, then a locals and a stack scope for each frame.
+const (
+	globalsReference = 1
+	framesReference  = 2
+)
+
+type session struct {
+	conn     *connection
+	debugger *zmachine.Debugger
+	input    chan string
+
+	lock    sync.Mutex // Guards running
+	running bool
+
+	stopOnEntry            bool
+	instructionBreakpoints []int
+	functionBreakpoints    []int
+	sourceBreakpoints      map[string][]int // By source path
+}
+
+var errNotLaunched = errors.New("No story has been launched")
+var errRunning = errors.New("The story is running")
+
+// Handles requests until the client disconnects.
+func (this *session) serve() error {
+	for {
+		request, err := this.conn.read()
+		if err != nil {
+			return err
+		}
+		if request.Type != "request" {
+			continue
+		}
+		body, err := this.handle(request)
+		if err != nil {
+			this.conn.fail(request, err)
+		} else {
+			this.conn.respond(request, body)
+		}
+		switch request.Command {
+		case "initialize":
+			// The client sends its launch request before the breakpoints
+			// this asks for, so there's a debugger to hold them by then.
+			this.conn.event("initialized", nil)
+		case "configurationDone":
+			this.start()
+		case "disconnect", "terminate":
+			return nil
+		}
+	}
+}
+
+func (this *session) handle(request *message) (interface{}, error) {
+	if request.Command != "initialize" && request.Command != "launch" && request.Command != "disconnect" && this.debugger == nil {
+		return nil, errNotLaunched
+	}
+	switch request.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsInstructionBreakpoints":   true,
+			"supportsDisassembleRequest":       true,
+			"supportsTerminateRequest":         true,
+			"supportsStepBack":                 true,
+		}, nil
+	case "launch":
+		var args struct {
+			Program     string `json:"program"`
+			StopOnEntry bool   `json:"stopOnEntry"`
+			DebugInfo   string `json:"debugInfo"`
+			Record      bool   `json:"record"`
+		}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return nil, this.launch(args.Program, args.StopOnEntry, args.DebugInfo, args.Record)
+	case "configurationDone", "disconnect", "terminate":
+		return nil, nil
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": threadID, "name": "Z-machine"}},
+		}, nil
+	case "setBreakpoints":
+		return this.setSourceBreakpoints(request.Arguments)
+	case "setInstructionBreakpoints":
+		return this.setInstructionBreakpoints(request.Arguments)
+	case "setFunctionBreakpoints":
+		return this.setFunctionBreakpoints(request.Arguments)
+	case "continue":
+		return map[string]interface{}{"allThreadsContinued": true}, this.resume(this.debugger.Continue)
+	case "next":
+		return nil, this.resume(this.debugger.Next)
+	case "stepIn":
+		return nil, this.resume(this.debugger.Step)
+	case "stepOut":
+		return nil, this.resume(this.debugger.Finish)
+	case "stepBack":
+		return nil, this.resume(func() zmachine.Stop {
+			if err := this.debugger.StepBack(); err != nil {
+				return zmachine.Stop{Reason: zmachine.DEBUG_STOP_ERROR, Err: err}
+			}
+			return zmachine.Stop{Reason: zmachine.DEBUG_STOP_STEP}
+		})
+	case "reverseContinue":
+		return nil, this.resume(this.debugger.ReverseContinue)
+	case "pause":
+		this.debugger.Interrupt()
+		return nil, nil
+	case "stackTrace":
+		return this.stackTrace(request.Arguments)
+	case "scopes":
+		return this.scopes(request.Arguments)
+	case "variables":
+		return this.variables(request.Arguments)
+	case "evaluate":
+		return this.evaluate(request.Arguments)
+	case "disassemble":
+		return this.disassemble(request.Arguments)
+	}
+	return nil, fmt.Errorf("Unsupported request %q", request.Command)
+}
+
+func (this *session) launch(program string, stopOnEntry bool, debugInfo string, record bool) error {
+	if this.debugger != nil {
+		return errors.New("A story has already been launched")
+	}
+	// Lines typed into the debug console while the game waits go to it as
+	// input. The buffer lets them be typed before the game asks.
+	this.input = make(chan string, 64)
+	output := make(chan string)
+	machine := zmachine.New(program, this.input, output, make(chan error, 1))
+	if err := machine.LoadStory(); err != nil {
+		return err
+	}
+	machine.CompleteSetup()
+	this.debugger = zmachine.NewDebugger(&machine)
+	if record {
+		this.debugger.Record()
+	}
+	this.stopOnEntry = stopOnEntry
+	if err := this.loadDebugInfo(program, debugInfo); err != nil {
+		return err
+	}
+
+	go func() {
+		for s := range output {
+			this.conn.event("output", map[string]interface{}{"category": "stdout", "output": s})
+		}
+	}()
+	return nil
+}
+
+// Loads the named debugging information. Without a name, Inform's usual
+// gameinfo.dbg beside the story is used if it's there and matches.
+func (this *session) loadDebugInfo(program, filename string) error {
+	explicit := filename != ""
+	if !explicit {
+		filename = filepath.Join(filepath.Dir(program), "gameinfo.dbg")
+		if _, err := os.Stat(filename); err != nil {
+			return nil
+		}
+	}
+	symbols, err := zmachine.ReadDebugInfoFile(filename)
+	if err != nil {
+		if explicit {
+			return err
+		}
+		return nil
+	}
+	if !symbols.Matches(this.debugger.Memory()) {
+		if explicit {
+			return fmt.Errorf("%s doesn't match %s", filename, program)
+		}
+		return nil
+	}
+	this.debugger.SetDebugInfo(symbols)
+	return nil
+}
+
+// Starts the game once the client has sent its breakpoints.
+func (this *session) start() {
+	if this.debugger == nil {
+		return
+	}
+	if this.stopOnEntry {
+		this.stopped("entry", "")
+		return
+	}
+	this.resume(this.debugger.Continue)
+}
+
+// Runs the machine in the background, reporting when it stops.
+func (this *session) resume(how func() zmachine.Stop) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.running {
+		return errRunning
+	}
+	this.running = true
+
+	go func() {
+		stop := how()
+		this.lock.Lock()
+		this.running = false
+		this.lock.Unlock()
+
+		switch stop.Reason {
+		case zmachine.DEBUG_STOP_QUIT:
+			if this.debugger.Recording() {
+				// The recording can still be rewound to before the quit.
+				this.stopped("pause", stop.String())
+				break
+			}
+			this.conn.event("exited", map[string]interface{}{"exitCode": 0})
+			this.conn.event("terminated", nil)
+		case zmachine.DEBUG_STOP_ERROR:
+			this.conn.event("output", map[string]interface{}{"category": "stderr", "output": stop.String() + "\n"})
+			this.stopped("exception", stop.String())
+		case zmachine.DEBUG_STOP_BREAKPOINT:
+			if stop.Breakpoint.Routine != 0 {
+				this.stopped("function breakpoint", stop.String())
+			} else {
+				this.stopped("instruction breakpoint", stop.String())
+			}
+		case zmachine.DEBUG_STOP_WATCHPOINT:
+			this.stopped("data breakpoint", stop.String())
+		case zmachine.DEBUG_STOP_INTERRUPTED:
+			this.stopped("pause", "")
+		default:
+			this.stopped("step", "")
+		}
+	}()
+	return nil
+}
+
+func (this *session) stopped(reason, text string) {
+	body := map[string]interface{}{
+		"reason":            reason,
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	}
+	if text != "" {
+		body["text"] = text
+	}
+	this.conn.event("stopped", body)
+}
+
+// Returns an error unless the machine is stopped, so its state can be read.
+func (this *session) checkStopped() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.running {
+		return errRunning
+	}
+	return nil
+}
+
+func (this *session) setSourceBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Source struct {
+			Name string `json:"name"`
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	file := args.Source.Path
+	if file == "" {
+		file = args.Source.Name
+	}
+	if this.sourceBreakpoints == nil {
+		this.sourceBreakpoints = make(map[string][]int)
+	}
+	for _, address := range this.sourceBreakpoints[file] {
+		this.debugger.ClearBreakpoint(address)
+	}
+	delete(this.sourceBreakpoints, file)
+
+	symbols := this.debugger.DebugInfo()
+	breakpoints := make([]map[string]interface{}, len(args.Breakpoints))
+	for i, breakpoint := range args.Breakpoints {
+		address, ok := 0, false
+		if symbols != nil {
+			address, ok = symbols.LineAddress(file, breakpoint.Line)
+		}
+		switch {
+		case symbols == nil:
+			breakpoints[i] = map[string]interface{}{
+				"verified": false,
+				"line":     breakpoint.Line,
+				"message":  "Source breakpoints need debugging information",
+			}
+		case !ok:
+			breakpoints[i] = map[string]interface{}{
+				"verified": false,
+				"line":     breakpoint.Line,
+				"message":  "No code for this line",
+			}
+		default:
+			this.debugger.SetBreakpoint(address)
+			this.sourceBreakpoints[file] = append(this.sourceBreakpoints[file], address)
+			breakpoints[i] = map[string]interface{}{
+				"verified":             true,
+				"line":                 breakpoint.Line,
+				"instructionReference": formatAddress(address),
+			}
+		}
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+func (this *session) setInstructionBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Breakpoints []struct {
+			InstructionReference string `json:"instructionReference"`
+			Offset               int    `json:"offset"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	for _, address := range this.instructionBreakpoints {
+		this.debugger.ClearBreakpoint(address)
+	}
+	this.instructionBreakpoints = nil
+
+	breakpoints := make([]map[string]interface{}, len(args.Breakpoints))
+	for i, breakpoint := range args.Breakpoints {
+		address, err := parseAddress(breakpoint.InstructionReference)
+		if err != nil {
+			breakpoints[i] = map[string]interface{}{"verified": false, "message": err.Error()}
+			continue
+		}
+		address += breakpoint.Offset
+		this.debugger.SetBreakpoint(address)
+		this.instructionBreakpoints = append(this.instructionBreakpoints, address)
+		breakpoints[i] = map[string]interface{}{"verified": true, "instructionReference": formatAddress(address)}
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+// Function breakpoints name routines by their hex address, or by name if
+// there's debugging information.
+func (this *session) setFunctionBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Breakpoints []struct {
+			Name string `json:"name"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	for _, routine := range this.functionBreakpoints {
+		this.debugger.ClearBreakpoint(routine)
+	}
+	this.functionBreakpoints = nil
+
+	breakpoints := make([]map[string]interface{}, len(args.Breakpoints))
+	for i, requested := range args.Breakpoints {
+		var routine int
+		var err error
+		if named := this.debugger.DebugInfo().RoutineNamed(requested.Name); named != nil {
+			routine = named.Address
+		} else {
+			routine, err = parseAddress(requested.Name)
+		}
+		var breakpoint *zmachine.Breakpoint
+		if err == nil {
+			breakpoint, err = this.debugger.SetRoutineBreakpoint(routine)
+		}
+		if err != nil {
+			breakpoints[i] = map[string]interface{}{"verified": false, "message": err.Error()}
+			continue
+		}
+		this.functionBreakpoints = append(this.functionBreakpoints, routine)
+		breakpoints[i] = map[string]interface{}{"verified": true, "instructionReference": formatAddress(breakpoint.Address)}
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+func (this *session) stackTrace(arguments json.RawMessage) (interface{}, error) {
+	if err := this.checkStopped(); err != nil {
+		return nil, err
+	}
+	var args struct {
+		StartFrame int `json:"startFrame"`
+		Levels     int `json:"levels"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	frames := this.debugger.StackFrames()
+	symbols := this.debugger.DebugInfo()
+	result := []map[string]interface{}{}
+	for i := args.StartFrame; i < len(frames) && (args.Levels <= 0 || i < args.StartFrame+args.Levels); i++ {
+		frame := map[string]interface{}{
+			"id":                          i + 1,
+			"name":                        routineName(frames[i], symbols),
+			"line":                        0,
+			"column":                      0,
+			"instructionPointerReference": formatAddress(frames[i].PC),
+		}
+		if symbols != nil {
+			if location, ok := symbols.LineAt(frames[i].PC); ok && location.File != "" {
+				frame["source"] = map[string]interface{}{"name": filepath.Base(location.File), "path": location.Path}
+				frame["line"] = location.Line
+				frame["column"] = location.Column
+			}
+		}
+		result = append(result, frame)
+	}
+	return map[string]interface{}{"stackFrames": result, "totalFrames": len(frames)}, nil
+}
+
+func routineName(frame zmachine.StackFrame, symbols *zmachine.DebugInfo) string {
+	if symbols != nil {
+		if routine := symbols.RoutineAt(frame.PC); routine != nil {
+			return routine.Name
+		}
+	}
+	if frame.Routine == 0 {
+		return "routine ????"
+	}
+	return fmt.Sprintf("routine %04x", frame.Routine)
+}
+
+func (this *session) scopes(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		FrameID int `json:"frameId"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	frame := args.FrameID - 1
+	return map[string]interface{}{
+		"scopes": []map[string]interface{}{
+			{"name": "Locals", "presentationHint": "locals", "variablesReference": framesReference + 2*frame, "expensive": false},
+			{"name": "Stack", "variablesReference": framesReference + 2*frame + 1, "expensive": false},
+			{"name": "Globals", "presentationHint": "globals", "variablesReference": globalsReference, "expensive": false},
+		},
+	}, nil
+}
+
+func (this *session) variables(arguments json.RawMessage) (interface{}, error) {
+	if err := this.checkStopped(); err != nil {
+		return nil, err
+	}
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	variables := []map[string]interface{}{}
+	add := func(name string, value uint16) {
+		variables = append(variables, map[string]interface{}{
+			"name":               name,
+			"value":              fmt.Sprintf("%d (0x%04x)", int16(value), value),
+			"variablesReference": 0,
+		})
+	}
+	symbols := this.debugger.DebugInfo()
+	if args.VariablesReference == globalsReference {
+		for n := 0; n < 240; n++ {
+			add(symbols.VariableName(byte(n+0x10), 0), this.debugger.Global(n))
+		}
+		return map[string]interface{}{"variables": variables}, nil
+	}
+
+	frames := this.debugger.StackFrames()
+	frame := (args.VariablesReference - framesReference) / 2
+	if frame < 0 || frame >= len(frames) {
+		return nil, fmt.Errorf("No frame %d", frame+1)
+	}
+	if (args.VariablesReference-framesReference)%2 == 0 {
+		for i, value := range frames[frame].Locals {
+			add(symbols.VariableName(byte(i+1), frames[frame].PC), value)
+		}
+	} else {
+		// Top of the stack first, as it's the end that matters.
+		stack := frames[frame].Stack
+		for i := len(stack) - 1; i >= 0; i-- {
+			add(fmt.Sprintf("[%d]", i), stack[i])
+		}
+	}
+	return map[string]interface{}{"variables": variables}, nil
+}
+
+// Lines typed into the debug console are given to the game as input.
+func (this *session) evaluate(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Expression string `json:"expression"`
+		Context    string `json:"context"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	if args.Context != "repl" {
+		return nil, errors.New("Only input for the game can be evaluated")
+	}
+	select {
+	case this.input <- args.Expression:
+	default:
+		return nil, errors.New("Too much input is waiting for the game")
+	}
+	return map[string]interface{}{"result": "", "variablesReference": 0}, nil
+}
+
+func (this *session) disassemble(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		MemoryReference   string `json:"memoryReference"`
+		Offset            int    `json:"offset"`
+		InstructionOffset int    `json:"instructionOffset"`
+		InstructionCount  int    `json:"instructionCount"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	address, err := parseAddress(args.MemoryReference)
+	if err != nil {
+		return nil, err
+	}
+	address += args.Offset
+
+	// Instructions vary in length, so there's no telling where those before
+	// the reference start. Pad with placeholders instead.
+	instructions := []map[string]interface{}{}
+	for i := args.InstructionOffset; i < 0 && len(instructions) < args.InstructionCount; i++ {
+		instructions = append(instructions, map[string]interface{}{
+			"address":          formatAddress(address + i),
+			"instruction":      "",
+			"presentationHint": "invalid",
+		})
+	}
+	memory := this.debugger.Memory()
+	for skip := args.InstructionOffset; len(instructions) < args.InstructionCount; skip-- {
+		instruction, err := zmachine.Decode(memory, address, this.debugger.Version())
+		if err != nil {
+			instructions = append(instructions, map[string]interface{}{
+				"address":          formatAddress(address),
+				"instruction":      err.Error(),
+				"presentationHint": "invalid",
+			})
+			address++
+			continue
+		}
+		if skip <= 0 {
+			instructions = append(instructions, map[string]interface{}{
+				"address":          formatAddress(address),
+				"instructionBytes": hexBytes(memory[address : address+instruction.Length]),
+				"instruction":      instruction.Format(this.debugger.DebugInfo()),
+			})
+		}
+		address += instruction.Length
+	}
+	return map[string]interface{}{"instructions": instructions}, nil
+}
+
+func parseAddress(s string) (int, error) {
+	address, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Bad address %q", s)
+	}
+	return int(address), nil
+}
+
+func formatAddress(address int) string {
+	return fmt.Sprintf("0x%04x", address)
+}
+
+func hexBytes(data []byte) string {
+	s := make([]string, len(data))
+	for i, b := range data {
+		s[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(s, " ")
+}
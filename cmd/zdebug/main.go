@@ -0,0 +1,486 @@
+// zdebug runs a story under an interactive debugger.
+//
+//	zdebug [-debug gameinfo.dbg] game.z3
+//
+// With Inform debugging information, routines and variables can be given by
+// name, breakpoints set on source lines as file.inf:123, and locations are
+// shown in the source.
+//
+// Type "help" at the (zdebug) prompt for the commands. While the game is
+// running, typed lines go to the game; press Ctrl-C to get back to the debugger.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+)
+
+import "github.com/Katharine/zmachine.go"
+
+const help = `Running:
+  s, step              execute one instruction
+  n, next              execute one instruction, stepping over calls
+  f, finish            run until the current routine returns
+  c, continue          run until a breakpoint or watchpoint
+Going backwards, once recording:
+  record               start recording, so that execution can be reversed
+  rs, reverse-step     go back one instruction
+  rc, reverse-continue go back to the last breakpoint or watchpoint
+  back global N        go back to the last write to global N
+  rewind TURN          go back to the start of turn TURN
+Breakpoints and watchpoints:
+  b, break ADDR        stop before the instruction at ADDR
+  b, break FILE:LINE   stop before the code for a source line
+  b, break r ROUTINE   stop on entry to the routine at ROUTINE (or named ROUTINE)
+  d, delete ADDR       remove a breakpoint
+  w, watch global N    stop when global N changes
+  w, watch byte ADDR   stop when the byte at ADDR changes
+  w, watch attr OBJ A  stop when attribute A of object OBJ changes
+  w, watch parent OBJ  stop when object OBJ moves
+  unwatch N            remove watchpoint N
+  info                 list breakpoints and watchpoints, and the recording
+Inspecting:
+  l, list [ADDR]       disassemble from ADDR, or the next instruction
+  bt, backtrace        show the call stack
+  locals               show the current routine's locals
+  stack                show the current routine's evaluation stack
+  g, global N          show global N
+  x ADDR [COUNT]       show COUNT bytes of memory from ADDR
+  o, object N          show object N
+  q, quit              leave the debugger
+Addresses are in hex; everything else is decimal. With debugging
+information, globals and routines can also be given by name.`
+
+func main() {
+	debugFile := flag.String("debug", "", "Inform debugging information for the story")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: zdebug [-debug file] story")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	input := make(chan string)
+	output := make(chan string)
+	errors := make(chan error, 1)
+	machine := zmachine.New(flag.Arg(0), input, output, errors)
+	if err := machine.LoadStory(); err != nil {
+		fmt.Fprintln(os.Stderr, "zdebug:", err)
+		os.Exit(1)
+	}
+	machine.CompleteSetup()
+	debugger := zmachine.NewDebugger(&machine)
+	if *debugFile != "" {
+		symbols, err := zmachine.ReadDebugInfoFile(*debugFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "zdebug:", err)
+			os.Exit(1)
+		}
+		if !symbols.Matches(debugger.Memory()) {
+			fmt.Fprintf(os.Stderr, "zdebug: warning: %s doesn't match %s\n", *debugFile, flag.Arg(0))
+		}
+		debugger.SetDebugInfo(symbols)
+	}
+
+	go func() {
+		for s := range output {
+			fmt.Print(s)
+		}
+	}()
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+			debugger.Interrupt()
+		}
+	}()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	session := &session{debugger: debugger, input: input, lines: lines}
+	session.where()
+	for {
+		fmt.Print("(zdebug) ")
+		line, ok := <-lines
+		if !ok {
+			return
+		}
+		if !session.command(strings.Fields(line)) {
+			return
+		}
+	}
+}
+
+type session struct {
+	debugger *zmachine.Debugger
+	input    chan string
+	lines    chan string
+	typed    []string // Lines typed while the game was running, which it hasn't read yet
+}
+
+// Runs one command, returning false when it's time to quit.
+func (this *session) command(words []string) bool {
+	if len(words) == 0 {
+		return true
+	}
+	d := this.debugger
+	args := words[1:]
+	var err error
+	switch words[0] {
+	case "h", "help":
+		fmt.Println(help)
+	case "s", "step":
+		this.run(d.Step)
+	case "n", "next":
+		this.run(d.Next)
+	case "f", "finish":
+		this.run(d.Finish)
+	case "c", "continue":
+		this.run(d.Continue)
+	case "record":
+		d.Record()
+	case "rs", "reverse-step":
+		err = this.reverse(d.StepBack)
+	case "rc", "reverse-continue":
+		stop := d.ReverseContinue()
+		if stop.Reason == zmachine.DEBUG_STOP_ERROR {
+			err = stop.Err
+			break
+		}
+		fmt.Println(stop)
+		this.where()
+	case "back":
+		if len(args) < 2 || args[0] != "global" {
+			err = fmt.Errorf("usage: back global N")
+			break
+		}
+		var n int
+		if n, err = this.global(args, 1); err == nil {
+			err = this.reverse(func() error { return d.BackToGlobalWrite(n) })
+		}
+	case "rewind":
+		var n int
+		if n, err = argument(args, 0, 10); err == nil {
+			err = this.reverse(func() error { return d.RewindToTurn(n) })
+		}
+	case "b", "break":
+		err = this.setBreakpoint(args)
+	case "d", "delete":
+		var address int
+		if address, err = argument(args, 0, 16); err == nil && !d.ClearBreakpoint(address) {
+			err = fmt.Errorf("No breakpoint at %04x", address)
+		}
+	case "w", "watch":
+		err = this.watch(args)
+	case "unwatch":
+		var n int
+		if n, err = argument(args, 0, 10); err == nil {
+			if watchpoints := d.Watchpoints(); n >= 1 && n <= len(watchpoints) {
+				d.Unwatch(watchpoints[n-1])
+			} else {
+				err = fmt.Errorf("No watchpoint %d", n)
+			}
+		}
+	case "info":
+		for _, breakpoint := range d.Breakpoints() {
+			fmt.Printf("Breakpoint at %s\n", breakpoint)
+		}
+		for i, watchpoint := range d.Watchpoints() {
+			fmt.Printf("Watchpoint %d on %s\n", i+1, watchpoint)
+		}
+		if d.Recording() {
+			fmt.Printf("Recording: at instruction %d, %d turns\n", d.Position(), d.Turns())
+		}
+	case "l", "list":
+		address := d.PC()
+		if len(args) > 0 {
+			address, err = argument(args, 0, 16)
+		}
+		if err == nil {
+			err = this.list(address, 10)
+		}
+	case "bt", "backtrace":
+		for i, frame := range d.StackFrames() {
+			routine := "????"
+			if frame.Routine != 0 {
+				routine = fmt.Sprintf("%04x", frame.Routine)
+			}
+			fmt.Printf("#%d  routine %s at %04x  locals %s", i, routine, frame.PC, words16(frame.Locals))
+			if symbols := d.DebugInfo(); symbols != nil {
+				fmt.Printf("  %s", symbols.Describe(frame.PC))
+			}
+			fmt.Println()
+		}
+	case "locals":
+		for i, value := range d.StackFrames()[0].Locals {
+			name := d.DebugInfo().VariableName(byte(i+1), d.PC())
+			fmt.Printf("%s = %d (%04x)\n", name, int16(value), value)
+		}
+	case "stack":
+		fmt.Println(words16(d.StackFrames()[0].Stack))
+	case "g", "global":
+		var n int
+		if n, err = this.global(args, 0); err == nil {
+			if n < 0 || n > 239 {
+				err = fmt.Errorf("No global %d", n)
+			} else {
+				value := d.Global(n)
+				name := d.DebugInfo().VariableName(byte(n+0x10), 0)
+				fmt.Printf("%s = %d (%04x)\n", name, int16(value), value)
+			}
+		}
+	case "x":
+		err = this.examine(args)
+	case "o", "object":
+		var n int
+		if n, err = argument(args, 0, 10); err == nil {
+			var description string
+			if description, err = d.DescribeObject(n); err == nil {
+				fmt.Println(description)
+			}
+		}
+	case "q", "quit":
+		return false
+	default:
+		err = fmt.Errorf("Unknown command %q; try help", words[0])
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+	return true
+}
+
+// Runs the machine, passing typed lines to the game until it stops. Lines the
+// game doesn't read before it stops are kept for the next time it runs.
+func (this *session) run(how func() zmachine.Stop) {
+	done := make(chan zmachine.Stop)
+	go func() {
+		done <- how()
+	}()
+	for {
+		// Only offer a line while there is one, so that a stop is never missed
+		// waiting for the game to read.
+		var input chan string
+		var next string
+		if len(this.typed) > 0 {
+			input, next = this.input, this.typed[0]
+		}
+		select {
+		case stop := <-done:
+			if stop.Reason != zmachine.DEBUG_STOP_STEP {
+				fmt.Println()
+				fmt.Println(stop)
+			}
+			if stop.Reason != zmachine.DEBUG_STOP_QUIT && stop.Reason != zmachine.DEBUG_STOP_ERROR {
+				this.where()
+			}
+			return
+		case line, ok := <-this.lines:
+			if !ok {
+				this.debugger.Interrupt()
+				this.lines = nil
+				continue
+			}
+			this.typed = append(this.typed, line)
+		case input <- next:
+			this.typed = this.typed[1:]
+		}
+	}
+}
+
+// Goes backwards, then shows where the machine has ended up.
+func (this *session) reverse(how func() error) error {
+	if err := how(); err != nil {
+		return err
+	}
+	this.where()
+	return nil
+}
+
+// Shows the next instruction.
+func (this *session) where() {
+	if err := this.list(this.debugger.PC(), 1); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (this *session) list(address, count int) error {
+	d := this.debugger
+	symbols := d.DebugInfo()
+	location := ""
+	for i := 0; i < count; i++ {
+		instruction, err := zmachine.Decode(d.Memory(), address, d.Version())
+		if err != nil {
+			return err
+		}
+		if symbols != nil {
+			if here := symbols.Describe(address); here != location {
+				fmt.Printf("; %s\n", here)
+				location = here
+			}
+		}
+		marker := " "
+		if address == d.PC() {
+			marker = ">"
+		}
+		fmt.Printf("%s %05x: %s\n", marker, address, instruction.Format(symbols))
+		address += instruction.Length
+	}
+	return nil
+}
+
+func (this *session) setBreakpoint(args []string) error {
+	symbols := this.debugger.DebugInfo()
+	if len(args) == 2 && args[0] == "r" {
+		var routine int
+		var err error
+		if r := symbols.RoutineNamed(args[1]); r != nil {
+			routine = r.Address
+		} else if routine, err = argument(args, 1, 16); err != nil {
+			return err
+		}
+		breakpoint, err := this.debugger.SetRoutineBreakpoint(routine)
+		if err == nil {
+			fmt.Printf("Breakpoint at %s (%04x)\n", breakpoint, breakpoint.Address)
+		}
+		return err
+	}
+	if len(args) == 1 && strings.Contains(args[0], ":") && symbols != nil {
+		colon := strings.LastIndex(args[0], ":")
+		line, err := strconv.Atoi(args[0][colon+1:])
+		if err != nil {
+			return fmt.Errorf("Bad line number in %q", args[0])
+		}
+		address, ok := symbols.LineAddress(args[0][:colon], line)
+		if !ok {
+			return fmt.Errorf("No code for %s", args[0])
+		}
+		fmt.Printf("Breakpoint at %s\n", this.debugger.SetBreakpoint(address))
+		return nil
+	}
+	address, err := argument(args, 0, 16)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Breakpoint at %s\n", this.debugger.SetBreakpoint(address))
+	return nil
+}
+
+// Reads a global's number, or its name if there's debugging information.
+func (this *session) global(args []string, i int) (int, error) {
+	if i < len(args) {
+		if n := this.debugger.DebugInfo().GlobalNamed(args[i]); n >= 0 {
+			return n, nil
+		}
+	}
+	return argument(args, i, 10)
+}
+
+func (this *session) watch(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: watch global N | byte ADDR | attr OBJ A | parent OBJ")
+	}
+	var kind zmachine.WatchKind
+	base := 10
+	switch args[0] {
+	case "global":
+		kind = zmachine.WATCH_GLOBAL
+	case "byte":
+		kind = zmachine.WATCH_MEMORY
+		base = 16
+	case "attr":
+		kind = zmachine.WATCH_ATTRIBUTE
+	case "parent":
+		kind = zmachine.WATCH_PARENT
+	default:
+		return fmt.Errorf("Can't watch %q", args[0])
+	}
+	var target int
+	var err error
+	if kind == zmachine.WATCH_GLOBAL {
+		target, err = this.global(args, 1)
+	} else {
+		target, err = argument(args, 1, base)
+	}
+	if err != nil {
+		return err
+	}
+	attribute := 0
+	if kind == zmachine.WATCH_ATTRIBUTE {
+		if attribute, err = argument(args, 2, 10); err != nil {
+			return err
+		}
+	}
+	watchpoint, err := this.debugger.Watch(kind, target, attribute)
+	if err == nil {
+		fmt.Printf("Watchpoint %d on %s\n", len(this.debugger.Watchpoints()), watchpoint)
+	}
+	return err
+}
+
+func (this *session) examine(args []string) error {
+	address, err := argument(args, 0, 16)
+	if err != nil {
+		return err
+	}
+	count := 16
+	if len(args) > 1 {
+		if count, err = argument(args, 1, 10); err != nil {
+			return err
+		}
+	}
+	memory := this.debugger.Memory()
+	for i := 0; i < count; i += 16 {
+		var bytes []string
+		for j := i; j < i+16 && j < count && address+j < len(memory); j++ {
+			bytes = append(bytes, fmt.Sprintf("%02x", memory[address+j]))
+		}
+		if len(bytes) == 0 {
+			break
+		}
+		fmt.Printf("%05x: %s\n", address+i, strings.Join(bytes, " "))
+	}
+	return nil
+}
+
+func argument(args []string, i int, base int) (int, error) {
+	if i >= len(args) {
+		return 0, fmt.Errorf("Missing argument")
+	}
+	s := args[i]
+	if base == 16 {
+		s = strings.TrimPrefix(s, "0x")
+	}
+	if strings.HasPrefix(s, "-") {
+		return 0, fmt.Errorf("%q is negative", args[i])
+	}
+	n, err := strconv.ParseInt(s, base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Bad number %q", args[i])
+	}
+	return int(n), nil
+}
+
+func words16(values []uint16) string {
+	s := make([]string, len(values))
+	for i, value := range values {
+		s[i] = fmt.Sprintf("%04x", value)
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
@@ -0,0 +1,78 @@
+// zdict lists the words in a story's dictionary, or looks some up.
+//
+//	zdict game.z3 [word...]
+//
+// Without words, every entry is listed with its address and the data the
+// story keeps with it, after the word separators. Given words, only their
+// entries are shown, and words the story doesn't know are reported.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+import "github.com/Katharine/zmachine.go"
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: zdict story [word...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	story, _, err := zmachine.ReadStoryFile(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	dictionary, err := zmachine.StoryDictionary(story)
+	if err != nil {
+		fail(err)
+	}
+
+	if words := flag.Args()[1:]; len(words) > 0 {
+		unknown := false
+		for _, word := range words {
+			if entry, ok := dictionary.Lookup(word); ok {
+				show(entry)
+			} else {
+				fmt.Printf("%q is not in the dictionary\n", word)
+				unknown = true
+			}
+		}
+		if unknown {
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Printf("Separators: %s\n", strconv.Quote(dictionary.Separators))
+	fmt.Printf("%d entries of %d bytes", len(dictionary.Entries), dictionary.EntryLength)
+	if !dictionary.Sorted {
+		fmt.Print(", unsorted")
+	}
+	fmt.Println()
+	for i := range dictionary.Entries {
+		show(&dictionary.Entries[i])
+	}
+}
+
+func show(entry *zmachine.DictionaryEntry) {
+	data := make([]string, len(entry.Data))
+	for i, b := range entry.Data {
+		data[i] = fmt.Sprintf("%02x", b)
+	}
+	fmt.Printf("%04x  %-10s %s\n", entry.Address, entry.Word, strings.Join(data, " "))
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "zdict:", err)
+	os.Exit(1)
+}
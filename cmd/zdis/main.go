@@ -0,0 +1,164 @@
+// zdis disassembles the routines of a story file. By default it starts from the
+// story's entry point and follows every call to a constant address.
+//
+//	zdis [-debug gameinfo.dbg] [-r addr]... game.z3
+//
+// With Inform debugging information, routines, variables, attributes and
+// properties are named, and each source line is marked.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import "github.com/Katharine/zmachine.go"
+
+type addressList []int
+
+func (this *addressList) String() string {
+	return fmt.Sprint(*this)
+}
+
+func (this *addressList) Set(s string) error {
+	address, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 32)
+	if err != nil {
+		return err
+	}
+	*this = append(*this, int(address))
+	return nil
+}
+
+func main() {
+	var starts addressList
+	flag.Var(&starts, "r", "disassemble only the routine at this hex address (repeatable)")
+	debugFile := flag.String("debug", "", "Inform debugging information for the story")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: zdis [-debug file] [-r addr]... story")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	story, _, err := zmachine.ReadStoryFile(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	if len(story) < 0x40 {
+		fail(fmt.Errorf("%s is too short to be a story file", flag.Arg(0)))
+	}
+	version := story[0]
+
+	var symbols *zmachine.DebugInfo
+	if *debugFile != "" {
+		if symbols, err = zmachine.ReadDebugInfoFile(*debugFile); err != nil {
+			fail(err)
+		}
+		if !symbols.Matches(story) {
+			fmt.Fprintf(os.Stderr, "zdis: warning: %s doesn't match %s\n", *debugFile, flag.Arg(0))
+		}
+	}
+
+	follow := len(starts) == 0
+	if follow {
+		starts = append(starts, zmachine.EntryRoutine(story))
+	}
+
+	routines := make(map[int]zmachine.Routine)
+	errors := make(map[int]error)
+	queue := append([]int(nil), starts...)
+	for len(queue) > 0 {
+		address := queue[0]
+		queue = queue[1:]
+		if _, seen := routines[address]; seen {
+			continue
+		}
+		if _, seen := errors[address]; seen {
+			continue
+		}
+
+		routine, err := zmachine.DisassembleRoutine(story, address, version)
+		if err != nil {
+			errors[address] = err
+			continue
+		}
+		routines[address] = routine
+		if follow {
+			for _, instruction := range routine.Instructions {
+				if target, ok := instruction.CallTarget(); ok && target != 0 {
+					queue = append(queue, target)
+				}
+			}
+		}
+	}
+
+	addresses := make([]int, 0, len(routines)+len(errors))
+	for address := range routines {
+		addresses = append(addresses, address)
+	}
+	for address := range errors {
+		addresses = append(addresses, address)
+	}
+	sort.Ints(addresses)
+
+	for _, address := range addresses {
+		if err, failed := errors[address]; failed {
+			fmt.Printf("Routine %04x: %s\n\n", address, err)
+			continue
+		}
+		printRoutine(story, routines[address], symbols)
+	}
+}
+
+func printRoutine(story []byte, routine zmachine.Routine, symbols *zmachine.DebugInfo) {
+	locals := make([]string, len(routine.Locals))
+	for i, value := range routine.Locals {
+		locals[i] = fmt.Sprintf("%04x", value)
+	}
+	name := ""
+	lines := make(map[int]zmachine.SourceLocation)
+	if symbols != nil {
+		if r := symbols.RoutineAt(routine.Address); r != nil && r.Address == routine.Address {
+			name = " " + r.Name
+			if r.Location.File != "" {
+				name += " (" + r.Location.String() + ")"
+			}
+			for _, line := range r.Lines {
+				lines[line.Address] = line.Location
+			}
+		}
+	}
+	fmt.Printf("Routine %04x%s, %d locals (%s)\n\n", routine.Address, name, len(routine.Locals), strings.Join(locals, ", "))
+	for _, instruction := range routine.Instructions {
+		if location, ok := lines[instruction.Address]; ok {
+			fmt.Printf("  ; %s\n", location)
+		}
+		fmt.Printf("  %04x:  %-24s %s\n", instruction.Address, hexBytes(story[instruction.Address:instruction.Address+instruction.Length]), instruction.Format(symbols))
+	}
+	fmt.Println()
+}
+
+// Formats up to eight bytes of an instruction.
+func hexBytes(data []byte) string {
+	s := make([]string, 0, 8)
+	for i, b := range data {
+		if i == 7 && len(data) > 8 {
+			s = append(s, "..")
+			break
+		}
+		s = append(s, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(s, " ")
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "zdis:", err)
+	os.Exit(1)
+}
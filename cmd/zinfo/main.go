@@ -0,0 +1,165 @@
+// zinfo describes a story file without running it: its header, memory map,
+// abbreviations, alphabets, dictionary and objects, any Blorb metadata, and
+// its IFID.
+//
+//	zinfo [-a] game.z3
+//
+// With -a, the abbreviations are listed in full.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+import "github.com/Katharine/zmachine.go"
+
+func main() {
+	all := flag.Bool("a", false, "list the abbreviations")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: zinfo [-a] story")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	story, blorb, err := zmachine.ReadStoryFile(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	info, err := zmachine.NewStoryInfo(story, blorb)
+	if err != nil {
+		fail(err)
+	}
+
+	fmt.Println("Story")
+	fmt.Printf("  Version:          %d\n", info.Version)
+	fmt.Printf("  Release:          %d\n", info.Release)
+	fmt.Printf("  Serial:           %s\n", info.Serial)
+	if info.ComputedChecksum == info.Checksum {
+		fmt.Printf("  Checksum:         %04x (correct)\n", info.Checksum)
+	} else {
+		fmt.Printf("  Checksum:         %04x (wrong: the story's bytes add up to %04x)\n", info.Checksum, info.ComputedChecksum)
+	}
+	fmt.Printf("  Length:           %d bytes", info.Length)
+	if info.FileSize != info.Length {
+		fmt.Printf(" (the file is %d)", info.FileSize)
+	}
+	fmt.Println()
+	fmt.Printf("  IFID:             %s\n", info.IFID)
+	if info.Compiler != "" {
+		fmt.Printf("  Compiler:         %s\n", info.Compiler)
+	}
+	if info.Standard != "" {
+		fmt.Printf("  Standard:         %s\n", info.Standard)
+	}
+	fmt.Printf("  Initial PC:       %04x\n", info.InitialPC)
+	fmt.Printf("  Flags 1:          %02x%s\n", info.Flags1, flags1(info))
+	fmt.Printf("  Flags 2:          %04x%s\n", info.Flags2, flags2(info))
+
+	fmt.Println("\nMemory map")
+	for _, region := range info.Regions {
+		fmt.Printf("  %05x-%05x  %6d bytes  %s\n", region.Start, region.End-1, region.End-region.Start, region.Name)
+	}
+
+	fmt.Println("\nText")
+	for i, alphabet := range info.Alphabets {
+		fmt.Printf("  A%d:               %s\n", i, strconv.Quote(alphabet))
+	}
+	if info.CustomAlphabet {
+		fmt.Println("  (from the story's own alphabet table)")
+	}
+	fmt.Printf("  Abbreviations:    %d\n", len(info.Abbreviations))
+	if *all {
+		for i, abbreviation := range info.Abbreviations {
+			fmt.Printf("    %2d  %s\n", i, strconv.Quote(abbreviation))
+		}
+	}
+
+	d := info.Dictionary
+	fmt.Println("\nDictionary")
+	fmt.Printf("  Address:          %04x\n", d.Address)
+	fmt.Printf("  Entries:          %d", d.Entries)
+	if !d.Sorted {
+		fmt.Print(" (unsorted)")
+	}
+	fmt.Println()
+	fmt.Printf("  Entry length:     %d bytes, %d of them the word\n", d.EntryLength, d.KeyLength)
+	fmt.Printf("  Separators:       %s\n", strconv.Quote(d.Separators))
+
+	fmt.Println("\nObjects")
+	fmt.Printf("  Count:            %d\n", info.Objects)
+
+	if info.Blorb != nil {
+		fmt.Println("\nBlorb")
+		counts := make(map[string]int)
+		for _, resource := range info.Blorb.Resources {
+			counts[resource.Usage]++
+		}
+		fmt.Printf("  Resources:        %d pictures, %d sounds, %d data\n",
+			counts[zmachine.BLORB_USAGE_PICTURE], counts[zmachine.BLORB_USAGE_SOUND], counts[zmachine.BLORB_USAGE_DATA])
+		if info.Blorb.Frontispiece >= 0 {
+			fmt.Printf("  Frontispiece:     picture %d\n", info.Blorb.Frontispiece)
+		}
+		if b := info.Bibliographic; b != nil {
+			for _, field := range [][2]string{
+				{"Title", b.Title}, {"Author", b.Author}, {"Headline", b.Headline},
+				{"First published", b.FirstPublished}, {"Genre", b.Genre}, {"Description", b.Description},
+			} {
+				if field[1] != "" {
+					fmt.Printf("  %-17s %s\n", field[0]+":", strings.TrimSpace(field[1]))
+				}
+			}
+		}
+	}
+}
+
+// Names the flags set in the first flags byte, as " (a, b)".
+func flags1(info *zmachine.StoryInfo) string {
+	var names []string
+	if info.Version <= 3 {
+		names = flagNames(uint16(info.Flags1), map[uint]string{
+			1: "time game", 2: "two disks", 4: "no status line", 5: "split screen", 6: "variable pitch font",
+		})
+	} else {
+		names = flagNames(uint16(info.Flags1), map[uint]string{
+			0: "colours", 1: "pictures", 2: "bold", 3: "italic", 4: "fixed-space", 5: "sound effects", 7: "timed input",
+		})
+	}
+	return list(names)
+}
+
+// Names the flags set in the second flags word.
+func flags2(info *zmachine.StoryInfo) string {
+	return list(flagNames(info.Flags2, map[uint]string{
+		0: "transcripting", 1: "fixed pitch", 2: "redraw", 3: "pictures", 4: "undo", 5: "mouse", 6: "colours", 7: "sound effects", 8: "menus",
+	}))
+}
+
+func list(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(names, ", ") + ")"
+}
+
+func flagNames(flags uint16, names map[uint]string) []string {
+	var set []string
+	for bit := uint(0); bit < 16; bit++ {
+		if name, ok := names[bit]; ok && flags&(1<<bit) != 0 {
+			set = append(set, name)
+		}
+	}
+	return set
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "zinfo:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,138 @@
+// zobjects lists the objects in a story file, as the story begins.
+//
+//	zobjects [-debug gameinfo.dbg] [-o] [-json] game.z3
+//
+// By default the object tree is drawn, each object indented beneath its
+// parent. With -o, every object is listed with its attributes, relatives and
+// properties, and -json gives the same for other tools. With Inform debugging
+// information, attributes and properties are named.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+import "github.com/Katharine/zmachine.go"
+
+func main() {
+	debugFile := flag.String("debug", "", "Inform debugging information for the story")
+	list := flag.Bool("o", false, "list every object in full")
+	asJSON := flag.Bool("json", false, "write the objects as JSON")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: zobjects [-debug file] [-o] [-json] story")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	story, _, err := zmachine.ReadStoryFile(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	// Without debugging information, there are no names to find.
+	symbols := &zmachine.DebugInfo{}
+	if *debugFile != "" {
+		if symbols, err = zmachine.ReadDebugInfoFile(*debugFile); err != nil {
+			fail(err)
+		}
+		if !symbols.Matches(story) {
+			fmt.Fprintf(os.Stderr, "zobjects: warning: %s doesn't match %s\n", *debugFile, flag.Arg(0))
+		}
+	}
+	objects, err := zmachine.StoryObjects(story)
+	if err != nil {
+		fail(err)
+	}
+
+	switch {
+	case *asJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if objects == nil {
+			objects = []*zmachine.Object{}
+		}
+		err = encoder.Encode(objects)
+	case *list:
+		for _, object := range objects {
+			describe(object, objects, symbols)
+		}
+	default:
+		tree(objects)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// Draws the tree, each object beneath its parent. Objects whose parents don't
+// list them as children, as in damaged tables, are left out.
+func tree(objects []*zmachine.Object) {
+	var draw func(n, depth int)
+	seen := make(map[int]bool)
+	draw = func(n, depth int) {
+		if n < 1 || n > len(objects) || seen[n] {
+			return
+		}
+		seen[n] = true
+		object := objects[n-1]
+		fmt.Printf("%s[%3d] %q\n", strings.Repeat(" . ", depth), n, object.Name)
+		for _, child := range object.Children {
+			draw(child, depth+1)
+		}
+	}
+	for _, object := range objects {
+		if object.Parent == 0 {
+			draw(object.Number, 0)
+		}
+	}
+}
+
+func describe(object *zmachine.Object, objects []*zmachine.Object, symbols *zmachine.DebugInfo) {
+	title := fmt.Sprintf("%d", object.Number)
+	if symbols.Objects[object.Number] != "" {
+		title += " " + symbols.Objects[object.Number]
+	}
+	fmt.Printf("%s %q\n", title, object.Name)
+	attributes := make([]string, len(object.Attributes))
+	for i, attribute := range object.Attributes {
+		attributes[i] = named(attribute, symbols.Attributes)
+	}
+	fmt.Printf("  Attributes: %s\n", strings.Join(attributes, ", "))
+	fmt.Printf("  Parent: %s  Sibling: %s  Child: %s\n",
+		relative(object.Parent, objects), relative(object.Sibling, objects), relative(object.Child, objects))
+	fmt.Printf("  Properties at %04x:\n", object.Address)
+	for _, property := range object.Properties {
+		data := make([]string, len(property.Data))
+		for i, b := range property.Data {
+			data[i] = fmt.Sprintf("%02x", b)
+		}
+		fmt.Printf("    [%s] %s\n", named(property.Number, symbols.Properties), strings.Join(data, " "))
+	}
+	fmt.Println()
+}
+
+func named(n int, names map[int]string) string {
+	if name, ok := names[n]; ok {
+		return fmt.Sprintf("%d (%s)", n, name)
+	}
+	return fmt.Sprint(n)
+}
+
+func relative(n int, objects []*zmachine.Object) string {
+	if n < 1 || n > len(objects) {
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("%d %q", n, objects[n-1].Name)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "zobjects:", err)
+	os.Exit(1)
+}
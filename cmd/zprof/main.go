@@ -0,0 +1,109 @@
+// zprof plays a story with the commands read from standard input, then reports
+// which routines it spent its time in.
+//
+//	zprof [-debug gameinfo.dbg] [-o story.pprof] [-top 20] game.z3 < walkthrough.txt
+//
+// The report of the most expensive routines and call paths goes to standard
+// error once the story quits or the commands run out. With -o, the profile is
+// also written in pprof's format, for use with "go tool pprof". With Inform
+// debugging information, routines are given their names from the source.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+import "github.com/Katharine/zmachine.go"
+
+func main() {
+	debugFile := flag.String("debug", "", "Inform debugging information for the story")
+	out := flag.String("o", "", "write a pprof profile to this file")
+	top := flag.Int("top", 20, "how many routines and paths to report")
+	quiet := flag.Bool("quiet", false, "don't show the story's output")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: zprof [-debug file] [-o file] [-top n] [-quiet] story < commands")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	input := make(chan string)
+	output := make(chan string)
+	machine := zmachine.New(flag.Arg(0), input, output, make(chan error, 1))
+	if err := machine.LoadStory(); err != nil {
+		fail(err)
+	}
+	machine.CompleteSetup()
+	debugger := zmachine.NewDebugger(&machine)
+
+	var symbols *zmachine.DebugInfo
+	if *debugFile != "" {
+		var err error
+		if symbols, err = zmachine.ReadDebugInfoFile(*debugFile); err != nil {
+			fail(err)
+		}
+		if !symbols.Matches(debugger.Memory()) {
+			fmt.Fprintf(os.Stderr, "zprof: warning: %s doesn't match %s\n", *debugFile, flag.Arg(0))
+		}
+		debugger.SetDebugInfo(symbols)
+	}
+
+	go func() {
+		for s := range output {
+			if !*quiet {
+				fmt.Print(s)
+			}
+		}
+	}()
+
+	// Once the commands run out, the story stops when it next asks for one.
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if !*quiet {
+				fmt.Println(scanner.Text())
+			}
+			input <- scanner.Text()
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintln(os.Stderr, "zprof:", err)
+		}
+		machine.EndInput()
+	}()
+
+	profiler := zmachine.NewProfiler()
+	machine.SetProfiler(profiler)
+	stop := debugger.Continue()
+	machine.SetProfiler(nil)
+	if stop.Reason != zmachine.DEBUG_STOP_QUIT {
+		fmt.Fprintln(os.Stderr, "zprof:", stop)
+	}
+
+	fmt.Fprintf(os.Stderr, "\n%d instructions\n\n", profiler.Instructions())
+	if err := profiler.WriteText(os.Stderr, symbols, *top); err != nil {
+		fail(err)
+	}
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fail(err)
+		}
+		if err := profiler.WritePprof(f, flag.Arg(0), symbols); err != nil {
+			fail(err)
+		}
+		if err := f.Close(); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "zprof:", err)
+	os.Exit(1)
+}
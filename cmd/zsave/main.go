@@ -0,0 +1,178 @@
+// zsave inspects Quetzal save files.
+//
+//	zsave [-story game.z3] dump save.qzl
+//	zsave [-story game.z3] diff old.qzl new.qzl
+//	zsave -story game.z3 validate save.qzl
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+import "github.com/Katharine/zmachine.go"
+
+func main() {
+	storyFile := flag.String("story", "", "story file the save belongs to")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: zsave [-story file] dump save")
+		fmt.Fprintln(os.Stderr, "       zsave [-story file] diff old new")
+		fmt.Fprintln(os.Stderr, "       zsave -story file validate save")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+
+	var story []byte
+	if *storyFile != "" {
+		var err error
+		if story, _, err = zmachine.ReadStoryFile(*storyFile); err != nil {
+			fail(err)
+		}
+	}
+
+	switch {
+	case len(args) == 2 && args[0] == "dump":
+		dump(load(args[1]), story)
+	case len(args) == 3 && args[0] == "diff":
+		diff(load(args[1]), load(args[2]), story)
+	case len(args) == 2 && args[0] == "validate" && story != nil:
+		validate(load(args[1]), story)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "zsave:", err)
+	os.Exit(1)
+}
+
+func load(filename string) *zmachine.QuetzalSave {
+	save, err := zmachine.ReadQuetzalFile(filename)
+	if err != nil {
+		fail(fmt.Errorf("%s: %s", filename, err))
+	}
+	return save
+}
+
+func dump(save *zmachine.QuetzalSave, story []byte) {
+	fmt.Printf("Chunks: %s\n", strings.Join(save.Chunks, " "))
+	printHeader(save.Header)
+	for _, annotation := range save.Annotations {
+		fmt.Printf("Annotation: %s\n", annotation)
+	}
+	if save.Author != "" {
+		fmt.Printf("Author: %s\n", save.Author)
+	}
+	if save.Copyright != "" {
+		fmt.Printf("Copyright: %s\n", save.Copyright)
+	}
+	if metadata := save.Metadata; metadata != nil {
+		fmt.Printf("Saved: %s\n", metadata.Saved.Format("2006-01-02 15:04:05 MST"))
+		if metadata.HasStatus {
+			fmt.Printf("Status: %s\n", metadata)
+		}
+		for _, line := range metadata.Preview {
+			fmt.Printf("  | %s\n", line)
+		}
+	}
+
+	kind := "uncompressed"
+	if save.Compressed {
+		kind = "compressed"
+	}
+	if changes, err := save.MemoryChanges(story); err != nil {
+		fmt.Printf("Memory (%s): %s\n", kind, err)
+	} else {
+		fmt.Printf("Memory (%s): %d bytes changed\n", kind, len(changes))
+		printMemory(changes, story == nil)
+	}
+
+	fmt.Printf("Frames: %d\n", len(save.Frames))
+	for i := range save.Frames {
+		printFrame(i, &save.Frames[i])
+	}
+}
+
+func diff(old, new *zmachine.QuetzalSave, story []byte) {
+	d, err := zmachine.DiffQuetzalSaves(old, new, story)
+	if err != nil {
+		fail(err)
+	}
+	if d.Empty() {
+		fmt.Println("Saves are identical")
+		return
+	}
+
+	if d.Headers[0] != d.Headers[1] {
+		fmt.Print("- ")
+		printHeader(d.Headers[0])
+		fmt.Print("+ ")
+		printHeader(d.Headers[1])
+	}
+	if len(d.Memory) > 0 {
+		fmt.Printf("Memory: %d bytes differ\n", len(d.Memory))
+		printMemory(d.Memory, d.XOR)
+	}
+	for _, frame := range d.Frames {
+		if frame.Old != nil {
+			fmt.Print("- ")
+			printFrame(frame.Index, frame.Old)
+		}
+		if frame.New != nil {
+			fmt.Print("+ ")
+			printFrame(frame.Index, frame.New)
+		}
+	}
+	os.Exit(1)
+}
+
+func validate(save *zmachine.QuetzalSave, story []byte) {
+	problems := save.Validate(story)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("OK")
+}
+
+func printHeader(header zmachine.QuetzalHeader) {
+	fmt.Printf("Release %d, serial %s, checksum 0x%04x, PC 0x%x\n", header.Release, header.Serial, header.Checksum, header.PC)
+}
+
+func printMemory(changes []zmachine.QuetzalMemoryChange, xor bool) {
+	for _, change := range changes {
+		if xor {
+			fmt.Printf("  0x%04x: xor 0x%02x\n", change.Address, change.New)
+		} else {
+			fmt.Printf("  0x%04x: 0x%02x -> 0x%02x\n", change.Address, change.Old, change.New)
+		}
+	}
+}
+
+func printFrame(index int, frame *zmachine.QuetzalFrame) {
+	if index == 0 && frame.ReturnPC == 0 {
+		fmt.Printf("  #%d (dummy) stack %s\n", index, words(frame.Stack))
+		return
+	}
+	result := "-> " + zmachine.VariableName(frame.ResultVariable)
+	if frame.DiscardsResult() {
+		result = "(result discarded)"
+	}
+	fmt.Printf("  #%d return to 0x%x %s, %d args, locals %s, stack %s\n",
+		index, frame.ReturnPC, result, frame.ArgumentCount(), words(frame.Locals), words(frame.Stack))
+}
+
+func words(values []uint16) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprintf("%d", v)
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
@@ -0,0 +1,427 @@
+package zmachine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Counts how often each instruction is executed and which way each branch
+// goes. A Coverage is a Tracer, so it's attached with SetTracer. Coverage
+// from several runs of the same story can be merged, and saved to be merged
+// later.
+type Coverage struct {
+	story        string // Identifies the story, so that only its coverage is merged
+	routines     map[int]bool
+	instructions map[int]*InstructionCoverage
+}
+
+// How often an instruction was executed, and for a branch, which way it went.
+type InstructionCoverage struct {
+	Executed uint64
+	Taken    uint64
+	NotTaken uint64
+}
+
+func NewCoverage(story []byte) *Coverage {
+	return &Coverage{
+		story:        storyIdentity(story),
+		routines:     make(map[int]bool),
+		instructions: make(map[int]*InstructionCoverage),
+	}
+}
+
+// Describes a story by its release, serial number and checksum.
+func storyIdentity(story []byte) string {
+	return fmt.Sprintf("%d.%s.%04x", int(story[0x02])<<8|int(story[0x03]), story[0x12:0x18], int(story[0x1C])<<8|int(story[0x1D]))
+}
+
+func (this *Coverage) Trace(event *TraceEvent) {
+	if event.Routine != 0 {
+		this.routines[event.Routine] = true
+	}
+	instruction := this.instructions[event.PC]
+	if instruction == nil {
+		instruction = &InstructionCoverage{}
+		this.instructions[event.PC] = instruction
+	}
+	instruction.Executed++
+	if event.Instruction.Branches {
+		if event.Branched {
+			instruction.Taken++
+		} else {
+			instruction.NotTaken++
+		}
+	}
+}
+
+// Returns what's known about the instruction at address. Instructions
+// which were never executed have all their counts zero.
+func (this *Coverage) Instruction(address int) InstructionCoverage {
+	if instruction := this.instructions[address]; instruction != nil {
+		return *instruction
+	}
+	return InstructionCoverage{}
+}
+
+// Adds the coverage from another run of the same story.
+func (this *Coverage) Merge(other *Coverage) error {
+	if other.story != this.story {
+		return fmt.Errorf("Coverage is for story %s, not %s", other.story, this.story)
+	}
+	for routine := range other.routines {
+		this.routines[routine] = true
+	}
+	for address, counts := range other.instructions {
+		instruction := this.instructions[address]
+		if instruction == nil {
+			instruction = &InstructionCoverage{}
+			this.instructions[address] = instruction
+		}
+		instruction.Executed += counts.Executed
+		instruction.Taken += counts.Taken
+		instruction.NotTaken += counts.NotTaken
+	}
+	return nil
+}
+
+// The first line of a saved coverage file, followed by the story's identity.
+const coverageMagic = "zcov 1"
+
+// Writes the coverage in a line-based text format: the story's identity, then
+// a line "r ADDRESS" for each routine seen, and a line
+// "i ADDRESS EXECUTED TAKEN NOTTAKEN" for each instruction, with addresses in
+// hex and counts in decimal.
+func (this *Coverage) Save(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	fmt.Fprintf(buffered, "%s %s\n", coverageMagic, this.story)
+	for _, routine := range sortedKeys(this.routines) {
+		fmt.Fprintf(buffered, "r %x\n", routine)
+	}
+	addresses := make([]int, 0, len(this.instructions))
+	for address := range this.instructions {
+		addresses = append(addresses, address)
+	}
+	sort.Ints(addresses)
+	for _, address := range addresses {
+		i := this.instructions[address]
+		fmt.Fprintf(buffered, "i %x %d %d %d\n", address, i.Executed, i.Taken, i.NotTaken)
+	}
+	return buffered.Flush()
+}
+
+func sortedKeys(set map[int]bool) []int {
+	keys := make([]int, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// Reads coverage written by Save.
+func ReadCoverage(r io.Reader) (*Coverage, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), coverageMagic+" ") {
+		return nil, errors.New("Not a coverage file")
+	}
+	coverage := &Coverage{
+		story:        strings.TrimPrefix(scanner.Text(), coverageMagic+" "),
+		routines:     make(map[int]bool),
+		instructions: make(map[int]*InstructionCoverage),
+	}
+	for line := 2; scanner.Scan(); line++ {
+		var address int
+		var err error
+		switch text := scanner.Text(); {
+		case strings.HasPrefix(text, "r "):
+			_, err = fmt.Sscanf(text, "r %x", &address)
+			coverage.routines[address] = true
+		case strings.HasPrefix(text, "i "):
+			i := &InstructionCoverage{}
+			_, err = fmt.Sscanf(text, "i %x %d %d %d", &address, &i.Executed, &i.Taken, &i.NotTaken)
+			coverage.instructions[address] = i
+		default:
+			err = errors.New("unknown record")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bad coverage on line %d: %v", line, err)
+		}
+	}
+	return coverage, scanner.Err()
+}
+
+func ReadCoverageFile(filename string) (*Coverage, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCoverage(f)
+}
+
+// The coverage of one routine. Each branch has two directions, and each
+// direction counts as covered once it's been followed.
+type RoutineCoverage struct {
+	Routine              Routine
+	Name                 string // From the debugging information, if any
+	Executed             int    // How many of the routine's instructions were executed
+	BranchDirections     int
+	CoveredDirections    int
+	Called               bool
+	InstructionsExecuted uint64 // The total of all the instructions' counts
+}
+
+func (this RoutineCoverage) InstructionPercent() float64 {
+	return percent(this.Executed, len(this.Routine.Instructions))
+}
+
+func (this RoutineCoverage) BranchPercent() float64 {
+	return percent(this.CoveredDirections, this.BranchDirections)
+}
+
+func percent(n, of int) float64 {
+	if of == 0 {
+		return 100
+	}
+	return 100 * float64(n) / float64(of)
+}
+
+// Returns the coverage of every routine that can be found: those run, those
+// named by the debugging information, and those called from them with
+// constant addresses. Routines which can't be disassembled are left out.
+func (this *Coverage) Routines(story []byte, symbols *DebugInfo) []RoutineCoverage {
+	queue := append([]int{EntryRoutine(story)}, sortedKeys(this.routines)...)
+	if symbols != nil {
+		for _, routine := range symbols.Routines {
+			queue = append(queue, routine.Address)
+		}
+	}
+	seen := make(map[int]bool)
+	var routines []RoutineCoverage
+	for len(queue) > 0 {
+		address := queue[0]
+		queue = queue[1:]
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		routine, err := DisassembleRoutine(story, address, story[0])
+		if err != nil {
+			continue
+		}
+
+		report := RoutineCoverage{Routine: routine, Called: this.routines[address]}
+		if r := symbols.routineStarting(address); r != nil {
+			report.Name = r.Name
+		}
+		for _, instruction := range routine.Instructions {
+			counts := this.Instruction(instruction.Address)
+			if counts.Executed > 0 {
+				report.Executed++
+				report.Called = true
+			}
+			report.InstructionsExecuted += counts.Executed
+			if instruction.Branches {
+				report.BranchDirections += 2
+				if counts.Taken > 0 {
+					report.CoveredDirections++
+				}
+				if counts.NotTaken > 0 {
+					report.CoveredDirections++
+				}
+			}
+			if target, ok := instruction.CallTarget(); ok && target != 0 {
+				queue = append(queue, target)
+			}
+		}
+		routines = append(routines, report)
+	}
+	sort.Slice(routines, func(i, j int) bool {
+		return routines[i].Routine.Address < routines[j].Routine.Address
+	})
+	return routines
+}
+
+// Writes a line for each routine with the percentage of its instructions
+// and branch directions covered, then the totals.
+func (this *Coverage) WriteSummary(w io.Writer, story []byte, symbols *DebugInfo) error {
+	instructions, executed, directions, covered, called := 0, 0, 0, 0, 0
+	routines := this.Routines(story, symbols)
+	for _, routine := range routines {
+		name := routine.Name
+		if name == "" {
+			name = fmt.Sprintf("%04x", routine.Routine.Address)
+		}
+		fmt.Fprintf(w, "%6.1f%% %6.1f%%  %s\n", routine.InstructionPercent(), routine.BranchPercent(), name)
+		instructions += len(routine.Routine.Instructions)
+		executed += routine.Executed
+		directions += routine.BranchDirections
+		covered += routine.CoveredDirections
+		if routine.Called {
+			called++
+		}
+	}
+	_, err := fmt.Fprintf(w, "\nRoutines: %d of %d called (%.1f%%)\nInstructions: %d of %d executed (%.1f%%)\nBranches: %d of %d directions followed (%.1f%%)\n",
+		called, len(routines), percent(called, len(routines)),
+		executed, instructions, percent(executed, instructions),
+		covered, directions, percent(covered, directions))
+	return err
+}
+
+// Writes the disassembly of every routine found, with how often each
+// instruction ran, "#####" for those which never did, and a note on every
+// branch which hasn't gone both ways.
+func (this *Coverage) WriteAnnotated(w io.Writer, story []byte, symbols *DebugInfo) error {
+	for _, routine := range this.Routines(story, symbols) {
+		name := ""
+		lines := make(map[int]SourceLocation)
+		if r := symbols.routineStarting(routine.Routine.Address); r != nil {
+			name = " " + r.Name
+			for _, line := range r.Lines {
+				lines[line.Address] = line.Location
+			}
+		}
+		fmt.Fprintf(w, "Routine %04x%s: %.1f%% of instructions, %.1f%% of branches\n\n",
+			routine.Routine.Address, name, routine.InstructionPercent(), routine.BranchPercent())
+		for _, instruction := range routine.Routine.Instructions {
+			if location, ok := lines[instruction.Address]; ok {
+				fmt.Fprintf(w, "           ; %s\n", location)
+			}
+			counts := this.Instruction(instruction.Address)
+			count := "#####"
+			if counts.Executed > 0 {
+				count = fmt.Sprint(counts.Executed)
+			}
+			note := ""
+			if instruction.Branches && counts.Executed > 0 {
+				switch {
+				case counts.Taken == 0:
+					note = "  ; never taken"
+				case counts.NotTaken == 0:
+					note = "  ; always taken"
+				}
+			}
+			fmt.Fprintf(w, "%9s  %04x:  %s%s\n", count, instruction.Address, instruction.Format(symbols), note)
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the coverage of the source in LCOV's tracefile format, for tools
+// such as genhtml. Each source line is counted as run as often as the first
+// instruction of its code, and each branch is attributed to the line holding
+// it. Debugging information is needed to know the lines.
+func (this *Coverage) WriteLCOV(w io.Writer, story []byte, symbols *DebugInfo) error {
+	if symbols == nil {
+		return errors.New("LCOV output needs debugging information")
+	}
+	type branch struct {
+		line            int
+		taken, notTaken uint64
+		executed        bool
+	}
+	type file struct {
+		functions []RoutineCoverage
+		locations []SourceLocation
+		lines     map[int]uint64
+		branches  []branch
+	}
+	files := make(map[string]*file)
+	for _, routine := range this.Routines(story, symbols) {
+		r := symbols.routineStarting(routine.Routine.Address)
+		if r == nil || r.Location.File == "" {
+			continue
+		}
+		f := files[r.Location.Path]
+		if f == nil {
+			f = &file{lines: make(map[int]uint64)}
+			files[r.Location.Path] = f
+		}
+		f.functions = append(f.functions, routine)
+		f.locations = append(f.locations, r.Location)
+
+		// Lines are listed in address order, so each runs until the next.
+		location := r.Location
+		next := 0
+		for _, instruction := range routine.Routine.Instructions {
+			first := false
+			for next < len(r.Lines) && r.Lines[next].Address <= instruction.Address {
+				location, first = r.Lines[next].Location, true
+				next++
+			}
+			counts := this.Instruction(instruction.Address)
+			if first && location.Path == r.Location.Path {
+				f.lines[location.Line] += counts.Executed
+			}
+			if instruction.Branches && location.Path == r.Location.Path {
+				f.branches = append(f.branches, branch{location.Line, counts.Taken, counts.NotTaken, counts.Executed > 0})
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	buffered := bufio.NewWriter(w)
+	for _, path := range paths {
+		f := files[path]
+		fmt.Fprintf(buffered, "TN:\nSF:%s\n", filepath.ToSlash(path))
+		hit := 0
+		for i, routine := range f.functions {
+			fmt.Fprintf(buffered, "FN:%d,%s\n", f.locations[i].Line, routine.Name)
+		}
+		for _, routine := range f.functions {
+			// The first instruction runs once per call.
+			calls := uint64(0)
+			if len(routine.Routine.Instructions) > 0 {
+				calls = this.Instruction(routine.Routine.Instructions[0].Address).Executed
+			}
+			if calls > 0 {
+				hit++
+			}
+			fmt.Fprintf(buffered, "FNDA:%d,%s\n", calls, routine.Name)
+		}
+		fmt.Fprintf(buffered, "FNF:%d\nFNH:%d\n", len(f.functions), hit)
+
+		covered := 0
+		for i, b := range f.branches {
+			for direction, count := range []uint64{b.taken, b.notTaken} {
+				taken := "-"
+				if b.executed {
+					taken = fmt.Sprint(count)
+				}
+				if count > 0 {
+					covered++
+				}
+				fmt.Fprintf(buffered, "BRDA:%d,%d,%d,%s\n", b.line, i, direction, taken)
+			}
+		}
+		fmt.Fprintf(buffered, "BRF:%d\nBRH:%d\n", 2*len(f.branches), covered)
+
+		lines := make([]int, 0, len(f.lines))
+		for line := range f.lines {
+			lines = append(lines, line)
+		}
+		sort.Ints(lines)
+		hit = 0
+		for _, line := range lines {
+			if f.lines[line] > 0 {
+				hit++
+			}
+			fmt.Fprintf(buffered, "DA:%d,%d\n", line, f.lines[line])
+		}
+		fmt.Fprintf(buffered, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hit)
+	}
+	return buffered.Flush()
+}
@@ -0,0 +1,116 @@
+package zmachine
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Returns tracingStory with a routine at 0x620 which is never called, and
+// coverage of a run of it.
+func coveredStory(t *testing.T) ([]byte, *Coverage) {
+	story := tracingStory()
+	story[0x620], story[0x621] = 0x00, 0xB0 // No locals; rtrue
+	coverage := NewCoverage(story)
+	traceTestMachine(t, story, coverage)
+	return story, coverage
+}
+
+// Debugging information naming the routines of coveredStory.
+func coveredSymbols() *DebugInfo {
+	location := func(line int) SourceLocation {
+		return SourceLocation{File: "game.inf", Path: "/src/game.inf", Line: line}
+	}
+	return &DebugInfo{Routines: []*DebugRoutine{
+		{Name: "Main", Address: 0x500, End: 0x50C, Location: location(1), Lines: []DebugLine{{0x501, location(2)}, {0x507, location(3)}}},
+		{Name: "Add", Address: 0x600, End: 0x608, Location: location(10), Lines: []DebugLine{{0x603, location(11)}}},
+		{Name: "Unused", Address: 0x620, End: 0x622, Location: location(20), Lines: []DebugLine{{0x621, location(21)}}},
+	}}
+}
+
+func TestCoverageRoutines(t *testing.T) {
+	story, coverage := coveredStory(t)
+	if counts := coverage.Instruction(0x507); counts != (InstructionCoverage{1, 1, 0}) {
+		t.Errorf("je counted %+v", counts)
+	}
+
+	routines := coverage.Routines(story, coveredSymbols())
+	if len(routines) != 3 {
+		t.Fatalf("%d routines", len(routines))
+	}
+	main, add, unused := routines[0], routines[1], routines[2]
+	if main.Name != "Main" || main.Executed != 3 || main.BranchDirections != 2 || main.CoveredDirections != 1 || main.BranchPercent() != 50 {
+		t.Errorf("main routine %+v", main)
+	}
+	if !add.Called || add.InstructionPercent() != 100 || add.InstructionsExecuted != 2 {
+		t.Errorf("called routine %+v", add)
+	}
+	if unused.Called || unused.Executed != 0 || unused.InstructionPercent() != 0 {
+		t.Errorf("unused routine %+v", unused)
+	}
+
+	// Without debugging information, only the routines run or called are found.
+	if routines := coverage.Routines(story, nil); len(routines) != 2 {
+		t.Errorf("%d routines without debugging information", len(routines))
+	}
+}
+
+func TestCoverageMerge(t *testing.T) {
+	story, coverage := coveredStory(t)
+	var saved bytes.Buffer
+	if err := coverage.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := ReadCoverage(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := merged.Merge(coverage); err != nil {
+		t.Fatal(err)
+	}
+	if counts := merged.Instruction(0x507); counts != (InstructionCoverage{2, 2, 0}) {
+		t.Errorf("je counted %+v after merging", counts)
+	}
+
+	other := append([]byte(nil), story...)
+	other[0x03] = 2 // Release 2
+	if err := merged.Merge(NewCoverage(other)); err == nil {
+		t.Error("merged coverage of another release")
+	}
+	if _, err := ReadCoverage(strings.NewReader("zcov 9 1.010101.0000\n")); err == nil {
+		t.Error("read coverage of an unknown version")
+	}
+}
+
+func TestCoverageReports(t *testing.T) {
+	story, coverage := coveredStory(t)
+	symbols := coveredSymbols()
+	var out bytes.Buffer
+	if err := coverage.WriteSummary(&out, story, symbols); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Routines: 2 of 3 called") || !strings.Contains(out.String(), " 50.0%  Main") {
+		t.Errorf("summary:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := coverage.WriteAnnotated(&out, story, symbols); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "#####  0621:  rtrue") || !strings.Contains(out.String(), "; always taken") {
+		t.Errorf("annotated disassembly:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := coverage.WriteLCOV(&out, story, symbols); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"SF:/src/game.inf\n", "FN:20,Unused\n", "FNDA:0,Unused\n", "DA:11,1\n", "DA:21,0\n", "end_of_record\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("LCOV doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	if err := coverage.WriteLCOV(&out, story, nil); err == nil {
+		t.Error("wrote LCOV without debugging information")
+	}
+}
@@ -0,0 +1,459 @@
+package zmachine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Why a Debugger stopped running the machine.
+type StopReason int
+
+const (
+	DEBUG_STOP_STEP        StopReason = iota // The requested step, next or finish completed
+	DEBUG_STOP_BREAKPOINT                    // The next instruction has a breakpoint
+	DEBUG_STOP_WATCHPOINT                    // A watched value changed
+	DEBUG_STOP_INTERRUPTED                   // Interrupt was called
+	DEBUG_STOP_QUIT                          // The game quit
+	DEBUG_STOP_ERROR                         // The machine panicked
+	DEBUG_STOP_HISTORY                       // Running backwards reached the start of the recording
+)
+
+type Stop struct {
+	Reason     StopReason
+	Breakpoint *Breakpoint // For DEBUG_STOP_BREAKPOINT
+	Watchpoint *Watchpoint // For DEBUG_STOP_WATCHPOINT
+	Old, New   uint16      // The watched value before and after it changed
+	Err        error       // For DEBUG_STOP_ERROR
+}
+
+func (this Stop) String() string {
+	switch this.Reason {
+	case DEBUG_STOP_BREAKPOINT:
+		return "Breakpoint: " + this.Breakpoint.String()
+	case DEBUG_STOP_WATCHPOINT:
+		return fmt.Sprintf("Watchpoint: %s changed from %d to %d", this.Watchpoint, this.Old, this.New)
+	case DEBUG_STOP_INTERRUPTED:
+		return "Interrupted"
+	case DEBUG_STOP_QUIT:
+		return "The game has quit"
+	case DEBUG_STOP_ERROR:
+		return "Error: " + this.Err.Error()
+	case DEBUG_STOP_HISTORY:
+		return "Reached the start of the recording"
+	}
+	return "Stopped"
+}
+
+// A place to stop before executing. Routine breakpoints stop at the first
+// instruction of the routine at Routine.
+type Breakpoint struct {
+	Address int
+	Routine int // The routine address, for routine breakpoints; otherwise 0
+}
+
+func (this *Breakpoint) String() string {
+	if this.Routine != 0 {
+		return fmt.Sprintf("routine %04x", this.Routine)
+	}
+	return fmt.Sprintf("%04x", this.Address)
+}
+
+type WatchKind int
+
+const (
+	WATCH_GLOBAL    WatchKind = iota // Target is a global, from 0 to 239
+	WATCH_MEMORY                     // Target is the address of a byte
+	WATCH_ATTRIBUTE                  // Target is an object, and Attribute one of its attributes
+	WATCH_PARENT                     // Target is an object
+)
+
+// A value which stops the debugger whenever it changes.
+type Watchpoint struct {
+	Kind      WatchKind
+	Target    int
+	Attribute int
+	value     uint16
+}
+
+func (this *Watchpoint) String() string {
+	switch this.Kind {
+	case WATCH_GLOBAL:
+		return fmt.Sprintf("global %d", this.Target)
+	case WATCH_MEMORY:
+		return fmt.Sprintf("byte %04x", this.Target)
+	case WATCH_ATTRIBUTE:
+		return fmt.Sprintf("attribute %d of object %d", this.Attribute, this.Target)
+	default:
+		return fmt.Sprintf("parent of object %d", this.Target)
+	}
+}
+
+func (this *Watchpoint) read(machine *ZMachine) uint16 {
+	switch this.Kind {
+	case WATCH_GLOBAL:
+		return machine.getVariable(byte(this.Target + 0x10))
+	case WATCH_MEMORY:
+		return uint16(machine.memory[this.Target])
+	case WATCH_ATTRIBUTE:
+		if machine.getObjectAttribute(uint16(this.Target), uint16(this.Attribute)) {
+			return 1
+		}
+		return 0
+	default:
+		return machine.getObjectParent(uint16(this.Target))
+	}
+}
+
+// One routine call on the stack.
+type StackFrame struct {
+	Routine        int // The routine's address, or 0 if it isn't known (e.g. after restoring)
+	PC             int // The next instruction to execute in this frame
+	Arguments      int // The number of arguments supplied
+	ResultVariable byte
+	Locals         []uint16
+	Stack          []uint16 // The routine's evaluation stack, bottom first
+}
+
+// Runs a machine an instruction at a time, stopping at breakpoints and
+// watchpoints so its state can be inspected.
+//
+// The machine must have been loaded with LoadStory and CompleteSetup, and must
+// not also be running in Run. Input is still read from the machine's input
+// channel, so whatever drives the debugger needs to supply it while the game
+// is running. Breakpoints and watchpoints can be changed from other goroutines
+// while it runs; nothing else can.
+type Debugger struct {
+	machine     *ZMachine
+	lock        sync.Mutex // Guards breakpoints and watchpoints
+	breakpoints map[int]*Breakpoint
+	watchpoints []*Watchpoint
+	interrupted int32
+	symbols     *DebugInfo
+	recording   *recording
+}
+
+func NewDebugger(machine *ZMachine) *Debugger {
+	machine.running = true
+	return &Debugger{
+		machine:     machine,
+		breakpoints: make(map[int]*Breakpoint),
+	}
+}
+
+// Stops a running Step, Next, Finish or Continue after the current
+// instruction. Can be called from any goroutine.
+func (this *Debugger) Interrupt() {
+	atomic.StoreInt32(&this.interrupted, 1)
+}
+
+func (this *Debugger) SetBreakpoint(address int) *Breakpoint {
+	breakpoint := &Breakpoint{Address: address}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.breakpoints[address] = breakpoint
+	return breakpoint
+}
+
+// Sets a breakpoint on the first instruction of the routine at address.
+func (this *Debugger) SetRoutineBreakpoint(routine int) (*Breakpoint, error) {
+	if routine < 0 || routine >= len(this.machine.memory) || this.machine.memory[routine] > 15 {
+		return nil, fmt.Errorf("No routine at %04x", routine)
+	}
+	address := routine + 1
+	if this.machine.version < 5 {
+		address += 2 * int(this.machine.memory[routine])
+	}
+	breakpoint := &Breakpoint{Address: address, Routine: routine}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.breakpoints[address] = breakpoint
+	return breakpoint, nil
+}
+
+// Removes the breakpoint at an instruction address, or on a routine.
+func (this *Debugger) ClearBreakpoint(address int) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for at, breakpoint := range this.breakpoints {
+		if at == address || breakpoint.Routine == address {
+			delete(this.breakpoints, at)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the breakpoints, in address order.
+func (this *Debugger) Breakpoints() []*Breakpoint {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	breakpoints := make([]*Breakpoint, 0, len(this.breakpoints))
+	for _, breakpoint := range this.breakpoints {
+		breakpoints = append(breakpoints, breakpoint)
+	}
+	sort.Slice(breakpoints, func(i, j int) bool {
+		return breakpoints[i].Address < breakpoints[j].Address
+	})
+	return breakpoints
+}
+
+func (this *Debugger) Watch(kind WatchKind, target, attribute int) (*Watchpoint, error) {
+	watchpoint := &Watchpoint{Kind: kind, Target: target, Attribute: attribute}
+	switch kind {
+	case WATCH_GLOBAL:
+		if target < 0 || target > 239 {
+			return nil, fmt.Errorf("No global %d", target)
+		}
+	case WATCH_MEMORY:
+		if target < 0 || target >= len(this.machine.memory) {
+			return nil, fmt.Errorf("Address %04x is outside memory", target)
+		}
+	case WATCH_ATTRIBUTE, WATCH_PARENT:
+		if target < 1 || target > this.machine.ObjectCount() {
+			return nil, fmt.Errorf("No object %d", target)
+		}
+		if kind == WATCH_ATTRIBUTE && (attribute < 0 || attribute >= int(this.machine.attributeCount())) {
+			return nil, fmt.Errorf("No attribute %d", attribute)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown watchpoint kind %d", kind)
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	watchpoint.value = watchpoint.read(this.machine)
+	this.watchpoints = append(this.watchpoints, watchpoint)
+	return watchpoint, nil
+}
+
+func (this *Debugger) Unwatch(watchpoint *Watchpoint) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for i, w := range this.watchpoints {
+		if w == watchpoint {
+			this.watchpoints = append(this.watchpoints[:i], this.watchpoints[i+1:]...)
+			return
+		}
+	}
+}
+
+func (this *Debugger) Watchpoints() []*Watchpoint {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]*Watchpoint(nil), this.watchpoints...)
+}
+
+// Executes a single instruction, following calls into the routine called.
+func (this *Debugger) Step() Stop {
+	return this.run(func() bool { return true })
+}
+
+// Executes a single instruction, running any routine it calls to completion.
+func (this *Debugger) Next() Stop {
+	depth := this.depth()
+	return this.run(func() bool { return this.depth() <= depth })
+}
+
+// Runs until the current routine returns.
+func (this *Debugger) Finish() Stop {
+	depth := this.depth()
+	return this.run(func() bool { return this.depth() < depth })
+}
+
+// Runs until a breakpoint or watchpoint is hit, or the game quits.
+func (this *Debugger) Continue() Stop {
+	return this.run(func() bool { return false })
+}
+
+func (this *Debugger) depth() uint {
+	return this.machine.callStack.Size() / 5
+}
+
+func (this *Debugger) run(done func() bool) Stop {
+	atomic.StoreInt32(&this.interrupted, 0)
+	for {
+		if !this.machine.running {
+			return Stop{Reason: DEBUG_STOP_QUIT}
+		}
+		if err := this.cycle(); err != nil {
+			return Stop{Reason: DEBUG_STOP_ERROR, Err: err}
+		}
+		if !this.machine.running {
+			return Stop{Reason: DEBUG_STOP_QUIT}
+		}
+		if stop, ok := this.checkPoints(); ok {
+			return stop
+		}
+		if done() {
+			return Stop{Reason: DEBUG_STOP_STEP}
+		}
+		if atomic.LoadInt32(&this.interrupted) != 0 {
+			return Stop{Reason: DEBUG_STOP_INTERRUPTED}
+		}
+	}
+}
+
+// Checks whether a watchpoint or breakpoint has been hit.
+func (this *Debugger) checkPoints() (Stop, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, watchpoint := range this.watchpoints {
+		if value := watchpoint.read(this.machine); value != watchpoint.value {
+			old := watchpoint.value
+			watchpoint.value = value
+			return Stop{Reason: DEBUG_STOP_WATCHPOINT, Watchpoint: watchpoint, Old: old, New: value}, true
+		}
+	}
+	if breakpoint, ok := this.breakpoints[this.machine.pc]; ok {
+		return Stop{Reason: DEBUG_STOP_BREAKPOINT, Breakpoint: breakpoint}, true
+	}
+	return Stop{}, false
+}
+
+// Executes one instruction, turning a panic into an error. A machine which
+// has panicked is left stopped, since it may be halfway through an instruction.
+func (this *Debugger) cycle() (err error) {
+	pc := this.machine.pc
+	defer func() {
+		if r := recover(); r != nil {
+			this.machine.running = false
+			err = fmt.Errorf("%v at %s", r, this.symbols.Describe(pc))
+		}
+	}()
+	if this.recording != nil {
+		this.recording.step(this.machine)
+	} else {
+		this.machine.executeCycle()
+	}
+	return nil
+}
+
+// Sets the debugging information used to name routines and variables.
+func (this *Debugger) SetDebugInfo(symbols *DebugInfo) {
+	this.symbols = symbols
+}
+
+// Returns the debugging information, which is nil if there isn't any.
+func (this *Debugger) DebugInfo() *DebugInfo {
+	return this.symbols
+}
+
+// The address of the next instruction to execute.
+func (this *Debugger) PC() int {
+	return this.machine.pc
+}
+
+func (this *Debugger) Version() byte {
+	return this.machine.version
+}
+
+// The machine's memory. It must not be modified.
+func (this *Debugger) Memory() []byte {
+	return this.machine.memory
+}
+
+// Returns the value of global n, from 0 to 239.
+func (this *Debugger) Global(n int) uint16 {
+	return this.machine.getVariable(byte(n + 0x10))
+}
+
+// Returns the routine calls on the stack, innermost first.
+func (this *Debugger) StackFrames() []StackFrame {
+	return this.machine.stackFrames()
+}
+
+func (this *ZMachine) stackFrames() []StackFrame {
+	count := int(this.callStack.Size() / 5)
+	frames := make([]StackFrame, count+1)
+
+	// The outermost frame is the main routine, which has no call frame.
+	base := uint(0)
+	for i := 0; i <= count; i++ {
+		frame := &frames[count-i]
+		if i < len(this.routines) {
+			frame.Routine = this.routines[i]
+		}
+		end := this.stack.Size()
+		if i < count {
+			end = uint(this.callStack.Look(uint(i*5 + 4)))
+		}
+		if i > 0 {
+			// Frame i was created by call frame i-1 on callStack.
+			words := uint(i-1) * 5
+			info := this.callStack.Look(words)
+			locals := uint(info & 0x0F)
+			for mask := info >> 8; mask != 0; mask >>= 1 {
+				frame.Arguments++
+			}
+			frame.ResultVariable = byte(this.callStack.Look(words + 1))
+			for j := uint(0); j < locals && base+j < end; j++ {
+				frame.Locals = append(frame.Locals, this.stack.Look(base+j))
+			}
+			base += locals
+		}
+		for j := base; j < end; j++ {
+			frame.Stack = append(frame.Stack, this.stack.Look(j))
+		}
+		base = end
+		if i < count {
+			// Where this frame continues when the routine it called returns.
+			words := uint(i) * 5
+			frame.PC = (int(this.callStack.Look(words+2))<<16 | int(this.callStack.Look(words+3))) + 1
+		} else {
+			frame.PC = this.pc
+		}
+	}
+	return frames
+}
+
+// Describes object n: its name, attributes, relatives and properties.
+func (this *Debugger) DescribeObject(n int) (string, error) {
+	object, err := this.machine.Object(n)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{fmt.Sprintf("%d %q", n, object.Name)}
+
+	var attributes []string
+	for _, attribute := range object.Attributes {
+		if name, ok := this.symbols.attribute(attribute); ok {
+			attributes = append(attributes, fmt.Sprintf("%d (%s)", attribute, name))
+		} else {
+			attributes = append(attributes, fmt.Sprint(attribute))
+		}
+	}
+	lines = append(lines, "  Attributes: "+strings.Join(attributes, " "))
+	for _, relative := range []struct {
+		name string
+		obj  int
+	}{
+		{"Parent", object.Parent},
+		{"Sibling", object.Sibling},
+		{"Child", object.Child},
+	} {
+		lines = append(lines, fmt.Sprintf("  %s: %d %s", relative.name, relative.obj, this.objectName(relative.obj)))
+	}
+
+	lines = append(lines, "  Properties:")
+	for _, property := range object.Properties {
+		data := make([]string, len(property.Data))
+		for i, b := range property.Data {
+			data[i] = fmt.Sprintf("%02x", b)
+		}
+		if name, ok := this.symbols.property(property.Number); ok {
+			lines = append(lines, fmt.Sprintf("    %2d (%s): %s", property.Number, name, strings.Join(data, " ")))
+		} else {
+			lines = append(lines, fmt.Sprintf("    %2d: %s", property.Number, strings.Join(data, " ")))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (this *Debugger) objectName(n int) string {
+	if object, err := this.machine.Object(n); err == nil {
+		return fmt.Sprintf("%q", object.Name)
+	}
+	return ""
+}
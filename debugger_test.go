@@ -0,0 +1,137 @@
+package zmachine
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns a debugger for a story whose main routine sets the first global,
+// calls a routine at 0x600, then changes two objects.
+func testDebugger(t *testing.T) *Debugger {
+	story := testStory(3)
+	copy(story[testRoutines+1:], []byte{
+		0x0D, 0x10, 0x01, // store g0 1
+		0xE0, 0x3F, 0x03, 0x00, 0x00, // call 0x600 -> sp
+		0x0B, 0x01, 0x03, // set_attr 1 3
+		0x0E, 0x02, 0x01, // insert_obj 2 1
+		0xBA, // quit
+	})
+	copy(story[0x600:], []byte{0x00, 0xB0}) // No locals; rtrue
+	addTestObjects(story,
+		testObject{name: "box", properties: []testProperty{{7, []byte{0x12, 0x34}}}},
+		testObject{name: "key"},
+	)
+	return NewDebugger(testMachine(t, story))
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	debugger := testDebugger(t)
+	if stop := debugger.Step(); stop.Reason != DEBUG_STOP_STEP || debugger.PC() != 0x504 {
+		t.Fatalf("stepped to %04x: %s", debugger.PC(), stop)
+	}
+	// Step goes into the call, and Finish comes back out.
+	debugger.Step()
+	if frames := debugger.StackFrames(); debugger.PC() != 0x601 || len(frames) != 2 || frames[0].Routine != 0x600 || frames[1].Routine != testRoutines {
+		t.Fatalf("stepped to %04x, in %+v", debugger.PC(), frames)
+	}
+	if debugger.Finish(); debugger.PC() != 0x509 || len(debugger.StackFrames()) != 1 {
+		t.Fatalf("finished at %04x", debugger.PC())
+	}
+
+	// Next runs the whole call.
+	debugger = testDebugger(t)
+	debugger.Step()
+	if debugger.Next(); debugger.PC() != 0x509 {
+		t.Fatalf("next stopped at %04x", debugger.PC())
+	}
+	if stop := debugger.Continue(); stop.Reason != DEBUG_STOP_QUIT {
+		t.Errorf("continued to %s", stop)
+	}
+	if stop := debugger.Step(); stop.Reason != DEBUG_STOP_QUIT {
+		t.Errorf("stepped after quitting to %s", stop)
+	}
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	debugger := testDebugger(t)
+	debugger.SetBreakpoint(0x509)
+	routine, err := debugger.SetRoutineBreakpoint(0x600)
+	if err != nil || routine.Address != 0x601 {
+		t.Fatalf("routine breakpoint %v, %v", routine, err)
+	}
+	if stop := debugger.Continue(); stop.Reason != DEBUG_STOP_BREAKPOINT || stop.Breakpoint != routine {
+		t.Fatalf("stopped for %s", stop)
+	}
+	if stop := debugger.Continue(); stop.Reason != DEBUG_STOP_BREAKPOINT || debugger.PC() != 0x509 {
+		t.Fatalf("stopped at %04x for %s", debugger.PC(), stop)
+	}
+
+	if !debugger.ClearBreakpoint(0x600) || debugger.ClearBreakpoint(0x600) {
+		t.Error("cleared the routine breakpoint by its routine other than once")
+	}
+	if breakpoints := debugger.Breakpoints(); len(breakpoints) != 1 || breakpoints[0].Address != 0x509 {
+		t.Errorf("breakpoints %v", breakpoints)
+	}
+	if _, err := debugger.SetRoutineBreakpoint(0x50F); err == nil {
+		t.Error("set a breakpoint on a routine starting with a quit")
+	}
+}
+
+func TestDebuggerWatchpoints(t *testing.T) {
+	debugger := testDebugger(t)
+	global, _ := debugger.Watch(WATCH_GLOBAL, 0, 0)
+	attribute, _ := debugger.Watch(WATCH_ATTRIBUTE, 1, 3)
+	parent, _ := debugger.Watch(WATCH_PARENT, 2, 0)
+	for _, want := range []Stop{
+		{Reason: DEBUG_STOP_WATCHPOINT, Watchpoint: global, Old: 0, New: 1},
+		{Reason: DEBUG_STOP_WATCHPOINT, Watchpoint: attribute, Old: 0, New: 1},
+		{Reason: DEBUG_STOP_WATCHPOINT, Watchpoint: parent, Old: 0, New: 1},
+		{Reason: DEBUG_STOP_QUIT},
+	} {
+		if stop := debugger.Continue(); stop != want {
+			t.Errorf("stopped for %s, want %s", stop, want)
+		}
+	}
+
+	for _, watch := range []struct {
+		kind              WatchKind
+		target, attribute int
+	}{
+		{WATCH_GLOBAL, 240, 0},
+		{WATCH_MEMORY, -1, 0},
+		{WATCH_ATTRIBUTE, 1, 32},
+		{WATCH_PARENT, 0, 0},
+		{WATCH_PARENT, 3, 0}, // The story has only two objects
+		{WatchKind(9), 0, 0},
+	} {
+		if _, err := debugger.Watch(watch.kind, watch.target, watch.attribute); err == nil {
+			t.Errorf("watched %d %d of kind %d", watch.target, watch.attribute, watch.kind)
+		}
+	}
+
+	// Objects have 48 attributes from version 4.
+	debugger = NewDebugger(testMachine(t, callingStory()))
+	if _, err := debugger.Watch(WATCH_ATTRIBUTE, 2, 47); err != nil {
+		t.Error(err)
+	}
+	if _, err := debugger.Watch(WATCH_ATTRIBUTE, 2, 48); err == nil {
+		t.Error("watched attribute 48")
+	}
+}
+
+func TestDebuggerDescribeObject(t *testing.T) {
+	debugger := testDebugger(t)
+	debugger.Continue()
+	description, err := debugger.DescribeObject(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`1 "box"`, "Attributes: 3", `Child: 2 "key"`, " 7: 12 34"} {
+		if !strings.Contains(description, want) {
+			t.Errorf("description doesn't contain %q:\n%s", want, description)
+		}
+	}
+	if _, err := debugger.DescribeObject(0); err == nil {
+		t.Error("described object 0")
+	}
+}
@@ -0,0 +1,564 @@
+package zmachine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A place in the source code.
+type SourceLocation struct {
+	File   string // The file name as given to the compiler
+	Path   string // The file's full path, if known; otherwise the same as File
+	Line   int
+	Column int
+}
+
+func (this SourceLocation) String() string {
+	return fmt.Sprintf("%s:%d", filepath.Base(this.File), this.Line)
+}
+
+// A routine described by debugging information.
+type DebugRoutine struct {
+	Name     string
+	Address  int
+	End      int // The address after the routine's last byte, or 0 if unknown
+	Location SourceLocation
+	Locals   []string // The names of the locals, from L00
+	Lines    []DebugLine
+}
+
+// The address at which the code for a source line starts.
+type DebugLine struct {
+	Address  int
+	Location SourceLocation
+}
+
+// The names and source locations which Inform writes to gameinfo.dbg when run
+// with -k. Both the binary format of Inform 6.31 and earlier and the XML
+// format of 6.33 onwards can be read.
+type DebugInfo struct {
+	Routines   []*DebugRoutine // In address order
+	Globals    map[int]string  // By global number, from 0 to 239
+	Objects    map[int]string
+	Attributes map[int]string
+	Properties map[int]string
+	Actions    map[int]string
+	Arrays     map[int]string // By address
+	Header     []byte         // The first 64 bytes of the story, if recorded
+}
+
+func newDebugInfo() *DebugInfo {
+	return &DebugInfo{
+		Globals:    make(map[int]string),
+		Objects:    make(map[int]string),
+		Attributes: make(map[int]string),
+		Properties: make(map[int]string),
+		Actions:    make(map[int]string),
+		Arrays:     make(map[int]string),
+	}
+}
+
+func ReadDebugInfoFile(filename string) (*DebugInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadDebugInfo(f)
+}
+
+// Reads debugging information in either format.
+func ReadDebugInfo(r io.Reader) (*DebugInfo, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var info *DebugInfo
+	switch {
+	case len(data) >= 2 && data[0] == 0xDE && data[1] == 0xBF:
+		info, err = readBinaryDebugInfo(data)
+	case len(bytes.TrimSpace(data)) > 0 && bytes.TrimSpace(data)[0] == '<':
+		info, err = readXMLDebugInfo(data)
+	default:
+		return nil, errors.New("Not an Inform debugging information file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(info.Routines, func(i, j int) bool {
+		return info.Routines[i].Address < info.Routines[j].Address
+	})
+	for _, routine := range info.Routines {
+		sort.SliceStable(routine.Lines, func(i, j int) bool {
+			return routine.Lines[i].Address < routine.Lines[j].Address
+		})
+	}
+	return info, nil
+}
+
+// Record types in the binary format.
+const (
+	debugRecordEOF = iota
+	debugRecordFile
+	debugRecordClass
+	debugRecordObject
+	debugRecordGlobal
+	debugRecordAttribute
+	debugRecordProperty
+	debugRecordFakeAction
+	debugRecordAction
+	debugRecordHeader
+	debugRecordLineRef
+	debugRecordRoutine
+	debugRecordArray
+	debugRecordMap
+	debugRecordRoutineEnd
+)
+
+type debugReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (this *debugReader) byte() int {
+	if this.pos >= len(this.data) {
+		this.err = errors.New("Debugging information is truncated")
+		return 0
+	}
+	this.pos++
+	return int(this.data[this.pos-1])
+}
+
+func (this *debugReader) word() int {
+	return this.byte()<<8 | this.byte()
+}
+
+func (this *debugReader) address() int {
+	return this.byte()<<16 | this.byte()<<8 | this.byte()
+}
+
+func (this *debugReader) string() string {
+	end := bytes.IndexByte(this.data[this.pos:], 0)
+	if end < 0 {
+		this.err = errors.New("Debugging information is truncated")
+		this.pos = len(this.data)
+		return ""
+	}
+	s := string(this.data[this.pos : this.pos+end])
+	this.pos += end + 1
+	return s
+}
+
+// A line reference: a file number byte, a line word and a character byte.
+func (this *debugReader) line(files map[int]SourceLocation) SourceLocation {
+	location := files[this.byte()]
+	location.Line = this.word()
+	location.Column = this.byte()
+	return location
+}
+
+func readBinaryDebugInfo(data []byte) (*DebugInfo, error) {
+	info := newDebugInfo()
+	r := &debugReader{data: data, pos: 6} // Skipping the magic number and two version words
+	files := make(map[int]SourceLocation)
+	routines := make(map[int]*DebugRoutine)
+	lines := make(map[int][]DebugLine) // Offsets from the start of each routine
+	codeArea := 0
+
+	for r.err == nil {
+		record := r.byte()
+		if r.err != nil || record == debugRecordEOF {
+			break
+		}
+		switch record {
+		case debugRecordFile:
+			number := r.byte()
+			name := r.string()
+			path := r.string()
+			files[number] = SourceLocation{File: name, Path: path}
+		case debugRecordClass:
+			r.string()
+			r.line(files)
+			r.line(files)
+		case debugRecordObject:
+			number := r.word()
+			info.Objects[number] = r.string()
+			r.line(files)
+			r.line(files)
+		case debugRecordGlobal:
+			number := r.byte()
+			info.Globals[number] = r.string()
+		case debugRecordAttribute:
+			number := r.word()
+			info.Attributes[number] = r.string()
+		case debugRecordProperty:
+			number := r.word()
+			info.Properties[number] = r.string()
+		case debugRecordFakeAction, debugRecordAction:
+			number := r.word()
+			info.Actions[number] = r.string()
+		case debugRecordHeader:
+			if r.pos+64 > len(r.data) {
+				r.err = errors.New("Debugging information is truncated")
+				break
+			}
+			info.Header = r.data[r.pos : r.pos+64]
+			r.pos += 64
+		case debugRecordLineRef:
+			number := r.word()
+			count := r.word()
+			for i := 0; i < count && r.err == nil; i++ {
+				location := r.line(files)
+				lines[number] = append(lines[number], DebugLine{r.word(), location})
+			}
+		case debugRecordRoutine:
+			number := r.word()
+			routine := &DebugRoutine{Location: r.line(files)}
+			routine.Address = r.address()
+			routine.Name = r.string()
+			for local := r.string(); local != "" && r.err == nil; local = r.string() {
+				routine.Locals = append(routine.Locals, local)
+			}
+			routines[number] = routine
+		case debugRecordArray:
+			address := r.word()
+			info.Arrays[address] = r.string()
+		case debugRecordMap:
+			for name := r.string(); name != "" && r.err == nil; name = r.string() {
+				address := r.address()
+				if name == "code area" {
+					codeArea = address
+				}
+			}
+		case debugRecordRoutineEnd:
+			number := r.word()
+			r.line(files)
+			end := r.address()
+			if routine, ok := routines[number]; ok {
+				routine.End = end
+			}
+		default:
+			return nil, fmt.Errorf("Unknown debugging information record %d", record)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// Routine addresses are relative to the start of the code area, and line
+	// addresses to the start of their routine.
+	for number, routine := range routines {
+		routine.Address += codeArea
+		if routine.End != 0 {
+			routine.End += codeArea
+		}
+		for _, line := range lines[number] {
+			line.Address += routine.Address
+			routine.Lines = append(routine.Lines, line)
+		}
+		info.Routines = append(info.Routines, routine)
+	}
+	return info, nil
+}
+
+type xmlSourceLocation struct {
+	File      int `xml:"file-index"`
+	Line      int `xml:"line"`
+	Character int `xml:"character"`
+}
+
+type xmlDebugValue struct {
+	Identifier string `xml:"identifier"`
+	Value      int    `xml:"value"`
+	Address    int    `xml:"address"`
+}
+
+type xmlDebugInfo struct {
+	Prefix  string `xml:"story-file-prefix"`
+	Sources []struct {
+		Index        int    `xml:"index,attr"`
+		GivenPath    string `xml:"given-path"`
+		ResolvedPath string `xml:"resolved-path"`
+	} `xml:"source"`
+	Globals    []xmlDebugValue `xml:"global-variable"`
+	Objects    []xmlDebugValue `xml:"object"`
+	Attributes []xmlDebugValue `xml:"attribute"`
+	Properties []xmlDebugValue `xml:"property"`
+	Actions    []xmlDebugValue `xml:"action"`
+	Arrays     []xmlDebugValue `xml:"array"`
+	Routines   []struct {
+		Identifier string            `xml:"identifier"`
+		Address    int               `xml:"address"`
+		ByteCount  int               `xml:"byte-count"`
+		Location   xmlSourceLocation `xml:"source-code-location"`
+		Locals     []struct {
+			Identifier string `xml:"identifier"`
+			Index      int    `xml:"index"`
+		} `xml:"local-variable"`
+		SequencePoints []struct {
+			Address  int               `xml:"address"`
+			Location xmlSourceLocation `xml:"source-code-location"`
+		} `xml:"sequence-point"`
+	} `xml:"routine"`
+}
+
+func readXMLDebugInfo(data []byte) (*DebugInfo, error) {
+	var document xmlDebugInfo
+	if err := xml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	info := newDebugInfo()
+
+	if document.Prefix != "" {
+		prefix, err := base64.StdEncoding.DecodeString(strings.TrimSpace(document.Prefix))
+		if err == nil && len(prefix) >= 64 {
+			info.Header = prefix[:64]
+		}
+	}
+
+	files := make(map[int]SourceLocation)
+	for _, source := range document.Sources {
+		path := source.ResolvedPath
+		if path == "" {
+			path = source.GivenPath
+		}
+		files[source.Index] = SourceLocation{File: source.GivenPath, Path: path}
+	}
+	locate := func(l xmlSourceLocation) SourceLocation {
+		location := files[l.File]
+		location.Line = l.Line
+		location.Column = l.Character
+		return location
+	}
+
+	// Globals are given by address, so their numbers need the story's header.
+	if len(document.Globals) > 0 && info.Header == nil {
+		return nil, errors.New("Debugging information has globals but no story-file-prefix")
+	}
+	for _, global := range document.Globals {
+		globals := int(info.Header[0x0C])<<8 | int(info.Header[0x0D])
+		info.Globals[(global.Address-globals)/2] = global.Identifier
+	}
+	for _, object := range document.Objects {
+		info.Objects[object.Value] = object.Identifier
+	}
+	for _, attribute := range document.Attributes {
+		info.Attributes[attribute.Value] = attribute.Identifier
+	}
+	for _, property := range document.Properties {
+		info.Properties[property.Value] = property.Identifier
+	}
+	for _, action := range document.Actions {
+		info.Actions[action.Value] = action.Identifier
+	}
+	for _, array := range document.Arrays {
+		info.Arrays[array.Value] = array.Identifier
+	}
+
+	for _, r := range document.Routines {
+		routine := &DebugRoutine{
+			Name:     r.Identifier,
+			Address:  r.Address,
+			Location: locate(r.Location),
+		}
+		if r.ByteCount > 0 {
+			routine.End = r.Address + r.ByteCount
+		}
+		for _, local := range r.Locals {
+			if local.Index < 1 || local.Index > 15 {
+				continue
+			}
+			for len(routine.Locals) < local.Index {
+				routine.Locals = append(routine.Locals, "")
+			}
+			routine.Locals[local.Index-1] = local.Identifier
+		}
+		for _, point := range r.SequencePoints {
+			routine.Lines = append(routine.Lines, DebugLine{point.Address, locate(point.Location)})
+		}
+		info.Routines = append(info.Routines, routine)
+	}
+	return info, nil
+}
+
+// Reports whether the information was written for this story, by comparing
+// headers. Information without a header is assumed to match.
+func (this *DebugInfo) Matches(story []byte) bool {
+	if this.Header == nil {
+		return true
+	}
+	// The flags at 0x01, 0x10 and 0x11 are changed by interpreters.
+	for i := 0; i < 64 && i < len(story); i++ {
+		if i == 0x01 || i == 0x10 || i == 0x11 {
+			continue
+		}
+		if story[i] != this.Header[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the routine containing address, or nil.
+func (this *DebugInfo) RoutineAt(address int) *DebugRoutine {
+	if this == nil {
+		return nil
+	}
+	i := sort.Search(len(this.Routines), func(i int) bool {
+		return this.Routines[i].Address > address
+	})
+	if i == 0 {
+		return nil
+	}
+	routine := this.Routines[i-1]
+	if routine.End != 0 && address >= routine.End {
+		return nil
+	}
+	return routine
+}
+
+// Returns the routine starting at address, or nil.
+func (this *DebugInfo) routineStarting(address int) *DebugRoutine {
+	if this == nil {
+		return nil
+	}
+	if routine := this.RoutineAt(address); routine != nil && routine.Address == address {
+		return routine
+	}
+	return nil
+}
+
+// Returns the routine with the given name, or nil.
+func (this *DebugInfo) RoutineNamed(name string) *DebugRoutine {
+	if this == nil {
+		return nil
+	}
+	for _, routine := range this.Routines {
+		if routine.Name == name {
+			return routine
+		}
+	}
+	return nil
+}
+
+// Returns the source line containing the code at address.
+func (this *DebugInfo) LineAt(address int) (SourceLocation, bool) {
+	if this == nil {
+		return SourceLocation{}, false
+	}
+	routine := this.RoutineAt(address)
+	if routine == nil {
+		return SourceLocation{}, false
+	}
+	location, found := routine.Location, false
+	for _, line := range routine.Lines {
+		if line.Address > address {
+			break
+		}
+		location, found = line.Location, true
+	}
+	return location, found || address == routine.Address
+}
+
+// Returns the address of the first code for a source line, matching the file
+// by its name or path.
+func (this *DebugInfo) LineAddress(file string, line int) (int, bool) {
+	if this == nil {
+		return 0, false
+	}
+	best, found := 0, false
+	for _, routine := range this.Routines {
+		for _, l := range routine.Lines {
+			if l.Location.Line != line || (l.Location.Path != file && l.Location.File != file && filepath.Base(l.Location.File) != filepath.Base(file)) {
+				continue
+			}
+			if !found || l.Address < best {
+				best, found = l.Address, true
+			}
+		}
+	}
+	return best, found
+}
+
+// Describes an address as "RoutineName (file.inf:123)", falling back to hex.
+func (this *DebugInfo) Describe(address int) string {
+	if this == nil {
+		return fmt.Sprintf("%04x", address)
+	}
+	routine := this.RoutineAt(address)
+	if routine == nil {
+		return fmt.Sprintf("%04x", address)
+	}
+	location, _ := this.LineAt(address)
+	if location.File == "" {
+		return routine.Name
+	}
+	return fmt.Sprintf("%s (%s)", routine.Name, location)
+}
+
+func (this *DebugInfo) attribute(n int) (string, bool) {
+	if this == nil {
+		return "", false
+	}
+	name, ok := this.Attributes[n]
+	return name, ok
+}
+
+func (this *DebugInfo) property(n int) (string, bool) {
+	if this == nil {
+		return "", false
+	}
+	name, ok := this.Properties[n]
+	return name, ok
+}
+
+func (this *DebugInfo) hasAttribute(n uint16) bool {
+	_, ok := this.attribute(int(n))
+	return ok
+}
+
+func (this *DebugInfo) hasProperty(n uint16) bool {
+	_, ok := this.property(int(n))
+	return ok
+}
+
+// Returns the index of a global by name, or -1.
+func (this *DebugInfo) GlobalNamed(name string) int {
+	if this == nil {
+		return -1
+	}
+	for number, global := range this.Globals {
+		if global == name {
+			return number
+		}
+	}
+	return -1
+}
+
+// Names a variable as VariableName does, but with the names from the source
+// where there are any. Locals are named from the routine containing address.
+func (this *DebugInfo) VariableName(variable byte, address int) string {
+	if this != nil {
+		switch {
+		case variable >= 0x10:
+			if name, ok := this.Globals[int(variable)-0x10]; ok {
+				return name
+			}
+		case variable > 0:
+			if routine := this.RoutineAt(address); routine != nil && int(variable) <= len(routine.Locals) && routine.Locals[variable-1] != "" {
+				return routine.Locals[variable-1]
+			}
+		}
+	}
+	return VariableName(variable)
+}
@@ -0,0 +1,132 @@
+package zmachine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Returns binary debugging information for tracingStory, as Inform 6.31
+// would write it.
+func testBinaryDebugInfo() []byte {
+	var data bytes.Buffer
+	data.Write([]byte{0xDE, 0xBF, 0x00, 0x00, 0x06, 0x4C})
+	data.Write([]byte{debugRecordFile, 0})
+	data.WriteString("game.inf\x00/src/game.inf\x00")
+	data.Write([]byte{debugRecordGlobal, 3})
+	data.WriteString("score\x00")
+	data.Write([]byte{debugRecordAttribute, 0, 7})
+	data.WriteString("light\x00")
+	// Routine addresses are from the code area, and lines from their routine.
+	data.Write([]byte{debugRecordRoutine, 0, 0, 0, 0, 10, 1, 0, 0, 0})
+	data.WriteString("Main\x00\x00")
+	data.Write([]byte{debugRecordRoutine, 0, 1, 0, 0, 20, 1, 0, 1, 0})
+	data.WriteString("Add\x00n\x00\x00")
+	data.Write([]byte{debugRecordLineRef, 0, 1, 0, 1, 0, 0, 21, 3, 0, 3})
+	data.Write([]byte{debugRecordRoutineEnd, 0, 1, 0, 0, 22, 1, 0, 1, 8})
+	data.Write([]byte{debugRecordMap})
+	data.WriteString("code area\x00")
+	data.Write([]byte{0, 5, 0, 0})
+	data.Write([]byte{debugRecordEOF})
+	return data.Bytes()
+}
+
+// Returns the same information in the XML format of Inform 6.33.
+func testXMLDebugInfo(story []byte) string {
+	return fmt.Sprintf(`<?xml version="1.0"?>
+<inform-story-file version="1.0">
+<story-file-prefix>%s</story-file-prefix>
+<source index="0"><given-path>game.inf</given-path><resolved-path>/src/game.inf</resolved-path></source>
+<global-variable><identifier>score</identifier><address>%d</address></global-variable>
+<attribute><identifier>light</identifier><value>7</value></attribute>
+<routine>
+	<identifier>Main</identifier><address>1280</address><byte-count>12</byte-count>
+	<source-code-location><file-index>0</file-index><line>10</line><character>1</character></source-code-location>
+</routine>
+<routine>
+	<identifier>Add</identifier><address>1536</address><byte-count>8</byte-count>
+	<source-code-location><file-index>0</file-index><line>20</line><character>1</character></source-code-location>
+	<local-variable><identifier>n</identifier><index>1</index></local-variable>
+	<sequence-point><address>1539</address><source-code-location><file-index>0</file-index><line>21</line><character>3</character></source-code-location></sequence-point>
+</routine>
+</inform-story-file>`, base64.StdEncoding.EncodeToString(story[:64]), testGlobals+6)
+}
+
+func TestDebugInfo(t *testing.T) {
+	story := tracingStory()
+	binary, err := ReadDebugInfo(bytes.NewReader(testBinaryDebugInfo()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xml, err := ReadDebugInfo(strings.NewReader(testXMLDebugInfo(story)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for format, info := range map[string]*DebugInfo{"binary": binary, "XML": xml} {
+		for address, want := range map[int]string{0x603: "Add (game.inf:21)", 0x601: "Add (game.inf:20)", 0x608: "0608"} {
+			if description := info.Describe(address); description != want {
+				t.Errorf("%s: described 0x%x as %q, want %q", format, address, description, want)
+			}
+		}
+		if routine := info.RoutineNamed("Add"); routine == nil || routine.Address != 0x600 || routine.End != 0x608 {
+			t.Errorf("%s: routine %+v", format, routine)
+		}
+		if info.GlobalNamed("score") != 3 || info.VariableName(0x13, 0) != "score" || info.VariableName(1, 0x603) != "n" || info.VariableName(1, 0x501) != "L00" {
+			t.Errorf("%s: globals %v", format, info.Globals)
+		}
+		if info.Attributes[7] != "light" {
+			t.Errorf("%s: attributes %v", format, info.Attributes)
+		}
+		for _, file := range []string{"/src/game.inf", "game.inf", "elsewhere/game.inf"} {
+			if address, ok := info.LineAddress(file, 21); !ok || address != 0x603 {
+				t.Errorf("%s: line 21 of %s at 0x%x, %v", format, file, address, ok)
+			}
+		}
+		if _, ok := info.LineAddress("game.inf", 99); ok {
+			t.Errorf("%s: found line 99", format)
+		}
+
+		for address, want := range map[int]string{0x501: "call Add #05 -> sp", 0x603: "add n #01 -> sp"} {
+			instruction, _ := Decode(story, address, 3)
+			if text := instruction.Format(info); text != want {
+				t.Errorf("%s: formatted %q, want %q", format, text, want)
+			}
+		}
+	}
+
+	if !binary.Matches(story) || !xml.Matches(story) {
+		t.Error("information doesn't match its story")
+	}
+	other := append([]byte(nil), story...)
+	other[0x03] = 2
+	if xml.Matches(other) {
+		t.Error("information matches another release")
+	}
+}
+
+func TestReadDebugInfoRejectsOtherFiles(t *testing.T) {
+	for _, data := range []string{"FORM", "\xDE\xBF\x00\x00\x06\x4C\x63"} {
+		if _, err := ReadDebugInfo(strings.NewReader(data)); err == nil {
+			t.Errorf("read %q as debugging information", data)
+		}
+	}
+}
+
+func TestNilDebugInfo(t *testing.T) {
+	var symbols *DebugInfo
+	if routine := symbols.RoutineAt(0x600); routine != nil {
+		t.Errorf("routine %+v", routine)
+	}
+	if _, ok := symbols.LineAt(0x600); ok {
+		t.Error("found a line")
+	}
+	if _, ok := symbols.LineAddress("story.inf", 1); ok {
+		t.Error("found an address")
+	}
+	if description := symbols.Describe(0x600); description != "0600" {
+		t.Errorf("described as %q", description)
+	}
+}
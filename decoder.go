@@ -0,0 +1,599 @@
+package zmachine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A single decoded instruction. Operands hold the raw operand bytes: constants
+// for OPERAND_TYPE_SMALL and OPERAND_TYPE_LARGE, and variable numbers for
+// OPERAND_TYPE_VAR.
+type Instruction struct {
+	Address      int
+	Length       int
+	Opcode       byte // The opcode number within Count, e.g. 0 for call
+	Name         string
+	Form         OpcodeFormat
+	Count        OperandCount
+	OperandTypes []OperandType
+	Operands     []uint16
+
+	Stores        bool
+	StoreVariable byte
+
+	Branches     bool
+	BranchOn     bool // Branch if the condition is this
+	BranchOffset int  // 0 and 1 mean return false and true
+	BranchTarget int  // The address branched to, unless the branch returns
+
+	HasText bool
+	Text    string // The inline string of print and print_ret
+
+	operandsEnd   int // The address after the last operand
+	version       byte
+	routineOffset int // The routine offset from the header, used by versions 6 and 7
+}
+
+const (
+	opcodeStores = 1 << iota
+	opcodeBranches
+	opcodeHasText
+	opcodeReturns    // Never continues to the next instruction
+	opcodeIndirect   // The first operand names a variable
+	opcodeCalls      // The first operand is a packed routine address
+	opcodeDoubleVars // Takes up to eight operands, with two type bytes
+)
+
+type opcodeInfo struct {
+	count      OperandCount
+	opcode     byte
+	name       string
+	minVersion byte
+	maxVersion byte
+	flags      int
+}
+
+var opcodeTable = []opcodeInfo{
+	{OPERAND_COUNT_0OP, 0, "rtrue", 1, 8, opcodeReturns},
+	{OPERAND_COUNT_0OP, 1, "rfalse", 1, 8, opcodeReturns},
+	{OPERAND_COUNT_0OP, 2, "print", 1, 8, opcodeHasText},
+	{OPERAND_COUNT_0OP, 3, "print_ret", 1, 8, opcodeHasText | opcodeReturns},
+	{OPERAND_COUNT_0OP, 4, "nop", 1, 8, 0},
+	{OPERAND_COUNT_0OP, 5, "save", 1, 3, opcodeBranches},
+	{OPERAND_COUNT_0OP, 5, "save", 4, 4, opcodeStores},
+	{OPERAND_COUNT_0OP, 6, "restore", 1, 3, opcodeBranches},
+	{OPERAND_COUNT_0OP, 6, "restore", 4, 4, opcodeStores},
+	{OPERAND_COUNT_0OP, 7, "restart", 1, 8, opcodeReturns},
+	{OPERAND_COUNT_0OP, 8, "ret_popped", 1, 8, opcodeReturns},
+	{OPERAND_COUNT_0OP, 9, "pop", 1, 4, 0},
+	{OPERAND_COUNT_0OP, 9, "catch", 5, 8, opcodeStores},
+	{OPERAND_COUNT_0OP, 10, "quit", 1, 8, opcodeReturns},
+	{OPERAND_COUNT_0OP, 11, "new_line", 1, 8, 0},
+	{OPERAND_COUNT_0OP, 12, "show_status", 3, 3, 0},
+	{OPERAND_COUNT_0OP, 13, "verify", 3, 8, opcodeBranches},
+	{OPERAND_COUNT_0OP, 15, "piracy", 5, 8, opcodeBranches},
+
+	{OPERAND_COUNT_1OP, 0, "jz", 1, 8, opcodeBranches},
+	{OPERAND_COUNT_1OP, 1, "get_sibling", 1, 8, opcodeStores | opcodeBranches},
+	{OPERAND_COUNT_1OP, 2, "get_child", 1, 8, opcodeStores | opcodeBranches},
+	{OPERAND_COUNT_1OP, 3, "get_parent", 1, 8, opcodeStores},
+	{OPERAND_COUNT_1OP, 4, "get_prop_len", 1, 8, opcodeStores},
+	{OPERAND_COUNT_1OP, 5, "inc", 1, 8, opcodeIndirect},
+	{OPERAND_COUNT_1OP, 6, "dec", 1, 8, opcodeIndirect},
+	{OPERAND_COUNT_1OP, 7, "print_addr", 1, 8, 0},
+	{OPERAND_COUNT_1OP, 8, "call_1s", 4, 8, opcodeStores | opcodeCalls},
+	{OPERAND_COUNT_1OP, 9, "remove_obj", 1, 8, 0},
+	{OPERAND_COUNT_1OP, 10, "print_obj", 1, 8, 0},
+	{OPERAND_COUNT_1OP, 11, "ret", 1, 8, opcodeReturns},
+	{OPERAND_COUNT_1OP, 12, "jump", 1, 8, opcodeReturns},
+	{OPERAND_COUNT_1OP, 13, "print_paddr", 1, 8, 0},
+	{OPERAND_COUNT_1OP, 14, "load", 1, 8, opcodeStores | opcodeIndirect},
+	{OPERAND_COUNT_1OP, 15, "not", 1, 4, opcodeStores},
+	{OPERAND_COUNT_1OP, 15, "call_1n", 5, 8, opcodeCalls},
+
+	{OPERAND_COUNT_2OP, 1, "je", 1, 8, opcodeBranches},
+	{OPERAND_COUNT_2OP, 2, "jl", 1, 8, opcodeBranches},
+	{OPERAND_COUNT_2OP, 3, "jg", 1, 8, opcodeBranches},
+	{OPERAND_COUNT_2OP, 4, "dec_chk", 1, 8, opcodeBranches | opcodeIndirect},
+	{OPERAND_COUNT_2OP, 5, "inc_chk", 1, 8, opcodeBranches | opcodeIndirect},
+	{OPERAND_COUNT_2OP, 6, "jin", 1, 8, opcodeBranches},
+	{OPERAND_COUNT_2OP, 7, "test", 1, 8, opcodeBranches},
+	{OPERAND_COUNT_2OP, 8, "or", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 9, "and", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 10, "test_attr", 1, 8, opcodeBranches},
+	{OPERAND_COUNT_2OP, 11, "set_attr", 1, 8, 0},
+	{OPERAND_COUNT_2OP, 12, "clear_attr", 1, 8, 0},
+	{OPERAND_COUNT_2OP, 13, "store", 1, 8, opcodeIndirect},
+	{OPERAND_COUNT_2OP, 14, "insert_obj", 1, 8, 0},
+	{OPERAND_COUNT_2OP, 15, "loadw", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 16, "loadb", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 17, "get_prop", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 18, "get_prop_addr", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 19, "get_next_prop", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 20, "add", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 21, "sub", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 22, "mul", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 23, "div", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 24, "mod", 1, 8, opcodeStores},
+	{OPERAND_COUNT_2OP, 25, "call_2s", 4, 8, opcodeStores | opcodeCalls},
+	{OPERAND_COUNT_2OP, 26, "call_2n", 5, 8, opcodeCalls},
+	{OPERAND_COUNT_2OP, 27, "set_colour", 5, 8, 0},
+	{OPERAND_COUNT_2OP, 28, "throw", 5, 8, opcodeReturns},
+
+	{OPERAND_COUNT_VAR, 0, "call", 1, 3, opcodeStores | opcodeCalls},
+	{OPERAND_COUNT_VAR, 0, "call_vs", 4, 8, opcodeStores | opcodeCalls},
+	{OPERAND_COUNT_VAR, 1, "storew", 1, 8, 0},
+	{OPERAND_COUNT_VAR, 2, "storeb", 1, 8, 0},
+	{OPERAND_COUNT_VAR, 3, "put_prop", 1, 8, 0},
+	{OPERAND_COUNT_VAR, 4, "sread", 1, 4, 0},
+	{OPERAND_COUNT_VAR, 4, "aread", 5, 8, opcodeStores},
+	{OPERAND_COUNT_VAR, 5, "print_char", 1, 8, 0},
+	{OPERAND_COUNT_VAR, 6, "print_num", 1, 8, 0},
+	{OPERAND_COUNT_VAR, 7, "random", 1, 8, opcodeStores},
+	{OPERAND_COUNT_VAR, 8, "push", 1, 8, 0},
+	{OPERAND_COUNT_VAR, 9, "pull", 1, 5, opcodeIndirect},
+	{OPERAND_COUNT_VAR, 9, "pull", 6, 6, opcodeStores},
+	{OPERAND_COUNT_VAR, 9, "pull", 7, 8, opcodeIndirect},
+	{OPERAND_COUNT_VAR, 10, "split_window", 3, 8, 0},
+	{OPERAND_COUNT_VAR, 11, "set_window", 3, 8, 0},
+	{OPERAND_COUNT_VAR, 12, "call_vs2", 4, 8, opcodeStores | opcodeCalls | opcodeDoubleVars},
+	{OPERAND_COUNT_VAR, 13, "erase_window", 4, 8, 0},
+	{OPERAND_COUNT_VAR, 14, "erase_line", 4, 8, 0},
+	{OPERAND_COUNT_VAR, 15, "set_cursor", 4, 8, 0},
+	{OPERAND_COUNT_VAR, 16, "get_cursor", 4, 8, 0},
+	{OPERAND_COUNT_VAR, 17, "set_text_style", 4, 8, 0},
+	{OPERAND_COUNT_VAR, 18, "buffer_mode", 4, 8, 0},
+	{OPERAND_COUNT_VAR, 19, "output_stream", 3, 8, 0},
+	{OPERAND_COUNT_VAR, 20, "input_stream", 3, 8, 0},
+	{OPERAND_COUNT_VAR, 21, "sound_effect", 3, 8, 0},
+	{OPERAND_COUNT_VAR, 22, "read_char", 4, 8, opcodeStores},
+	{OPERAND_COUNT_VAR, 23, "scan_table", 4, 8, opcodeStores | opcodeBranches},
+	{OPERAND_COUNT_VAR, 24, "not", 5, 8, opcodeStores},
+	{OPERAND_COUNT_VAR, 25, "call_vn", 5, 8, opcodeCalls},
+	{OPERAND_COUNT_VAR, 26, "call_vn2", 5, 8, opcodeCalls | opcodeDoubleVars},
+	{OPERAND_COUNT_VAR, 27, "tokenise", 5, 8, 0},
+	{OPERAND_COUNT_VAR, 28, "encode_text", 5, 8, 0},
+	{OPERAND_COUNT_VAR, 29, "copy_table", 5, 8, 0},
+	{OPERAND_COUNT_VAR, 30, "print_table", 5, 8, 0},
+	{OPERAND_COUNT_VAR, 31, "check_arg_count", 5, 8, opcodeBranches},
+
+	{OPERAND_COUNT_EXT, 0, "save", 5, 8, opcodeStores},
+	{OPERAND_COUNT_EXT, 1, "restore", 5, 8, opcodeStores},
+	{OPERAND_COUNT_EXT, 2, "log_shift", 5, 8, opcodeStores},
+	{OPERAND_COUNT_EXT, 3, "art_shift", 5, 8, opcodeStores},
+	{OPERAND_COUNT_EXT, 4, "set_font", 5, 8, opcodeStores},
+	{OPERAND_COUNT_EXT, 5, "draw_picture", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 6, "picture_data", 6, 6, opcodeBranches},
+	{OPERAND_COUNT_EXT, 7, "erase_picture", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 8, "set_margins", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 9, "save_undo", 5, 8, opcodeStores},
+	{OPERAND_COUNT_EXT, 10, "restore_undo", 5, 8, opcodeStores},
+	{OPERAND_COUNT_EXT, 11, "print_unicode", 5, 8, 0},
+	{OPERAND_COUNT_EXT, 12, "check_unicode", 5, 8, opcodeStores},
+	{OPERAND_COUNT_EXT, 13, "set_true_colour", 5, 8, 0},
+	{OPERAND_COUNT_EXT, 16, "move_window", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 17, "window_size", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 18, "window_style", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 19, "get_wind_prop", 6, 6, opcodeStores},
+	{OPERAND_COUNT_EXT, 20, "scroll_window", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 21, "pop_stack", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 22, "read_mouse", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 23, "mouse_window", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 24, "push_stack", 6, 6, opcodeBranches},
+	{OPERAND_COUNT_EXT, 25, "put_wind_prop", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 26, "print_form", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 27, "make_menu", 6, 6, opcodeBranches},
+	{OPERAND_COUNT_EXT, 28, "picture_table", 6, 6, 0},
+	{OPERAND_COUNT_EXT, 29, "buffer_screen", 6, 6, opcodeStores},
+}
+
+// Indexed by operand count and opcode, then searched for the right version.
+var opcodeLookup [5][256][]*opcodeInfo
+
+func init() {
+	for i := range opcodeTable {
+		info := &opcodeTable[i]
+		opcodeLookup[info.count][info.opcode] = append(opcodeLookup[info.count][info.opcode], info)
+	}
+}
+
+func findOpcode(count OperandCount, opcode byte, version byte) *opcodeInfo {
+	for _, info := range opcodeLookup[count][opcode] {
+		if version >= info.minVersion && version <= info.maxVersion {
+			return info
+		}
+	}
+	return nil
+}
+
+// Decodes the instruction at addr in a story's memory.
+func Decode(memory []byte, addr int, version byte) (Instruction, error) {
+	return decode(memory, addr, version, true)
+}
+
+// Decodes an instruction, leaving out its inline text unless withText is set.
+// The interpreter doesn't need the text decoding twice.
+func decode(memory []byte, addr int, version byte, withText bool) (Instruction, error) {
+	instruction := Instruction{Address: addr, version: version}
+	overrun := errors.New(fmt.Sprintf("Instruction at 0x%x runs past the end of memory", addr))
+	if addr < 0 || addr >= len(memory) {
+		return instruction, overrun
+	}
+	if version == 6 || version == 7 {
+		instruction.routineOffset = 8 * (int(memory[0x28])<<8 | int(memory[0x29]))
+	}
+
+	pc := addr
+	opcode := memory[pc]
+	pc++
+	typeBytes := 0
+	switch {
+	case opcode == 0xBE && version >= 5:
+		instruction.Form = OPCODE_FORMAT_EXTENDED
+		instruction.Count = OPERAND_COUNT_EXT
+		if pc >= len(memory) {
+			return instruction, overrun
+		}
+		opcode = memory[pc]
+		pc++
+		typeBytes = 1
+	case opcode&0xC0 == 0xC0:
+		instruction.Form = OPCODE_FORMAT_VARIABLE
+		if opcode&0x20 == 0 {
+			instruction.Count = OPERAND_COUNT_2OP
+		} else {
+			instruction.Count = OPERAND_COUNT_VAR
+		}
+		opcode &= 0x1F
+		typeBytes = 1
+	case opcode&0x80 == 0x80:
+		instruction.Form = OPCODE_FORMAT_SHORT
+		if opcode&0x30 == 0x30 {
+			instruction.Count = OPERAND_COUNT_0OP
+		} else {
+			instruction.Count = OPERAND_COUNT_1OP
+			instruction.OperandTypes = []OperandType{OperandType((opcode >> 4) & 0x03)}
+		}
+		opcode &= 0x0F
+	default:
+		instruction.Form = OPCODE_FORMAT_LONG
+		instruction.Count = OPERAND_COUNT_2OP
+		instruction.OperandTypes = []OperandType{OPERAND_TYPE_SMALL, OPERAND_TYPE_SMALL}
+		if opcode&0x40 == 0x40 {
+			instruction.OperandTypes[0] = OPERAND_TYPE_VAR
+		}
+		if opcode&0x20 == 0x20 {
+			instruction.OperandTypes[1] = OPERAND_TYPE_VAR
+		}
+		opcode &= 0x1F
+	}
+	instruction.Opcode = opcode
+
+	info := findOpcode(instruction.Count, opcode, version)
+	if info == nil {
+		return instruction, errors.New(fmt.Sprintf("Illegal opcode %s:%d at 0x%x", instruction.Count, opcode, addr))
+	}
+	instruction.Name = info.name
+
+	if typeBytes > 0 {
+		if info.flags&opcodeDoubleVars != 0 {
+			typeBytes = 2
+		}
+		if pc+typeBytes > len(memory) {
+			return instruction, overrun
+		}
+		instruction.OperandTypes = make([]OperandType, 0, 4*typeBytes)
+	types:
+		for _, bits := range memory[pc : pc+typeBytes] {
+			for i := uint(0); i < 4; i++ {
+				now := OperandType((bits >> ((3 - i) * 2)) & 0x03)
+				if now == OPERAND_TYPE_OMITTED {
+					break types
+				}
+				instruction.OperandTypes = append(instruction.OperandTypes, now)
+			}
+		}
+		pc += typeBytes
+	}
+
+	instruction.Operands = make([]uint16, len(instruction.OperandTypes))
+	for i, t := range instruction.OperandTypes {
+		if t == OPERAND_TYPE_LARGE {
+			if pc+2 > len(memory) {
+				return instruction, overrun
+			}
+			instruction.Operands[i] = uint16(memory[pc])<<8 | uint16(memory[pc+1])
+			pc += 2
+		} else {
+			if pc >= len(memory) {
+				return instruction, overrun
+			}
+			instruction.Operands[i] = uint16(memory[pc])
+			pc++
+		}
+	}
+	instruction.operandsEnd = pc
+
+	if info.flags&opcodeStores != 0 {
+		if pc >= len(memory) {
+			return instruction, overrun
+		}
+		instruction.Stores = true
+		instruction.StoreVariable = memory[pc]
+		pc++
+	}
+
+	if info.flags&opcodeBranches != 0 {
+		if pc >= len(memory) {
+			return instruction, overrun
+		}
+		branch := memory[pc]
+		pc++
+		instruction.Branches = true
+		instruction.BranchOn = branch&0x80 == 0x80
+		offset := int(branch & 0x3F)
+		// If the second bit is clear, the offset is a signed 14-bit number.
+		if branch&0x40 == 0 {
+			if pc >= len(memory) {
+				return instruction, overrun
+			}
+			offset = offset<<8 | int(memory[pc])
+			pc++
+			if offset&(1<<13) != 0 {
+				offset -= 1 << 14
+			}
+		}
+		instruction.BranchOffset = offset
+		if offset != 0 && offset != 1 {
+			instruction.BranchTarget = pc + offset - 2
+		}
+	}
+
+	if info.flags&opcodeHasText != 0 {
+		instruction.HasText = true
+		// The string ends with the first word with its top bit set.
+		for {
+			if pc+2 > len(memory) {
+				return instruction, overrun
+			}
+			pc += 2
+			if memory[pc-2]&0x80 != 0 {
+				break
+			}
+		}
+		if withText {
+			text, err := decodeText(memory, instruction.operandsEnd, version)
+			if err != nil {
+				return instruction, err
+			}
+			instruction.Text = text
+		}
+	}
+
+	instruction.Length = pc - addr
+	return instruction, nil
+}
+
+// Decodes the string at addr without a running machine. Abbreviations in
+// nonsense strings can point anywhere, so failures become errors.
+func decodeText(memory []byte, addr int, version byte) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("Bad string at 0x%x: %v", addr, r))
+		}
+	}()
+	machine := textMachine(memory, version)
+	zchars := machine.zString(addr, false)
+	zscii := zchars.ZSCIIString()
+	return zscii.String(), nil
+}
+
+// Returns a machine which isn't running, able only to read and write the
+// story's text.
+func textMachine(memory []byte, version byte) *ZMachine {
+	machine := &ZMachine{memory: memory, version: version}
+	machine.abbreviationStart = machine.number(0x18)
+	machine.unicode = machine.readUnicodeTable()
+	alphabets := storyAlphabets(memory)
+	machine.alphabets = &alphabets
+	return machine
+}
+
+// Reports whether execution never continues to the next instruction.
+func (this Instruction) Returns() bool {
+	info := findOpcode(this.Count, this.Opcode, this.version)
+	return info != nil && info.flags&opcodeReturns != 0
+}
+
+// Returns the address of the routine called, if this is a call to a constant
+// address.
+func (this Instruction) CallTarget() (int, bool) {
+	info := findOpcode(this.Count, this.Opcode, this.version)
+	if info == nil || info.flags&opcodeCalls == 0 || len(this.Operands) == 0 || this.OperandTypes[0] == OPERAND_TYPE_VAR {
+		return 0, false
+	}
+	return unpackRoutineAddress(this.Operands[0], this.version, this.routineOffset), true
+}
+
+// Returns the destination of a jump to a constant offset.
+func (this Instruction) JumpTarget() (int, bool) {
+	if this.Count != OPERAND_COUNT_1OP || this.Opcode != 12 || this.OperandTypes[0] == OPERAND_TYPE_VAR {
+		return 0, false
+	}
+	return this.Address + this.Length + int(int16(this.Operands[0])) - 2, true
+}
+
+// The routine holding the first instruction executed. Before version 6 the
+// initial PC points just past the header of a routine with no locals.
+func EntryRoutine(memory []byte) int {
+	pc := int(memory[0x06])<<8 | int(memory[0x07])
+	switch memory[0] {
+	case 6, 7:
+		return 4*pc + 8*(int(memory[0x28])<<8|int(memory[0x29]))
+	default:
+		return pc - 1
+	}
+}
+
+// Formats the instruction in the style of an assembler listing, e.g.
+// "call 4b42 L00 #05 -> sp" or "jz G12 ?~4e50".
+func (this Instruction) String() string {
+	return this.Format(nil)
+}
+
+// Formats the instruction like String, but using the names of variables,
+// routines, attributes and properties from symbols, which may be nil.
+func (this Instruction) Format(symbols *DebugInfo) string {
+	parts := []string{this.Name}
+	info := findOpcode(this.Count, this.Opcode, this.version)
+	variable := func(v uint16) string {
+		return symbols.VariableName(byte(v), this.Address)
+	}
+	for i, t := range this.OperandTypes {
+		value := this.Operands[i]
+		switch {
+		case t == OPERAND_TYPE_VAR && i == 0 && info != nil && info.flags&opcodeIndirect != 0:
+			parts = append(parts, "["+variable(value)+"]")
+		case t == OPERAND_TYPE_VAR:
+			parts = append(parts, variable(value))
+		case i == 0 && info != nil && info.flags&opcodeIndirect != 0:
+			parts = append(parts, variable(value))
+		case i == 0 && info != nil && info.flags&opcodeCalls != 0:
+			target, _ := this.CallTarget()
+			if routine := symbols.routineStarting(target); routine != nil {
+				parts = append(parts, routine.Name)
+			} else {
+				parts = append(parts, fmt.Sprintf("%04x", target))
+			}
+		case i == 1 && this.namesAttribute() && symbols.hasAttribute(value):
+			name, _ := symbols.attribute(int(value))
+			parts = append(parts, name)
+		case i == 1 && this.namesProperty() && symbols.hasProperty(value):
+			name, _ := symbols.property(int(value))
+			parts = append(parts, name)
+		case i == 0 && this.Count == OPERAND_COUNT_1OP && this.Opcode == 12:
+			target, _ := this.JumpTarget()
+			parts = append(parts, fmt.Sprintf("%04x", target))
+		case t == OPERAND_TYPE_LARGE:
+			parts = append(parts, fmt.Sprintf("#%04x", value))
+		default:
+			parts = append(parts, fmt.Sprintf("#%02x", value))
+		}
+	}
+	if this.HasText {
+		parts = append(parts, fmt.Sprintf("%q", this.Text))
+	}
+	if this.Stores {
+		parts = append(parts, "-> "+variable(uint16(this.StoreVariable)))
+	}
+	if this.Branches {
+		branch := "?"
+		if !this.BranchOn {
+			branch += "~"
+		}
+		switch this.BranchOffset {
+		case 0:
+			branch += "rfalse"
+		case 1:
+			branch += "rtrue"
+		default:
+			branch += fmt.Sprintf("%04x", this.BranchTarget)
+		}
+		parts = append(parts, branch)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Reports whether the second operand is an attribute number, for test_attr,
+// set_attr and clear_attr.
+func (this Instruction) namesAttribute() bool {
+	return this.Count == OPERAND_COUNT_2OP && this.Opcode >= 10 && this.Opcode <= 12
+}
+
+// Reports whether the second operand is a property number, for put_prop,
+// get_prop, get_prop_addr and get_next_prop.
+func (this Instruction) namesProperty() bool {
+	return (this.Count == OPERAND_COUNT_2OP && this.Opcode >= 17 && this.Opcode <= 19) ||
+		(this.Count == OPERAND_COUNT_VAR && this.Opcode == 3)
+}
+
+// Names a variable as assemblers do: sp for the stack, L00-L0e for locals and
+// G00-Gef for globals.
+func VariableName(variable byte) string {
+	switch {
+	case variable == 0:
+		return "sp"
+	case variable < 0x10:
+		return fmt.Sprintf("L%02x", variable-1)
+	default:
+		return fmt.Sprintf("G%02x", variable-0x10)
+	}
+}
+
+func (this OperandCount) String() string {
+	switch this {
+	case OPERAND_COUNT_0OP:
+		return "0OP"
+	case OPERAND_COUNT_1OP:
+		return "1OP"
+	case OPERAND_COUNT_2OP:
+		return "2OP"
+	case OPERAND_COUNT_VAR:
+		return "VAR"
+	default:
+		return "EXT"
+	}
+}
+
+// A routine's header and code.
+type Routine struct {
+	Address      int
+	Locals       []uint16 // Initial values, which are always zero from version 5
+	Instructions []Instruction
+	End          int // The address after the last instruction
+}
+
+// Disassembles the routine starting at addr. As in txd, the routine is taken to
+// end at the first instruction which doesn't continue to the next one, unless a
+// branch or jump seen so far goes beyond it.
+func DisassembleRoutine(memory []byte, addr int, version byte) (Routine, error) {
+	routine := Routine{Address: addr}
+	if addr <= 0 || addr >= len(memory) || memory[addr] > 15 {
+		return routine, errors.New(fmt.Sprintf("No routine at 0x%x", addr))
+	}
+
+	pc := addr + 1
+	routine.Locals = make([]uint16, memory[addr])
+	if version < 5 {
+		if pc+2*len(routine.Locals) > len(memory) {
+			return routine, errors.New(fmt.Sprintf("Routine at 0x%x runs past the end of memory", addr))
+		}
+		for i := range routine.Locals {
+			routine.Locals[i] = uint16(memory[pc])<<8 | uint16(memory[pc+1])
+			pc += 2
+		}
+	}
+
+	furthest := pc
+	for {
+		instruction, err := Decode(memory, pc, version)
+		if err != nil {
+			return routine, err
+		}
+		routine.Instructions = append(routine.Instructions, instruction)
+		pc += instruction.Length
+
+		if instruction.Branches && instruction.BranchTarget > furthest {
+			furthest = instruction.BranchTarget
+		}
+		if target, ok := instruction.JumpTarget(); ok && target > furthest {
+			furthest = target
+		}
+		if instruction.Returns() && pc > furthest {
+			break
+		}
+	}
+	routine.End = pc
+	return routine, nil
+}
@@ -0,0 +1,105 @@
+package zmachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		version byte
+		code    []byte
+		want    string
+	}{
+		{3, []byte{0x14, 0x05, 0x03, 0x10}, "add #05 #03 -> G00"},
+		{3, []byte{0x74, 0x01, 0x00, 0x00}, "add L00 sp -> sp"},
+		{3, []byte{0xA0, 0x01, 0xC5}, "jz L00 ?0606"},
+		{3, []byte{0xA0, 0x01, 0x40}, "jz L00 ?~rfalse"},
+		{3, []byte{0x8C, 0xFF, 0xFF}, "jump 0600"},
+		{3, []byte{0xE0, 0x3F, 0x01, 0x80, 0x00}, "call 0300 -> sp"},
+		{3, []byte{0xB2, 0xB5, 0xC5}, `print "hi"`},
+		{5, []byte{0xE0, 0x3F, 0x01, 0x80, 0x00}, "call_vs 0600 -> sp"},
+		{5, []byte{0xBE, 0x02, 0x5F, 0x01, 0x02, 0x00}, "log_shift #01 #02 -> sp"},
+		{5, []byte{0xEC, 0x15, 0xFF, 0x01, 0x80, 0x01, 0x02, 0x03, 0x00}, "call_vs2 0600 #01 #02 #03 -> sp"},
+	}
+	for _, test := range tests {
+		story := testStory(test.version)
+		copy(story[0x600:], test.code)
+		instruction, err := Decode(story, 0x600, test.version)
+		if err != nil {
+			t.Errorf("%x: %s", test.code, err)
+			continue
+		}
+		if instruction.String() != test.want || instruction.Length != len(test.code) {
+			t.Errorf("%x decoded to %q of %d bytes, want %q", test.code, instruction.String(), instruction.Length, test.want)
+		}
+	}
+}
+
+func TestDecodeFields(t *testing.T) {
+	story := testStory(5)
+	copy(story[0x600:], []byte{0xEC, 0x15, 0xFF, 0x01, 0x80, 0x01, 0x02, 0x03, 0x10})
+	instruction, err := Decode(story, 0x600, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []OperandType{OPERAND_TYPE_LARGE, OPERAND_TYPE_SMALL, OPERAND_TYPE_SMALL, OPERAND_TYPE_SMALL}
+	if instruction.Form != OPCODE_FORMAT_VARIABLE || instruction.Count != OPERAND_COUNT_VAR || instruction.Opcode != 12 {
+		t.Errorf("form %v, count %v, opcode %d", instruction.Form, instruction.Count, instruction.Opcode)
+	}
+	if !reflect.DeepEqual(instruction.OperandTypes, types) || !reflect.DeepEqual(instruction.Operands, []uint16{0x180, 1, 2, 3}) {
+		t.Errorf("operands %v %v", instruction.OperandTypes, instruction.Operands)
+	}
+	if !instruction.Stores || instruction.StoreVariable != 0x10 || instruction.Branches {
+		t.Errorf("stores %v in %d, branches %v", instruction.Stores, instruction.StoreVariable, instruction.Branches)
+	}
+	if target, ok := instruction.CallTarget(); !ok || target != 0x600 {
+		t.Errorf("calls 0x%x", target)
+	}
+
+	// A long branch backwards.
+	copy(story[0x600:], []byte{0xA0, 0x01, 0xBF, 0xFE})
+	instruction, _ = Decode(story, 0x600, 5)
+	if !instruction.Branches || !instruction.BranchOn || instruction.BranchOffset != -2 || instruction.BranchTarget != 0x600 {
+		t.Errorf("branch on %v, offset %d to 0x%x", instruction.BranchOn, instruction.BranchOffset, instruction.BranchTarget)
+	}
+}
+
+func TestDecodeOverrun(t *testing.T) {
+	story := testStory(3)
+	story[len(story)-1] = 0xE0 // call, with no operand types
+	if _, err := Decode(story, len(story)-1, 3); err == nil {
+		t.Error("decoded an instruction past the end of memory")
+	}
+}
+
+func TestDisassembleRoutine(t *testing.T) {
+	story := testStory(3)
+	copy(story[0x600:], []byte{
+		0x01, 0x00, 0x07, // One local, 7
+		0xA0, 0x01, 0xC3, // jz L00 ?0607
+		0xB0,       // rtrue
+		0x9B, 0x05, // ret #05
+		0xB0, // Not part of the routine
+	})
+	routine, err := DisassembleRoutine(story, 0x600, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rtrue doesn't end the routine, as the branch goes past it.
+	if !reflect.DeepEqual(routine.Locals, []uint16{7}) || len(routine.Instructions) != 3 || routine.End != 0x609 {
+		t.Errorf("locals %v, %d instructions, ends at 0x%x", routine.Locals, len(routine.Instructions), routine.End)
+	}
+	story[0x700] = 16
+	if _, err := DisassembleRoutine(story, 0x700, 3); err == nil {
+		t.Error("disassembled a routine with 16 locals")
+	}
+}
+
+func TestVariableName(t *testing.T) {
+	for variable, want := range map[byte]string{0: "sp", 1: "L00", 0x0F: "L0e", 0x10: "G00", 0xFF: "Gef"} {
+		if name := VariableName(variable); name != want {
+			t.Errorf("variable %d is %q, want %q", variable, name, want)
+		}
+	}
+}
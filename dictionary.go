@@ -1,42 +1,46 @@
 package zmachine
 
-import "bytes"
-
-func (this *ZMachine) locateStringInDictionary(bytes []byte) int {
-	index := this.dictionaryLength / 2
-	lowerBound := uint16(0)
-	upperBound := this.dictionaryLength
-	k := uint16(this.dictionaryEntryLength)
-	start := this.dictionaryStart + uint16(this.memory[this.dictionaryStart]) + 4
-	for {
-		direction := 0
-		for j := uint16(0); j < 4; j++ {
-			chr := this.memory[start+index*k+j]
-			if chr > bytes[j] {
-				direction = -1
-				break
-			} else if chr < bytes[j] {
-				direction = 1
-				break
-			}
-		}
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
 
-		switch {
-		case direction == 0:
-			return int(start + index*k)
-		case upperBound == lowerBound || index == lowerBound || index == upperBound:
-			return 0
-		case direction < 0:
-			upperBound = index
-		case direction > 0:
-			lowerBound = index
+// Returns the address of the entry for the encoded word key in the dictionary
+// at address, or 0 if there is none. A negative number of entries marks an
+// unsorted dictionary, which has to be searched in full.
+func (this *ZMachine) lookupWord(dictionary int, key []byte) int {
+	separators := int(this.memory[dictionary])
+	length := int(this.memory[dictionary+1+separators])
+	count := int(int16(this.number(dictionary + 2 + separators)))
+	start := dictionary + 4 + separators
+	compare := func(i int) int {
+		entry := start + i*length
+		return bytes.Compare(this.memory[entry:entry+len(key)], key)
+	}
+
+	if count < 0 {
+		for i := 0; i < -count; i++ {
+			if compare(i) == 0 {
+				return start + i*length
+			}
 		}
-		index = (lowerBound + upperBound) / 2
+		return 0
 	}
-	panic("One does not simply exit the infinite loop!")
+	// Sorted entries are in numerical order of their keys.
+	i := sort.Search(count, func(i int) bool { return compare(i) >= 0 })
+	if i < count && compare(i) == 0 {
+		return start + i*length
+	}
+	return 0
 }
 
-func (this *ZMachine) tokeniseZSCII(table int, zscii ZSCIIString) {
+// Splits the text into words and looks each up in the dictionary at address,
+// filling the parse table as read and tokenise do. With skipUnknown, the slots
+// of words which aren't in the dictionary are left as they were.
+func (this *ZMachine) tokeniseZSCII(table int, zscii ZSCIIString, dictionary int, skipUnknown bool) {
+	separators := this.memory[dictionary+1 : dictionary+1+int(this.memory[dictionary])]
 	words := make([][]byte, 0, this.memory[table])
 	nextWord := make([]byte, 0, 6)
 	wordStarts := make([]byte, 0, this.memory[table])
@@ -44,7 +48,7 @@ func (this *ZMachine) tokeniseZSCII(table int, zscii ZSCIIString) {
 
 	// Split the input into words separated by any separators present and spaces
 	for i, char := range zscii.Bytes() {
-		if char == 32 || bytes.Contains(this.wordSeparators, []byte{char}) {
+		if char == 32 || bytes.Contains(separators, []byte{char}) {
 			if len(nextWord) > 0 {
 				words = append(words, nextWord)
 				wordStarts = append(wordStarts, lastNewWord)
@@ -67,22 +71,132 @@ func (this *ZMachine) tokeniseZSCII(table int, zscii ZSCIIString) {
 		wordStarts = append(wordStarts, lastNewWord)
 	}
 
+	// The available space is given in the first byte of the table.
+	// Be sure we don't overrun it.
+	if len(words) > int(this.memory[table]) {
+		words = words[:this.memory[table]]
+	}
+
+	// Positions count from the start of the text buffer, where the text
+	// follows its maximum length, and from version 5, its length.
+	start := byte(1)
+	if this.version >= 5 {
+		start = 2
+	}
+
 	// Store the number of words.
 	this.memory[table+1] = byte(len(words))
 	for i, word := range words {
-		// The available space is given in the first byte of the table.
-		// Be sure we don't overrun it.
-		if byte(i) > this.memory[table] {
-			break
-		}
-
 		zsciistring := ZSCIIString{word, this}
-		zstring := zsciistring.ZString(4)
-		pos := this.locateStringInDictionary(zstring)
+		zstring := zsciistring.ZString(this.dictionaryKeyLength())
+		pos := this.lookupWord(dictionary, zstring)
+		if pos == 0 && skipUnknown {
+			continue
+		}
 
 		// Stuff the relevant information in.
-		this.setNumber(table+i*4+2+0, uint16(pos))     // Bytes 0-1: Position in dictionary
-		this.memory[table+i*4+2+2] = byte(len(word))   // Byte 2: Length of word in ZSCII string
-		this.memory[table+i*4+2+3] = wordStarts[i] + 1 // Byte 3: Start of word in ZSCII string
+		this.setNumber(table+i*4+2+0, uint16(pos))         // Bytes 0-1: Position in dictionary
+		this.memory[table+i*4+2+2] = byte(len(word))       // Byte 2: Length of word in ZSCII string
+		this.memory[table+i*4+2+3] = wordStarts[i] + start // Byte 3: Start of word in ZSCII string
+	}
+}
+
+// A dictionary of the words a story's parser understands.
+type Dictionary struct {
+	Address     int
+	Separators  string // The characters which are words by themselves, such as commas
+	EntryLength int
+	KeyLength   int  // The bytes of encoded text in each entry: 4, or 6 from version 4
+	Sorted      bool // Only user dictionaries given to tokenise may be unsorted
+	Entries     []DictionaryEntry
+
+	index   map[string]int
+	machine *ZMachine // For encoding words as the story does
+}
+
+// One word in a dictionary.
+type DictionaryEntry struct {
+	Address int    // As tokenise stores it in the parse buffer
+	Word    string // As far as the key holds it
+	Key     []byte // The encoded word
+	Data    []byte // The rest of the entry, which the story uses as it pleases
+}
+
+// Reads the story's main dictionary as it stands in the machine's memory.
+func (this *ZMachine) Dictionary() (*Dictionary, error) {
+	return this.readDictionary(int(this.dictionaryStart))
+}
+
+// Reads the main dictionary of a story which isn't running.
+func StoryDictionary(story []byte) (*Dictionary, error) {
+	machine, err := storyMachine(story)
+	if err != nil {
+		return nil, err
+	}
+	return machine.Dictionary()
+}
+
+// Reads the dictionary at address. A negative number of entries marks an
+// unsorted dictionary.
+func (this *ZMachine) readDictionary(address int) (dictionary *Dictionary, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			dictionary, err = nil, fmt.Errorf("Dictionary at 0x%x is unreadable: %v", address, r)
+		}
+	}()
+	memory := this.memory
+	separators := int(memory[address])
+	dictionary = &Dictionary{
+		Address:     address,
+		Separators:  string(memory[address+1 : address+1+separators]),
+		EntryLength: int(memory[address+1+separators]),
+		KeyLength:   this.dictionaryKeyLength(),
+		index:       make(map[string]int),
+		machine:     this,
+	}
+	count := int(int16(this.number(address + 2 + separators)))
+	dictionary.Sorted = count >= 0
+	if count < 0 {
+		count = -count
+	}
+	if dictionary.EntryLength < dictionary.KeyLength {
+		return nil, fmt.Errorf("Dictionary at 0x%x has entries of %d bytes, too short for words", address, dictionary.EntryLength)
+	}
+
+	start := address + 4 + separators
+	for i := 0; i < count; i++ {
+		entry := start + i*dictionary.EntryLength
+		key := make([]byte, dictionary.KeyLength)
+		copy(key, memory[entry:entry+dictionary.KeyLength])
+		data := make([]byte, dictionary.EntryLength-dictionary.KeyLength)
+		copy(data, memory[entry+dictionary.KeyLength:entry+dictionary.EntryLength])
+		word, err := decodeText(memory, entry, this.version)
+		if err != nil {
+			return nil, err
+		}
+		dictionary.Entries = append(dictionary.Entries, DictionaryEntry{entry, word, key, data})
+		if _, ok := dictionary.index[string(key)]; !ok {
+			dictionary.index[string(key)] = i
+		}
+	}
+	return dictionary, nil
+}
+
+// Returns the bytes of encoded text at the start of each dictionary entry.
+func (this *ZMachine) dictionaryKeyLength() int {
+	if this.version >= 4 {
+		return 6
+	}
+	return 4
+}
+
+// Finds the entry for a word as the story's parser would, considering only
+// as much of it as the dictionary holds.
+func (this *Dictionary) Lookup(word string) (*DictionaryEntry, bool) {
+	zscii := ZSCIIString{zsciiFromString(strings.ToLower(word), this.machine.characterTable()), this.machine}
+	i, ok := this.index[string(zscii.ZString(this.KeyLength))]
+	if !ok {
+		return nil, false
 	}
+	return &this.Entries[i], true
 }
@@ -0,0 +1,302 @@
+package zmachine
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Words from the dictionaries of Infocom's stories, which end with "zork".
+var testWords = []string{"a", "again", "all", "brass", "drop", "lantern", "lanterns", "mailbox", "north", "take", "zork"}
+
+// Writes a dictionary of words at testDictionary, with the separators ".,\"",
+// each entry followed by three bytes of data: its number in words, then
+// 0xDA 0x7A. Sorted dictionaries are sorted by key; unsorted ones keep the
+// words' order, and have a negative count.
+func addTestDictionary(story []byte, sorted bool, words ...string) {
+	keyLength := 4
+	if story[0] >= 4 {
+		keyLength = 6
+	}
+
+	type entry struct {
+		key  []byte
+		data []byte
+	}
+	var entries []entry
+	for i, word := range words {
+		entries = append(entries, entry{encodeWord(word, keyLength), []byte{byte(i), 0xDA, 0x7A}})
+	}
+	if sorted {
+		sort.Slice(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i].key, entries[j].key) < 0
+		})
+	}
+
+	p := testDictionary
+	p += copy(story[p:], []byte{3, '.', ',', '"', byte(keyLength + 3)})
+	count := len(entries)
+	if !sorted {
+		count = -count
+	}
+	story[p], story[p+1] = byte(count>>8), byte(count)
+	p += 2
+	for _, entry := range entries {
+		p += copy(story[p:], entry.key)
+		p += copy(story[p:], entry.data)
+	}
+}
+
+// Returns a machine for a story of the given version holding a dictionary of
+// words, as addTestDictionary writes it.
+func dictionaryStory(t *testing.T, version byte, words []string, sorted bool) *ZMachine {
+	story := testStory(version)
+	addTestDictionary(story, sorted, words...)
+	return testMachine(t, story)
+}
+
+// Encodes a lower case word as a dictionary key of keyLength bytes.
+func encodeWord(word string, keyLength int) []byte {
+	zscii := ZSCIIString{[]byte(word), nil}
+	return zscii.ZString(keyLength)
+}
+
+// Returns the number in testWords of the entry at address, from its data.
+func entryWord(machine *ZMachine, address int) string {
+	return testWords[machine.memory[address+machine.dictionaryKeyLength()]]
+}
+
+func TestStoryDictionary(t *testing.T) {
+	for _, test := range []struct {
+		version byte
+		lantern string // As far as the key holds it
+	}{
+		{3, "lanter"},
+		{5, "lantern"},
+	} {
+		story := testStory(test.version)
+		addTestDictionary(story, true, "zebra", "lantern", "box", "cat")
+		dictionary, err := StoryDictionary(story)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyLength := 4 + 2*int(test.version/4)
+		if dictionary.Address != testDictionary || dictionary.Separators != ".,\"" || !dictionary.Sorted ||
+			dictionary.KeyLength != keyLength || dictionary.EntryLength != keyLength+3 || len(dictionary.Entries) != 4 {
+			t.Fatalf("version %d dictionary %+v", test.version, dictionary)
+		}
+		words := make([]string, len(dictionary.Entries))
+		for i, entry := range dictionary.Entries {
+			words[i] = entry.Word
+		}
+		if words[0] != "box" || words[2] != test.lantern || words[3] != "zebra" {
+			t.Errorf("version %d words %q", test.version, words)
+		}
+
+		entry, ok := dictionary.Lookup("Lanterns")
+		if test.version >= 4 {
+			// The key is long enough to tell the two apart.
+			ok = !ok
+			entry, _ = dictionary.Lookup("LANTERN")
+		}
+		if !ok || entry.Word != test.lantern || !bytes.Equal(entry.Data, []byte{1, 0xDA, 0x7A}) {
+			t.Errorf("version %d looked up %+v", test.version, entry)
+		}
+		if zebra, ok := dictionary.Lookup("zebra"); !ok || zebra.Address != testDictionary+7+3*(keyLength+3) {
+			t.Errorf("version %d found zebra at %+v", test.version, zebra)
+		}
+		if _, ok := dictionary.Lookup("dog"); ok {
+			t.Errorf("version %d found a dog", test.version)
+		}
+	}
+}
+
+func TestUnreadableDictionary(t *testing.T) {
+	story := testStory(3)
+	addTestDictionary(story, false, "box")
+	story[testDictionary+4] = 3 // Entries too short for their keys
+	if _, err := StoryDictionary(story); err == nil {
+		t.Error("read entries shorter than their keys")
+	}
+	if _, err := StoryDictionary(story[:0x20]); err == nil {
+		t.Error("read a truncated story")
+	}
+}
+
+func TestZSCIIFromString(t *testing.T) {
+	if zscii := zsciiFromString("café €\n", extraCharacters[:]); !bytes.Equal(zscii, []byte{'c', 'a', 'f', 170, ' ', '?', 13}) {
+		t.Errorf("converted to %v", zscii)
+	}
+}
+
+func TestEncodedKeys(t *testing.T) {
+	// "a" is the shift-free 6 padded with 5s, with the end bit on the last word.
+	for _, test := range []struct {
+		version byte
+		key     []byte
+	}{
+		{3, []byte{0x18, 0xA5, 0x94, 0xA5}},
+		{5, []byte{0x18, 0xA5, 0x14, 0xA5, 0x94, 0xA5}},
+	} {
+		machine := dictionaryStory(t, test.version, testWords, true)
+		dictionary, err := machine.Dictionary()
+		if err != nil {
+			t.Fatalf("version %d: %v", test.version, err)
+		}
+		first := dictionary.Entries[0]
+		if first.Word != "a" || !bytes.Equal(first.Key, test.key) {
+			t.Errorf("version %d: first entry is %q, key % x; want \"a\", key % x", test.version, first.Word, first.Key, test.key)
+		}
+	}
+}
+
+func TestLookupWord(t *testing.T) {
+	for _, test := range []struct {
+		version byte
+		sorted  bool
+	}{
+		{3, true},
+		{5, true},
+		{3, false},
+		{5, false},
+	} {
+		machine := dictionaryStory(t, test.version, testWords, test.sorted)
+		keyLength := machine.dictionaryKeyLength()
+		if want := map[byte]int{3: 4, 5: 6}[test.version]; keyLength != want {
+			t.Fatalf("version %d: keys of %d bytes, want %d", test.version, keyLength, want)
+		}
+		for _, word := range testWords {
+			key := encodeWord(word, keyLength)
+			address := machine.lookupWord(testDictionary, key)
+			if address == 0 {
+				t.Errorf("version %d, sorted %v: %q not found", test.version, test.sorted, word)
+				continue
+			}
+			// A 4-byte key holds only six letters, so "lanterns" is "lanter"
+			// like "lantern", and either entry will do.
+			if found := entryWord(machine, address); found != word && !bytes.Equal(encodeWord(found, keyLength), key) {
+				t.Errorf("version %d, sorted %v: %q found %q", test.version, test.sorted, word, found)
+			}
+		}
+		for _, word := range []string{"xyzzy", "", "aa", "zorkmid"} {
+			if address := machine.lookupWord(testDictionary, encodeWord(word, keyLength)); address != 0 {
+				t.Errorf("version %d, sorted %v: %q found %q", test.version, test.sorted, word, entryWord(machine, address))
+			}
+		}
+	}
+}
+
+func TestLookupWordEnds(t *testing.T) {
+	for _, version := range []byte{3, 5} {
+		machine := dictionaryStory(t, version, testWords, true)
+		dictionary, err := machine.Dictionary()
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		if !dictionary.Sorted || len(dictionary.Entries) != len(testWords) {
+			t.Fatalf("version %d: %d entries, sorted %v", version, len(dictionary.Entries), dictionary.Sorted)
+		}
+		for _, entry := range []DictionaryEntry{dictionary.Entries[0], dictionary.Entries[len(dictionary.Entries)-1]} {
+			if address := machine.lookupWord(testDictionary, entry.Key); address != entry.Address {
+				t.Errorf("version %d: %q found at 0x%x, want 0x%x", version, entry.Word, address, entry.Address)
+			}
+		}
+		if last := dictionary.Entries[len(dictionary.Entries)-1].Word; last != "zork" {
+			t.Errorf("version %d: last entry is %q", version, last)
+		}
+	}
+}
+
+func TestLookupWordLongKeys(t *testing.T) {
+	// Only version 4 keys are long enough to tell these apart.
+	machine := dictionaryStory(t, 5, testWords, true)
+	for _, word := range []string{"lantern", "lanterns"} {
+		address := machine.lookupWord(testDictionary, encodeWord(word, 6))
+		if address == 0 || entryWord(machine, address) != word {
+			t.Errorf("%q found at 0x%x", word, address)
+		}
+	}
+}
+
+func TestTokenise(t *testing.T) {
+	machine := dictionaryStory(t, 5, testWords, true)
+	// A user dictionary, unsorted, which knows only "brass" and "lamp".
+	user := 0x360
+	copy(machine.memory[user:], []byte{0, 9, 0xFF, 0xFE})
+	copy(machine.memory[user+4:], encodeWord("lamp", 6))
+	copy(machine.memory[user+13:], encodeWord("brass", 6))
+
+	text, parse := 0x380, 0x3B0
+	input := "take brass lamp"
+	machine.memory[text], machine.memory[text+1] = 40, byte(len(input))
+	copy(machine.memory[text+2:], input)
+	reset := func() {
+		machine.memory[parse] = 10
+		for i := parse + 1; i < parse+2+40; i++ {
+			machine.memory[i] = 0xEE
+		}
+	}
+	slot := func(i int) (address uint16, length, start byte) {
+		p := parse + 2 + 4*i
+		return machine.number(p), machine.memory[p+2], machine.memory[p+3]
+	}
+
+	// Without a dictionary operand, the story's dictionary is used.
+	reset()
+	impvop[27](machine, uint16(text), uint16(parse))
+	if machine.memory[parse+1] != 3 {
+		t.Fatalf("%d words", machine.memory[parse+1])
+	}
+	if address, length, start := slot(0); entryWord(machine, int(address)) != "take" || length != 4 || start != 2 {
+		t.Errorf("take: 0x%x, %d, %d", address, length, start)
+	}
+	if address, _, start := slot(2); address != 0 || start != 13 {
+		t.Errorf("lamp: 0x%x at %d", address, start)
+	}
+
+	// With one, its words are found there, and with the flag set, unknown
+	// words leave their slots alone.
+	reset()
+	impvop[27](machine, uint16(text), uint16(parse), uint16(user), 1)
+	if address, _, _ := slot(0); address != 0xEEEE {
+		t.Errorf("take changed its slot to 0x%x", address)
+	}
+	if address, length, start := slot(1); int(address) != user+13 || length != 5 || start != 7 {
+		t.Errorf("brass: 0x%x, %d, %d", address, length, start)
+	}
+	if address, _, _ := slot(2); int(address) != user+4 {
+		t.Errorf("lamp: 0x%x", address)
+	}
+}
+
+// Looks up every word of the dictionaries of real stories, given as a list of
+// files in $ZMACHINE_STORIES, separated as in $PATH.
+func TestLookupWordInStories(t *testing.T) {
+	files := filepath.SplitList(os.Getenv("ZMACHINE_STORIES"))
+	if len(files) == 0 {
+		t.Skip("No stories given in $ZMACHINE_STORIES")
+	}
+	for _, file := range files {
+		story, _, err := ReadStoryFile(file)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		machine := &ZMachine{memory: story}
+		machine.readHeader()
+		dictionary, err := machine.Dictionary()
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		for _, entry := range dictionary.Entries {
+			// Some stories have words twice, and either entry will do.
+			address := machine.lookupWord(dictionary.Address, entry.Key)
+			if address == 0 || !bytes.Equal(machine.memory[address:address+dictionary.KeyLength], entry.Key) {
+				t.Errorf("%s: %q found at 0x%x, want 0x%x", filepath.Base(file), entry.Word, address, entry.Address)
+			}
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package zmachine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Everything that can be read from a story file without running it.
+type StoryInfo struct {
+	Version          byte
+	Release          int
+	Serial           string
+	Checksum         uint16 // As given in the header
+	ComputedChecksum uint16 // As the verify opcode computes it
+	Length           int    // The story's length as given in the header, or the file's if none is
+	FileSize         int
+	Flags1           byte
+	Flags2           uint16
+	InitialPC        int
+	Compiler         string // The compiler's version, e.g. "6.31", if the story records it
+	Standard         string // The revision of the standard the story was written for, e.g. "1.1", if any
+	IFID             string
+
+	Regions        []MemoryRegion // In address order, larger regions before those inside them
+	Abbreviations  []string
+	Alphabets      [3]string
+	CustomAlphabet bool
+	Dictionary     DictionaryInfo
+	Objects        int
+
+	Blorb         *Blorb // The Blorb the story came in, if any
+	Bibliographic *BlorbBibliographic
+}
+
+// A part of a story's memory, from Start up to but not including End.
+type MemoryRegion struct {
+	Name       string
+	Start, End int
+}
+
+type DictionaryInfo struct {
+	Address     int
+	Separators  string
+	EntryLength int
+	Entries     int
+	Sorted      bool // Negative counts mark unsorted dictionaries, from version 5
+	KeyLength   int  // The bytes of encoded text in each entry: 4, or 6 from version 4
+}
+
+// Returns a machine which isn't running, with the story's header read, for
+// looking at a story's tables.
+func storyMachine(story []byte) (machine *ZMachine, err error) {
+	if len(story) < 0x40 || story[0] < 1 || story[0] > 8 {
+		return nil, errors.New("Not a story file")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			machine, err = nil, fmt.Errorf("Story file is damaged: %v", r)
+		}
+	}()
+	machine = &ZMachine{memory: story}
+	machine.readHeader()
+	return machine, nil
+}
+
+// Describes a story, such as one returned by ReadStoryFile along with its
+// Blorb, which may be nil.
+func NewStoryInfo(story []byte, blorb *Blorb) (info *StoryInfo, err error) {
+	machine, err := storyMachine(story)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			info, err = nil, fmt.Errorf("Story file is damaged: %v", r)
+		}
+	}()
+	version := machine.version
+
+	info = &StoryInfo{
+		Version:          version,
+		Release:          int(machine.number(0x02)),
+		Serial:           string(story[0x12:0x18]),
+		Checksum:         machine.number(0x1C),
+		ComputedChecksum: Checksum(story),
+		Length:           storyLength(story),
+		FileSize:         len(story),
+		Flags1:           story[0x01],
+		Flags2:           machine.number(0x10),
+		InitialPC:        machine.pc,
+		IFID:             storyIFID(story),
+		Blorb:            blorb,
+	}
+	if compiler := story[0x3C:0x40]; printableASCII(compiler) {
+		info.Compiler = string(bytes.TrimRight(compiler, " "))
+	}
+	if story[0x32] != 0 || story[0x33] != 0 {
+		info.Standard = fmt.Sprintf("%d.%d", story[0x32], story[0x33])
+	}
+	if blorb != nil {
+		if bibliographic, err := blorb.Bibliographic(); err == nil {
+			info.Bibliographic = &bibliographic
+			if bibliographic.IFID != "" {
+				info.IFID = bibliographic.IFID
+			}
+		}
+	}
+
+	alphabets := storyAlphabets(story)
+	for i, alphabet := range alphabets {
+		info.Alphabets[i] = string(alphabet[:])
+	}
+	info.CustomAlphabet = version >= 5 && machine.number(0x34) != 0
+
+	abbreviations := 0
+	switch {
+	case version == 2:
+		abbreviations = 32
+	case version >= 3:
+		abbreviations = 96
+	}
+	for i := 0; i < abbreviations; i++ {
+		address := 2 * int(machine.number(int(machine.abbreviationStart)+2*i))
+		text, err := decodeText(story, address, version)
+		if err != nil {
+			text = fmt.Sprintf("<%v>", err)
+		}
+		info.Abbreviations = append(info.Abbreviations, text)
+	}
+
+	dictionary := int(machine.dictionaryStart)
+	entries := int(int16(machine.dictionaryLength))
+	info.Dictionary = DictionaryInfo{
+		Address:     dictionary,
+		Separators:  string(machine.wordSeparators),
+		EntryLength: int(machine.dictionaryEntryLength),
+		Entries:     entries,
+		Sorted:      entries >= 0,
+		KeyLength:   machine.dictionaryKeyLength(),
+	}
+	if entries < 0 {
+		info.Dictionary.Entries = -entries
+	}
+
+	properties := objectPropertyTables(story)
+	info.Objects = len(properties)
+	info.Regions = storyRegions(machine, properties, abbreviations, info.Dictionary)
+	return info, nil
+}
+
+func printableASCII(b []byte) bool {
+	for _, c := range b {
+		if c < 32 || c > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the story's alphabets: its own table, from version 5, or the defaults.
+func storyAlphabets(story []byte) [3][26]byte {
+	alphabets := defaultAlphabets(story[0])
+	table := int(story[0x34])<<8 | int(story[0x35])
+	if story[0] >= 5 && table != 0 && table+78 <= len(story) {
+		for i := range alphabets {
+			copy(alphabets[i][:], story[table+26*i:])
+		}
+		// The escape and newline can't be changed.
+		alphabets[2][0], alphabets[2][1] = ' ', '\n'
+	}
+	return alphabets
+}
+
+// Returns the length of the story given in its header, which is scaled by
+// the version, or for the earliest stories without one, the file's length.
+func storyLength(story []byte) int {
+	length := int(story[0x1A])<<8 | int(story[0x1B])
+	switch {
+	case length == 0:
+		return len(story)
+	case story[0] <= 3:
+		length *= 2
+	case story[0] <= 5:
+		length *= 4
+	default:
+		length *= 8
+	}
+	if length > len(story) {
+		return len(story)
+	}
+	return length
+}
+
+// Returns the checksum which the verify opcode compares with the header's: the
+// sum of the bytes after the header up to the story's length.
+func Checksum(story []byte) uint16 {
+	sum := uint16(0)
+	for _, b := range story[0x40:storyLength(story)] {
+		sum += uint16(b)
+	}
+	return sum
+}
+
+var uuidPattern = regexp.MustCompile(`UUID://([0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12})//`)
+
+// Returns the story's IFID as the Treaty of Babel gives it: the UUID which
+// modern compilers embed, or else one made from the release, serial and
+// checksum. The checksum is left out for Infocom's stories, whose serials are
+// dates from the 1980s and 1990s.
+func storyIFID(story []byte) string {
+	if match := uuidPattern.FindSubmatch(story); match != nil {
+		return string(bytes.ToUpper(match[1]))
+	}
+	serial := story[0x12:0x18]
+	ifid := fmt.Sprintf("ZCODE-%d-%s", int(story[0x02])<<8|int(story[0x03]), serial)
+	infocom := serial[0] == '8' || serial[0] == '9'
+	for _, c := range serial {
+		if c < '0' || c > '9' {
+			infocom = false
+		}
+	}
+	if !infocom {
+		ifid += fmt.Sprintf("-%04X", int(story[0x1C])<<8|int(story[0x1D]))
+	}
+	return ifid
+}
+
+// Returns the address of each object's property table, which is how many
+// objects there are: the table isn't otherwise counted, so it's taken to end
+// where the first property table begins.
+func objectPropertyTables(story []byte) []int {
+	word := func(address int) int {
+		return int(story[address])<<8 | int(story[address+1])
+	}
+	entry, defaults, count := 9, 31, 255
+	if story[0] >= 4 {
+		entry, defaults, count = 14, 63, 65535
+	}
+	first := word(0x0A) + 2*defaults
+	end := len(story)
+	var tables []int
+	for obj := 0; obj < count && first+(obj+1)*entry <= end; obj++ {
+		properties := word(first + obj*entry + entry - 2)
+		if properties < first+(obj+1)*entry || properties >= len(story) {
+			break
+		}
+		if properties < end {
+			end = properties
+		}
+		tables = append(tables, properties)
+	}
+	return tables
+}
+
+// Returns the end of the property table at address.
+func propertyTableEnd(story []byte, address int) int {
+	p := address + 1 + 2*int(story[address])
+	for story[p] != 0 {
+		size, header := propertySize(story, p)
+		p += header + size
+	}
+	return p + 1
+}
+
+// Maps out the story's memory.
+func storyRegions(machine *ZMachine, properties []int, abbreviations int, dictionary DictionaryInfo) []MemoryRegion {
+	story := machine.memory
+	static := int(machine.memoryDynamicEnd)
+	high := int(machine.memoryHighStart)
+	objects := int(machine.objectTableStart)
+	entry, defaults := 9, 31
+	if machine.version >= 4 {
+		entry, defaults = 14, 63
+	}
+	staticEnd := len(story)
+	if staticEnd > 0x10000 {
+		staticEnd = 0x10000
+	}
+
+	regions := []MemoryRegion{
+		{"Dynamic memory", 0, static},
+		{"Static memory", static, staticEnd},
+		{"High memory", high, len(story)},
+		{"Header", 0, 0x40},
+		{"Property defaults", objects, objects + 2*defaults},
+		{"Object table", objects + 2*defaults, objects + 2*defaults + entry*len(properties)},
+		{"Global variables", int(machine.globalVariableStart), int(machine.globalVariableStart) + 480},
+		{"Dictionary", dictionary.Address, dictionary.Address + len(dictionary.Separators) + 4 + dictionary.Entries*dictionary.EntryLength},
+	}
+	if abbreviations > 0 {
+		start := int(machine.abbreviationStart)
+		regions = append(regions, MemoryRegion{"Abbreviations table", start, start + 2*abbreviations})
+	}
+	if len(properties) > 0 {
+		start, end := properties[0], 0
+		for _, address := range properties {
+			if address < start {
+				start = address
+			}
+			if e := propertyTableEnd(story, address); e > end {
+				end = e
+			}
+		}
+		regions = append(regions, MemoryRegion{"Property tables", start, end})
+	}
+	if machine.version >= 5 {
+		if table := int(machine.number(0x34)); table != 0 {
+			regions = append(regions, MemoryRegion{"Alphabet table", table, table + 78})
+		}
+	}
+	kept := regions[:0]
+	for _, region := range regions {
+		if region.End > region.Start {
+			kept = append(kept, region)
+		}
+	}
+	regions = kept
+	sort.SliceStable(regions, func(i, j int) bool {
+		if regions[i].Start != regions[j].Start {
+			return regions[i].Start < regions[j].Start
+		}
+		return regions[i].End > regions[j].End
+	})
+	return regions
+}
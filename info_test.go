@@ -0,0 +1,81 @@
+package zmachine
+
+import (
+	"os"
+	"testing"
+)
+
+func TestVerifyWithoutStoryFile(t *testing.T) {
+	story := testStory(3)
+	story[0x1A], story[0x1B] = 0x04, 0x00 // 0x800 bytes long
+	for i := 0x600; i < len(story); i++ {
+		story[i] = byte(i)
+	}
+	sum := Checksum(story)
+	story[0x1C], story[0x1D] = byte(sum>>8), byte(sum)
+	machine := testMachine(t, story)
+
+	// Neither the game changing its memory nor the file going away matters.
+	os.Remove(machine.story_file)
+	machine.memory[testGlobals]++
+	for _, branch := range []struct {
+		onTrue bool
+		want   int
+	}{{true, 3}, {false, 0}} {
+		machine.pc = 0x580
+		machine.memory[0x581] = 0x45 // Branch on false by 5
+		if branch.onTrue {
+			machine.memory[0x581] |= 0x80
+		}
+		imp0op[13](machine)
+		if moved := machine.pc - 0x581; moved != branch.want {
+			t.Errorf("branch on %v moved %d, want %d", branch.onTrue, moved, branch.want)
+		}
+	}
+}
+
+func TestNewStoryInfo(t *testing.T) {
+	story := testStory(3)
+	story[0x1C], story[0x1D] = 0x12, 0x34
+	copy(story[0x3C:], "6.31")
+	addTestObjects(story, testObject{name: "box"}, testObject{name: "key"})
+	info, err := NewStoryInfo(story, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 3 || info.Release != 1 || info.Serial != "010101" || info.InitialPC != testRoutines+1 || info.Compiler != "6.31" {
+		t.Errorf("info %+v", info)
+	}
+	if info.IFID != "ZCODE-1-010101-1234" || info.Checksum != 0x1234 || info.Length != len(story) {
+		t.Errorf("IFID %s, checksum %04x, length %d", info.IFID, info.Checksum, info.Length)
+	}
+	if info.Objects != 2 || len(info.Abbreviations) != 96 || info.Alphabets[0] != "abcdefghijklmnopqrstuvwxyz" {
+		t.Errorf("%d objects, %d abbreviations, alphabet %q", info.Objects, len(info.Abbreviations), info.Alphabets[0])
+	}
+	if want := (DictionaryInfo{testDictionary, "", 7, 0, true, 4}); info.Dictionary != want {
+		t.Errorf("dictionary %+v, want %+v", info.Dictionary, want)
+	}
+	regions := make(map[string]MemoryRegion)
+	for _, region := range info.Regions {
+		regions[region.Name] = region
+	}
+	if regions["Object table"] != (MemoryRegion{"Object table", testObjects + 62, testObjects + 62 + 18}) || regions["Static memory"].Start != testDictionary {
+		t.Errorf("regions %+v", info.Regions)
+	}
+
+	if _, err := NewStoryInfo(story[:0x20], nil); err == nil {
+		t.Error("described a truncated story")
+	}
+}
+
+func TestStoryIFID(t *testing.T) {
+	story := testStory(3)
+	copy(story[0x12:], "870917") // Infocom's serials are dates
+	if ifid := storyIFID(story); ifid != "ZCODE-1-870917" {
+		t.Errorf("Infocom story's IFID %s", ifid)
+	}
+	copy(story[0x600:], "UUID://1974a053-7db0-4103-93a1-767c1382c0b7//")
+	if ifid := storyIFID(story); ifid != "1974A053-7DB0-4103-93A1-767C1382C0B7" {
+		t.Errorf("IFID %s", ifid)
+	}
+}
@@ -0,0 +1,111 @@
+package zmachine
+
+import (
+	"bytes"
+	"time"
+)
+
+// Waits for a line of input, returning it with the character which ended it:
+// a newline, or from version 5 one of the story's terminating characters. If
+// tenths and routine are both non-zero, the routine at that packed address is
+// called every tenths tenths of a second while waiting; if it returns true,
+// input is abandoned and ok is false.
+func (this *ZMachine) readLine(tenths, routine uint16) (line string, terminator byte, ok bool) {
+	// What's left of a line read_char was reading is read first.
+	typed := this.typedAhead
+	this.typedAhead = nil
+	if this.journal != nil && this.journal.replaying() {
+		event := this.replayInput(routine, journalLine)
+		return event.line, byte(event.value), event.ok
+	}
+	if this.turnObserver != nil {
+		this.observeTurn()
+	}
+	this.profiler.pause()
+	switch {
+	case len(typed) > 0:
+		zscii := ZSCIIString{bytes.TrimSuffix(typed, []byte{KEY_RETURN}), this}
+		line, terminator, ok = zscii.String(), KEY_RETURN, true
+	case this.keys != nil:
+		line, terminator, ok = this.typeLine(tenths, routine)
+	default:
+		if line, ok = this.waitForLine(tenths, routine); ok {
+			terminator = KEY_RETURN
+		}
+	}
+	this.profiler.resume()
+	if this.journal != nil && this.running {
+		this.journal.record(journalEvent{kind: journalLine, line: line, ok: ok, value: uint16(terminator)})
+	}
+	return line, terminator, ok
+}
+
+// Repeats recorded input, calling the timed routine as often as it was, and
+// returns the event recorded for the input itself.
+func (this *ZMachine) replayInput(routine uint16, kind journalKind) journalEvent {
+	for this.journal.replaying() && this.journal.events[this.journal.cursor].kind == journalTimer {
+		this.journal.next(journalTimer)
+		this.callInterrupt(routine)
+		if !this.running {
+			return journalEvent{kind: kind}
+		}
+	}
+	return this.journal.next(kind)
+}
+
+func (this *ZMachine) waitForLine(tenths, routine uint16) (line string, ok bool) {
+	for {
+		var timeout <-chan time.Time
+		stop := func() {}
+		if tenths != 0 && routine != 0 {
+			timeout, stop = this.inputClock().After(time.Duration(tenths) * time.Second / 10)
+		}
+		select {
+		case line, ok = <-this.input:
+			stop()
+			if !ok {
+				panic("Input channel not okay!")
+			}
+			return line, true
+		case <-this.inputEnded:
+			stop()
+			// A line sent before input ended still comes first.
+			select {
+			case line, ok = <-this.input:
+				if ok {
+					return line, true
+				}
+			default:
+			}
+			this.running = false
+			return "", false
+		case <-timeout:
+			if this.inputTimedOut(routine) {
+				return "", false
+			}
+		}
+	}
+}
+
+// Tells the machine that no more input is coming, so that when the story
+// next waits for a line or a key, or straight away if it's waiting now, the
+// machine stops as if the story had quit. Unlike closing the input channel,
+// this may be done while the story is running. It may only be done once.
+func (this *ZMachine) EndInput() {
+	close(this.inputEnded)
+}
+
+func (this *ZMachine) inputClock() Clock {
+	if this.clock == nil {
+		return realClock{}
+	}
+	return this.clock
+}
+
+// Calls the timed input routine, reporting whether it abandoned input.
+func (this *ZMachine) inputTimedOut(routine uint16) bool {
+	if this.journal != nil {
+		this.journal.record(journalEvent{kind: journalTimer})
+	}
+	return this.callInterrupt(routine) != 0 || !this.running
+}
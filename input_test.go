@@ -0,0 +1,118 @@
+package zmachine
+
+import "testing"
+
+func inputMachine(t *testing.T) *ZMachine {
+	machine := testMachine(t, testStory(5))
+	machine.running = true
+	return machine
+}
+
+func TestReadAfterReadChar(t *testing.T) {
+	machine := inputMachine(t)
+	machine.input <- "look"
+	machine.input <- "north"
+	if c := machine.readChar(0, 0); c != 'l' {
+		t.Fatalf("read_char gave %d", c)
+	}
+	// The rest of the line comes before the next one.
+	if line, terminator, ok := machine.readLine(0, 0); line != "ook" || terminator != KEY_RETURN || !ok {
+		t.Fatalf("read gave %q, %d, %v", line, terminator, ok)
+	}
+	if line, _, _ := machine.readLine(0, 0); line != "north" {
+		t.Fatalf("read gave %q", line)
+	}
+}
+
+func TestSnapshotTypedAhead(t *testing.T) {
+	machine := inputMachine(t)
+	machine.journal = &journal{}
+	machine.input <- "up"
+	machine.readChar(0, 0)
+	snapshot := takeSnapshot(machine, 0)
+	machine.readChar(0, 0)
+	machine.readChar(0, 0)
+	snapshot.restore(machine)
+	if c := machine.readChar(0, 0); c != 'p' {
+		t.Fatalf("read_char gave %d after restoring", c)
+	}
+}
+
+func TestTypeLine(t *testing.T) {
+	story := testStory(5)
+	story[0x2E], story[0x2F] = 0x03, 0xF0
+	story[0x3F0] = KEY_F1 + 1 // F2 ends input
+	machine := testMachine(t, story)
+	machine.running = true
+	keys := make(chan Key, 16)
+	machine.SetKeyInput(keys)
+	for _, key := range []Key{{Rune: 'g'}, {Rune: '\x1b'}, {Rune: '\t'}, {Rune: 'o'}, {Rune: 'x'}, {Rune: '\b'}, FunctionKey(1), FunctionKey(2), {Rune: 'u'}, {Rune: 'p'}, {Rune: '\r'}} {
+		keys <- key
+	}
+	if line, terminator, ok := machine.readLine(0, 0); line != "go" || terminator != KEY_F1+1 || !ok {
+		t.Errorf("read %q, %d, %v", line, terminator, ok)
+	}
+	if line, terminator, _ := machine.readLine(0, 0); line != "up" || terminator != KEY_RETURN {
+		t.Errorf("read %q, %d", line, terminator)
+	}
+}
+
+func TestReadCharKeys(t *testing.T) {
+	machine := inputMachine(t)
+	keys := make(chan Key, 4)
+	machine.SetKeyInput(keys)
+	keys <- Key{Rune: 'é'}
+	keys <- KeypadKey(3)
+	keys <- Key{Rune: '\x1b'}
+	for _, want := range []byte{170, KEY_KEYPAD_0 + 3, KEY_ESCAPE} {
+		if code := machine.readChar(0, 0); code != want {
+			t.Errorf("read_char gave %d, want %d", code, want)
+		}
+	}
+}
+
+func TestEndInput(t *testing.T) {
+	story := testStory(3)
+	copy(story[testRoutines+1:], []byte{
+		0xE4, 0x0F, 0x03, 0xC0, 0x03, 0xE0, // sread 0x3C0 0x3E0
+		0xE4, 0x0F, 0x03, 0xD0, 0x03, 0xE0, // sread 0x3D0 0x3E0
+		0x0D, 0x10, 0x01, // store g0 1
+		0xBA, // quit
+	})
+	story[0x3C0], story[0x3D0] = 10, 10
+	story[0x3D1] = 'x'
+	machine := testMachine(t, story)
+	machine.input <- "look"
+	machine.EndInput()
+
+	// The line sent before input ended is read, then the machine stops at
+	// the next read.
+	runTestMachine(machine)
+	if typed := string(machine.memory[0x3C1:0x3C5]); typed != "look" || machine.memory[0x3D1] != 0 {
+		t.Errorf("read %q, then %q", typed, machine.memory[0x3D1])
+	}
+	if machine.running || machine.getVariable(0x10) != 0 {
+		t.Error("carried on after input ended")
+	}
+}
+
+func TestKeyRanges(t *testing.T) {
+	if FunctionKey(12).Special != KEY_F1+11 || KeypadKey(9).Special != KEY_KEYPAD_0+9 {
+		t.Error("wrong codes for F12 and keypad 9")
+	}
+	for _, key := range []func(){
+		func() { FunctionKey(0) },
+		func() { FunctionKey(13) },
+		func() { KeypadKey(-1) },
+		func() { KeypadKey(10) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("made a key ZSCII has no code for")
+				}
+			}()
+			key()
+		}()
+	}
+}
@@ -0,0 +1,97 @@
+package zmachine
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Everything which can make two runs of the same story differ is noted in a
+// journal while recording, so that running again from a snapshot reproduces
+// the recording exactly.
+type journalKind int
+
+const (
+	journalLine    journalKind = iota // A line of input, or ok false if it was abandoned
+	journalTimer                      // The timed input routine was called
+	journalSave                       // The result of a save, with any error in line
+	journalRandom                     // A random number
+	journalRestore                    // A successful restore, which replay jumps over
+	journalRestart                    // A restart, which replay also jumps over
+	journalKey                        // A keystroke's ZSCII code, with where the mouse was and the rest of the line in line
+)
+
+type journalEvent struct {
+	kind  journalKind
+	line  string
+	ok    bool
+	value uint16 // Also the character which ended a line
+	x, y  int
+}
+
+type journal struct {
+	events []journalEvent
+	cursor int // The next event to replay; at the end, the machine is running live
+}
+
+func (this *journal) replaying() bool {
+	return this.cursor < len(this.events)
+}
+
+// Notes an event which has just happened live.
+func (this *journal) record(event journalEvent) {
+	this.events = append(this.events, event)
+	this.cursor = len(this.events)
+}
+
+// Returns the next event, which must be of the given kind.
+func (this *journal) next(kind journalKind) journalEvent {
+	if !this.replaying() || this.events[this.cursor].kind != kind {
+		panic(fmt.Sprintf("Replay has diverged from the recording at event %d", this.cursor))
+	}
+	this.cursor++
+	return this.events[this.cursor-1]
+}
+
+// Reads a filename for save or restore.
+func (this *ZMachine) readFilename() string {
+	if this.journal != nil && this.journal.replaying() {
+		return this.journal.next(journalLine).line
+	}
+	filename := <-this.input
+	if this.journal != nil {
+		this.journal.record(journalEvent{kind: journalLine, line: filename, ok: true})
+	}
+	return filename
+}
+
+// Returns a random number for the random opcode.
+func (this *ZMachine) random(n int16) uint16 {
+	if this.journal != nil && this.journal.replaying() {
+		return this.journal.next(journalRandom).value
+	}
+	value := uint16(rand.Int31n(int32(n) + 1))
+	if this.journal != nil {
+		this.journal.record(journalEvent{kind: journalRandom, value: value})
+	}
+	return value
+}
+
+// Writes a save file, or while replaying, repeats the recorded result.
+func (this *ZMachine) save(filename string, metadata SaveMetadata) error {
+	if this.journal != nil && this.journal.replaying() {
+		if event := this.journal.next(journalSave); !event.ok {
+			return errors.New(event.line)
+		}
+		return nil
+	}
+	err := writeQuetzalFile(filename, this, true, metadata)
+	if this.journal != nil {
+		event := journalEvent{kind: journalSave, ok: err == nil}
+		if err != nil {
+			event.line = err.Error()
+		}
+		this.journal.record(event)
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+package zmachine
+
+import (
+	"fmt"
+	"time"
+	"unicode"
+)
+
+// The ZSCII codes of keys which aren't characters.
+const KEY_DELETE = 8
+const KEY_RETURN = 13
+const KEY_ESCAPE = 27
+const KEY_UP = 129
+const KEY_DOWN = 130
+const KEY_LEFT = 131
+const KEY_RIGHT = 132
+const KEY_F1 = 133       // Up to KEY_F1 + 11 for F12
+const KEY_KEYPAD_0 = 145 // Up to KEY_KEYPAD_0 + 9 for keypad 9
+const KEY_MENU_CLICK = 252
+const KEY_DOUBLE_CLICK = 253
+const KEY_CLICK = 254
+
+// A key pressed by the player, or a click of the mouse.
+type Key struct {
+	Rune    rune // The character typed, if Special is 0
+	Special byte // One of the KEY_ codes
+	X, Y    int  // Where the mouse was clicked, from 1 at the top left
+}
+
+// Returns the Key for one of the numbered function keys, from 1 to 12. It
+// panics for any other number, which ZSCII has no code for.
+func FunctionKey(n int) Key {
+	if n < 1 || n > 12 {
+		panic(fmt.Sprintf("No function key F%d", n))
+	}
+	return Key{Special: byte(KEY_F1 + n - 1)}
+}
+
+// Returns the Key for one of the keypad's digits, panicking for anything
+// else.
+func KeypadKey(digit int) Key {
+	if digit < 0 || digit > 9 {
+		panic(fmt.Sprintf("No keypad key %d", digit))
+	}
+	return Key{Special: byte(KEY_KEYPAD_0 + digit)}
+}
+
+// Sets where single keystrokes come from. Without keys, read_char takes the
+// characters of lines from the input channel one at a time. With them, lines
+// are typed a key at a time too, so that the story's terminating characters
+// can end them.
+func (this *ZMachine) SetKeyInput(keys chan Key) {
+	this.keys = keys
+}
+
+// Waits for a keystroke, returning its ZSCII code. Timed input is as for
+// readLine, with 0 for abandoned input.
+func (this *ZMachine) readChar(tenths, routine uint16) byte {
+	if this.journal != nil && this.journal.replaying() {
+		event := this.replayInput(routine, journalKey)
+		if event.value >= KEY_MENU_CLICK {
+			this.setMousePosition(event.x, event.y)
+		}
+		this.typedAhead = []byte(event.line)
+		return byte(event.value)
+	}
+	this.profiler.pause()
+	var code byte
+	var key Key
+	if this.keys != nil {
+		var ok bool
+		if key, ok = this.waitForKey(tenths, routine); ok {
+			code = this.keyCode(key)
+		}
+	} else {
+		code = this.nextTypedChar(tenths, routine)
+	}
+	this.profiler.resume()
+	if this.journal != nil && this.running {
+		// The rest of the line is kept, so that replay leaves it as it was.
+		this.journal.record(journalEvent{kind: journalKey, value: uint16(code), x: key.X, y: key.Y, line: string(this.typedAhead)})
+	}
+	return code
+}
+
+// Returns the next character of the lines from the input channel, ending each
+// with a newline.
+func (this *ZMachine) nextTypedChar(tenths, routine uint16) byte {
+	if len(this.typedAhead) == 0 {
+		line, ok := this.waitForLine(tenths, routine)
+		if !ok {
+			return 0
+		}
+		this.typedAhead = append(zsciiFromString(line, this.characterTable()), KEY_RETURN)
+	}
+	code := this.typedAhead[0]
+	this.typedAhead = this.typedAhead[1:]
+	return code
+}
+
+func (this *ZMachine) waitForKey(tenths, routine uint16) (key Key, ok bool) {
+	for {
+		var timeout <-chan time.Time
+		stop := func() {}
+		if tenths != 0 && routine != 0 {
+			timeout, stop = this.inputClock().After(time.Duration(tenths) * time.Second / 10)
+		}
+		select {
+		case key, ok = <-this.keys:
+			stop()
+			if !ok {
+				panic("Key channel not okay!")
+			}
+			return key, true
+		case <-this.inputEnded:
+			stop()
+			select {
+			case key, ok = <-this.keys:
+				if ok {
+					return key, true
+				}
+			default:
+			}
+			this.running = false
+			return Key{}, false
+		case <-timeout:
+			if this.inputTimedOut(routine) {
+				return Key{}, false
+			}
+		}
+	}
+}
+
+// Builds a line from keystrokes, until the player presses return or one of
+// the terminating characters.
+func (this *ZMachine) typeLine(tenths, routine uint16) (string, byte, bool) {
+	var typed []rune
+	for {
+		key, ok := this.waitForKey(tenths, routine)
+		if !ok {
+			return "", 0, false
+		}
+		code := this.keyCode(key)
+		switch {
+		case code == KEY_RETURN || this.terminates(code):
+			return string(typed), code, true
+		case code == KEY_DELETE:
+			if len(typed) > 0 {
+				typed = typed[:len(typed)-1]
+			}
+		case key.Special == 0 && unicode.IsPrint(key.Rune):
+			// Escape and other controls aren't typed.
+			typed = append(typed, key.Rune)
+		}
+	}
+}
+
+// Returns the ZSCII code of a key, noting where the mouse was for clicks.
+func (this *ZMachine) keyCode(key Key) byte {
+	switch {
+	case key.Special >= KEY_MENU_CLICK:
+		this.setMousePosition(key.X, key.Y)
+		return key.Special
+	case key.Special != 0:
+		return key.Special
+	case key.Rune == '\n' || key.Rune == '\r':
+		return KEY_RETURN
+	case key.Rune == '\b' || key.Rune == 0x7F:
+		return KEY_DELETE
+	case key.Rune == 0x1B:
+		return KEY_ESCAPE
+	}
+	code, _ := zsciiFromRune(key.Rune, this.characterTable())
+	return code
+}
+
+// Reports whether the story's terminating characters table, from version 5,
+// includes code. 255 in the table stands for every function key.
+func (this *ZMachine) terminates(code byte) bool {
+	function := code >= KEY_UP && code <= KEY_KEYPAD_0+9 || code >= KEY_MENU_CLICK && code <= KEY_CLICK
+	table := int(this.number(0x2E))
+	if this.version < 5 || table == 0 || !function {
+		return false
+	}
+	for p := table; p < len(this.memory) && this.memory[p] != 0; p++ {
+		if this.memory[p] == code || this.memory[p] == 255 {
+			return true
+		}
+	}
+	return false
+}
+
+// Records where the mouse was clicked in the header extension, if the story
+// has room for it.
+func (this *ZMachine) setMousePosition(x, y int) {
+	extension := int(this.number(0x36))
+	if this.version < 5 || extension == 0 || extension+6 > len(this.memory) || this.number(extension) < 2 {
+		return
+	}
+	this.setNumber(extension+2, uint16(x))
+	this.setNumber(extension+4, uint16(y))
+}
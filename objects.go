@@ -1,32 +1,45 @@
 package zmachine
 
-func (this *ZMachine) getObjectAddress(obj byte) int {
-	return int(this.objectTableStart + 62 + (uint16(obj)-1)*9)
+import (
+	"encoding/json"
+	"fmt"
+)
+
+func (this *ZMachine) getObjectAddress(obj uint16) int {
+	return this.objectEntry(int(obj))
 }
 
-func (this *ZMachine) getObjectAttribute(obj, attribute byte) bool {
-	if attribute > 31 {
+// The number of attributes each object has.
+func (this *ZMachine) attributeCount() uint16 {
+	if this.version >= 4 {
+		return 48
+	}
+	return 32
+}
+
+func (this *ZMachine) getObjectAttribute(obj, attribute uint16) bool {
+	if attribute >= this.attributeCount() {
 		panic("Attempt to read invalid attribute")
 	}
 	if obj == 0 {
 		return false
 	}
-	address := uint16(this.getObjectAddress(obj))
+	address := this.getObjectAddress(obj)
 	bit := byte(0x80 >> (attribute % 8))
-	part := uint16(attribute / 8)
+	part := int(attribute / 8)
 	return (this.memory[address+part]&bit == bit)
 }
 
-func (this *ZMachine) setObjectAttribute(obj, attribute byte, value bool) {
-	if attribute > 31 {
+func (this *ZMachine) setObjectAttribute(obj, attribute uint16, value bool) {
+	if attribute >= this.attributeCount() {
 		panic("Attempt to set invalid attribute")
 	}
 	if obj == 0 {
 		panic("Attempted to set attribute from null object")
 	}
-	address := uint16(this.getObjectAddress(obj))
+	address := this.getObjectAddress(obj)
 	bit := byte(0x80 >> (attribute % 8))
-	part := uint16(attribute / 8)
+	part := int(attribute / 8)
 	if value {
 		this.memory[address+part] |= bit
 	} else {
@@ -34,30 +47,38 @@ func (this *ZMachine) setObjectAttribute(obj, attribute byte, value bool) {
 	}
 }
 
-func (this *ZMachine) getObjectPropertyTableAddress(obj byte) int {
+func (this *ZMachine) getObjectPropertyTableAddress(obj uint16) int {
 	if obj == 0 {
 		panic("Attempted to read property table for null object")
 	}
 	address := this.getObjectAddress(obj)
-	return int(this.number(address + 7))
+	return int(this.number(address + this.objectEntryLength() - 2))
 }
 
-func (this *ZMachine) getObjectName(obj byte) ZString {
+func (this *ZMachine) getObjectName(obj uint16) ZString {
 	return this.zString(this.getObjectPropertyTableAddress(obj)+1, false)
 }
 
-func (this *ZMachine) getObjectPropertyAddress(obj, prop byte) int {
+// The number of the property whose size byte is at address.
+func (this *ZMachine) propertyNumber(address int) byte {
+	if this.version >= 4 {
+		return this.memory[address] & 0x3F
+	}
+	return this.memory[address] & 0x1F
+}
+
+func (this *ZMachine) getObjectPropertyAddress(obj uint16, prop byte) int {
 	address := this.getObjectPropertyTableAddress(obj)
 	address += int(this.memory[address])*2 + 1
 	for this.memory[address] != 0 {
-		now := this.memory[address] % 32
-		size := this.memory[address]/32 + 1
+		now := this.propertyNumber(address)
+		size, header := propertySize(this.memory, address)
 		if now == prop {
-			return address + 1
+			return address + header
 		} else if now < prop {
 			return 0
 		}
-		address += int(size) + 1
+		address += size + header
 	}
 	return 0
 }
@@ -66,36 +87,71 @@ func (this *ZMachine) getDefaultPropertyAddress(prop byte) int {
 	return int(this.objectTableStart) + (int(prop)-1)*2
 }
 
-func (this *ZMachine) getObjectPropertySize(obj, prop byte) byte {
-	address := this.getObjectPropertyAddress(obj, prop) - 1
-	return this.memory[address]/32 + 1
+// Returns the length of the property data at address, as get_prop_len does.
+// From version 4 the size byte before the data may be the second of two.
+func (this *ZMachine) getPropertyLength(address int) int {
+	size := this.memory[address-1]
+	switch {
+	case this.version <= 3:
+		return int(size)/32 + 1
+	case size&0x80 != 0:
+		if size&0x3F == 0 {
+			return 64
+		}
+		return int(size & 0x3F)
+	case size&0x40 != 0:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func (this *ZMachine) getObjectPropertySize(obj uint16, prop byte) int {
+	return this.getPropertyLength(this.getObjectPropertyAddress(obj, prop))
 }
 
-func (this *ZMachine) getObjectParent(obj byte) byte {
+func (this *ZMachine) getObjectParent(obj uint16) uint16 {
 	if obj == 0 {
 		return 0
 	}
-	address := this.getObjectAddress(obj)
-	return this.memory[address+4]
+	parent, _, _ := this.objectRelatives(int(obj))
+	return uint16(parent)
 }
 
-func (this *ZMachine) getObjectSibling(obj byte) byte {
+func (this *ZMachine) getObjectSibling(obj uint16) uint16 {
 	if obj == 0 {
 		return 0
 	}
-	address := this.getObjectAddress(obj)
-	return this.memory[address+5]
+	_, sibling, _ := this.objectRelatives(int(obj))
+	return uint16(sibling)
 }
 
-func (this *ZMachine) getObjectChild(obj byte) byte {
+func (this *ZMachine) getObjectChild(obj uint16) uint16 {
 	if obj == 0 {
 		return 0
 	}
+	_, _, child := this.objectRelatives(int(obj))
+	return uint16(child)
+}
+
+// Which of an object's relatives setObjectRelative changes, in the order
+// they're kept in its entry.
+const (
+	relativeParent = iota
+	relativeSibling
+	relativeChild
+)
+
+func (this *ZMachine) setObjectRelative(obj uint16, relative int, value uint16) {
 	address := this.getObjectAddress(obj)
-	return this.memory[address+6]
+	if this.version >= 4 {
+		this.setNumber(address+6+2*relative, value)
+	} else {
+		this.memory[address+4+relative] = byte(value)
+	}
 }
 
-func (this *ZMachine) getObjectPreviousSibling(obj byte) byte {
+func (this *ZMachine) getObjectPreviousSibling(obj uint16) uint16 {
 	parent := this.getObjectParent(obj)
 	if parent > 0 {
 		child := this.getObjectChild(parent)
@@ -113,31 +169,203 @@ func (this *ZMachine) getObjectPreviousSibling(obj byte) byte {
 	return 0
 }
 
-func (this *ZMachine) removeObject(obj byte) {
-	address := this.getObjectAddress(obj)
+func (this *ZMachine) removeObject(obj uint16) {
 	previousSibling := this.getObjectPreviousSibling(obj)
 	if previousSibling == 0 {
-		parent := this.memory[address+4]
+		parent := this.getObjectParent(obj)
 		if parent > 0 {
-			parentAddress := this.getObjectAddress(parent)
-			this.memory[parentAddress+6] = this.memory[address+5] // object.parentNode.firstChild = object.nextSibling
+			this.setObjectRelative(parent, relativeChild, this.getObjectSibling(obj)) // object.parentNode.firstChild = object.nextSibling
 		}
 	} else {
-		previousAddress := this.getObjectAddress(previousSibling)
-		this.memory[previousAddress+5] = this.memory[address+5] // object.previousSibling.nextSibling = object.nextSibling
+		this.setObjectRelative(previousSibling, relativeSibling, this.getObjectSibling(obj)) // object.previousSibling.nextSibling = object.nextSibling
 	}
-	this.memory[address+5] = 0 // object.nextSibling = null
-	this.memory[address+4] = 0 // object.parentNode = null
+	this.setObjectRelative(obj, relativeSibling, 0) // object.nextSibling = null
+	this.setObjectRelative(obj, relativeParent, 0)  // object.parentNode = null
 }
 
-func (this *ZMachine) insertObject(obj, dest byte) {
-	objAddress := this.getObjectAddress(obj)
-	destAddress := this.getObjectAddress(dest)
-
+func (this *ZMachine) insertObject(obj, dest uint16) {
 	// Pull the object out of its old location.
 	this.removeObject(obj)
 
-	this.memory[objAddress+5] = this.memory[destAddress+6] // object.nextSibling = dest.firstChild
-	this.memory[objAddress+4] = dest                       // object.parentNode = dest
-	this.memory[destAddress+6] = obj                       // dest.firstChild = object
+	this.setObjectRelative(obj, relativeSibling, this.getObjectChild(dest)) // object.nextSibling = dest.firstChild
+	this.setObjectRelative(obj, relativeParent, dest)                       // object.parentNode = dest
+	this.setObjectRelative(dest, relativeChild, obj)                        // dest.firstChild = object
+}
+
+// An object as the story's object table describes it. Object numbers of
+// relatives are 0 where there are none.
+type Object struct {
+	Number     int        `json:"number"`
+	Name       string     `json:"name"`
+	Parent     int        `json:"parent"`
+	Sibling    int        `json:"sibling"`
+	Child      int        `json:"child"`
+	Children   []int      `json:"children"` // The child and each of its siblings, in order
+	Attributes []int      `json:"attributes"`
+	Properties []Property `json:"properties"` // In the table's order, highest numbered first
+	Address    int        `json:"propertyTable"`
+}
+
+// One of an object's properties, with a copy of its data.
+type Property struct {
+	Number  int    `json:"number"`
+	Address int    `json:"address"` // Of the data, as get_prop_addr gives it
+	Data    []byte `json:"-"`
+}
+
+func (this Property) MarshalJSON() ([]byte, error) {
+	data := make([]int, len(this.Data))
+	for i, b := range this.Data {
+		data[i] = int(b)
+	}
+	return json.Marshal(struct {
+		Number  int   `json:"number"`
+		Address int   `json:"address"`
+		Data    []int `json:"data"`
+	}{this.Number, this.Address, data})
+}
+
+// Returns the value of a property of one or two bytes, as get_prop gives it.
+func (this Property) Value() uint16 {
+	if len(this.Data) == 1 {
+		return uint16(this.Data[0])
+	}
+	return uint16(this.Data[0])<<8 | uint16(this.Data[1])
+}
+
+// Returns how many objects the story has, as objectPropertyTables finds them.
+func (this *ZMachine) ObjectCount() int {
+	return len(objectPropertyTables(this.memory))
+}
+
+// Reads object n, numbered from 1, as it stands in the machine's memory.
+func (this *ZMachine) Object(n int) (*Object, error) {
+	return this.object(n, this.ObjectCount())
+}
+
+// Reads object n of count, so that callers reading every object only count
+// them once.
+func (this *ZMachine) object(n, count int) (object *Object, err error) {
+	if n < 1 || n > count {
+		return nil, fmt.Errorf("No object %d", n)
+	}
+	// A story with a broken object table is exactly when this gets used.
+	defer func() {
+		if r := recover(); r != nil {
+			object, err = nil, fmt.Errorf("Object %d is unreadable: %v", n, r)
+		}
+	}()
+	memory := this.memory
+	object = &Object{Number: n}
+	parent, sibling, child := this.objectRelatives(n)
+	object.Parent, object.Sibling, object.Child = parent, sibling, child
+
+	entry, attributes := this.objectEntry(n), 32
+	if this.version >= 4 {
+		attributes = 48
+	}
+	for attribute := 0; attribute < attributes; attribute++ {
+		if memory[entry+attribute/8]&(0x80>>uint(attribute%8)) != 0 {
+			object.Attributes = append(object.Attributes, attribute)
+		}
+	}
+
+	// Sibling chains can loop in a damaged table, but never need to be longer
+	// than the number of objects.
+	for child != 0 && len(object.Children) < count {
+		object.Children = append(object.Children, child)
+		_, child, _ = this.objectRelatives(child)
+	}
+
+	table := int(this.number(entry + this.objectEntryLength() - 2))
+	object.Address = table
+	if memory[table] != 0 {
+		if object.Name, err = decodeText(memory, table+1, this.version); err != nil {
+			return nil, err
+		}
+	}
+	for p := table + 1 + 2*int(memory[table]); memory[p] != 0; {
+		size, header := propertySize(memory, p)
+		number := int(memory[p] & 0x1F)
+		if this.version >= 4 {
+			number = int(memory[p] & 0x3F)
+		}
+		data := make([]byte, size)
+		copy(data, memory[p+header:p+header+size])
+		object.Properties = append(object.Properties, Property{number, p + header, data})
+		p += header + size
+	}
+	return object, nil
+}
+
+// Returns the objects which have no parent, from which the rest of the tree
+// descends.
+func (this *ZMachine) RootObjects() []int {
+	var roots []int
+	for n, count := 1, this.ObjectCount(); n <= count; n++ {
+		if parent, _, _ := this.objectRelatives(n); parent == 0 {
+			roots = append(roots, n)
+		}
+	}
+	return roots
+}
+
+// Reads every object of a story which isn't running.
+func StoryObjects(story []byte) ([]*Object, error) {
+	machine, err := storyMachine(story)
+	if err != nil {
+		return nil, err
+	}
+	var objects []*Object
+	for n, count := 1, machine.ObjectCount(); n <= count; n++ {
+		object, err := machine.object(n, count)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func (this *ZMachine) objectEntryLength() int {
+	if this.version >= 4 {
+		return 14
+	}
+	return 9
+}
+
+// The address of object n's entry, in any version.
+func (this *ZMachine) objectEntry(n int) int {
+	defaults := 31
+	if this.version >= 4 {
+		defaults = 63
+	}
+	return int(this.objectTableStart) + 2*defaults + (n-1)*this.objectEntryLength()
+}
+
+func (this *ZMachine) objectRelatives(n int) (parent, sibling, child int) {
+	entry := this.objectEntry(n)
+	if this.version >= 4 {
+		return int(this.number(entry + 6)), int(this.number(entry + 8)), int(this.number(entry + 10))
+	}
+	return int(this.memory[entry+4]), int(this.memory[entry+5]), int(this.memory[entry+6])
+}
+
+// Returns the size of the property data following the size byte at p, and
+// how many bytes the sizes take.
+func propertySize(story []byte, p int) (size, header int) {
+	if story[0] <= 3 {
+		return int(story[p])/32 + 1, 1
+	}
+	switch {
+	case story[p]&0x80 != 0:
+		if size = int(story[p+1] & 0x3F); size == 0 {
+			size = 64
+		}
+		return size, 2
+	case story[p]&0x40 != 0:
+		return 2, 1
+	default:
+		return 1, 1
+	}
 }
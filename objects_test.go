@@ -0,0 +1,97 @@
+package zmachine
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Writes a room holding two items into a story from testStory.
+func addTestRoom(story []byte) {
+	addTestObjects(story,
+		testObject{name: "room", child: 2, attributes: []int{0, 31}, properties: []testProperty{{7, []byte{0, 5}}, {3, []byte{9}}}},
+		testObject{name: "lamp", parent: 1, sibling: 3},
+		testObject{name: "key", parent: 1},
+	)
+}
+
+func TestStoryObjects(t *testing.T) {
+	story := testStory(3)
+	addTestRoom(story)
+	objects, err := StoryObjects(story)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 3 {
+		t.Fatalf("%d objects", len(objects))
+	}
+
+	room := objects[0]
+	if room.Number != 1 || room.Name != "room" || room.Child != 2 || !reflect.DeepEqual(room.Children, []int{2, 3}) || !reflect.DeepEqual(room.Attributes, []int{0, 31}) {
+		t.Errorf("room %+v", room)
+	}
+	want := []Property{{7, room.Address + 6, []byte{0, 5}}, {3, room.Address + 9, []byte{9}}}
+	if !reflect.DeepEqual(room.Properties, want) || room.Properties[0].Value() != 5 || room.Properties[1].Value() != 9 {
+		t.Errorf("room's properties %+v, want %+v", room.Properties, want)
+	}
+	if lamp := objects[1]; lamp.Name != "lamp" || lamp.Parent != 1 || lamp.Sibling != 3 || lamp.Children != nil || lamp.Properties != nil {
+		t.Errorf("lamp %+v", lamp)
+	}
+
+	data, err := json.Marshal(room.Properties[0])
+	if want := fmt.Sprintf(`{"number":7,"address":%d,"data":[0,5]}`, room.Address+6); err != nil || string(data) != want {
+		t.Errorf("property as JSON %s, want %s", data, want)
+	}
+}
+
+func TestObjectsInVersion5(t *testing.T) {
+	story := testStory(5)
+	addTestObjects(story,
+		testObject{name: "box", attributes: []int{47}, properties: []testProperty{{40, []byte{1, 2, 3}}, {2, []byte{4}}}},
+		testObject{name: "ball", parent: 1},
+	)
+	machine := testMachine(t, story)
+	machine.insertObject(2, 1)
+	if count := machine.ObjectCount(); count != 2 {
+		t.Fatalf("%d objects", count)
+	}
+	box, err := machine.Object(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(box.Attributes, []int{47}) || !reflect.DeepEqual(box.Children, []int{2}) || len(box.Properties) != 2 {
+		t.Fatalf("box %+v", box)
+	}
+	if long := box.Properties[0]; long.Number != 40 || !reflect.DeepEqual(long.Data, []byte{1, 2, 3}) || long.Address != box.Address+5 {
+		t.Errorf("property %+v", long)
+	}
+	if short := box.Properties[1]; short.Number != 2 || short.Value() != 4 {
+		t.Errorf("property %+v", short)
+	}
+	if roots := machine.RootObjects(); !reflect.DeepEqual(roots, []int{1}) {
+		t.Errorf("roots %v", roots)
+	}
+	for _, n := range []int{0, 3} {
+		if _, err := machine.Object(n); err == nil {
+			t.Errorf("read object %d", n)
+		}
+	}
+}
+
+func TestObjectSiblingLoop(t *testing.T) {
+	story := testStory(3)
+	addTestObjects(story,
+		testObject{name: "room", child: 2},
+		testObject{name: "lamp", parent: 1, sibling: 3},
+		testObject{name: "key", parent: 1, sibling: 2},
+	)
+	machine := testMachine(t, story)
+	room, err := machine.Object(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(room.Children, []int{2, 3, 2}) {
+		t.Errorf("children %v", room.Children)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 var imp0op = []func(*ZMachine){
@@ -23,7 +24,7 @@ var imp0op = []func(*ZMachine){
 		zchars := this.zString(this.pc+1, false)
 		this.pc += (zchars.Size() / 3) * 2
 		zscii := zchars.ZSCIIString()
-		this.output <- zscii.String()
+		this.print(zscii.String())
 	},
 
 	// print_ret
@@ -32,8 +33,8 @@ var imp0op = []func(*ZMachine){
 		zchars := this.zString(this.pc+1, false)
 		this.pc += (zchars.Size() / 3) * 2
 		zscii := zchars.ZSCIIString()
-		this.output <- zscii.String()
-		this.output <- "\n"
+		this.print(zscii.String())
+		this.print("\n")
 		this.returnFromRoutine(1)
 	},
 
@@ -44,34 +45,36 @@ var imp0op = []func(*ZMachine){
 
 	// save
 	func(this *ZMachine) {
-		this.output <- "Please enter a filename to save: "
-		filename := <-this.input
-		if err := SaveQuetzalFile(filename, this, true); err != nil {
-			this.output <- err.Error()
-			this.output <- "\n"
-			this.branch(false)
+		saved := this.saveGame()
+		if this.version >= 4 {
+			this.store(boolValue(saved))
 		} else {
-			this.branch(true)
+			this.branch(saved)
 		}
 	},
 
 	// restore
 	func(this *ZMachine) {
-		this.output <- "Please enter a filename to load: "
-		filename := <-this.input
-		if err := LoadQuetzalFile(filename, this); err != nil {
-			this.output <- err.Error()
-			this.output <- "\n"
-			this.branch(false)
+		restored := this.restoreGame()
+		if this.version >= 4 {
+			// The result is stored by the save instruction the game is back at.
+			this.store(2 * boolValue(restored))
 		} else {
-			this.branch(true)
+			this.branch(restored)
 		}
 	},
 
 	// restart
 	func(this *ZMachine) {
-		this.Run()
+		// Calling Run here would make the opcode tables part of their own initialisation.
+		if err := this.LoadStory(); err != nil {
+			panic(err)
+		}
+		this.CompleteSetup()
 		this.pc--
+		if this.journal != nil {
+			this.journal.record(journalEvent{kind: journalRestart})
+		}
 	},
 
 	// ret_popped
@@ -79,21 +82,29 @@ var imp0op = []func(*ZMachine){
 		this.returnFromRoutine(this.stack.Pop())
 	},
 
-	// pop
+	// pop, or from version 5, catch
 	func(this *ZMachine) {
+		if this.version >= 5 {
+			this.store(uint16(this.callStack.Size()))
+			return
+		}
 		this.stack.Pop()
 	},
 
 	// quit
 	func(this *ZMachine) {
 		this.running = false
+		// A recording can be rewound to before the quit, and carry on printing.
+		if this.journal != nil {
+			return
+		}
 		close(this.output)
 		close(this.errors)
 	},
 
 	// new_line
 	func(this *ZMachine) {
-		this.output <- "\n"
+		this.print("\n")
 	},
 
 	// set_status
@@ -103,8 +114,15 @@ var imp0op = []func(*ZMachine){
 
 	// verify
 	func(this *ZMachine) {
-		// This is supposed to check for corruption.
-		// Unimplemented.
+		// The checksum is of the story as it was loaded, before the game changed it.
+		this.branch(this.checksum == this.number(0x1C))
+	},
+
+	// The first byte of extended opcodes
+	nil,
+
+	// piracy
+	func(this *ZMachine) {
 		this.branch(true)
 	},
 }
@@ -117,22 +135,21 @@ var imp1op = []func(*ZMachine, uint16){
 
 	// get_sibling
 	func(this *ZMachine, obj uint16) {
-		sibling := uint16(this.getObjectSibling(byte(obj)))
+		sibling := this.getObjectSibling(obj)
 		this.store(sibling)
 		this.branch(sibling != 0)
 	},
 
 	// get_child
 	func(this *ZMachine, obj uint16) {
-		child := uint16(this.getObjectChild(byte(obj)))
+		child := this.getObjectChild(obj)
 		this.store(child)
 		this.branch(child != 0)
 	},
 
 	// get_parent
 	func(this *ZMachine, obj uint16) {
-		parent := uint16(this.getObjectParent(byte(obj)))
-		this.store(parent)
+		this.store(this.getObjectParent(obj))
 	},
 
 	// get_prop_len
@@ -140,7 +157,7 @@ var imp1op = []func(*ZMachine, uint16){
 		if address == 0 {
 			this.store(0)
 		} else {
-			this.store(uint16(this.memory[address-1]/32 + 1))
+			this.store(uint16(this.getPropertyLength(int(address))))
 		}
 	},
 
@@ -164,23 +181,24 @@ var imp1op = []func(*ZMachine, uint16){
 	func(this *ZMachine, address uint16) {
 		zchars := this.zString(int(address), false)
 		zscii := zchars.ZSCIIString()
-		this.output <- zscii.String()
+		this.print(zscii.String())
 	},
 
-	// Nothing
-	nil,
+	// call_1s
+	func(this *ZMachine, routine uint16) {
+		this.callStoring([]uint16{routine})
+	},
 
 	// remove_obj
 	func(this *ZMachine, obj uint16) {
-		this.removeObject(byte(obj))
+		this.removeObject(obj)
 	},
 
 	// print_obj
-	func(this *ZMachine, objw uint16) {
-		obj := byte(objw)
+	func(this *ZMachine, obj uint16) {
 		zstring := this.getObjectName(obj)
 		zscii := zstring.ZSCIIString()
-		this.output <- zscii.String()
+		this.print(zscii.String())
 	},
 
 	// ret
@@ -196,10 +214,10 @@ var imp1op = []func(*ZMachine, uint16){
 
 	// print_paddr
 	func(this *ZMachine, paddr uint16) {
-		address := this.unpackAddress(paddr)
+		address := this.unpackStringAddress(paddr)
 		zchars := this.zString(address, false)
 		zscii := zchars.ZSCIIString()
-		this.output <- zscii.String()
+		this.print(zscii.String())
 	},
 
 	// load
@@ -207,8 +225,12 @@ var imp1op = []func(*ZMachine, uint16){
 		this.store(this.getVariable(byte(varw)))
 	},
 
-	// not
+	// not, or from version 5, call_1n
 	func(this *ZMachine, value uint16) {
+		if this.version >= 5 {
+			this.callDiscarding([]uint16{value})
+			return
+		}
 		this.store(^value)
 	},
 }
@@ -256,7 +278,7 @@ var imp2op = []func(*ZMachine, uint16, uint16){
 
 	// jin
 	func(this *ZMachine, a, b uint16) {
-		this.branch(this.getObjectParent(byte(a)) == byte(b))
+		this.branch(this.getObjectParent(a) == b)
 	},
 
 	// test
@@ -276,17 +298,17 @@ var imp2op = []func(*ZMachine, uint16, uint16){
 
 	// test_attr
 	func(this *ZMachine, obj, attr uint16) {
-		this.branch(this.getObjectAttribute(byte(obj), byte(attr)))
+		this.branch(this.getObjectAttribute(obj, attr))
 	},
 
 	// set_attr
 	func(this *ZMachine, obj, attr uint16) {
-		this.setObjectAttribute(byte(obj), byte(attr), true)
+		this.setObjectAttribute(obj, attr, true)
 	},
 
 	// clear_attr
 	func(this *ZMachine, obj, attr uint16) {
-		this.setObjectAttribute(byte(obj), byte(attr), false)
+		this.setObjectAttribute(obj, attr, false)
 	},
 
 	// store
@@ -296,7 +318,7 @@ var imp2op = []func(*ZMachine, uint16, uint16){
 
 	// insert_obj
 	func(this *ZMachine, obj, dest uint16) {
-		this.insertObject(byte(obj), byte(dest))
+		this.insertObject(obj, dest)
 	},
 
 	// loadw
@@ -311,11 +333,11 @@ var imp2op = []func(*ZMachine, uint16, uint16){
 
 	// get_prop
 	func(this *ZMachine, obj, prop uint16) {
-		address := this.getObjectPropertyAddress(byte(obj), byte(prop))
+		address := this.getObjectPropertyAddress(obj, byte(prop))
 		if address == 0 {
 			this.store(this.number(this.getDefaultPropertyAddress(byte(prop))))
 		} else {
-			size := this.getObjectPropertySize(byte(obj), byte(prop))
+			size := this.getPropertyLength(address)
 			if size == 1 {
 				this.store(uint16(this.memory[address]))
 			} else {
@@ -326,12 +348,11 @@ var imp2op = []func(*ZMachine, uint16, uint16){
 
 	// get_prop_addr
 	func(this *ZMachine, obj, prop uint16) {
-		this.store(uint16(this.getObjectPropertyAddress(byte(obj), byte(prop))))
+		this.store(uint16(this.getObjectPropertyAddress(obj, byte(prop))))
 	},
 
 	// get_next_prop
-	func(this *ZMachine, objw, propw uint16) {
-		obj := byte(objw)
+	func(this *ZMachine, obj, propw uint16) {
 		prop := byte(propw)
 		var address int
 		if prop == 0 {
@@ -339,17 +360,13 @@ var imp2op = []func(*ZMachine, uint16, uint16){
 			address += int(this.memory[address])*2 + 1
 		} else {
 			address = this.getObjectPropertyAddress(obj, prop)
-			address += int(this.memory[address-1])/32 + 1
-		}
-		nextSizeByte := this.memory[address]
-		if address == 0 {
-			panic("get_next_prop on nonexistent object property!")
-		}
-		if nextSizeByte == 0 {
-			this.store(0)
-		} else {
-			this.store(uint16(nextSizeByte % 32))
+			if address == 0 {
+				panic("get_next_prop on nonexistent object property!")
+			}
+			address += this.getPropertyLength(address)
 		}
+		// The table ends with a size byte of 0, which is property 0.
+		this.store(uint16(this.propertyNumber(address)))
 	},
 
 	// add
@@ -383,6 +400,30 @@ var imp2op = []func(*ZMachine, uint16, uint16){
 		}
 		this.store(uint16(int16(a) % int16(b)))
 	},
+
+	// call_2s
+	func(this *ZMachine, routine, arg uint16) {
+		this.callStoring([]uint16{routine, arg})
+	},
+
+	// call_2n
+	func(this *ZMachine, routine, arg uint16) {
+		this.callDiscarding([]uint16{routine, arg})
+	},
+
+	// set_colour
+	func(this *ZMachine, foreground, background uint16) {
+		this.setColour(foreground, background)
+	},
+
+	// throw
+	func(this *ZMachine, value, frame uint16) {
+		// Return from the routine which caught the frame, abandoning those it called.
+		for this.callStack.Size() > uint(frame) {
+			this.leaveRoutine()
+		}
+		this.returnFromRoutine(value)
+	},
 }
 
 var imp3op = map[byte]func(*ZMachine, uint16, uint16, uint16){
@@ -399,134 +440,387 @@ var imp4op = map[byte]func(*ZMachine, uint16, uint16, uint16, uint16){
 	},
 }
 
-var impvop = []func(*ZMachine, ...uint16){
-	// call
-	func(this *ZMachine, args ...uint16) {
-		routine := this.unpackAddress(args[0])
-		// Method 0 does nothing and returns 0.
-		if routine == 0 {
-			this.store(0)
-			return
-		}
-
-		varcount := this.memory[routine]
-		if varcount > 15 {
-			panic("Calling address without a routine")
-		}
+var impvop []func(*ZMachine, ...uint16)
+
+// read can run interrupt routines, which takes it back through executeCycle to
+// this table, so it can't be built by the variable's initialiser.
+func init() {
+	impvop = []func(*ZMachine, ...uint16){
+		// call
+		func(this *ZMachine, args ...uint16) {
+			this.callStoring(args)
+		},
+
+		// storew
+		func(this *ZMachine, args ...uint16) {
+			arr, index, value := int(args[0]), int(args[1]), uint16(args[2])
+			this.setNumber(arr+2*index, value)
+		},
+
+		// storeb
+		func(this *ZMachine, args ...uint16) {
+			arr, index, value := args[0], args[1], byte(args[2])
+			this.memory[arr+index] = value
+		},
+
+		// put_prop
+		func(this *ZMachine, args ...uint16) {
+			obj, prop, value := args[0], byte(args[1]), args[2]
+			address := this.getObjectPropertyAddress(obj, prop)
+			size := this.getObjectPropertySize(obj, prop)
+			if size == 1 {
+				this.memory[address] = byte(value)
+			} else if size == 2 {
+				this.setNumber(address, value)
+			} else {
+				panic("Illegal put_prop on property of size greater than two")
+			}
+		},
+
+		// read
+		func(this *ZMachine, args ...uint16) {
+			text, parse := int(args[0]), int(args[1])
+			var tenths, routine uint16
+			if len(args) > 3 && this.version >= 4 {
+				tenths, routine = args[2], args[3]
+			}
+			input, terminator, ok := this.readLine(tenths, routine)
+			if !ok {
+				// The interrupt routine abandoned input, or input ended,
+				// leaving nothing typed.
+				this.memory[text+1] = 0
+				if parse != 0 {
+					this.memory[parse+1] = 0
+				}
+				if this.version >= 5 {
+					this.store(0)
+				}
+				return
+			}
 
-		// Store information so we can get back here.
-		this.pc++
-		this.callStack.Push(uint16(((0x7F >> uint(len(args)-1)) << 8) | varcount)) // Only used for creating save files
-		this.callStack.Push(uint16(this.memory[this.pc]))                          // The variable in which to store the return value
-		this.callStack.Push(uint16(this.pc >> 16))                                 // The location to return to (minus one, actually)...
-		this.callStack.Push(uint16(this.pc & 0xFFFF))                              // ...split over two words
-		this.callStack.Push(uint16(this.stack.Size()))                             // Where to truncate the call stack on returning
-
-		// Push the arguments to the routine we're calling onto the stack.
-		// Any arguments not provided are filled with the destination's declared defaults.
-		for i := byte(0); i < varcount; i++ {
-			if i < byte(len(args)-1) {
-				this.stack.Push(args[i+1])
+			read := strings.ToLower(input)
+			if this.corrector != nil {
+				read = this.correctInput(read)
+			}
+			typed := zsciiFromString(read, this.characterTable())
+			var zscii ZSCIIString
+			if this.version >= 5 {
+				// The length comes first, and there's no terminating null.
+				if maxlength := int(this.memory[text]); len(typed) > maxlength {
+					typed = typed[0:maxlength]
+				}
+				zscii = ZSCIIString{typed, this}
+				this.memory[text+1] = byte(zscii.Size())
+				copy(this.memory[text+2:], zscii.Bytes())
 			} else {
-				this.stack.Push(this.number(int(routine) + 2*int(i) + 1))
+				maxlength := int(this.memory[text]) + 1
+				if len(typed) > maxlength {
+					typed = typed[0:maxlength]
+				}
+				zscii = ZSCIIString{typed, this}
+				copy(this.memory[text+1:text+maxlength+1], zscii.Bytes())
+				this.memory[text+zscii.Size()+1] = 0 // Terminate string with null
 			}
-		}
+			if parse != 0 {
+				this.tokeniseZSCII(parse, zscii, int(this.dictionaryStart), false)
+			}
+			if this.version >= 5 {
+				this.store(uint16(terminator))
+			}
+		},
+
+		// print_char
+		func(this *ZMachine, args ...uint16) {
+			zscii := ZSCIIString{[]byte{byte(args[0])}, this}
+			this.print(zscii.String())
+		},
+
+		// print_num
+		func(this *ZMachine, args ...uint16) {
+			this.print(fmt.Sprintf("%d", args[0]))
+		},
+
+		// random
+		func(this *ZMachine, args ...uint16) {
+			r := int16(args[0])
+			if r == 0 {
+				rand.Seed(time.Now().Unix())
+			} else if r < 0 {
+				rand.Seed(int64(r * -1))
+			} else {
+				this.store(this.random(r))
+			}
+		},
+
+		// push
+		func(this *ZMachine, args ...uint16) {
+			this.stack.Push(args[0])
+		},
+
+		// pull
+		func(this *ZMachine, args ...uint16) {
+			variable := byte(args[0])
+			this.setVariable(variable, this.stack.Pop())
+		},
+
+		// split_window
+		func(this *ZMachine, args ...uint16) {
+			// Front ends are given the upper window's text but not its size.
+		},
+
+		// set_window
+		func(this *ZMachine, args ...uint16) {
+			this.setWindow(args[0])
+		},
+
+		// call_vs2
+		func(this *ZMachine, args ...uint16) {
+			this.callStoring(args)
+		},
+
+		// erase_window
+		func(this *ZMachine, args ...uint16) {
+			// Unimplemented.
+		},
+
+		// erase_line
+		func(this *ZMachine, args ...uint16) {
+			// Unimplemented.
+		},
+
+		// set_cursor
+		func(this *ZMachine, args ...uint16) {
+			// Unimplemented.
+		},
+
+		// get_cursor
+		func(this *ZMachine, args ...uint16) {
+			// The cursor is always taken to be at the top left.
+			this.setNumber(int(args[0]), 1)
+			this.setNumber(int(args[0])+2, 1)
+		},
+
+		// set_text_style
+		func(this *ZMachine, args ...uint16) {
+			this.setTextStyle(args[0])
+		},
+
+		// buffer_mode
+		func(this *ZMachine, args ...uint16) {
+			// Output is never buffered here, so there's nothing to turn off.
+		},
+
+		// output_stream
+		func(this *ZMachine, args ...uint16) {
+			var table uint16
+			if len(args) > 1 {
+				table = args[1]
+			}
+			this.outputStream(int16(args[0]), table)
+		},
+
+		// input_stream
+		func(this *ZMachine, args ...uint16) {
+			// Input only ever comes from the input channel.
+		},
+
+		// sound_effect
+		func(this *ZMachine, args ...uint16) {
+			this.soundEffect(args)
+		},
+
+		// read_char
+		func(this *ZMachine, args ...uint16) {
+			var tenths, routine uint16
+			if len(args) > 2 {
+				tenths, routine = args[1], args[2]
+			}
+			this.store(uint16(this.readChar(tenths, routine)))
+		},
+
+		// scan_table
+		func(this *ZMachine, args ...uint16) {
+			// Words of two bytes by default, or fields whose size is in the low bits.
+			form := uint16(0x82)
+			if len(args) > 3 {
+				form = args[3]
+			}
+			for i := 0; i < int(args[2]); i++ {
+				address := int(args[1]) + i*int(form&0x7F)
+				value := uint16(this.memory[address])
+				if form&0x80 != 0 {
+					value = this.number(address)
+				}
+				if value == args[0] {
+					this.store(uint16(address))
+					this.branch(true)
+					return
+				}
+			}
+			this.store(0)
+			this.branch(false)
+		},
+
+		// not
+		func(this *ZMachine, args ...uint16) {
+			this.store(^args[0])
+		},
+
+		// call_vn
+		func(this *ZMachine, args ...uint16) {
+			this.callDiscarding(args)
+		},
+
+		// call_vn2
+		func(this *ZMachine, args ...uint16) {
+			this.callDiscarding(args)
+		},
+
+		// tokenise
+		func(this *ZMachine, args ...uint16) {
+			text, parse := int(args[0]), int(args[1])
+			dictionary, skipUnknown := int(this.dictionaryStart), false
+			if len(args) > 2 && args[2] != 0 {
+				dictionary = int(args[2])
+			}
+			if len(args) > 3 {
+				skipUnknown = args[3] != 0
+			}
+			// The text is as read leaves it from version 5, after its length.
+			zscii := ZSCIIString{this.memory[text+2 : text+2+int(this.memory[text+1])], this}
+			this.tokeniseZSCII(parse, zscii, dictionary, skipUnknown)
+		},
+
+		// encode_text
+		func(this *ZMachine, args ...uint16) {
+			text, length, from, coded := int(args[0]), int(args[1]), int(args[2]), int(args[3])
+			zscii := this.memory[text+from : text+from+length]
+			size := this.dictionaryKeyLength()
+			copy(this.memory[coded:coded+size], encodeZSCII(zscii, this.version, this.alphabetTable(), size))
+		},
+
+		// copy_table
+		func(this *ZMachine, args ...uint16) {
+			first, second, size := int(args[0]), int(args[1]), int(int16(args[2]))
+			switch {
+			case second == 0:
+				if size < 0 {
+					size = -size
+				}
+				for i := 0; i < size; i++ {
+					this.memory[first+i] = 0
+				}
+			case size < 0:
+				// A negative size asks for a copy forwards, even if the tables overlap.
+				for i := 0; i < -size; i++ {
+					this.memory[second+i] = this.memory[first+i]
+				}
+			default:
+				copy(this.memory[second:second+size], this.memory[first:first+size])
+			}
+		},
 
-		// Jump to the target routine (which starts varcount words after the given address)
-		this.pc = routine + int(varcount)*2
-	},
+		// print_table
+		func(this *ZMachine, args ...uint16) {
+			text, width, height, skip := int(args[0]), int(args[1]), 1, 0
+			if len(args) > 2 {
+				height = int(args[2])
+			}
+			if len(args) > 3 {
+				skip = int(args[3])
+			}
+			for row := 0; row < height; row++ {
+				if row > 0 {
+					this.print("\n")
+				}
+				start := text + row*(width+skip)
+				zscii := ZSCIIString{this.memory[start : start+width], this}
+				this.print(zscii.String())
+			}
+		},
 
-	// storew
-	func(this *ZMachine, args ...uint16) {
-		arr, index, value := int(args[0]), int(args[1]), uint16(args[2])
-		this.setNumber(arr+2*index, value)
-	},
+		// check_arg_count
+		func(this *ZMachine, args ...uint16) {
+			this.branch(int(args[0]) <= this.argumentCount())
+		},
+	}
+}
 
-	// storeb
-	func(this *ZMachine, args ...uint16) {
-		arr, index, value := args[0], args[1], byte(args[2])
-		this.memory[arr+index] = value
+var impextop = map[byte]func(*ZMachine, ...uint16){
+	// save
+	0: func(this *ZMachine, args ...uint16) {
+		// Saving and restoring parts of memory, with a table, isn't supported.
+		if len(args) > 0 {
+			this.store(0)
+			return
+		}
+		this.store(boolValue(this.saveGame()))
 	},
 
-	// put_prop
-	func(this *ZMachine, args ...uint16) {
-		obj, prop, value := byte(args[0]), byte(args[1]), args[2]
-		address := this.getObjectPropertyAddress(obj, prop)
-		size := this.getObjectPropertySize(obj, prop)
-		if size == 1 {
-			this.memory[address] = byte(value)
-		} else if size == 2 {
-			this.setNumber(address, value)
-		} else {
-			panic("Illegal put_prop on property of size greater than two")
+	// restore
+	1: func(this *ZMachine, args ...uint16) {
+		if len(args) > 0 {
+			this.store(0)
+			return
 		}
+		this.store(2 * boolValue(this.restoreGame()))
 	},
 
-	// read
-	func(this *ZMachine, args ...uint16) {
-		text, parse := int(args[0]), int(args[1])
-		input, ok := <-this.input
-		if !ok {
-			panic("Input channel not okay!")
+	// log_shift
+	2: func(this *ZMachine, args ...uint16) {
+		if places := int16(args[1]); places >= 0 {
+			this.store(args[0] << uint(places))
+		} else {
+			this.store(args[0] >> uint(-places))
 		}
+	},
 
-		maxlength := int(this.memory[text]) + 1
-		var read string
-		if len(input) > maxlength {
-			read = input[0:maxlength]
+	// art_shift
+	3: func(this *ZMachine, args ...uint16) {
+		if places := int16(args[1]); places >= 0 {
+			this.store(args[0] << uint(places))
 		} else {
-			read = input
+			this.store(uint16(int16(args[0]) >> uint(-places)))
 		}
-		read = strings.ToLower(read)
-		zscii := ZSCIIString{[]byte(read), this}
-		copy(this.memory[text+1:text+maxlength+1], zscii.Bytes())
-		this.memory[text+zscii.Size()+1] = 0 // Terminate string with null
-		this.tokeniseZSCII(parse, zscii)
 	},
 
-	// print_char
-	func(this *ZMachine, args ...uint16) {
-		zscii := ZSCIIString{[]byte{byte(args[0])}, this}
-		this.output <- zscii.String()
+	// set_font
+	4: func(this *ZMachine, args ...uint16) {
+		this.store(this.setFont(args[0]))
 	},
 
-	// print_num
-	func(this *ZMachine, args ...uint16) {
-		this.output <- fmt.Sprintf("%d", args[0])
+	// save_undo
+	9: func(this *ZMachine, args ...uint16) {
+		// -1 tells the game that undo isn't available.
+		this.store(0xFFFF)
 	},
 
-	// random
-	func(this *ZMachine, args ...uint16) {
-		r := int16(args[0])
-		if r == 0 {
-			rand.Seed(time.Now().Unix())
-		} else if r < 0 {
-			rand.Seed(int64(r * -1))
-		} else {
-			this.store(uint16(rand.Int31n(int32(r + 1))))
-		}
+	// restore_undo
+	10: func(this *ZMachine, args ...uint16) {
+		this.store(0)
 	},
 
-	// push
-	func(this *ZMachine, args ...uint16) {
-		this.stack.Push(args[0])
+	// print_unicode
+	11: func(this *ZMachine, args ...uint16) {
+		this.print(string(rune(args[0])))
 	},
 
-	// pull
-	func(this *ZMachine, args ...uint16) {
-		variable := byte(args[0])
-		this.setVariable(variable, this.stack.Pop())
+	// check_unicode
+	12: func(this *ZMachine, args ...uint16) {
+		// Output is Unicode, so anything can be printed, but only characters
+		// with ZSCII codes can be typed.
+		result := uint16(0)
+		if r := rune(args[0]); utf8.ValidRune(r) {
+			result = 1
+			if _, ok := zsciiFromRune(r, this.characterTable()); ok {
+				result |= 2
+			}
+		}
+		this.store(result)
 	},
 
-	// split_window
-	nil,
-
-	// set_window
-	nil,
-
-	// output_stream
-	nil,
-
-	// input_stream
-	nil,
+	// set_true_colour
+	13: func(this *ZMachine, args ...uint16) {
+		this.setTrueColour(args[0], args[1])
+	},
 }
@@ -0,0 +1,399 @@
+package zmachine
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Attributes the instructions executed, and the time taken, to the routines
+// which executed them. Costs are kept for each path through the call graph,
+// so that they can be exported to pprof with their full call stacks. Time
+// spent waiting for the player isn't counted.
+type Profiler struct {
+	root    *profileNode
+	current *profileNode
+	depth   int // The number of routines on the path to current
+
+	started time.Time
+	clock   time.Time // When time was last attributed
+	paused  bool
+}
+
+// A routine reached by one particular path of calls.
+type profileNode struct {
+	routine      int
+	parent       *profileNode
+	children     map[int]*profileNode
+	calls        int
+	instructions int64
+	time         time.Duration
+}
+
+func NewProfiler() *Profiler {
+	now := time.Now()
+	root := &profileNode{children: make(map[int]*profileNode)}
+	return &Profiler{root: root, current: root, started: now, clock: now}
+}
+
+// Sets the profiler to report to. Pass nil to stop profiling.
+func (this *ZMachine) SetProfiler(profiler *Profiler) {
+	this.profiler = profiler
+}
+
+func (this *profileNode) child(routine int) *profileNode {
+	child := this.children[routine]
+	if child == nil {
+		child = &profileNode{routine: routine, parent: this, children: make(map[int]*profileNode)}
+		this.children[routine] = child
+	}
+	return child
+}
+
+// Gives the time since the last tick to the current routine.
+func (this *Profiler) tick() {
+	now := time.Now()
+	if !this.paused {
+		this.current.time += now.Sub(this.clock)
+	}
+	this.clock = now
+}
+
+// Called as a routine is called.
+func (this *Profiler) enter(routine int) {
+	this.tick()
+	this.current = this.current.child(routine)
+	this.current.calls++
+	this.depth++
+}
+
+// Called as a routine returns. The main routine never returns, just as the
+// machine keeps it when a return would leave nothing running.
+func (this *Profiler) leave() {
+	if this.depth <= 1 {
+		return
+	}
+	this.tick()
+	this.current = this.current.parent
+	this.depth--
+}
+
+// Called before each instruction. Restores and restarts replace the call
+// stack without any calls or returns, so the path is checked against the
+// machine's here.
+func (this *Profiler) instruction(machine *ZMachine) {
+	if this.depth != len(machine.routines) || this.current.routine != machine.currentRoutine() {
+		this.tick()
+		this.current, this.depth = this.root, 0
+		for _, routine := range machine.routines {
+			this.current = this.current.child(routine)
+			this.depth++
+		}
+	}
+	this.current.instructions++
+}
+
+// Stops the clock while waiting for input. Safe to call on a nil Profiler.
+func (this *Profiler) pause() {
+	if this != nil && !this.paused {
+		this.tick()
+		this.paused = true
+	}
+}
+
+func (this *Profiler) resume() {
+	if this != nil && this.paused {
+		this.tick()
+		this.paused = false
+	}
+}
+
+// The cost of one routine, over every path by which it was called.
+type RoutineProfile struct {
+	Routine           int
+	Calls             int
+	Instructions      int64 // Executed by the routine itself
+	TotalInstructions int64 // Including those of the routines it called
+	Time              time.Duration
+	TotalTime         time.Duration
+}
+
+// The cost of the instructions executed in the last routine of a call path.
+type HotPath struct {
+	Routines     []int // Outermost first
+	Instructions int64
+	Time         time.Duration
+}
+
+// Returns the total number of instructions profiled.
+func (this *Profiler) Instructions() int64 {
+	total := int64(0)
+	this.walk(func(node *profileNode, _ []int) {
+		total += node.instructions
+	})
+	return total
+}
+
+// Calls f for every node below the root, with the routines on its path.
+func (this *Profiler) walk(f func(node *profileNode, path []int)) {
+	this.tick()
+	var visit func(node *profileNode, path []int)
+	visit = func(node *profileNode, path []int) {
+		for _, child := range node.children {
+			childPath := append(path[:len(path):len(path)], child.routine)
+			f(child, childPath)
+			visit(child, childPath)
+		}
+	}
+	visit(this.root, nil)
+}
+
+func (this *profileNode) total() (int64, time.Duration) {
+	instructions, elapsed := this.instructions, this.time
+	for _, child := range this.children {
+		i, t := child.total()
+		instructions += i
+		elapsed += t
+	}
+	return instructions, elapsed
+}
+
+// Returns the cost of each routine, the most expensive first.
+func (this *Profiler) Routines() []RoutineProfile {
+	profiles := make(map[int]*RoutineProfile)
+	this.walk(func(node *profileNode, path []int) {
+		profile := profiles[node.routine]
+		if profile == nil {
+			profile = &RoutineProfile{Routine: node.routine}
+			profiles[node.routine] = profile
+		}
+		profile.Calls += node.calls
+		profile.Instructions += node.instructions
+		profile.Time += node.time
+		// A recursive call's cost is already in that of the outer call.
+		for _, routine := range path[:len(path)-1] {
+			if routine == node.routine {
+				return
+			}
+		}
+		instructions, elapsed := node.total()
+		profile.TotalInstructions += instructions
+		profile.TotalTime += elapsed
+	})
+
+	routines := make([]RoutineProfile, 0, len(profiles))
+	for _, profile := range profiles {
+		routines = append(routines, *profile)
+	}
+	sort.Slice(routines, func(i, j int) bool {
+		if routines[i].Instructions != routines[j].Instructions {
+			return routines[i].Instructions > routines[j].Instructions
+		}
+		return routines[i].Routine < routines[j].Routine
+	})
+	return routines
+}
+
+// Returns the n call paths whose last routine executed the most instructions.
+func (this *Profiler) HotPaths(n int) []HotPath {
+	var paths []HotPath
+	this.walk(func(node *profileNode, path []int) {
+		if node.instructions > 0 {
+			paths = append(paths, HotPath{path, node.instructions, node.time})
+		}
+	})
+	sort.Slice(paths, func(i, j int) bool {
+		return paths[i].Instructions > paths[j].Instructions
+	})
+	if len(paths) > n {
+		paths = paths[:n]
+	}
+	return paths
+}
+
+// Names a routine from the debugging information, if there is any.
+func profileName(symbols *DebugInfo, routine int) string {
+	if r := symbols.routineStarting(routine); r != nil {
+		return r.Name
+	}
+	return fmt.Sprintf("r%05x", routine)
+}
+
+// Writes a table of the n most expensive routines, then the n hottest paths.
+func (this *Profiler) WriteText(w io.Writer, symbols *DebugInfo, n int) error {
+	total := this.Instructions()
+	if total == 0 {
+		total = 1
+	}
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "self\tself%\ttotal\ttotal%\tcalls\ttime\t routine")
+	for i, routine := range this.Routines() {
+		if i == n {
+			break
+		}
+		fmt.Fprintf(table, "%d\t%.1f%%\t%d\t%.1f%%\t%d\t%s\t %s\n",
+			routine.Instructions, 100*float64(routine.Instructions)/float64(total),
+			routine.TotalInstructions, 100*float64(routine.TotalInstructions)/float64(total),
+			routine.Calls, routine.Time.Round(time.Microsecond), profileName(symbols, routine.Routine))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Hot paths:")
+	for _, path := range this.HotPaths(n) {
+		names := ""
+		for i, routine := range path.Routines {
+			if i > 0 {
+				names += " > "
+			}
+			names += profileName(symbols, routine)
+		}
+		if _, err := fmt.Fprintf(w, "%10d  %5.1f%%  %s\n", path.Instructions, 100*float64(path.Instructions)/float64(total), names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the profile in pprof's format, a gzipped profile.proto, with two
+// sample types: instructions and wall time. Each routine is a function,
+// named from the debugging information if given, and story is named as
+// the binary being profiled.
+func (this *Profiler) WritePprof(w io.Writer, story string, symbols *DebugInfo) error {
+	p := &pprofBuilder{strings: map[string]int{"": 0}, stringTable: []string{""}}
+	instructions := p.valueType("instructions", "count")
+	wall := p.valueType("wall", "nanoseconds")
+
+	var profile protoBuffer
+	profile.message(1, instructions)
+	profile.message(1, wall)
+
+	locations := make(map[int]int)
+	var locationTable, functionTable protoBuffer
+	location := func(routine int) int {
+		if id, ok := locations[routine]; ok {
+			return id
+		}
+		id := len(locations) + 1
+		locations[routine] = id
+		var function protoBuffer
+		function.uint(1, uint64(id))
+		function.uint(2, uint64(p.string(profileName(symbols, routine))))
+		if r := symbols.routineStarting(routine); r != nil && r.Location.File != "" {
+			function.uint(4, uint64(p.string(r.Location.File)))
+			function.uint(5, uint64(r.Location.Line))
+		}
+		functionTable.message(5, function.bytes)
+
+		var line, loc protoBuffer
+		line.uint(1, uint64(id))
+		loc.uint(1, uint64(id))
+		loc.uint(2, 1)
+		loc.uint(3, uint64(routine))
+		loc.message(4, line.bytes)
+		locationTable.message(4, loc.bytes)
+		return id
+	}
+
+	this.walk(func(node *profileNode, path []int) {
+		if node.instructions == 0 && node.time == 0 {
+			return
+		}
+		// Stacks go from the innermost routine outwards.
+		ids := make([]uint64, len(path))
+		for i, routine := range path {
+			ids[len(path)-1-i] = uint64(location(routine))
+		}
+		var sample protoBuffer
+		sample.packed(1, ids)
+		sample.packed(2, []uint64{uint64(node.instructions), uint64(node.time)})
+		profile.message(2, sample.bytes)
+	})
+
+	var mapping protoBuffer
+	mapping.uint(1, 1)
+	mapping.uint(3, 0x80000) // The most any version can address
+	mapping.uint(5, uint64(p.string(story)))
+	mapping.uint(7, 1)
+	profile.message(3, mapping.bytes)
+	profile.bytes = append(profile.bytes, locationTable.bytes...)
+	profile.bytes = append(profile.bytes, functionTable.bytes...)
+	for _, s := range p.stringTable {
+		profile.message(6, []byte(s))
+	}
+	profile.uint(9, uint64(this.started.UnixNano()))
+	profile.uint(10, uint64(time.Since(this.started)))
+	profile.message(11, instructions)
+	profile.uint(12, 1)
+	profile.uint(14, uint64(p.string("instructions")))
+
+	compressed := gzip.NewWriter(w)
+	if _, err := compressed.Write(profile.bytes); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+type pprofBuilder struct {
+	strings     map[string]int
+	stringTable []string
+}
+
+// Returns the index of s in the string table, adding it if needed.
+func (this *pprofBuilder) string(s string) int {
+	if i, ok := this.strings[s]; ok {
+		return i
+	}
+	this.strings[s] = len(this.stringTable)
+	this.stringTable = append(this.stringTable, s)
+	return len(this.stringTable) - 1
+}
+
+func (this *pprofBuilder) valueType(kind, unit string) []byte {
+	var b protoBuffer
+	b.uint(1, uint64(this.string(kind)))
+	b.uint(2, uint64(this.string(unit)))
+	return b.bytes
+}
+
+// Just enough of the protocol buffer encoding to write a profile.
+type protoBuffer struct {
+	bytes []byte
+}
+
+func (this *protoBuffer) varint(n uint64) {
+	for n >= 0x80 {
+		this.bytes = append(this.bytes, byte(n)|0x80)
+		n >>= 7
+	}
+	this.bytes = append(this.bytes, byte(n))
+}
+
+// Writes a varint field, leaving out zero as the encoding does.
+func (this *protoBuffer) uint(field int, n uint64) {
+	if n == 0 {
+		return
+	}
+	this.varint(uint64(field) << 3)
+	this.varint(n)
+}
+
+// Writes a length-delimited field: a string, bytes or an embedded message.
+func (this *protoBuffer) message(field int, b []byte) {
+	this.varint(uint64(field)<<3 | 2)
+	this.varint(uint64(len(b)))
+	this.bytes = append(this.bytes, b...)
+}
+
+func (this *protoBuffer) packed(field int, values []uint64) {
+	var b protoBuffer
+	for _, n := range values {
+		b.varint(n)
+	}
+	this.message(field, b.bytes)
+}
@@ -0,0 +1,76 @@
+package zmachine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func profileTestMachine(t *testing.T) *Profiler {
+	machine := testMachine(t, tracingStory())
+	profiler := NewProfiler()
+	machine.SetProfiler(profiler)
+	runTestMachine(machine)
+	return profiler
+}
+
+func TestProfilerCounts(t *testing.T) {
+	profiler := profileTestMachine(t)
+	if n := profiler.Instructions(); n != 5 {
+		t.Errorf("profiled %d instructions, want 5", n)
+	}
+
+	routines := profiler.Routines()
+	if len(routines) != 2 {
+		t.Fatalf("routines %+v", routines)
+	}
+	main, called := routines[0], routines[1]
+	if main.Routine != testRoutines || main.Instructions != 3 || main.TotalInstructions != 5 {
+		t.Errorf("main routine %+v", main)
+	}
+	if called.Routine != 0x600 || called.Calls != 1 || called.Instructions != 2 || called.TotalInstructions != 2 {
+		t.Errorf("called routine %+v", called)
+	}
+
+	paths := profiler.HotPaths(5)
+	if len(paths) != 2 || !reflect.DeepEqual(paths[1].Routines, []int{testRoutines, 0x600}) || paths[1].Instructions != 2 {
+		t.Errorf("hot paths %+v", paths)
+	}
+	if paths := profiler.HotPaths(1); len(paths) != 1 || paths[0].Instructions != 3 {
+		t.Errorf("hottest path %+v", paths)
+	}
+}
+
+func TestProfilerOutput(t *testing.T) {
+	profiler := profileTestMachine(t)
+	var text bytes.Buffer
+	if err := profiler.WriteText(&text, nil, 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"r00600", "Hot paths:", "r00500 > r00600"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("profile doesn't contain %q:\n%s", want, text.String())
+		}
+	}
+
+	var pprof bytes.Buffer
+	if err := profiler.WritePprof(&pprof, "story.z3", nil); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := gzip.NewReader(&pprof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"instructions", "wall", "story.z3", "r00600"} {
+		if !bytes.Contains(proto, []byte(want)) {
+			t.Errorf("pprof profile doesn't contain %q", want)
+		}
+	}
+}
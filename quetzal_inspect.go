@@ -0,0 +1,348 @@
+package zmachine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+import "github.com/Katharine/chunk.go"
+
+// The identifying information from an IFhd chunk.
+type QuetzalHeader struct {
+	Release  uint16
+	Serial   string
+	Checksum uint16
+	PC       int
+}
+
+// Reports whether the header was written by the story whose memory is given.
+func (this QuetzalHeader) matches(story []byte) bool {
+	if len(story) < 0x1E {
+		return false
+	}
+	release := uint16(story[0x02])<<8 | uint16(story[0x03])
+	checksum := uint16(story[0x1C])<<8 | uint16(story[0x1D])
+	return release == this.Release && string(story[0x12:0x18]) == this.Serial && checksum == this.Checksum
+}
+
+// A single call frame from a Stks chunk. The first frame in a V1-5 save is a
+// dummy frame with a zero ReturnPC which only holds the evaluation stack.
+type QuetzalFrame struct {
+	ReturnPC       int
+	Flags          byte
+	ResultVariable byte
+	Arguments      byte // Bit n is set if argument n+1 was supplied
+	Locals         []uint16
+	Stack          []uint16
+}
+
+// Reports whether the caller discards the value returned by this frame.
+func (this QuetzalFrame) DiscardsResult() bool {
+	return this.Flags&0x10 == 0x10
+}
+
+// The number of arguments supplied to the routine owning this frame.
+func (this QuetzalFrame) ArgumentCount() int {
+	count := 0
+	for mask := this.Arguments; mask != 0; mask >>= 1 {
+		count += int(mask & 1)
+	}
+	return count
+}
+
+// A byte of dynamic memory that differs between two images. If no story file
+// was available the values are XORs against the original story rather than
+// the actual contents of memory.
+type QuetzalMemoryChange struct {
+	Address int
+	Old     byte
+	New     byte
+}
+
+// The parsed contents of a Quetzal save file.
+type QuetzalSave struct {
+	Header      QuetzalHeader
+	Compressed  bool
+	Frames      []QuetzalFrame
+	Annotations []string
+	Author      string
+	Copyright   string
+	Chunks      []string      // The name of every chunk in the file, in order
+	Metadata    *SaveMetadata // Only present in saves written by zmachine.go
+
+	memory []byte // XOR image if compressed, otherwise the raw dynamic memory
+}
+
+// Parses the Quetzal save file with the given name without restoring it.
+func ReadQuetzalFile(filename string) (*QuetzalSave, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadQuetzal(f)
+}
+
+// Parses a Quetzal save file from r without restoring it.
+func ReadQuetzal(r io.Reader) (*QuetzalSave, error) {
+	form, err := chunk.New(r)
+	if err != nil {
+		return nil, err
+	}
+	ifzs := make([]byte, 4)
+	if n, err := form.Read(ifzs); err != nil || n != 4 || form.Name() != "FORM" || string(ifzs) != "IFZS" {
+		return nil, errors.New("File is not a quetzal save file")
+	}
+
+	save := &QuetzalSave{Chunks: make([]string, 0)}
+	seenHeader, seenMemory, seenStack := false, false, false
+	for {
+		c, err := chunk.New(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		save.Chunks = append(save.Chunks, c.Name())
+
+		switch c.Name() {
+		case "IFhd":
+			if save.Header, err = readQuetzalHeader(c); err != nil {
+				return nil, err
+			}
+			seenHeader = true
+		case "CMem", "UMem":
+			data := make([]byte, c.Size())
+			if _, err := io.ReadFull(c, data); err != nil {
+				return nil, err
+			}
+			save.Compressed = c.Name() == "CMem"
+			if save.Compressed {
+				if save.memory, err = decompressQuetzalMemory(data, 0xFFFF); err != nil {
+					return nil, err
+				}
+			} else {
+				save.memory = data
+			}
+			seenMemory = true
+		case "Stks":
+			if save.Frames, err = readQuetzalFrames(c); err != nil {
+				return nil, err
+			}
+			seenStack = true
+		case "ZMmd":
+			data := make([]byte, c.Size())
+			if _, err := io.ReadFull(c, data); err != nil {
+				return nil, err
+			}
+			save.Metadata = parseSaveMetadata(data)
+		case "ANNO", "AUTH", "(c) ":
+			data := make([]byte, c.Size())
+			if _, err := io.ReadFull(c, data); err != nil {
+				return nil, err
+			}
+			switch c.Name() {
+			case "ANNO":
+				save.Annotations = append(save.Annotations, string(data))
+			case "AUTH":
+				save.Author = string(data)
+			default:
+				save.Copyright = string(data)
+			}
+		default:
+			c.Skip()
+		}
+	}
+
+	switch {
+	case !seenHeader:
+		return nil, errors.New("Save file has no IFhd chunk")
+	case !seenMemory:
+		return nil, errors.New("Save file has no memory chunk")
+	case !seenStack:
+		return nil, errors.New("Save file has no Stks chunk")
+	}
+	return save, nil
+}
+
+// Returns the dynamic memory stored in the save. Compressed saves can only be
+// reconstructed given the original story.
+func (this *QuetzalSave) DynamicMemory(story []byte) ([]byte, error) {
+	if !this.Compressed {
+		return this.memory, nil
+	}
+	if story == nil {
+		return nil, errors.New("The story file is needed to reconstruct compressed memory")
+	}
+	if len(story) < 0x10 {
+		return nil, errors.New("Story file is too short")
+	}
+	dynamicEnd := int(story[0x0E])<<8 | int(story[0x0F])
+	if len(this.memory) > dynamicEnd || dynamicEnd > len(story) {
+		return nil, errors.New("CMem data overruns dynamic memory")
+	}
+	memory := make([]byte, dynamicEnd)
+	copy(memory, story)
+	for i, b := range this.memory {
+		memory[i] ^= b
+	}
+	return memory, nil
+}
+
+// Lists every byte of dynamic memory changed since the start of the game. The
+// story may be nil for compressed saves, in which case Old is zero and New is
+// the XOR against the original.
+func (this *QuetzalSave) MemoryChanges(story []byte) ([]QuetzalMemoryChange, error) {
+	if story == nil {
+		if !this.Compressed {
+			return nil, errors.New("The story file is needed to find changes in uncompressed memory")
+		}
+		return diffMemory(make([]byte, len(this.memory)), this.memory), nil
+	}
+	memory, err := this.DynamicMemory(story)
+	if err != nil {
+		return nil, err
+	}
+	if len(memory) > len(story) {
+		return nil, errors.New("Memory image is larger than the story file")
+	}
+	return diffMemory(story[:len(memory)], memory), nil
+}
+
+func diffMemory(old, new []byte) []QuetzalMemoryChange {
+	changes := make([]QuetzalMemoryChange, 0)
+	for i := 0; i < len(old) || i < len(new); i++ {
+		var a, b byte
+		if i < len(old) {
+			a = old[i]
+		}
+		if i < len(new) {
+			b = new[i]
+		}
+		if a != b {
+			changes = append(changes, QuetzalMemoryChange{i, a, b})
+		}
+	}
+	return changes
+}
+
+// Checks that the save is consistent with the given story file, returning
+// every problem found.
+func (this *QuetzalSave) Validate(story []byte) []error {
+	problems := make([]error, 0)
+	if len(story) < 0x40 {
+		return append(problems, errors.New("Story file is too short to have a header"))
+	}
+	if !this.Header.matches(story) {
+		problems = append(problems, errors.New(fmt.Sprintf("Save is for release %d serial %s checksum 0x%04x, story is release %d serial %s checksum 0x%04x",
+			this.Header.Release, this.Header.Serial, this.Header.Checksum,
+			int(story[0x02])<<8|int(story[0x03]), story[0x12:0x18], int(story[0x1C])<<8|int(story[0x1D]))))
+	}
+	if this.Header.PC <= 0 || this.Header.PC >= len(story) {
+		problems = append(problems, errors.New(fmt.Sprintf("PC 0x%x is outside the story file", this.Header.PC)))
+	}
+
+	dynamicEnd := int(story[0x0E])<<8 | int(story[0x0F])
+	if this.Compressed && len(this.memory) > dynamicEnd {
+		problems = append(problems, errors.New(fmt.Sprintf("CMem data covers %d bytes, but dynamic memory is only %d bytes", len(this.memory), dynamicEnd)))
+	} else if !this.Compressed && len(this.memory) != dynamicEnd {
+		problems = append(problems, errors.New(fmt.Sprintf("UMem data is %d bytes, but dynamic memory is %d bytes", len(this.memory), dynamicEnd)))
+	}
+
+	if len(this.Frames) == 0 {
+		problems = append(problems, errors.New("Stks chunk has no frames"))
+	} else if story[0] != 6 && this.Frames[0].ReturnPC != 0 {
+		problems = append(problems, errors.New("First frame is not a dummy frame"))
+	}
+	for i, frame := range this.Frames {
+		if i == 0 && frame.ReturnPC == 0 {
+			if len(frame.Locals) != 0 {
+				problems = append(problems, errors.New("Dummy frame has local variables"))
+			}
+			continue
+		}
+		if frame.ReturnPC >= len(story) {
+			problems = append(problems, errors.New(fmt.Sprintf("Frame %d returns to 0x%x, outside the story file", i, frame.ReturnPC)))
+		}
+		if frame.ArgumentCount() > len(frame.Locals) {
+			problems = append(problems, errors.New(fmt.Sprintf("Frame %d was passed %d arguments but only has %d locals", i, frame.ArgumentCount(), len(frame.Locals))))
+		}
+	}
+	return problems
+}
+
+// The differences between two saves of the same story.
+type QuetzalDiff struct {
+	Headers [2]QuetzalHeader
+	Memory  []QuetzalMemoryChange
+	XOR     bool // Whether Memory's values are XORs against the story, for compressed saves compared without it
+	Frames  []QuetzalFrameDiff
+}
+
+// A call frame present in only one save, or different between the two. Old or
+// New is nil if the frame is absent from that save.
+type QuetzalFrameDiff struct {
+	Index int
+	Old   *QuetzalFrame
+	New   *QuetzalFrame
+}
+
+// Compares two saves. The story may be nil if both saves are compressed, in
+// which case memory values are reported as XORs against the original story.
+func DiffQuetzalSaves(a, b *QuetzalSave, story []byte) (*QuetzalDiff, error) {
+	diff := &QuetzalDiff{Headers: [2]QuetzalHeader{a.Header, b.Header}}
+
+	var oldMemory, newMemory []byte
+	if story == nil && a.Compressed && b.Compressed {
+		oldMemory, newMemory = a.memory, b.memory
+		diff.XOR = true
+	} else {
+		var err error
+		if oldMemory, err = a.DynamicMemory(story); err != nil {
+			return nil, err
+		}
+		if newMemory, err = b.DynamicMemory(story); err != nil {
+			return nil, err
+		}
+	}
+	diff.Memory = diffMemory(oldMemory, newMemory)
+
+	for i := 0; i < len(a.Frames) || i < len(b.Frames); i++ {
+		var old, new *QuetzalFrame
+		if i < len(a.Frames) {
+			old = &a.Frames[i]
+		}
+		if i < len(b.Frames) {
+			new = &b.Frames[i]
+		}
+		if old == nil || new == nil || !old.equals(new) {
+			diff.Frames = append(diff.Frames, QuetzalFrameDiff{i, old, new})
+		}
+	}
+	return diff, nil
+}
+
+func (this *QuetzalFrame) equals(other *QuetzalFrame) bool {
+	if this.ReturnPC != other.ReturnPC || this.Flags != other.Flags || this.ResultVariable != other.ResultVariable ||
+		this.Arguments != other.Arguments || len(this.Locals) != len(other.Locals) || len(this.Stack) != len(other.Stack) {
+		return false
+	}
+	for i := range this.Locals {
+		if this.Locals[i] != other.Locals[i] {
+			return false
+		}
+	}
+	for i := range this.Stack {
+		if this.Stack[i] != other.Stack[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether the saves are for the same game and at the same point.
+func (this *QuetzalDiff) Empty() bool {
+	return this.Headers[0] == this.Headers[1] && len(this.Memory) == 0 && len(this.Frames) == 0
+}
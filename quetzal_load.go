@@ -1,7 +1,6 @@
 package zmachine
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -16,6 +15,7 @@ func LoadQuetzalFile(filename string, machine *ZMachine) (err error) {
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	form, err := chunk.New(f)
 	if err != nil {
@@ -47,49 +47,46 @@ func LoadQuetzalFile(filename string, machine *ZMachine) (err error) {
 	return nil
 }
 
+// Asks the player which game to restore and restores it, reporting whether it
+// worked. Afterwards the machine is at the save instruction which saved it.
+func (this *ZMachine) restoreGame() bool {
+	this.print("Please enter a filename to load: ")
+	filename := this.readFilename()
+	if err := LoadQuetzalFile(filename, this); err != nil {
+		this.print(err.Error())
+		this.print("\n")
+		return false
+	}
+	if this.journal != nil {
+		this.journal.record(journalEvent{kind: journalRestore})
+	}
+	return true
+}
+
 var quetzalChunkHandlers = map[string]func(machine *ZMachine, chunk *chunk.Chunk) error{
 	"IFhd": func(machine *ZMachine, chunk *chunk.Chunk) error {
-		var release uint16
-		var serial = make([]byte, 6)
-		var checksum uint16
-		var pcb [3]byte
-		binary.Read(chunk, binary.BigEndian, &release)
-		binary.Read(chunk, binary.BigEndian, &serial)
-		binary.Read(chunk, binary.BigEndian, &checksum)
-		binary.Read(chunk, binary.BigEndian, &pcb)
-		pc := int(pcb[0])<<16 | int(pcb[1])<<8 | int(pcb[2])
-
-		if machine.number(0x02) != release || !bytes.Equal(serial, machine.memory[0x12:0x18]) || checksum != machine.number(0x1C) {
+		header, err := readQuetzalHeader(chunk)
+		if err != nil {
+			return err
+		}
+
+		if !header.matches(machine.memory) {
 			return errors.New("Wrong game")
 		}
 
 		machine.LoadStory()
-		machine.pc = pc - 1
+		machine.pc = header.PC - 1
 		return nil
 	},
 	"CMem": func(machine *ZMachine, chunk *chunk.Chunk) error {
 		cmem := make([]byte, chunk.Size())
 		chunk.Read(cmem)
-		pointer := uint16(0)
-		skipping := false
-		for _, b := range cmem {
-			if b != 0 && !skipping {
-				machine.memory[pointer] ^= b
-				pointer++
-			} else if !skipping {
-				skipping = true
-				pointer++
-			} else {
-				skipping = false
-				pointer += uint16(b)
-			}
-		}
-
-		if skipping {
-			return errors.New("CMem chunk ended while skipping")
+		xor, err := decompressQuetzalMemory(cmem, int(machine.memoryDynamicEnd))
+		if err != nil {
+			return err
 		}
-		if pointer > machine.memoryDynamicEnd {
-			return errors.New("CMem data overruns dynamic memory")
+		for i, b := range xor {
+			machine.memory[i] ^= b
 		}
 		return nil
 	},
@@ -103,50 +100,121 @@ var quetzalChunkHandlers = map[string]func(machine *ZMachine, chunk *chunk.Chunk
 		return nil
 	},
 	"Stks": func(machine *ZMachine, chunk *chunk.Chunk) error {
+		frames, err := readQuetzalFrames(chunk)
+		if err != nil {
+			return err
+		}
+
 		machine.stack.Truncate(0)
 		machine.callStack.Truncate(0)
+		// Saves don't record which routines were running, except the first.
+		main := 0
+		if len(machine.routines) > 0 {
+			main = machine.routines[0]
+		}
+		machine.routines = []int{main}
 
-		for {
-			var pcb [3]byte
-			if err := binary.Read(chunk, binary.BigEndian, &pcb); err == io.EOF {
-				break
-			} else if err != nil {
-				return errors.New(fmt.Sprintf("Error while reading stack frame: %s", err))
-			}
-
-			pc := int(pcb[0])<<16 | int(pcb[1])<<8 | int(pcb[2])
-
-			var flags, ret, argCount byte
-			var stackSize uint16
-			binary.Read(chunk, binary.BigEndian, &flags)
-			binary.Read(chunk, binary.BigEndian, &ret)
-			binary.Read(chunk, binary.BigEndian, &argCount)
-			binary.Read(chunk, binary.BigEndian, &stackSize)
-
-			localCount := flags & 0x0F
-			//discardResult := flags & 0x10 == 0x10 // Unused by v1-3.
-
-			local := make([]uint16, localCount)
-			stack := make([]uint16, stackSize)
-
-			binary.Read(chunk, binary.BigEndian, &local)
-			binary.Read(chunk, binary.BigEndian, &stack)
-
-			if pc > 0 {
-				pc--
-				machine.callStack.Push(uint16(argCount)<<8 | uint16(localCount))
-				machine.callStack.Push(uint16(ret))
+		for _, frame := range frames {
+			if frame.ReturnPC > 0 {
+				pc := frame.ReturnPC - 1
+				machine.callStack.Push(uint16(frame.Arguments)<<8 | uint16(frame.Flags&(0x0F|frameDiscardsResult)))
+				machine.callStack.Push(uint16(frame.ResultVariable))
 				machine.callStack.Push(uint16(pc >> 16))
 				machine.callStack.Push(uint16(pc & 0xFFFF))
 				machine.callStack.Push(uint16(machine.stack.Size()))
+				machine.routines = append(machine.routines, 0)
 			}
-			for _, v := range local {
+			for _, v := range frame.Locals {
 				machine.stack.Push(v)
 			}
-			for _, word := range stack {
+			for _, word := range frame.Stack {
 				machine.stack.Push(word)
 			}
 		}
 		return nil
 	},
 }
+
+// Reads the body of an IFhd chunk.
+func readQuetzalHeader(r io.Reader) (QuetzalHeader, error) {
+	var raw struct {
+		Release  uint16
+		Serial   [6]byte
+		Checksum uint16
+		PC       [3]byte
+	}
+	if err := binary.Read(r, binary.BigEndian, &raw); err != nil {
+		return QuetzalHeader{}, errors.New(fmt.Sprintf("Error while reading header: %s", err))
+	}
+	return QuetzalHeader{
+		Release:  raw.Release,
+		Serial:   string(raw.Serial[:]),
+		Checksum: raw.Checksum,
+		PC:       int(raw.PC[0])<<16 | int(raw.PC[1])<<8 | int(raw.PC[2]),
+	}, nil
+}
+
+// Expands the run-length encoding of a CMem chunk, returning the XOR of the saved
+// dynamic memory against the original story. The result may be shorter than the
+// dynamic memory area, in which case the remainder is unchanged.
+func decompressQuetzalMemory(cmem []byte, limit int) ([]byte, error) {
+	xor := make([]byte, 0, limit)
+	skipping := false
+	for _, b := range cmem {
+		if b != 0 && !skipping {
+			xor = append(xor, b)
+		} else if !skipping {
+			skipping = true
+			xor = append(xor, 0)
+		} else {
+			skipping = false
+			for i := 0; i < int(b); i++ {
+				xor = append(xor, 0)
+			}
+		}
+		if len(xor) > limit {
+			return nil, errors.New("CMem data overruns dynamic memory")
+		}
+	}
+
+	if skipping {
+		return nil, errors.New("CMem chunk ended while skipping")
+	}
+	return xor, nil
+}
+
+// Reads every frame in a Stks chunk, oldest first.
+func readQuetzalFrames(r io.Reader) ([]QuetzalFrame, error) {
+	frames := make([]QuetzalFrame, 0)
+	for {
+		var raw struct {
+			PC             [3]byte
+			Flags          byte
+			ResultVariable byte
+			Arguments      byte
+			StackSize      uint16
+		}
+		if err := binary.Read(r, binary.BigEndian, &raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error while reading stack frame: %s", err))
+		}
+
+		frame := QuetzalFrame{
+			ReturnPC:       int(raw.PC[0])<<16 | int(raw.PC[1])<<8 | int(raw.PC[2]),
+			Flags:          raw.Flags,
+			ResultVariable: raw.ResultVariable,
+			Arguments:      raw.Arguments,
+			Locals:         make([]uint16, raw.Flags&0x0F),
+			Stack:          make([]uint16, raw.StackSize),
+		}
+		if err := binary.Read(r, binary.BigEndian, &frame.Locals); err != nil {
+			return nil, errors.New(fmt.Sprintf("Error while reading stack frame: %s", err))
+		}
+		if err := binary.Read(r, binary.BigEndian, &frame.Stack); err != nil {
+			return nil, errors.New(fmt.Sprintf("Error while reading stack frame: %s", err))
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
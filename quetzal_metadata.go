@@ -0,0 +1,134 @@
+package zmachine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How many lines of output are kept in a save's preview.
+const savePreviewLines = 4
+
+// Describes the state of the game at the moment it was saved, so that saves
+// can be browsed without restoring them. It is stored in a private ZMmd chunk.
+type SaveMetadata struct {
+	HasStatus bool // Whether Room, Score, Turns and TimeGame are set, as only versions 1 to 3 keep them in globals
+	Room      string
+	Score     int16  // Hours, if TimeGame is set
+	Turns     uint16 // Minutes, if TimeGame is set
+	TimeGame  bool
+	Saved     time.Time
+	Preview   []string // The last few lines of output
+}
+
+// Gathers the information shown on the status line, along with the tail of the output.
+// Later versions draw their own status lines, so their first globals may be anything.
+func (this *ZMachine) saveMetadata() SaveMetadata {
+	metadata := SaveMetadata{
+		Saved:   time.Now().UTC(),
+		Preview: make([]string, 0, savePreviewLines),
+	}
+	if this.version <= 3 {
+		metadata.HasStatus = true
+		metadata.Score = int16(this.getVariable(0x11))
+		metadata.Turns = this.getVariable(0x12)
+		metadata.TimeGame = this.version == 3 && this.memory[0x01]&0x02 == 0x02
+		if location := this.getVariable(0x10); location != 0 && location <= 0xFF {
+			name := this.getObjectName(location)
+			zscii := name.ZSCIIString()
+			metadata.Room = zscii.String()
+		}
+	}
+
+	lines := strings.Split(string(this.outputTail), "\n")
+	// The first line is probably only part of one.
+	if len(this.outputTail) == outputTailSize {
+		lines = lines[1:]
+	}
+	for i := len(lines) - 1; i >= 0 && len(metadata.Preview) < savePreviewLines; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			metadata.Preview = append([]string{line}, metadata.Preview...)
+		}
+	}
+	return metadata
+}
+
+// A one-line summary, as written to the ANNO chunk, or "" without a status.
+func (this SaveMetadata) String() string {
+	if !this.HasStatus {
+		return ""
+	}
+	var status string
+	if this.TimeGame {
+		status = fmt.Sprintf("time %d:%02d", this.Score, this.Turns)
+	} else {
+		status = fmt.Sprintf("score %d, %d turns", this.Score, this.Turns)
+	}
+	if this.Room == "" {
+		return status
+	}
+	return this.Room + ", " + status
+}
+
+// Encodes the metadata as the body of a ZMmd chunk: one key=value pair per line.
+func (this SaveMetadata) chunkData() []byte {
+	b := new(bytes.Buffer)
+	if this.HasStatus {
+		fmt.Fprintf(b, "room=%s\n", this.Room)
+		fmt.Fprintf(b, "score=%d\n", this.Score)
+		fmt.Fprintf(b, "turns=%d\n", this.Turns)
+		fmt.Fprintf(b, "timegame=%t\n", this.TimeGame)
+	}
+	fmt.Fprintf(b, "saved=%s\n", this.Saved.Format(time.RFC3339))
+	for _, line := range this.Preview {
+		fmt.Fprintf(b, "preview=%s\n", line)
+	}
+	return b.Bytes()
+}
+
+// Decodes the body of a ZMmd chunk. Unknown keys are ignored.
+func parseSaveMetadata(data []byte) *SaveMetadata {
+	metadata := &SaveMetadata{Preview: make([]string, 0)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "room", "score", "turns", "timegame":
+			metadata.HasStatus = true
+		}
+		switch key {
+		case "room":
+			metadata.Room = value
+		case "score":
+			score, _ := strconv.ParseInt(value, 10, 16)
+			metadata.Score = int16(score)
+		case "turns":
+			turns, _ := strconv.ParseUint(value, 10, 16)
+			metadata.Turns = uint16(turns)
+		case "timegame":
+			metadata.TimeGame = value == "true"
+		case "saved":
+			metadata.Saved, _ = time.Parse(time.RFC3339, value)
+		case "preview":
+			metadata.Preview = append(metadata.Preview, value)
+		}
+	}
+	return metadata
+}
+
+// Reads only the metadata of a save file. It returns nil if the file was
+// not written by zmachine.go.
+func ReadSaveMetadata(filename string) (*SaveMetadata, error) {
+	save, err := ReadQuetzalFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return save.Metadata, nil
+}
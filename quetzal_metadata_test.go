@@ -0,0 +1,90 @@
+package zmachine
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSaveMetadata(t *testing.T) {
+	story := testStory(3)
+	addTestObjects(story, testObject{name: "kitchen"})
+	story[testGlobals+1] = 1  // In the kitchen
+	story[testGlobals+3] = 5  // Score
+	story[testGlobals+5] = 12 // Turns
+	machine := testMachine(t, story)
+	machine.print("Zork\nWelcome\nKitchen\nYou are in a kitchen.\n\n>")
+
+	filename := filepath.Join(t.TempDir(), "game.qzl")
+	if err := SaveQuetzalFile(filename, machine, true); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := ReadSaveMetadata(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Room != "kitchen" || metadata.Score != 5 || metadata.Turns != 12 || metadata.TimeGame || metadata.Saved.IsZero() {
+		t.Errorf("metadata %+v", metadata)
+	}
+	if want := []string{"Welcome", "Kitchen", "You are in a kitchen.", ">"}; !reflect.DeepEqual(metadata.Preview, want) {
+		t.Errorf("preview %q, want %q", metadata.Preview, want)
+	}
+
+	save, err := ReadQuetzalFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"kitchen, score 5, 12 turns"}; !reflect.DeepEqual(save.Annotations, want) {
+		t.Errorf("annotations %q, want %q", save.Annotations, want)
+	}
+}
+
+func TestSaveMetadataForTimeGames(t *testing.T) {
+	story := testStory(3)
+	story[0x01] = 0x02
+	story[testGlobals+3] = 9
+	story[testGlobals+5] = 5
+	machine := testMachine(t, story)
+	metadata := machine.saveMetadata()
+	if !metadata.TimeGame || metadata.String() != "time 9:05" {
+		t.Errorf("metadata %+v, %q", metadata, metadata)
+	}
+
+	parsed := parseSaveMetadata(metadata.chunkData())
+	parsed.Saved = metadata.Saved
+	if !reflect.DeepEqual(*parsed, metadata) {
+		t.Errorf("read back %+v, want %+v", parsed, metadata)
+	}
+}
+
+func TestSaveMetadataWithoutStatus(t *testing.T) {
+	// From version 4, the first globals are the story's own.
+	story := testStory(5)
+	addTestObjects(story, testObject{name: "kitchen"})
+	story[testGlobals+1] = 1
+	story[testGlobals+3] = 5
+	machine := testMachine(t, story)
+	machine.print("You are in a kitchen.\n")
+
+	metadata := machine.saveMetadata()
+	if metadata.HasStatus || metadata.Room != "" || metadata.Score != 0 || metadata.String() != "" {
+		t.Errorf("metadata %+v", metadata)
+	}
+	parsed := parseSaveMetadata(metadata.chunkData())
+	parsed.Saved = metadata.Saved
+	if !reflect.DeepEqual(*parsed, metadata) {
+		t.Errorf("read back %+v, want %+v", parsed, metadata)
+	}
+
+	filename := filepath.Join(t.TempDir(), "game.qzl")
+	if err := SaveQuetzalFile(filename, machine, true); err != nil {
+		t.Fatal(err)
+	}
+	save, err := ReadQuetzalFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(save.Annotations) != 0 || !reflect.DeepEqual(save.Metadata.Preview, []string{"You are in a kitchen."}) {
+		t.Errorf("annotations %q, preview %q", save.Annotations, save.Metadata.Preview)
+	}
+}
@@ -3,12 +3,15 @@ package zmachine
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"os"
 )
 
 func SaveQuetzalFile(filename string, machine *ZMachine, compressed bool) (err error) {
+	return writeQuetzalFile(filename, machine, compressed, machine.saveMetadata())
+}
+
+func writeQuetzalFile(filename string, machine *ZMachine, compressed bool, metadata SaveMetadata) (err error) {
 	f, err := os.Create(filename)
 	if err != nil {
 		return err
@@ -30,7 +33,10 @@ func SaveQuetzalFile(filename string, machine *ZMachine, compressed bool) (err e
 		quetzalWriteUMem(s, machine)
 	}
 	quetzalWriteStks(s, machine)
-	quetzalWriteANNO(s, machine)
+	if metadata.HasStatus {
+		quetzalWriteANNO(s, metadata)
+	}
+	quetzalWriteZMmd(s, metadata)
 
 	// Write it to our file.
 	length := uint32(s.Len() + 4)
@@ -49,6 +55,21 @@ func SaveQuetzalFile(filename string, machine *ZMachine, compressed bool) (err e
 	return
 }
 
+// Asks the player where to save the game and saves it there, reporting whether
+// it worked.
+func (this *ZMachine) saveGame() bool {
+	// Describe the game before the prompt becomes part of the preview.
+	metadata := this.saveMetadata()
+	this.print("Please enter a filename to save: ")
+	filename := this.readFilename()
+	if err := this.save(filename, metadata); err != nil {
+		this.print(err.Error())
+		this.print("\n")
+		return false
+	}
+	return true
+}
+
 func multiWrite(stream io.Writer, data []interface{}) error {
 	for _, v := range data {
 		if err := binary.Write(stream, binary.BigEndian, v); err != nil {
@@ -141,7 +162,7 @@ func quetzalWriteStks(stream io.Writer, machine *ZMachine) {
 
 	// Dummy first frame
 	frames.Write([]byte{0, 0, 0, 0, 0, 0}) // pc, flags, return variable, argument mask
-	dummyFrameStackSize := uint16(0)
+	dummyFrameStackSize := uint16(machine.stack.Size())
 	if machine.callStack.Size() > 4 {
 		dummyFrameStackSize = machine.callStack.Look(4)
 	}
@@ -150,9 +171,10 @@ func quetzalWriteStks(stream io.Writer, machine *ZMachine) {
 	// Real frames!
 	for callStackPointer < machine.callStack.Size() {
 		argumentMask := byte(machine.callStack.Look(callStackPointer) >> 8)
-		localCount := byte(machine.callStack.Look(callStackPointer) & 0x0F)
+		flags := byte(machine.callStack.Look(callStackPointer))
+		localCount := flags & 0x0F
 		ret := byte(machine.callStack.Look(callStackPointer + 1))
-		pc := int(machine.callStack.Look(callStackPointer+2))<<8 | int(machine.callStack.Look(callStackPointer+3))
+		pc := int(machine.callStack.Look(callStackPointer+2))<<16 | int(machine.callStack.Look(callStackPointer+3))
 		top := machine.callStack.Look(callStackPointer + 4)
 		callStackPointer += 5
 		var stackSize uint16
@@ -169,7 +191,7 @@ func quetzalWriteStks(stream io.Writer, machine *ZMachine) {
 
 		frame := []interface{}{
 			pcb,
-			localCount,
+			flags,
 			ret,
 			argumentMask,
 			stackSize,
@@ -193,8 +215,8 @@ func quetzalWriteStks(stream io.Writer, machine *ZMachine) {
 	}
 }
 
-func quetzalWriteANNO(stream io.Writer, machine *ZMachine) {
-	message := fmt.Sprintf("Version %d game, saved by zmachine.go", machine.version)
+func quetzalWriteANNO(stream io.Writer, metadata SaveMetadata) {
+	message := metadata.String()
 	data := []interface{}{
 		[]byte("ANNO"),
 		uint32(len(message)),
@@ -205,3 +227,16 @@ func quetzalWriteANNO(stream io.Writer, machine *ZMachine) {
 		stream.Write([]byte{0})
 	}
 }
+
+func quetzalWriteZMmd(stream io.Writer, metadata SaveMetadata) {
+	body := metadata.chunkData()
+	data := []interface{}{
+		[]byte("ZMmd"),
+		uint32(len(body)),
+		body,
+	}
+	multiWrite(stream, data)
+	if len(body)&1 == 1 {
+		stream.Write([]byte{0})
+	}
+}
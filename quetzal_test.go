@@ -0,0 +1,201 @@
+package zmachine
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Returns a version 3 story whose main routine pushes 9 and calls a routine
+// at 0x600 with one argument. That routine has two locals, pushes 7 and saves
+// the game.
+func savingStory() []byte {
+	story := testStory(3)
+	copy(story[testRoutines+1:], []byte{
+		0xE8, 0x7F, 0x09, // push 9
+		0xE0, 0x1F, 0x03, 0x00, 0x03, 0x00, // call 0x600 3 -> sp
+		0xBA, // quit
+	})
+	copy(story[0x600:], []byte{
+		0x02, 0x00, 0x00, 0x00, 0x05, // Two locals, 0 and 5
+		0xE8, 0x7F, 0x07, // push 7
+		0xB5, 0xC2, // save ?(next)
+		0xB0, // rtrue
+	})
+	return story
+}
+
+// Runs the story, answering its save prompt with a file in a new directory,
+// and returns the file's name.
+func saveTestGame(t *testing.T, story []byte) string {
+	machine := testMachine(t, story)
+	filename := filepath.Join(t.TempDir(), "game.qzl")
+	machine.input <- filename
+	runTestMachine(machine)
+	return filename
+}
+
+func TestQuetzalFrames(t *testing.T) {
+	story := savingStory()
+	save, err := ReadQuetzalFile(saveTestGame(t, story))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := save.Validate(story); len(problems) != 0 {
+		t.Errorf("problems with the save: %v", problems)
+	}
+	// The header's PC is at the save instruction's branch.
+	if want := (QuetzalHeader{1, "010101", 0, 0x609}); save.Header != want {
+		t.Errorf("header %+v, want %+v", save.Header, want)
+	}
+	if !save.Compressed {
+		t.Error("save isn't compressed")
+	}
+
+	want := []QuetzalFrame{
+		{Locals: []uint16{}, Stack: []uint16{9}},
+		{ReturnPC: 0x50A, Flags: 2, Arguments: 1, Locals: []uint16{3, 5}, Stack: []uint16{7}},
+	}
+	if !reflect.DeepEqual(save.Frames, want) {
+		t.Fatalf("frames %+v, want %+v", save.Frames, want)
+	}
+	if frame := save.Frames[1]; frame.ArgumentCount() != 1 || frame.DiscardsResult() {
+		t.Errorf("frame has %d arguments, discards result %v", frame.ArgumentCount(), frame.DiscardsResult())
+	}
+}
+
+func TestQuetzalWithoutCalls(t *testing.T) {
+	story := testStory(3)
+	copy(story[testRoutines+1:], []byte{
+		0xE8, 0x7F, 0x01, // push 1
+		0xE8, 0x7F, 0x02, // push 2
+		0xB5, 0xC2, // save ?(next)
+		0xBA, // quit
+	})
+	filename := saveTestGame(t, story)
+	save, err := ReadQuetzalFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []QuetzalFrame{{Locals: []uint16{}, Stack: []uint16{1, 2}}}
+	if !reflect.DeepEqual(save.Frames, want) {
+		t.Fatalf("frames %+v, want %+v", save.Frames, want)
+	}
+
+	machine := testMachine(t, story)
+	if err := LoadQuetzalFile(filename, machine); err != nil {
+		t.Fatal(err)
+	}
+	if machine.stack.Size() != 2 || machine.stack.Peek() != 2 || machine.callStack.Size() != 0 {
+		t.Errorf("restored %d words with %d on top, and %d of call frames", machine.stack.Size(), machine.stack.Peek(), machine.callStack.Size())
+	}
+}
+
+func TestQuetzalRestore(t *testing.T) {
+	story := savingStory()
+	filename := saveTestGame(t, story)
+	machine := testMachine(t, story)
+	if err := LoadQuetzalFile(filename, machine); err != nil {
+		t.Fatal(err)
+	}
+	// Just before the save instruction's branch, in the called routine.
+	if machine.pc != 0x608 {
+		t.Errorf("pc 0x%x", machine.pc)
+	}
+	if machine.callStack.Size() != 5 || machine.callStack.Look(0) != 0x0102 {
+		t.Errorf("call stack %v", machine.callStack.store[:machine.callStack.Size()])
+	}
+	if got, want := machine.stack.store[:machine.stack.Size()], []uint16{9, 3, 5, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stack %v, want %v", got, want)
+	}
+}
+
+func TestQuetzalDiff(t *testing.T) {
+	story := testStory(3)
+	machine := testMachine(t, story)
+	dir := t.TempDir()
+	a, b, c := filepath.Join(dir, "a.qzl"), filepath.Join(dir, "b.qzl"), filepath.Join(dir, "c.qzl")
+	machine.memory[testGlobals] = 0x30
+	if err := SaveQuetzalFile(a, machine, true); err != nil {
+		t.Fatal(err)
+	}
+	machine.memory[testGlobals] = 0x31
+	if err := SaveQuetzalFile(b, machine, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveQuetzalFile(c, machine, false); err != nil {
+		t.Fatal(err)
+	}
+	saves := make([]*QuetzalSave, 3)
+	for i, filename := range []string{a, b, c} {
+		var err error
+		if saves[i], err = ReadQuetzalFile(filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diff, err := DiffQuetzalSaves(saves[0], saves[1], story)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []QuetzalMemoryChange{{testGlobals, 0x30, 0x31}}; !reflect.DeepEqual(diff.Memory, want) || diff.XOR || len(diff.Frames) != 0 {
+		t.Errorf("diff %+v", diff)
+	}
+	if diff, err := DiffQuetzalSaves(saves[1], saves[2], story); err != nil || !diff.Empty() {
+		t.Errorf("compressed and uncompressed saves differ: %+v, %v", diff, err)
+	}
+
+	// Without the story, compressed saves can only be compared as they're
+	// stored, against the original.
+	diff, err = DiffQuetzalSaves(saves[0], saves[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []QuetzalMemoryChange{{testGlobals, 0x30, 0x31}}; !reflect.DeepEqual(diff.Memory, want) || !diff.XOR {
+		t.Errorf("diff %+v", diff)
+	}
+	if _, err := DiffQuetzalSaves(saves[0], saves[2], nil); err == nil {
+		t.Error("compared an uncompressed save without the story")
+	}
+	// Uncompressed saves hold their memory as it is.
+	if diff, err := DiffQuetzalSaves(saves[2], saves[2], nil); err != nil || diff.XOR || !diff.Empty() {
+		t.Errorf("uncompressed diff %+v, %v", diff, err)
+	}
+
+	changes, err := saves[2].MemoryChanges(story)
+	if want := []QuetzalMemoryChange{{testGlobals, 0, 0x31}}; err != nil || !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes %+v, %v", changes, err)
+	}
+}
+
+func TestQuetzalValidate(t *testing.T) {
+	story := savingStory()
+	save, err := ReadQuetzalFile(saveTestGame(t, story))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := append([]byte(nil), story...)
+	other[0x03] = 2 // Release 2
+	save.Frames[1].Locals = nil
+	if problems := save.Validate(other); len(problems) != 2 {
+		t.Errorf("problems %v, want the release and the arguments", problems)
+	}
+}
+
+func TestReadQuetzalRejectsOtherFiles(t *testing.T) {
+	if _, err := ReadQuetzal(bytes.NewReader([]byte("FORM\x00\x00\x00\x04AIFF"))); err == nil {
+		t.Error("read an AIFF file as a save")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	machine := testMachine(t, testStory(3))
+	machine.memory[testGlobals] = 1
+	machine.stack.Push(5)
+	machine.pc = 0x600
+	imp0op[7](machine)
+	if machine.memory[testGlobals] != 0 || machine.stack.Size() != 0 || machine.pc+1 != testRoutines+1 {
+		t.Errorf("global %d, %d words of stack, pc 0x%x after restarting", machine.memory[testGlobals], machine.stack.Size(), machine.pc)
+	}
+}
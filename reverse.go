@@ -0,0 +1,371 @@
+package zmachine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// How many instructions are run between snapshots while recording.
+const recordingInterval = 10000
+
+// How many of the latest turns keep all their snapshots. Older turns only keep
+// the snapshot from their start, so going back into them replays more.
+const recordingDetailedTurns = 10
+
+// The first byte of the read instruction, which starts each turn.
+const readOpcodeByte = 0xE4
+
+// The machine's state before the instruction at position.
+type snapshot struct {
+	position int
+	cursor   int  // The journal's cursor
+	turn     bool // Taken before a read
+	jump     bool // Taken after a restore or restart, which replay can't repeat
+
+	memory          []byte // Dynamic memory
+	stack           []uint16
+	callStack       []uint16
+	routines        []int
+	pc              int
+	running         bool
+	outputTail      []byte
+	typedAhead      []byte
+	style           *TextStyle // Never changed in place, so it can be shared
+	fixedStyle      bool
+	memoryStreams   []int
+	upperWindow     bool
+	opcodesExecuted int
+}
+
+// Everything needed to return to any instruction since recording began: the
+// machine is restored from the last snapshot before it, then run forward
+// with the journal standing in for the player, the clock and chance.
+type recording struct {
+	position  int // The number of instructions run since recording began
+	head      int // The furthest position reached
+	snapshots []*snapshot
+	turns     []int // The position of each read
+}
+
+func takeSnapshot(machine *ZMachine, position int) *snapshot {
+	return &snapshot{
+		position:        position,
+		cursor:          machine.journal.cursor,
+		memory:          append([]byte(nil), machine.memory[:machine.memoryDynamicEnd]...),
+		stack:           stackContents(&machine.stack),
+		callStack:       stackContents(&machine.callStack),
+		routines:        append([]int(nil), machine.routines...),
+		pc:              machine.pc,
+		running:         machine.running,
+		outputTail:      append([]byte(nil), machine.outputTail...),
+		typedAhead:      append([]byte(nil), machine.typedAhead...),
+		style:           machine.style,
+		fixedStyle:      machine.fixedStyle,
+		memoryStreams:   append([]int(nil), machine.memoryStreams...),
+		upperWindow:     machine.upperWindow,
+		opcodesExecuted: machine.opcodesExecuted,
+	}
+}
+
+func stackContents(stack *Stack) []uint16 {
+	return append([]uint16(nil), stack.store[:stack.pointer]...)
+}
+
+func restoreStack(stack *Stack, contents []uint16) {
+	copy(stack.store, contents)
+	stack.pointer = uint(len(contents))
+}
+
+func (this *snapshot) restore(machine *ZMachine) {
+	copy(machine.memory, this.memory)
+	restoreStack(&machine.stack, this.stack)
+	restoreStack(&machine.callStack, this.callStack)
+	machine.routines = append(machine.routines[:0], this.routines...)
+	machine.pc = this.pc
+	machine.running = this.running
+	machine.outputTail = append(machine.outputTail[:0], this.outputTail...)
+	machine.typedAhead = append([]byte(nil), this.typedAhead...)
+	machine.style = this.style
+	machine.fixedStyle = this.fixedStyle
+	machine.memoryStreams = append(machine.memoryStreams[:0], this.memoryStreams...)
+	machine.upperWindow = this.upperWindow
+	machine.opcodesExecuted = this.opcodesExecuted
+	machine.journal.cursor = this.cursor
+}
+
+// Adds a snapshot of the current state, unless there's one already.
+func (this *recording) snapshot(machine *ZMachine) *snapshot {
+	if last := this.snapshots[len(this.snapshots)-1]; last.position == this.position {
+		return last
+	}
+	s := takeSnapshot(machine, this.position)
+	this.snapshots = append(this.snapshots, s)
+	return s
+}
+
+// Returns the last snapshot at or before position.
+func (this *recording) before(position int) *snapshot {
+	i := sort.Search(len(this.snapshots), func(i int) bool {
+		return this.snapshots[i].position > position
+	})
+	return this.snapshots[i-1]
+}
+
+// Runs one instruction, noting anything new.
+func (this *recording) step(machine *ZMachine) {
+	live := this.position == this.head
+	if this.position < this.head {
+		// Restores and restarts are never repeated: replay jumps to their results.
+		if next := this.before(this.position + 1); next.position == this.position+1 && next.jump {
+			next.restore(machine)
+			this.position++
+			return
+		}
+	}
+	if live && machine.memory[machine.pc] == readOpcodeByte {
+		this.snapshot(machine).turn = true
+		this.turns = append(this.turns, this.position)
+		this.thin()
+	}
+
+	events := len(machine.journal.events)
+	machine.executeCycle()
+	this.position++
+	if !live {
+		return
+	}
+	this.head = this.position
+	if len(machine.journal.events) > events {
+		if kind := machine.journal.events[len(machine.journal.events)-1].kind; kind == journalRestore || kind == journalRestart {
+			this.snapshot(machine).jump = true
+			return
+		}
+	}
+	if this.position%recordingInterval == 0 {
+		this.snapshot(machine)
+	}
+}
+
+// Drops the snapshots within turns which are no longer recent.
+func (this *recording) thin() {
+	if len(this.turns) <= recordingDetailedTurns {
+		return
+	}
+	recent := this.turns[len(this.turns)-recordingDetailedTurns]
+	kept := this.snapshots[:0]
+	for i, s := range this.snapshots {
+		if i == 0 || s.turn || s.jump || s.position >= recent {
+			kept = append(kept, s)
+		}
+	}
+	this.snapshots = kept
+}
+
+// Starts recording, so that execution can be reversed back to this point.
+func (this *Debugger) Record() {
+	if this.recording != nil {
+		return
+	}
+	this.machine.journal = &journal{}
+	this.recording = &recording{}
+	this.recording.snapshots = []*snapshot{takeSnapshot(this.machine, 0)}
+}
+
+func (this *Debugger) Recording() bool {
+	return this.recording != nil
+}
+
+// Returns how many instructions have run since recording began.
+func (this *Debugger) Position() int {
+	if this.recording == nil {
+		return 0
+	}
+	return this.recording.position
+}
+
+// Returns how many turns have been recorded, each starting with a read.
+func (this *Debugger) Turns() int {
+	if this.recording == nil {
+		return 0
+	}
+	return len(this.recording.turns)
+}
+
+var errNotRecording = errors.New("Not recording")
+
+// Goes back to the state before the previous instruction.
+func (this *Debugger) StepBack() error {
+	if this.recording == nil {
+		return errNotRecording
+	}
+	if this.recording.position == 0 {
+		return errors.New("At the start of the recording")
+	}
+	return this.seek(this.recording.position - 1)
+}
+
+// Goes back to just before the read which started turn n, counting from 1.
+func (this *Debugger) RewindToTurn(n int) error {
+	if this.recording == nil {
+		return errNotRecording
+	}
+	if n < 1 || n > len(this.recording.turns) {
+		return fmt.Errorf("Only %d turns have been recorded", len(this.recording.turns))
+	}
+	return this.seek(this.recording.turns[n-1])
+}
+
+// Goes back to just before the last instruction to write global g.
+func (this *Debugger) BackToGlobalWrite(g int) error {
+	if this.recording == nil {
+		return errNotRecording
+	}
+	if g < 0 || g > 239 {
+		return fmt.Errorf("No global %d", g)
+	}
+	variable := byte(g + 0x10)
+	written := false
+	tracer := TracerFunc(func(event *TraceEvent) {
+		if writesVariable(event, variable) {
+			written = true
+		}
+	})
+	found := this.searchBack(tracer, func(run func()) bool {
+		value := this.machine.getVariable(variable)
+		written = false
+		run()
+		return written || this.machine.getVariable(variable) != value
+	})
+	if !found {
+		return fmt.Errorf("Global %d hasn't been written since recording began", g)
+	}
+	return nil
+}
+
+// Runs backwards to the last breakpoint or change to a watched value.
+func (this *Debugger) ReverseContinue() Stop {
+	if this.recording == nil {
+		return Stop{Reason: DEBUG_STOP_ERROR, Err: errNotRecording}
+	}
+	this.lock.Lock()
+	watchpoints := append([]*Watchpoint(nil), this.watchpoints...)
+	breakpoints := make(map[int]*Breakpoint, len(this.breakpoints))
+	for address, breakpoint := range this.breakpoints {
+		breakpoints[address] = breakpoint
+	}
+	this.lock.Unlock()
+
+	var stop Stop
+	found := this.searchBack(nil, func(run func()) bool {
+		breakpoint, hit := breakpoints[this.machine.pc]
+		values := make([]uint16, len(watchpoints))
+		for i, watchpoint := range watchpoints {
+			values[i] = watchpoint.read(this.machine)
+		}
+		run()
+		for i, watchpoint := range watchpoints {
+			if value := watchpoint.read(this.machine); value != values[i] {
+				stop = Stop{Reason: DEBUG_STOP_WATCHPOINT, Watchpoint: watchpoint, Old: values[i], New: value}
+				return true
+			}
+		}
+		if hit {
+			stop = Stop{Reason: DEBUG_STOP_BREAKPOINT, Breakpoint: breakpoint}
+		}
+		return hit
+	})
+	if !found {
+		if err := this.seek(0); err != nil {
+			return Stop{Reason: DEBUG_STOP_ERROR, Err: err}
+		}
+		return Stop{Reason: DEBUG_STOP_HISTORY}
+	}
+	return stop
+}
+
+// Reports whether an instruction stored to variable. Returns, which store to
+// a variable named by the call, aren't counted.
+func writesVariable(event *TraceEvent, variable byte) bool {
+	if event.Stored && event.Instruction.Stores && event.Instruction.StoreVariable == variable {
+		return true
+	}
+	switch event.Instruction.Name {
+	case "store", "inc", "dec", "inc_chk", "dec_chk", "pull":
+		return len(event.Operands) > 0 && event.Operands[0] == uint16(variable)
+	}
+	return false
+}
+
+// Finds the last position before the current one at which hit reports true,
+// and goes back to it. Each segment between snapshots is replayed in turn,
+// latest first, calling hit before each instruction with a function which
+// runs it. The tracer, if any, sees every instruction replayed.
+func (this *Debugger) searchBack(tracer Tracer, hit func(run func()) bool) bool {
+	r := this.recording
+	machine := this.machine
+	start := r.position
+	end := start
+
+	defer this.quietly(tracer)()
+	for i := len(r.snapshots) - 1; i >= 0; i-- {
+		s := r.snapshots[i]
+		if s.position >= end {
+			continue
+		}
+		s.restore(machine)
+		r.position = s.position
+		last := -1
+		for r.position < end {
+			position := r.position
+			if hit(func() { r.step(machine) }) {
+				last = position
+			}
+		}
+		if last >= 0 {
+			this.seekQuietly(last)
+			return true
+		}
+		end = s.position
+	}
+	this.seekQuietly(start)
+	return false
+}
+
+// Goes to the state before the instruction at position.
+func (this *Debugger) seek(position int) error {
+	if position < 0 || position > this.recording.head {
+		return fmt.Errorf("Position %d hasn't been recorded", position)
+	}
+	defer this.quietly(nil)()
+	this.seekQuietly(position)
+	return nil
+}
+
+func (this *Debugger) seekQuietly(position int) {
+	r := this.recording
+	r.before(position).restore(this.machine)
+	r.position = r.before(position).position
+	for r.position < position {
+		r.step(this.machine)
+	}
+}
+
+// Stops output and swaps in tracer while replaying, returning a function to
+// put things back. Watchpoints are then updated, so that where the machine
+// has ended up doesn't count as a change.
+func (this *Debugger) quietly(tracer Tracer) func() {
+	machine := this.machine
+	saved := machine.tracer
+	machine.quiet = true
+	machine.tracer = tracer
+	return func() {
+		machine.quiet = false
+		machine.tracer = saved
+		this.lock.Lock()
+		defer this.lock.Unlock()
+		for _, watchpoint := range this.watchpoints {
+			watchpoint.value = watchpoint.read(machine)
+		}
+	}
+}
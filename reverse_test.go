@@ -0,0 +1,86 @@
+package zmachine
+
+import "testing"
+
+// Returns a debugger, recording, for a story which counts turns in the first
+// global and rolls a die into the second before reading each line.
+func reversingDebugger(t *testing.T) *Debugger {
+	story := testStory(3)
+	story[0x3C0] = 20
+	story[0x3E0] = 4
+	copy(story[testRoutines+1:], []byte{
+		0x95, 0x10, // inc g0
+		0xE7, 0x7F, 0x0A, 0x11, // random 10 -> g1
+		0xE4, 0x0F, 0x03, 0xC0, 0x03, 0xE0, // sread 0x3C0 0x3E0
+		0x8C, 0xFF, 0xF3, // jump 0x501
+	})
+	machine := testMachine(t, story)
+	go func() {
+		for range machine.output {
+		}
+	}()
+	for _, line := range []string{"a", "b", "c"} {
+		machine.input <- line
+	}
+	debugger := NewDebugger(machine)
+	debugger.Record()
+	return debugger
+}
+
+func TestReverseExecution(t *testing.T) {
+	debugger := reversingDebugger(t)
+	for i := 0; i < 12; i++ {
+		if stop := debugger.Step(); stop.Reason != DEBUG_STOP_STEP {
+			t.Fatal(stop)
+		}
+	}
+	roll := debugger.Global(1)
+	if debugger.Position() != 12 || debugger.Turns() != 3 || debugger.Global(0) != 3 {
+		t.Fatalf("at %d after %d turns, with g0 %d", debugger.Position(), debugger.Turns(), debugger.Global(0))
+	}
+
+	if err := debugger.RewindToTurn(2); err != nil {
+		t.Fatal(err)
+	}
+	if debugger.Position() != 6 || debugger.Global(0) != 2 || debugger.PC() != 0x507 {
+		t.Fatalf("rewound to %d at %04x, with g0 %d", debugger.Position(), debugger.PC(), debugger.Global(0))
+	}
+	// Replaying gives the same input and the same random numbers.
+	for i := 0; i < 6; i++ {
+		debugger.Step()
+	}
+	if debugger.Position() != 12 || debugger.Global(0) != 3 || debugger.Global(1) != roll {
+		t.Fatalf("replayed to %d with g0 %d and g1 %d, want g1 %d", debugger.Position(), debugger.Global(0), debugger.Global(1), roll)
+	}
+
+	if err := debugger.StepBack(); err != nil || debugger.Position() != 11 {
+		t.Fatalf("stepped back to %d: %v", debugger.Position(), err)
+	}
+	debugger.Step()
+	if err := debugger.BackToGlobalWrite(0); err != nil || debugger.Position() != 8 || debugger.Global(0) != 2 {
+		t.Fatalf("went back to %d with g0 %d: %v", debugger.Position(), debugger.Global(0), err)
+	}
+}
+
+func TestReverseContinue(t *testing.T) {
+	debugger := reversingDebugger(t)
+	for i := 0; i < 8; i++ {
+		debugger.Step()
+	}
+	debugger.Watch(WATCH_GLOBAL, 0, 0)
+	if stop := debugger.ReverseContinue(); stop.Reason != DEBUG_STOP_WATCHPOINT || debugger.Position() != 4 {
+		t.Fatalf("stopped at %d for %s", debugger.Position(), stop)
+	}
+
+	// Stepping past the end of the recording runs the game again.
+	for debugger.Position() < 8 {
+		debugger.Step()
+	}
+	debugger.machine.input <- "d"
+	for i := 0; i < 8; i++ {
+		debugger.Step()
+	}
+	if debugger.Position() != 16 || debugger.Turns() != 4 || debugger.Global(0) != 4 {
+		t.Errorf("at %d after %d turns, with g0 %d", debugger.Position(), debugger.Turns(), debugger.Global(0))
+	}
+}
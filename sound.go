@@ -0,0 +1,178 @@
+package zmachine
+
+import "sync"
+
+const SOUND_EFFECT_PREPARE = 1
+const SOUND_EFFECT_START = 2
+const SOUND_EFFECT_STOP = 3
+const SOUND_EFFECT_FINISH = 4
+
+// A sound requested by the game. Data and Type come from the story's Blorb, and
+// are empty if the story wasn't loaded from one or it has no such sound.
+type Sound struct {
+	Number  int
+	Type    string // The Blorb chunk type, e.g. "OGGV" or "FORM" for AIFF
+	Data    []byte
+	Volume  int // From 1 to 8
+	Repeats int // 0 means whatever the sound itself specifies, 255 means forever
+}
+
+// Plays the sounds requested by sound_effect. Numbers 1 and 2 are the
+// interpreter's own high and low bleeps; everything else is a sampled sound.
+type AudioSink interface {
+	Bleep(number int)
+	Prepare(sound Sound)
+	// Starts playing a sound. If it plays to the end (rather than being
+	// stopped), the sink must call done, from any goroutine.
+	Start(sound Sound, done func())
+	Stop(number int)
+	Finish(number int)
+}
+
+// Sets where sound effects are played. With no sink, they are silently ignored.
+func (this *ZMachine) SetAudio(sink AudioSink) {
+	this.audio = sink
+	if this.soundFinished == nil {
+		this.soundFinished = make(chan uint16, 16)
+	}
+}
+
+// Looks up a sound in the story's Blorb.
+func (this *ZMachine) sound(number int) Sound {
+	sound := Sound{Number: number}
+	if this.blorb != nil {
+		if resource, ok := this.blorb.Resource(BLORB_USAGE_SOUND, number); ok {
+			sound.Type = resource.Type
+			sound.Data, _ = this.blorb.ResourceData(BLORB_USAGE_SOUND, number)
+		}
+	}
+	return sound
+}
+
+// Implements sound_effect number effect volume routine.
+func (this *ZMachine) soundEffect(args []uint16) {
+	if this.audio == nil {
+		return
+	}
+	// With no operands, the interpreter just beeps.
+	if len(args) == 0 {
+		this.audio.Bleep(1)
+		return
+	}
+
+	number := int(args[0])
+	if number == 1 || number == 2 {
+		this.audio.Bleep(number)
+		return
+	}
+	effect := SOUND_EFFECT_START
+	if len(args) > 1 {
+		effect = int(args[1])
+	}
+
+	switch effect {
+	case SOUND_EFFECT_PREPARE:
+		this.audio.Prepare(this.sound(number))
+	case SOUND_EFFECT_START:
+		sound := this.sound(number)
+		sound.Volume = 8
+		if len(args) > 2 {
+			// The low byte is the volume, with 255 meaning as loud as possible.
+			if volume := int(args[2] & 0xFF); volume >= 1 && volume <= 8 {
+				sound.Volume = volume
+			}
+			// Only from version 5 does the high byte give the number of repeats.
+			if this.version >= 5 {
+				sound.Repeats = int(args[2] >> 8)
+				if sound.Repeats == 0 {
+					sound.Repeats = 1
+				}
+			}
+		}
+		var routine uint16
+		if len(args) > 3 && this.version >= 5 {
+			routine = args[3]
+		}
+		finished := this.soundFinished
+		this.audio.Start(sound, func() {
+			if routine == 0 {
+				return
+			}
+			// If the game is ignoring a pile of finished sounds, it won't miss another.
+			select {
+			case finished <- routine:
+			default:
+			}
+		})
+	case SOUND_EFFECT_STOP:
+		this.audio.Stop(number)
+	case SOUND_EFFECT_FINISH:
+		this.audio.Finish(number)
+	}
+}
+
+// A sound_effect call, as seen by an AudioRecorder.
+type AudioEvent struct {
+	Effect string // "bleep", "prepare", "start", "stop" or "finish"
+	Sound  Sound  // Only Number is set for bleep, stop and finish
+}
+
+// An AudioSink which plays nothing, but remembers what it was asked to do.
+// Sounds only finish when told to, so it can also be used to test
+// end-of-sound routines.
+type AudioRecorder struct {
+	Events []AudioEvent
+
+	lock    sync.Mutex
+	playing map[int]func()
+}
+
+func (this *AudioRecorder) record(effect string, sound Sound) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Events = append(this.Events, AudioEvent{effect, sound})
+}
+
+func (this *AudioRecorder) Bleep(number int) {
+	this.record("bleep", Sound{Number: number})
+}
+
+func (this *AudioRecorder) Prepare(sound Sound) {
+	this.record("prepare", sound)
+}
+
+func (this *AudioRecorder) Start(sound Sound, done func()) {
+	this.record("start", sound)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.playing == nil {
+		this.playing = make(map[int]func())
+	}
+	this.playing[sound.Number] = done
+}
+
+func (this *AudioRecorder) Stop(number int) {
+	this.record("stop", Sound{Number: number})
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.playing, number)
+}
+
+func (this *AudioRecorder) Finish(number int) {
+	this.record("finish", Sound{Number: number})
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.playing, number)
+}
+
+// Pretends that a sound has played to the end, reporting whether it was playing.
+func (this *AudioRecorder) Complete(number int) bool {
+	this.lock.Lock()
+	done, ok := this.playing[number]
+	delete(this.playing, number)
+	this.lock.Unlock()
+	if ok {
+		done()
+	}
+	return ok
+}
@@ -0,0 +1,82 @@
+package zmachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Returns a machine for a story of the given version, whose routine at packed
+// address 0x180 sets the first global to 7.
+func soundMachine(t *testing.T, version byte) (*ZMachine, *AudioRecorder) {
+	story := testStory(version)
+	copy(story[0x600:], []byte{0x00, 0x0D, 0x10, 0x07, 0xB0}) // store g0 7; rtrue
+	machine := testMachine(t, story)
+	recorder := &AudioRecorder{}
+	machine.SetAudio(recorder)
+	return machine, recorder
+}
+
+func TestAudioRecorderEvents(t *testing.T) {
+	machine, recorder := soundMachine(t, 5)
+	machine.soundEffect(nil)
+	machine.soundEffect([]uint16{2})
+	machine.soundEffect([]uint16{3, SOUND_EFFECT_PREPARE})
+	machine.soundEffect([]uint16{3, SOUND_EFFECT_START, 0x0205})
+	machine.soundEffect([]uint16{4})
+	machine.soundEffect([]uint16{3, SOUND_EFFECT_STOP})
+	machine.soundEffect([]uint16{4, SOUND_EFFECT_FINISH})
+
+	want := []AudioEvent{
+		{"bleep", Sound{Number: 1}},
+		{"bleep", Sound{Number: 2}},
+		{"prepare", Sound{Number: 3}},
+		{"start", Sound{Number: 3, Volume: 5, Repeats: 2}},
+		{"start", Sound{Number: 4, Volume: 8}},
+		{"stop", Sound{Number: 3}},
+		{"finish", Sound{Number: 4}},
+	}
+	if !reflect.DeepEqual(recorder.Events, want) {
+		t.Errorf("events %+v\nwant %+v", recorder.Events, want)
+	}
+	// Neither sound is playing any more.
+	if recorder.Complete(3) || recorder.Complete(4) {
+		t.Error("stopped sound completed")
+	}
+}
+
+func TestAudioRecorderComplete(t *testing.T) {
+	machine, recorder := soundMachine(t, 5)
+	machine.soundEffect([]uint16{3, SOUND_EFFECT_START, 8, 0x180})
+	machine.soundEffect([]uint16{4, SOUND_EFFECT_START, 8})
+	if recorder.Complete(5) {
+		t.Error("sound 5 completed without starting")
+	}
+	if !recorder.Complete(4) {
+		t.Fatal("sound 4 wasn't playing")
+	}
+	if !recorder.Complete(3) {
+		t.Fatal("sound 3 wasn't playing")
+	}
+	// Only sound 3 has a routine to call, and a sound only completes once.
+	if len(machine.soundFinished) != 1 || recorder.Complete(3) {
+		t.Fatalf("%d routines waiting", len(machine.soundFinished))
+	}
+
+	runTestMachine(machine)
+	if g := machine.getVariable(0x10); g != 7 {
+		t.Errorf("routine didn't run: global is %d", g)
+	}
+}
+
+func TestAudioRecorderVersion3(t *testing.T) {
+	// Before version 5, there are no repeats or routines.
+	machine, recorder := soundMachine(t, 3)
+	machine.soundEffect([]uint16{3, SOUND_EFFECT_START, 0x0205, 0x180})
+	if want := (Sound{Number: 3, Volume: 5}); !reflect.DeepEqual(recorder.Events[0].Sound, want) {
+		t.Errorf("started %+v, want %+v", recorder.Events[0].Sound, want)
+	}
+	recorder.Complete(3)
+	if len(machine.soundFinished) != 0 {
+		t.Error("routine called in version 3")
+	}
+}
@@ -0,0 +1,184 @@
+package zmachine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rewrites the player's input before the story parses it, expanding aliases
+// and correcting words which aren't in the dictionary to the nearest ones
+// which are.
+type InputCorrector struct {
+	Aliases map[string]string // Words and the text which replaces them, such as "inv" for "inventory"
+
+	// The most single-character edits a correction may make. Zero turns
+	// correction off. Words of fewer than three letters are never corrected.
+	MaxDistance int
+	Suggest     bool // Only suggest corrections, leaving the input alone
+
+	// Called for each change made or suggested. If nil, they're printed.
+	Report func(substitution Substitution)
+
+	dictionary *Dictionary
+}
+
+// A change made to the player's input, or suggested.
+type Substitution struct {
+	Typed       string
+	Replacement string
+	Alias       bool // An alias was expanded, rather than a word corrected
+	Suggested   bool // The input was left as it was
+}
+
+func (this Substitution) String() string {
+	if this.Suggested {
+		return fmt.Sprintf("[Did you mean %q?]", this.Replacement)
+	}
+	return fmt.Sprintf("[%s → %s]", this.Typed, this.Replacement)
+}
+
+// Sets how the player's input is corrected. Pass nil to leave it alone.
+func (this *ZMachine) SetInputCorrector(corrector *InputCorrector) {
+	if corrector != nil {
+		corrector.dictionary = nil
+	}
+	this.corrector = corrector
+}
+
+// Returns the line with aliases expanded and unknown words corrected,
+// reporting each substitution. Words are split as the tokeniser splits them.
+func (this *ZMachine) correctInput(line string) string {
+	corrector := this.corrector
+	if corrector.dictionary == nil {
+		dictionary, err := this.Dictionary()
+		if err != nil {
+			return line
+		}
+		corrector.dictionary = dictionary
+	}
+
+	var corrected []string
+	for _, word := range this.splitWords(line) {
+		substitution, ok := corrector.substitute(word)
+		if ok {
+			if corrector.Report != nil {
+				corrector.Report(substitution)
+			} else {
+				this.print(substitution.String() + "\n")
+			}
+			if !substitution.Suggested {
+				word = substitution.Replacement
+			}
+		}
+		corrected = append(corrected, word)
+	}
+	return strings.Join(corrected, "")
+}
+
+// Splits a line into words, separators and the spaces between them, which
+// join to give the line again.
+func (this *ZMachine) splitWords(line string) []string {
+	var words []string
+	start := 0
+	for i := 0; i < len(line); i++ {
+		if line[i] == ' ' || strings.IndexByte(string(this.wordSeparators), line[i]) >= 0 {
+			if i > start {
+				words = append(words, line[start:i])
+			}
+			words = append(words, line[i:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(line) {
+		words = append(words, line[start:])
+	}
+	return words
+}
+
+// Decides what, if anything, should replace word.
+func (this *InputCorrector) substitute(word string) (Substitution, bool) {
+	if replacement, ok := this.Aliases[strings.ToLower(word)]; ok {
+		return Substitution{Typed: word, Replacement: replacement, Alias: true}, true
+	}
+	if this.MaxDistance <= 0 || len(word) < 3 || !isLetters(word) {
+		return Substitution{}, false
+	}
+	if _, ok := this.dictionary.Lookup(word); ok {
+		return Substitution{}, false
+	}
+
+	// Only as much of the word as the dictionary keeps is compared, and the
+	// nearest entry must be the only one so near.
+	typed, limit := word, this.dictionary.KeyLength/2*3
+	if len(typed) > limit {
+		typed = typed[:limit]
+	}
+	best, nearest, ties := this.MaxDistance+1, "", 0
+	for _, entry := range this.dictionary.Entries {
+		if !isLetters(entry.Word) {
+			continue
+		}
+		distance := editDistance(typed, entry.Word)
+		switch {
+		case distance < best:
+			best, nearest, ties = distance, entry.Word, 1
+		case distance == best:
+			ties++
+		}
+	}
+	if nearest == "" || ties > 1 || best >= len(typed) {
+		return Substitution{}, false
+	}
+	// An entry as long as the key may be the start of a longer word, which
+	// the rest of what was typed finishes.
+	if len(nearest) == limit {
+		nearest += word[len(typed):]
+	}
+	return Substitution{Typed: word, Replacement: nearest, Suggested: this.Suggest}, true
+}
+
+func isLetters(word string) bool {
+	for i := 0; i < len(word); i++ {
+		if c := word[i]; (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return word != ""
+}
+
+// Returns the fewest insertions, deletions and replacements of single
+// characters, and swaps of neighbouring ones, turning a into b. Swaps are the
+// commonest typing mistake.
+func editDistance(a, b string) int {
+	rows := make([][]int, len(a)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(b)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min3(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && rows[i-2][j-2]+1 < rows[i][j] {
+				rows[i][j] = rows[i-2][j-2] + 1
+			}
+		}
+	}
+	return rows[len(a)][len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,112 @@
+package zmachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		distance int
+	}{
+		{"take", "take", 0},
+		{"tkae", "take", 1}, // A swap
+		{"tak", "take", 1},
+		{"takes", "take", 1},
+		{"tale", "take", 1},
+		{"atke", "take", 1},
+		{"", "take", 4},
+		{"north", "south", 2},
+	} {
+		if distance := editDistance(test.a, test.b); distance != test.distance {
+			t.Errorf("%q to %q is %d, want %d", test.a, test.b, distance, test.distance)
+		}
+	}
+}
+
+// Returns a machine whose dictionary has a few words, and a corrector for it
+// which records the substitutions it makes.
+func correctingMachine(t *testing.T, words ...string) (*ZMachine, *[]Substitution) {
+	machine := dictionaryStory(t, 3, words, true)
+	var substitutions []Substitution
+	machine.SetInputCorrector(&InputCorrector{
+		Aliases:     map[string]string{"tl": "take lamp"},
+		MaxDistance: 2,
+		Report: func(substitution Substitution) {
+			substitutions = append(substitutions, substitution)
+		},
+	})
+	return machine, &substitutions
+}
+
+func TestCorrectInput(t *testing.T) {
+	machine, substitutions := correctingMachine(t, "take", "the", "lamp", "brass", "grass")
+	if line := machine.correctInput("tkae the lmap, TL"); line != "take the lamp, take lamp" {
+		t.Errorf("corrected to %q", line)
+	}
+	want := []Substitution{
+		{Typed: "tkae", Replacement: "take"},
+		{Typed: "lmap", Replacement: "lamp"},
+		{Typed: "TL", Replacement: "take lamp", Alias: true},
+	}
+	if !reflect.DeepEqual(*substitutions, want) {
+		t.Errorf("substitutions %+v, want %+v", *substitutions, want)
+	}
+}
+
+func TestCorrectLongWords(t *testing.T) {
+	// The dictionary keeps only "lanter" and "mailbo", but the corrections
+	// are whole words.
+	machine, substitutions := correctingMachine(t, "lantern", "mailbox", "take")
+	if line := machine.correctInput("take lanturn, mialbox"); line != "take lantern, mailbox" {
+		t.Errorf("corrected to %q", line)
+	}
+	want := []Substitution{
+		{Typed: "lanturn", Replacement: "lantern"},
+		{Typed: "mialbox", Replacement: "mailbox"},
+	}
+	if !reflect.DeepEqual(*substitutions, want) {
+		t.Errorf("substitutions %+v, want %+v", *substitutions, want)
+	}
+	// As for the story, a word whose start is in the dictionary is known.
+	if line := machine.correctInput("lanternsss"); line != "lanternsss" {
+		t.Errorf("corrected to %q", line)
+	}
+}
+
+func TestCorrectInputLeavesAlone(t *testing.T) {
+	machine, substitutions := correctingMachine(t, "take", "the", "lamp", "brass", "grass")
+	for _, line := range []string{
+		"crass", // As near to brass as to grass
+		"th",    // Too short
+		"123",   // Not a word
+		"xyzzy", // Too far from anything
+		"lamp.", // Already known
+		"tkae2", // Not only letters
+	} {
+		if corrected := machine.correctInput(line); corrected != line {
+			t.Errorf("%q corrected to %q", line, corrected)
+		}
+	}
+	if len(*substitutions) != 0 {
+		t.Errorf("substitutions %+v", *substitutions)
+	}
+
+	machine.corrector.MaxDistance = 0
+	if line := machine.correctInput("tkae tl"); line != "tkae take lamp" {
+		t.Errorf("corrected to %q with correction off", line)
+	}
+}
+
+func TestSuggestCorrections(t *testing.T) {
+	machine, _ := correctingMachine(t, "take", "lamp")
+	machine.corrector.Suggest = true
+	machine.corrector.Report = nil
+	if line := machine.correctInput("tkae lamp"); line != "tkae lamp" {
+		t.Errorf("suggesting changed the input to %q", line)
+	}
+	if output := <-machine.output; output != "[Did you mean \"take\"?]\n" {
+		t.Errorf("suggested %q", output)
+	}
+}
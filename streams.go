@@ -0,0 +1,35 @@
+package zmachine
+
+// Selects or deselects an output stream, as output_stream does. Only stream 3,
+// which writes to a table in memory, changes anything: the screen is always
+// written to, and there's no transcript.
+func (this *ZMachine) outputStream(stream int16, table uint16) {
+	switch stream {
+	case 3:
+		if len(this.memoryStreams) == 16 {
+			panic("Output stream 3 selected more than 16 times")
+		}
+		this.setNumber(int(table), 0)
+		this.memoryStreams = append(this.memoryStreams, int(table))
+	case -3:
+		if len(this.memoryStreams) > 0 {
+			this.memoryStreams = this.memoryStreams[:len(this.memoryStreams)-1]
+		}
+	}
+}
+
+// Adds s to the table output stream 3 is writing to, after its length.
+func (this *ZMachine) printToTable(s string) {
+	table := this.memoryStreams[len(this.memoryStreams)-1]
+	length := int(this.number(table))
+	zscii := zsciiFromString(s, this.characterTable())
+	copy(this.memory[table+2+length:], zscii)
+	this.setNumber(table, uint16(length+len(zscii)))
+}
+
+// Selects the lower window, 0, or the upper window, 1. Stories print their
+// status lines and quotations in the upper window, whose text is passed to
+// the text sink marked as the upper window's.
+func (this *ZMachine) setWindow(window uint16) {
+	this.upperWindow = window == 1
+}
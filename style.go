@@ -0,0 +1,279 @@
+package zmachine
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+const STYLE_ROMAN = 0
+const STYLE_REVERSE = 1
+const STYLE_BOLD = 2
+const STYLE_ITALIC = 4
+const STYLE_FIXED = 8
+
+const FONT_NORMAL = 1
+const FONT_PICTURE = 2
+const FONT_CHARACTER_GRAPHICS = 3
+const FONT_FIXED = 4
+
+// A colour as set_true_colour gives it, with five bits each of blue, green
+// and red from the highest, or COLOUR_DEFAULT for the front-end's own.
+type Colour int
+
+const COLOUR_DEFAULT Colour = -1
+
+// The colours which set_colour numbers from 2, as the standard defines them.
+var standardColours = []Colour{
+	0x0000, // Black
+	0x001D, // Red
+	0x0340, // Green
+	0x03BD, // Yellow
+	0x59A0, // Blue
+	0x7C1F, // Magenta
+	0x77A0, // Cyan
+	0x7FFF, // White
+	0x5AD6, // Light grey
+	0x4631, // Medium grey
+	0x2D6B, // Dark grey
+}
+
+// Returns the colour's red, green and blue, from 0 to 255.
+func (this Colour) RGB() (r, g, b byte) {
+	scale := func(c int) byte {
+		return byte(c * 255 / 31)
+	}
+	return scale(int(this) & 0x1F), scale(int(this) >> 5 & 0x1F), scale(int(this) >> 10 & 0x1F)
+}
+
+// How text is to be shown.
+type TextStyle struct {
+	Bold, Italic, Reverse bool
+	Fixed                 bool // Fixed-pitch, whether by style or by font
+	Foreground            Colour
+	Background            Colour
+	Font                  int
+}
+
+var defaultStyle = TextStyle{Foreground: COLOUR_DEFAULT, Background: COLOUR_DEFAULT, Font: FONT_NORMAL}
+
+// Some text, all in one style.
+type StyledRun struct {
+	Text   string
+	Style  TextStyle
+	Window int // 0 for the lower window, or 1 for the upper, where stories put status lines and quotations
+}
+
+// Receives the story's output with its styles, fonts and colours.
+type TextSink interface {
+	Text(run StyledRun)
+}
+
+// Sets where output goes along with its style. With a sink, output is sent
+// there instead of to the output channel, including the upper window's,
+// which the output channel never gets.
+func (this *ZMachine) SetTextSink(sink TextSink) {
+	this.textSink = sink
+}
+
+// Returns the style text is printed in.
+func (this *ZMachine) Style() TextStyle {
+	if this.style == nil {
+		return defaultStyle
+	}
+	return *this.style
+}
+
+func (this *ZMachine) setStyle(style TextStyle) {
+	style.Fixed = style.Font == FONT_FIXED || this.fixedStyle
+	this.style = &style
+}
+
+// Implements set_text_style. Roman turns everything off; the others add to
+// what's already set.
+func (this *ZMachine) setTextStyle(style uint16) {
+	current := this.Style()
+	if style == STYLE_ROMAN {
+		current.Bold, current.Italic, current.Reverse = false, false, false
+		this.fixedStyle = false
+	}
+	current.Reverse = current.Reverse || style&STYLE_REVERSE != 0
+	current.Bold = current.Bold || style&STYLE_BOLD != 0
+	current.Italic = current.Italic || style&STYLE_ITALIC != 0
+	this.fixedStyle = this.fixedStyle || style&STYLE_FIXED != 0
+	this.setStyle(current)
+}
+
+// Implements set_colour. 0 leaves a colour as it is and 1 is the default.
+func (this *ZMachine) setColour(foreground, background uint16) {
+	style := this.Style()
+	colour := func(n uint16, current Colour) Colour {
+		switch {
+		case n == 1:
+			return COLOUR_DEFAULT
+		case n >= 2 && int(n)-2 < len(standardColours):
+			return standardColours[n-2]
+		}
+		return current
+	}
+	style.Foreground = colour(foreground, style.Foreground)
+	style.Background = colour(background, style.Background)
+	this.setStyle(style)
+}
+
+// Implements set_true_colour. -1 is the default, and other negative values
+// leave a colour as it is.
+func (this *ZMachine) setTrueColour(foreground, background uint16) {
+	style := this.Style()
+	colour := func(n uint16, current Colour) Colour {
+		switch {
+		case n == 0xFFFF:
+			return COLOUR_DEFAULT
+		case n < 0x8000:
+			return Colour(n)
+		}
+		return current
+	}
+	style.Foreground = colour(foreground, style.Foreground)
+	style.Background = colour(background, style.Background)
+	this.setStyle(style)
+}
+
+// Implements set_font, returning the previous font, or 0 if the font isn't
+// available. Font 0 asks for the current font without changing it.
+func (this *ZMachine) setFont(font uint16) uint16 {
+	style := this.Style()
+	previous := uint16(style.Font)
+	switch font {
+	case 0:
+	case FONT_NORMAL, FONT_FIXED:
+		style.Font = int(font)
+		this.setStyle(style)
+	default:
+		return 0
+	}
+	return previous
+}
+
+// Writes output to a terminal, using ANSI escape sequences for its styles and
+// colours. Fonts aren't shown.
+type ANSIRenderer struct {
+	w     io.Writer
+	style TextStyle
+	err   error
+}
+
+func NewANSIRenderer(w io.Writer) *ANSIRenderer {
+	return &ANSIRenderer{w: w, style: defaultStyle}
+}
+
+// Only the lower window is written, as the upper window's status lines would
+// break up the story's text.
+func (this *ANSIRenderer) Text(run StyledRun) {
+	if this.err != nil || run.Window != 0 {
+		return
+	}
+	if run.Style != this.style {
+		codes := []string{"0"}
+		for _, style := range []struct {
+			on   bool
+			code string
+		}{{run.Style.Bold, "1"}, {run.Style.Italic, "3"}, {run.Style.Reverse, "7"}} {
+			if style.on {
+				codes = append(codes, style.code)
+			}
+		}
+		if c := run.Style.Foreground; c != COLOUR_DEFAULT {
+			r, g, b := c.RGB()
+			codes = append(codes, fmt.Sprintf("38;2;%d;%d;%d", r, g, b))
+		}
+		if c := run.Style.Background; c != COLOUR_DEFAULT {
+			r, g, b := c.RGB()
+			codes = append(codes, fmt.Sprintf("48;2;%d;%d;%d", r, g, b))
+		}
+		if _, this.err = fmt.Fprintf(this.w, "\x1b[%sm", strings.Join(codes, ";")); this.err != nil {
+			return
+		}
+		this.style = run.Style
+	}
+	_, this.err = io.WriteString(this.w, run.Text)
+}
+
+// Puts the terminal back to its usual style, if the output has changed it.
+func (this *ANSIRenderer) Close() error {
+	if this.err == nil && this.style != defaultStyle {
+		_, this.err = io.WriteString(this.w, "\x1b[0m")
+		this.style = defaultStyle
+	}
+	return this.err
+}
+
+// Returns the first error writing the output, if any.
+func (this *ANSIRenderer) Err() error {
+	return this.err
+}
+
+// Writes output as HTML, with each run of styled text in a span. Lines are
+// broken with <br>.
+type HTMLRenderer struct {
+	w   io.Writer
+	err error
+}
+
+func NewHTMLRenderer(w io.Writer) *HTMLRenderer {
+	return &HTMLRenderer{w: w}
+}
+
+// Only the lower window is written, as for ANSIRenderer.
+func (this *HTMLRenderer) Text(run StyledRun) {
+	if this.err != nil || run.Text == "" || run.Window != 0 {
+		return
+	}
+	text := strings.Replace(html.EscapeString(run.Text), "\n", "<br>\n", -1)
+	css := htmlStyle(run.Style)
+	if css == "" {
+		_, this.err = io.WriteString(this.w, text)
+	} else {
+		_, this.err = fmt.Fprintf(this.w, `<span style="%s">%s</span>`, css, text)
+	}
+}
+
+// Returns the first error writing the output, if any.
+func (this *HTMLRenderer) Err() error {
+	return this.err
+}
+
+// Returns the CSS for a style, or "" for the default. Reversing the default
+// colours uses the browser's own.
+func htmlStyle(style TextStyle) string {
+	var css []string
+	if style.Bold {
+		css = append(css, "font-weight:bold")
+	}
+	if style.Italic {
+		css = append(css, "font-style:italic")
+	}
+	if style.Fixed {
+		css = append(css, "font-family:monospace")
+	}
+	foreground, background := htmlColour(style.Foreground, "CanvasText"), htmlColour(style.Background, "Canvas")
+	if style.Reverse {
+		foreground, background = background, foreground
+	}
+	if style.Reverse || style.Foreground != COLOUR_DEFAULT {
+		css = append(css, "color:"+foreground)
+	}
+	if style.Reverse || style.Background != COLOUR_DEFAULT {
+		css = append(css, "background-color:"+background)
+	}
+	return strings.Join(css, ";")
+}
+
+func htmlColour(colour Colour, otherwise string) string {
+	if colour == COLOUR_DEFAULT {
+		return otherwise
+	}
+	r, g, b := colour.RGB()
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
@@ -0,0 +1,104 @@
+package zmachine
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func styleMachine(t *testing.T) *ZMachine {
+	return testMachine(t, testStory(5))
+}
+
+func TestStyleResetByRestart(t *testing.T) {
+	machine := styleMachine(t)
+	machine.setTextStyle(STYLE_BOLD | STYLE_FIXED)
+	machine.setColour(3, 9)
+	if style := machine.Style(); !style.Bold || !style.Fixed || style.Foreground != standardColours[1] {
+		t.Fatalf("style %+v", style)
+	}
+	machine.CompleteSetup()
+	if style := machine.Style(); style != defaultStyle || machine.fixedStyle {
+		t.Errorf("style %+v after restarting", style)
+	}
+}
+
+func TestStyleInSnapshot(t *testing.T) {
+	machine := styleMachine(t)
+	machine.journal = &journal{}
+	machine.setTextStyle(STYLE_ITALIC | STYLE_FIXED)
+	snapshot := takeSnapshot(machine, 0)
+	before := machine.Style()
+
+	machine.setTextStyle(STYLE_ROMAN)
+	machine.setFont(FONT_FIXED)
+	snapshot.restore(machine)
+	if style := machine.Style(); style != before || !machine.fixedStyle {
+		t.Errorf("style %+v after restoring, want %+v", style, before)
+	}
+	// Roman turns off the fixed style which the snapshot brought back.
+	machine.setTextStyle(STYLE_ROMAN)
+	if machine.Style().Fixed {
+		t.Error("still fixed after roman")
+	}
+}
+
+func TestRenderers(t *testing.T) {
+	bold := defaultStyle
+	bold.Bold = true
+	red := defaultStyle
+	red.Foreground = standardColours[1]
+	runs := []StyledRun{{"a <b>\n", defaultStyle, 0}, {"c", bold, 0}, {"Score: 0", bold, 1}, {"d", red, 0}, {"", bold, 0}}
+
+	var ansi bytes.Buffer
+	ansiRenderer := NewANSIRenderer(&ansi)
+	for _, run := range runs {
+		ansiRenderer.Text(run)
+	}
+	if err := ansiRenderer.Close(); err != nil || ansi.String() != "a <b>\n\x1b[0;1mc\x1b[0;38;2;238;0;0md\x1b[0;1m\x1b[0m" {
+		t.Errorf("ANSI %q, %v", ansi.String(), err)
+	}
+
+	var html bytes.Buffer
+	htmlRenderer := NewHTMLRenderer(&html)
+	for _, run := range runs {
+		htmlRenderer.Text(run)
+	}
+	if want := `a &lt;b&gt;<br>
+<span style="font-weight:bold">c</span><span style="color:#ee0000">d</span>`; html.String() != want {
+		t.Errorf("HTML %q", html.String())
+	}
+}
+
+// Collects the runs of text sent to it.
+type testSink []StyledRun
+
+func (this *testSink) Text(run StyledRun) {
+	*this = append(*this, run)
+}
+
+func TestUpperWindowText(t *testing.T) {
+	story := testStory(5)
+	code := []byte{0xEB, 0x7F, 0x01, 0xB2} // set_window 1; print "up"
+	code = append(code, encodeTestText("up")...)
+	code = append(code, 0xEB, 0x7F, 0x00, 0xB2) // set_window 0; print "down"
+	code = append(code, encodeTestText("down")...)
+	code = append(code, 0xBA) // quit
+	copy(story[testRoutines+1:], code)
+
+	// The output channel gets only the lower window.
+	machine := testMachine(t, story)
+	runTestMachine(machine)
+	if output := <-machine.output; output != "down" {
+		t.Errorf("output %q", output)
+	}
+
+	machine = testMachine(t, story)
+	var sink testSink
+	machine.SetTextSink(&sink)
+	runTestMachine(machine)
+	want := testSink{{"up", defaultStyle, 1}, {"down", defaultStyle, 0}}
+	if !reflect.DeepEqual(sink, want) {
+		t.Errorf("sink got %+v", sink)
+	}
+}
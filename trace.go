@@ -0,0 +1,248 @@
+package zmachine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// What happened when an instruction was executed.
+type TraceEvent struct {
+	PC          int
+	Routine     int // The routine containing the instruction, or 0 if unknown
+	Depth       int // The number of routine calls below this one
+	Instruction Instruction
+	Operands    []uint16 // The operand values, after reading any variables
+
+	Stored      bool // Whether the instruction stored a result, which for a return is the call's
+	StoredValue uint16
+	Branched    bool // Whether the branch was taken, for instructions which branch
+}
+
+// Receives an event for every instruction the machine executes.
+type Tracer interface {
+	Trace(event *TraceEvent)
+}
+
+// Lets an ordinary function be used as a Tracer.
+type TracerFunc func(event *TraceEvent)
+
+func (this TracerFunc) Trace(event *TraceEvent) {
+	this(event)
+}
+
+// Sets where execution is traced to. Pass nil to stop tracing.
+func (this *ZMachine) SetTracer(tracer Tracer) {
+	this.tracer = tracer
+}
+
+// A range of addresses, from Low up to but not including High.
+type AddressRange struct {
+	Low, High int
+}
+
+func (this AddressRange) Contains(address int) bool {
+	return address >= this.Low && address < this.High
+}
+
+// Returns a Tracer which only passes on instructions in routines starting
+// within one of the ranges. With no ranges, everything is passed on.
+func FilterTrace(tracer Tracer, ranges ...AddressRange) Tracer {
+	return TracerFunc(func(event *TraceEvent) {
+		if len(ranges) == 0 {
+			tracer.Trace(event)
+			return
+		}
+		for _, r := range ranges {
+			if r.Contains(event.Routine) {
+				tracer.Trace(event)
+				return
+			}
+		}
+	})
+}
+
+// Writes one line per instruction: its address and disassembly, followed by the
+// operand values and the outcome unless Brief is set. Brief traces line up
+// with the instruction traces of other interpreters, such as Frotz, so the two
+// can be compared with diff.
+//
+// With Symbols, instructions use the names from the source, and each new
+// source line is announced with its routine, as "; Name (file.inf:123)".
+type TextTracer struct {
+	Writer  io.Writer
+	Brief   bool
+	Symbols *DebugInfo
+
+	location string // The last location announced
+}
+
+func NewTextTracer(w io.Writer) *TextTracer {
+	return &TextTracer{Writer: w}
+}
+
+func (this *TextTracer) Trace(event *TraceEvent) {
+	if this.Symbols != nil {
+		if location := this.Symbols.Describe(event.PC); location != this.location {
+			fmt.Fprintf(this.Writer, "; %s\n", location)
+			this.location = location
+		}
+	}
+	instruction := event.Instruction.Format(this.Symbols)
+	if this.Brief {
+		fmt.Fprintf(this.Writer, "%05x: %s\n", event.PC, instruction)
+		return
+	}
+
+	line := fmt.Sprintf("%05x: %-40s", event.PC, instruction)
+	if len(event.Operands) > 0 {
+		values := make([]string, len(event.Operands))
+		for i, value := range event.Operands {
+			values[i] = fmt.Sprintf("%04x", value)
+		}
+		line += " (" + strings.Join(values, " ") + ")"
+	}
+	if event.Stored {
+		line += fmt.Sprintf(" = %04x", event.StoredValue)
+	}
+	if event.Instruction.Branches {
+		if event.Branched {
+			line += " taken"
+		} else {
+			line += " not taken"
+		}
+	}
+	fmt.Fprintln(this.Writer, strings.TrimRight(line, " "))
+}
+
+// The magic number at the start of a binary trace.
+const binaryTraceMagic = "ZTRC"
+
+// Writes a compact binary record of each instruction. The trace starts with
+// "ZTRC" and the story's version byte, followed by a record per instruction,
+// with all numbers big-endian:
+//
+//	4 bytes   address of the instruction
+//	4 bytes   address of its routine
+//	1 byte    operand count: 0 to 4 for 0OP, 1OP, 2OP, VAR and EXT
+//	1 byte    opcode number
+//	1 byte    number of operands, n
+//	2n bytes  operand values
+//	1 byte    flags: 1 if a value was stored, 2 if a branch was taken
+//	2 bytes   the value stored, only present if flag 1 is set
+type BinaryTracer struct {
+	writer  io.Writer
+	started bool
+	err     error
+}
+
+func NewBinaryTracer(w io.Writer) *BinaryTracer {
+	return &BinaryTracer{writer: w}
+}
+
+// Returns the first error encountered writing the trace, if any.
+func (this *BinaryTracer) Err() error {
+	return this.err
+}
+
+func (this *BinaryTracer) Trace(event *TraceEvent) {
+	if this.err != nil {
+		return
+	}
+	record := make([]byte, 0, 24)
+	if !this.started {
+		record = append(record, binaryTraceMagic...)
+		record = append(record, event.Instruction.version)
+		this.started = true
+	}
+	record = appendUint32(record, uint32(event.PC))
+	record = appendUint32(record, uint32(event.Routine))
+	record = append(record, byte(event.Instruction.Count), event.Instruction.Opcode, byte(len(event.Operands)))
+	for _, value := range event.Operands {
+		record = append(record, byte(value>>8), byte(value))
+	}
+	flags := byte(0)
+	if event.Stored {
+		flags |= 1
+	}
+	if event.Branched {
+		flags |= 2
+	}
+	record = append(record, flags)
+	if event.Stored {
+		record = append(record, byte(event.StoredValue>>8), byte(event.StoredValue))
+	}
+	_, this.err = this.writer.Write(record)
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// Reads the records written by a BinaryTracer back into events. Only the
+// address, count, opcode and name of each event's Instruction are filled in.
+type BinaryTraceReader struct {
+	reader  *bufio.Reader
+	version byte
+}
+
+func NewBinaryTraceReader(r io.Reader) (*BinaryTraceReader, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(binaryTraceMagic)+1)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(binaryTraceMagic)]) != binaryTraceMagic {
+		return nil, errors.New("Not a binary trace")
+	}
+	return &BinaryTraceReader{reader, header[len(binaryTraceMagic)]}, nil
+}
+
+// Returns the next event in the trace, or io.EOF at the end.
+func (this *BinaryTraceReader) Next() (*TraceEvent, error) {
+	fixed := make([]byte, 11)
+	if _, err := io.ReadFull(this.reader, fixed); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("Truncated binary trace")
+		}
+		return nil, err
+	}
+	event := &TraceEvent{
+		PC:      int(binary.BigEndian.Uint32(fixed[0:])),
+		Routine: int(binary.BigEndian.Uint32(fixed[4:])),
+	}
+	event.Instruction = Instruction{
+		Address: event.PC,
+		Count:   OperandCount(fixed[8]),
+		Opcode:  fixed[9],
+		version: this.version,
+	}
+	if info := findOpcode(event.Instruction.Count, event.Instruction.Opcode, this.version); info != nil {
+		event.Instruction.Name = info.name
+		event.Instruction.Stores = info.flags&opcodeStores != 0
+		event.Instruction.Branches = info.flags&opcodeBranches != 0
+	}
+
+	rest := make([]byte, 2*int(fixed[10])+1)
+	if _, err := io.ReadFull(this.reader, rest); err != nil {
+		return nil, errors.New("Truncated binary trace")
+	}
+	event.Operands = make([]uint16, fixed[10])
+	for i := range event.Operands {
+		event.Operands[i] = binary.BigEndian.Uint16(rest[2*i:])
+	}
+	flags := rest[len(rest)-1]
+	event.Branched = flags&2 != 0
+	if flags&1 != 0 {
+		value := make([]byte, 2)
+		if _, err := io.ReadFull(this.reader, value); err != nil {
+			return nil, errors.New("Truncated binary trace")
+		}
+		event.Stored = true
+		event.StoredValue = binary.BigEndian.Uint16(value)
+	}
+	return event, nil
+}
@@ -0,0 +1,120 @@
+package zmachine
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Returns a story whose main routine calls a routine at 0x600 which adds one
+// to its argument, and branches on the result.
+func tracingStory() []byte {
+	story := testStory(3)
+	copy(story[testRoutines+1:], []byte{
+		0xE0, 0x1F, 0x03, 0x00, 0x05, 0x00, // call 0x600 5 -> sp
+		0x41, 0x00, 0x06, 0xC2, // je sp 6 ?(next)
+		0xBA, // quit
+	})
+	copy(story[0x600:], []byte{
+		0x01, 0x00, 0x00, // One local
+		0x54, 0x01, 0x01, 0x00, // add L00 1 -> sp
+		0xB8, // ret_popped
+	})
+	return story
+}
+
+// Runs the story with a tracer until it quits.
+func traceTestMachine(t *testing.T, story []byte, tracer Tracer) {
+	machine := testMachine(t, story)
+	machine.SetTracer(tracer)
+	machine.running = true
+	for machine.running {
+		machine.executeCycle()
+	}
+}
+
+func TestTraceEvents(t *testing.T) {
+	var events []*TraceEvent
+	traceTestMachine(t, tracingStory(), TracerFunc(func(event *TraceEvent) {
+		events = append(events, event)
+	}))
+	if len(events) != 5 {
+		t.Fatalf("%d events, want 5", len(events))
+	}
+	add := events[1]
+	if add.PC != 0x603 || add.Routine != 0x600 || add.Depth != 1 || !add.Stored || add.StoredValue != 6 {
+		t.Errorf("add event %+v", add)
+	}
+	if len(add.Operands) != 2 || add.Operands[0] != 5 || add.Operands[1] != 1 {
+		t.Errorf("add operands %v", add.Operands)
+	}
+	// The call's result is stored when the routine returns.
+	if call, ret := events[0], events[2]; call.Stored || !ret.Stored || ret.StoredValue != 6 {
+		t.Errorf("call event %+v, return event %+v", call, ret)
+	}
+	if je := events[3]; je.PC != 0x507 || je.Depth != 0 || !je.Branched {
+		t.Errorf("je event %+v", je)
+	}
+}
+
+func TestTextTracer(t *testing.T) {
+	var text bytes.Buffer
+	traceTestMachine(t, tracingStory(), NewTextTracer(&text))
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("trace %q", text.String())
+	}
+	if !strings.HasPrefix(lines[1], "00603: add L00 #01 -> sp") || !strings.HasSuffix(lines[1], " (0005 0001) = 0006") {
+		t.Errorf("add traced as %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[3], " taken") || strings.HasSuffix(lines[3], "not taken") {
+		t.Errorf("je traced as %q", lines[3])
+	}
+
+	// Brief traces of only the called routine.
+	text.Reset()
+	traceTestMachine(t, tracingStory(), FilterTrace(&TextTracer{Writer: &text, Brief: true}, AddressRange{0x600, 0x610}))
+	if want := "00603: add L00 #01 -> sp\n00607: ret_popped\n"; text.String() != want {
+		t.Errorf("filtered trace %q, want %q", text.String(), want)
+	}
+}
+
+func TestBinaryTrace(t *testing.T) {
+	var events []*TraceEvent
+	var data bytes.Buffer
+	binary := NewBinaryTracer(&data)
+	traceTestMachine(t, tracingStory(), TracerFunc(func(event *TraceEvent) {
+		events = append(events, event)
+		binary.Trace(event)
+	}))
+	if err := binary.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewBinaryTraceReader(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		event, err := reader.Next()
+		if err == io.EOF {
+			if i != len(events) {
+				t.Errorf("read %d events, want %d", i, len(events))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := events[i]
+		if event.PC != want.PC || event.Routine != want.Routine || event.Instruction.Name != want.Instruction.Name ||
+			event.Stored != want.Stored || event.StoredValue != want.StoredValue || event.Branched != want.Branched {
+			t.Errorf("event %d read as %+v, want %+v", i, event, want)
+		}
+	}
+
+	if _, err := NewBinaryTraceReader(strings.NewReader("FORM")); err == nil {
+		t.Error("read a trace without the magic number")
+	}
+}
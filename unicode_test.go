@@ -0,0 +1,65 @@
+package zmachine
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Returns a version 5 story whose header extension gives a Unicode
+// translation table of Cyrillic zhe and e acute.
+func unicodeStory() []byte {
+	story := testStory(5)
+	story[0x36], story[0x37] = 0x03, 0x60
+	copy(story[0x360:], []byte{0x00, 0x03, 0, 0, 0, 0, 0x03, 0x70})
+	copy(story[0x370:], []byte{2, 0x04, 0x36, 0x00, 0xE9})
+	return story
+}
+
+func TestUnicodeTable(t *testing.T) {
+	machine := testMachine(t, unicodeStory())
+	if table := string(machine.characterTable()); table != "жé" {
+		t.Fatalf("read table %q", table)
+	}
+	zscii := ZSCIIString{[]byte{155, 156, 'a', 157, 0, 13}, machine}
+	if s := zscii.String(); s != "жéa?\n" {
+		t.Errorf("decoded %q", s)
+	}
+
+	// Characters the table leaves out lose their accents, or become
+	// question marks.
+	if typed := zsciiFromString("Жжéäß☃", machine.characterTable()); !bytes.Equal(typed, []byte{'?', 155, 156, 'a', 's', 's', '?'}) {
+		t.Errorf("typed %v", typed)
+	}
+
+	// Earlier versions, and stories without tables, use the default.
+	for _, story := range [][]byte{testStory(5), testStory(3)} {
+		machine := testMachine(t, story)
+		if typed := zsciiFromString("äж", machine.characterTable()); !bytes.Equal(typed, []byte{155, '?'}) {
+			t.Errorf("version %d typed %v", story[0], typed)
+		}
+	}
+}
+
+func TestUnicodeOpcodes(t *testing.T) {
+	story := unicodeStory()
+	copy(story[testRoutines+1:], []byte{
+		0xBE, 0x0B, 0x3F, 0x04, 0x36, // print_unicode 0x436
+		0xBE, 0x0C, 0x3F, 0x04, 0x36, 0x10, // check_unicode 0x436 -> g0
+		0xBE, 0x0C, 0x3F, 0x26, 0x3A, 0x11, // check_unicode 0x263A -> g1
+		0xBE, 0x0C, 0x3F, 0xD8, 0x00, 0x12, // check_unicode 0xD800 -> g2
+		0xBE, 0x0C, 0x7F, 0xE4, 0x13, // check_unicode 0xE4 -> g3
+		0xBA, // quit
+	})
+	machine := testMachine(t, story)
+	runTestMachine(machine)
+
+	if output := <-machine.output; output != "ж" {
+		t.Errorf("printed %q", output)
+	}
+	want := []uint16{3, 1, 0, 1}
+	for i, result := range want {
+		if got := machine.getVariable(byte(0x10 + i)); got != result {
+			t.Errorf("check_unicode %d gave %d, want %d", i, got, result)
+		}
+	}
+}
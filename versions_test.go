@@ -0,0 +1,90 @@
+package zmachine
+
+import "testing"
+
+// Returns a version 5 story whose main routine calls routines in each of the
+// ways version 5 allows, prints to a table and moves an object.
+func callingStory() []byte {
+	story := testStory(5)
+	copy(story[testRoutines+1:], []byte{
+		0xE0, 0x1F, 0x01, 0x80, 0x05, 0x10, // call_vs 0x600 5 -> g0
+		0xF9, 0x3F, 0x01, 0x88, // call_vn 0x620
+		0xE0, 0x3F, 0x01, 0x90, 0x12, // call_vs 0x640 -> g2
+		0xF3, 0x4F, 0x03, 0x03, 0xE0, // output_stream 3 0x3E0
+		0xB2, 0xB5, 0xC5, // print "hi"
+		0xF3, 0x3F, 0xFF, 0xFD, // output_stream -3
+		0x0E, 0x02, 0x01, // insert_obj 2 1
+		0x92, 0x01, 0x13, 0xC2, // get_child 1 -> g3 ?(next)
+		0x13, 0x01, 0x00, 0x14, // get_next_prop 1 0 -> g4
+		0x13, 0x01, 0x28, 0x15, // get_next_prop 1 40 -> g5
+		0xBA, // quit
+	})
+	// Adds its argument to its uninitialised second local.
+	copy(story[0x600:], []byte{0x02, 0x74, 0x01, 0x02, 0x00, 0xB8})
+	// Sets g1 to 7.
+	copy(story[0x620:], []byte{0x00, 0x0D, 0x11, 0x07, 0xB0})
+	// Catches, and passes the frame to 0x660, which throws 42 back to it.
+	copy(story[0x640:], []byte{0x01, 0xB9, 0x01, 0xF9, 0x2F, 0x01, 0x98, 0x01, 0xB1})
+	copy(story[0x660:], []byte{0x01, 0x3C, 0x2A, 0x01})
+
+	addTestObjects(story,
+		testObject{name: "box", properties: []testProperty{{40, []byte{0, 5}}, {3, []byte{1, 2, 3}}}},
+		testObject{name: "key"},
+	)
+	return story
+}
+
+func TestVersion5Story(t *testing.T) {
+	machine := testMachine(t, callingStory())
+	runTestMachine(machine)
+
+	global := func(n int) uint16 { return machine.getVariable(byte(0x10 + n)) }
+	if global(0) != 5 || global(1) != 7 || global(2) != 42 || machine.stack.Size() != 0 {
+		t.Errorf("calls left g0 %d, g1 %d, g2 %d and %d words of stack", global(0), global(1), global(2), machine.stack.Size())
+	}
+	if machine.number(0x3E0) != 2 || string(machine.memory[0x3E2:0x3E4]) != "hi" {
+		t.Errorf("printed %v to the table", machine.memory[0x3E0:0x3E4])
+	}
+	if global(3) != 2 || global(4) != 40 || global(5) != 3 || machine.getObjectParent(2) != 1 {
+		t.Errorf("child %d, properties %d and %d", global(3), global(4), global(5))
+	}
+	if machine.memory[0x1E] != INTERPRETER_NUMBER || machine.memory[0x21] != 80 {
+		t.Errorf("interpreter %d, screen width %d", machine.memory[0x1E], machine.memory[0x21])
+	}
+}
+
+func TestTokeniseWordStarts(t *testing.T) {
+	for _, version := range []byte{3, 5} {
+		machine := testMachine(t, testStory(version))
+		table := 0x3C0
+		machine.memory[table] = 4
+		machine.tokeniseZSCII(table, ZSCIIString{[]byte("go north"), machine}, testDictionary, false)
+
+		// The text starts after the buffer's maximum length, and from version
+		// 5, its length too.
+		start := byte(1)
+		if version >= 5 {
+			start = 2
+		}
+		if machine.memory[table+1] != 2 || machine.memory[table+5] != start || machine.memory[table+9] != start+3 {
+			t.Errorf("version %d parse table %v", version, machine.memory[table:table+10])
+		}
+	}
+}
+
+func TestUnpackRoutineAddress(t *testing.T) {
+	tests := []struct {
+		version byte
+		want    int
+	}{
+		{3, 0x200},
+		{5, 0x400},
+		{7, 0x440},
+		{8, 0x800},
+	}
+	for _, test := range tests {
+		if address := unpackRoutineAddress(0x100, test.version, 0x40); address != test.want {
+			t.Errorf("version %d unpacked 0x100 to 0x%x, want 0x%x", test.version, address, test.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package zmachine
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// The parts of the machine's memory which make up the game world: the globals
+// and the objects, with their attributes and properties.
+type WorldState struct {
+	Globals []uint16
+	Objects []*Object // Object n is at n-1. Unreadable objects are nil.
+}
+
+type ChangeKind int
+
+const (
+	CHANGE_GLOBAL            ChangeKind = iota // Target is a global, from 0 to 239
+	CHANGE_MOVED                               // Target is an object, moved from the parent From to To
+	CHANGE_ATTRIBUTE_SET                       // Target is an object, and Number the attribute
+	CHANGE_ATTRIBUTE_CLEARED                   // Target is an object, and Number the attribute
+	CHANGE_PROPERTY                            // Target is an object, and Number the property
+)
+
+// One difference between two world states.
+type WorldChange struct {
+	Kind             ChangeKind
+	Target           int
+	Number           int
+	From, To         int    // Old and new values of globals, and parents of moved objects
+	OldData, NewData []byte // Old and new data of properties
+}
+
+func (this WorldChange) String() string {
+	switch this.Kind {
+	case CHANGE_GLOBAL:
+		return fmt.Sprintf("global 0x%02x changed %d→%d", this.Target, this.From, this.To)
+	case CHANGE_MOVED:
+		return fmt.Sprintf("object %d moved from %d to %d", this.Target, this.From, this.To)
+	case CHANGE_ATTRIBUTE_SET:
+		return fmt.Sprintf("attribute %d set on %d", this.Number, this.Target)
+	case CHANGE_ATTRIBUTE_CLEARED:
+		return fmt.Sprintf("attribute %d cleared on %d", this.Number, this.Target)
+	case CHANGE_PROPERTY:
+		return fmt.Sprintf("property %d of %d changed %s→%s", this.Number, this.Target, hexBytes(this.OldData), hexBytes(this.NewData))
+	}
+	return "unknown change"
+}
+
+func hexBytes(data []byte) string {
+	words := make([]string, len(data))
+	for i, b := range data {
+		words[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(words, " ")
+}
+
+// Takes a copy of the world as it stands.
+func (this *ZMachine) WorldState() *WorldState {
+	state := &WorldState{Globals: make([]uint16, 240)}
+	for i := range state.Globals {
+		state.Globals[i] = this.number(int(this.globalVariableStart) + 2*i)
+	}
+	for n, count := 1, this.ObjectCount(); n <= count; n++ {
+		object, _ := this.object(n, count)
+		state.Objects = append(state.Objects, object)
+	}
+	return state
+}
+
+// Reports what changed between this state and a later one: globals first,
+// then each object's moves, attributes and properties.
+func (this *WorldState) Diff(after *WorldState) []WorldChange {
+	var changes []WorldChange
+	for i, value := range this.Globals {
+		if i < len(after.Globals) && after.Globals[i] != value {
+			changes = append(changes, WorldChange{Kind: CHANGE_GLOBAL, Target: i, From: int(value), To: int(after.Globals[i])})
+		}
+	}
+	for i, before := range this.Objects {
+		if i >= len(after.Objects) || before == nil || after.Objects[i] == nil {
+			continue
+		}
+		changes = append(changes, diffObject(before, after.Objects[i])...)
+	}
+	return changes
+}
+
+func diffObject(before, after *Object) []WorldChange {
+	var changes []WorldChange
+	n := before.Number
+	if before.Parent != after.Parent {
+		changes = append(changes, WorldChange{Kind: CHANGE_MOVED, Target: n, From: before.Parent, To: after.Parent})
+	}
+
+	had := make(map[int]bool)
+	for _, attribute := range before.Attributes {
+		had[attribute] = true
+	}
+	has := make(map[int]bool)
+	for _, attribute := range after.Attributes {
+		has[attribute] = true
+		if !had[attribute] {
+			changes = append(changes, WorldChange{Kind: CHANGE_ATTRIBUTE_SET, Target: n, Number: attribute})
+		}
+	}
+	for _, attribute := range before.Attributes {
+		if !has[attribute] {
+			changes = append(changes, WorldChange{Kind: CHANGE_ATTRIBUTE_CLEARED, Target: n, Number: attribute})
+		}
+	}
+
+	// Property tables have a fixed layout, so only the data can change.
+	old := make(map[int][]byte)
+	for _, property := range before.Properties {
+		old[property.Number] = property.Data
+	}
+	for _, property := range after.Properties {
+		if data, ok := old[property.Number]; ok && !bytes.Equal(data, property.Data) {
+			changes = append(changes, WorldChange{Kind: CHANGE_PROPERTY, Target: n, Number: property.Number, OldData: data, NewData: property.Data})
+		}
+	}
+	return changes
+}
+
+// Sets a function to be told what changed in the world during each turn,
+// between one read of the player's input and the next. Pass nil to stop.
+func (this *ZMachine) SetTurnObserver(observer func(changes []WorldChange)) {
+	this.turnObserver = observer
+	this.lastWorld = nil
+}
+
+// Reports the changes since the last read, and remembers the world as it is
+// for the next.
+func (this *ZMachine) observeTurn() {
+	state := this.WorldState()
+	if this.lastWorld != nil {
+		this.turnObserver(this.lastWorld.Diff(state))
+	}
+	this.lastWorld = state
+}
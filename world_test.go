@@ -0,0 +1,67 @@
+package zmachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWorldDiff(t *testing.T) {
+	story := testStory(3)
+	addTestRoom(story)
+	machine := testMachine(t, story)
+	before := machine.WorldState()
+	if len(before.Globals) != 240 || len(before.Objects) != 3 {
+		t.Fatalf("%d globals and %d objects", len(before.Globals), len(before.Objects))
+	}
+
+	machine.setVariable(0x10+3, 5)
+	machine.insertObject(3, 2)
+	machine.setObjectAttribute(2, 10, true)
+	machine.setObjectAttribute(1, 0, false)
+	room, _ := machine.Object(1)
+	machine.memory[room.Properties[0].Address+1] = 6
+	changes := before.Diff(machine.WorldState())
+
+	want := []WorldChange{
+		{Kind: CHANGE_GLOBAL, Target: 3, From: 0, To: 5},
+		{Kind: CHANGE_ATTRIBUTE_CLEARED, Target: 1, Number: 0},
+		{Kind: CHANGE_PROPERTY, Target: 1, Number: 7, OldData: []byte{0, 5}, NewData: []byte{0, 6}},
+		{Kind: CHANGE_ATTRIBUTE_SET, Target: 2, Number: 10},
+		{Kind: CHANGE_MOVED, Target: 3, From: 1, To: 2},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("changes %v\nwant %v", changes, want)
+	}
+	for i, text := range []string{
+		"global 0x03 changed 0→5",
+		"attribute 0 cleared on 1",
+		"property 7 of 1 changed 00 05→00 06",
+		"attribute 10 set on 2",
+		"object 3 moved from 1 to 2",
+	} {
+		if changes[i].String() != text {
+			t.Errorf("change %d described as %q, want %q", i, changes[i], text)
+		}
+	}
+}
+
+func TestTurnObserver(t *testing.T) {
+	story := testStory(3)
+	addTestRoom(story)
+	machine := testMachine(t, story)
+	var turns [][]WorldChange
+	machine.SetTurnObserver(func(changes []WorldChange) {
+		turns = append(turns, changes)
+	})
+	machine.input <- "look"
+	machine.input <- "take key"
+	machine.readLine(0, 0)
+	machine.insertObject(3, 2)
+	machine.readLine(0, 0)
+
+	// The first read only notes the world as it is.
+	want := [][]WorldChange{{{Kind: CHANGE_MOVED, Target: 3, From: 1, To: 2}}}
+	if !reflect.DeepEqual(turns, want) {
+		t.Errorf("turns %v, want %v", turns, want)
+	}
+}
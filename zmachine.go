@@ -1,13 +1,25 @@
 package zmachine
 
-import "os"
+import (
+	"fmt"
+	"io"
+	"os"
+)
 
 type OperandType byte
 type OpcodeFormat byte
+type OperandCount byte
 
 const OPCODE_FORMAT_SHORT OpcodeFormat = 1
 const OPCODE_FORMAT_LONG OpcodeFormat = 2
 const OPCODE_FORMAT_VARIABLE OpcodeFormat = 3
+const OPCODE_FORMAT_EXTENDED OpcodeFormat = 4
+
+const OPERAND_COUNT_0OP OperandCount = 0
+const OPERAND_COUNT_1OP OperandCount = 1
+const OPERAND_COUNT_2OP OperandCount = 2
+const OPERAND_COUNT_VAR OperandCount = 3
+const OPERAND_COUNT_EXT OperandCount = 4
 
 const OPERAND_TYPE_SMALL OperandType = 1
 const OPERAND_TYPE_LARGE OperandType = 0
@@ -15,13 +27,16 @@ const OPERAND_TYPE_VAR OperandType = 2
 const OPERAND_TYPE_OMITTED OperandType = 3
 
 type ZMachine struct {
-	input  chan string
-	output chan string
-	errors chan error
+	input      chan string
+	output     chan string
+	errors     chan error
+	inputEnded chan bool // Closed by EndInput
 
 	story_file string
+	blorb      *Blorb
 	memory     []byte
 	version    byte
+	checksum   uint16 // Of the story as it was loaded, for verify
 
 	memoryDynamicEnd  uint16
 	memoryStaticStart uint16
@@ -34,6 +49,9 @@ type ZMachine struct {
 	globalVariableStart uint16
 	abbreviationStart   uint16
 
+	unicode   []rune       // The story's Unicode translation table, if it has one
+	alphabets *[3][26]byte // The story's alphabets, whether its own or the defaults
+
 	wordSeparators        []byte
 	dictionaryEntryLength byte
 	dictionaryLength      uint16
@@ -41,35 +59,89 @@ type ZMachine struct {
 	pc        int
 	stack     Stack
 	callStack Stack
+	routines  []int // The address of the routine running at each depth of callStack, or 0 if unknown
 	running   bool
 
+	outputTail []byte // The most recent output, used for save previews
+
+	keys       chan Key
+	typedAhead []byte // Characters of a line from the input channel not yet read by read_char
+
+	textSink   TextSink
+	style      *TextStyle // Nil until the story changes it
+	fixedStyle bool       // Whether set_text_style has asked for fixed pitch
+
+	memoryStreams []int // The tables output is being written to by output stream 3, innermost last
+	upperWindow   bool  // Whether the story is printing to the upper window
+
+	clock         Clock
+	audio         AudioSink
+	soundFinished chan uint16 // Routines to call for sounds that have finished playing
+
+	tracer     Tracer
+	traceEvent *TraceEvent // The event for the instruction being executed, if tracing
+
+	profiler *Profiler
+
+	corrector    *InputCorrector
+	turnObserver func(changes []WorldChange)
+	lastWorld    *WorldState // The world at the last read, while observing turns
+
+	journal *journal // Set while recording for reverse execution
+	quiet   bool     // Set while replaying, so that output isn't repeated
+
 	opcodesExecuted int
 }
 
+// Creates a machine to run the story in file, which may be a bare story or a Blorb.
 func New(file string, in chan string, out chan string, err chan error) ZMachine {
 	machine := ZMachine{
 		story_file: file,
 		input:      in,
 		output:     out,
 		errors:     err,
+		inputEnded: make(chan bool),
 	}
 
 	return machine
 }
 
-func (this *ZMachine) loadStory(buffer *[]byte) error {
-	file, err := os.Open(this.story_file)
+// Reads a story from a file, which may be either a bare story or a Blorb
+// containing one. The Blorb is nil for bare stories.
+func ReadStoryFile(filename string) ([]byte, *Blorb, error) {
+	file, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	defer file.Close()
 
 	stat, _ := file.Stat()
 
 	buf := make([]byte, stat.Size())
-	_, err = file.Read(buf)
+	if _, err = io.ReadFull(file, buf); err != nil {
+		return nil, nil, err
+	}
+	if !isBlorb(buf) {
+		return buf, nil, nil
+	}
+
+	blorb, err := ReadBlorb(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	story, err := blorb.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The story is modified as the game runs, so it mustn't share the Blorb's memory.
+	return append([]byte(nil), story...), blorb, nil
+}
+
+func (this *ZMachine) loadStory(buffer *[]byte) error {
+	buf, blorb, err := ReadStoryFile(this.story_file)
 	if err == nil {
 		*buffer = buf
+		this.blorb = blorb
 	}
 
 	return err
@@ -79,12 +151,38 @@ func (this *ZMachine) LoadStory() error {
 	return this.loadStory(&this.memory)
 }
 
+// The Blorb the story was loaded from, or nil if it was a bare story file.
+func (this *ZMachine) Blorb() *Blorb {
+	return this.blorb
+}
+
 func (this *ZMachine) CompleteSetup() {
-	this.version = this.memory[0]
-	if this.version > 3 {
+	this.readHeader()
+	if this.version > 5 && this.version != 8 {
 		panic("Unsupported version")
 	}
+	this.checksum = Checksum(this.memory)
+	this.writeInterpreterHeader()
 
+	this.stack = NewStack(1024)
+	this.callStack = NewStack(1024)
+	this.memoryStreams = nil
+	this.upperWindow = false
+	this.typedAhead = nil
+	this.style = nil
+	this.fixedStyle = false
+	this.routines = []int{this.pc - 1}
+
+	//log.Printf("Loaded version %d story file from %s", this.version, this.story_file)
+	//log.Printf("dynamic_end: 0x%x, static_end: 0x%x, high_start: 0x%x", this.memoryDynamicEnd, this.memoryStaticEnd, this.memoryHighStart)
+	//log.Printf("dictionaryStart: 0x%x, dictionaryEntryLength: %d, objectTableStart: 0x%x, globalVariableStart: 0x%x, abbreviationStart; 0x%x",
+	//	this.dictionaryStart, this.dictionaryEntryLength, this.objectTableStart, this.globalVariableStart, this.abbreviationStart)
+	//log.Printf("pc: 0x%x", this.pc)
+}
+
+// Finds the story's tables and memory regions from its header.
+func (this *ZMachine) readHeader() {
+	this.version = this.memory[0]
 	this.memoryHighEnd = uint16(len(this.memory) - 1)
 	this.memoryDynamicEnd = this.number(0x0E)
 	this.memoryStaticStart = this.memoryDynamicEnd + 1
@@ -101,24 +199,47 @@ func (this *ZMachine) CompleteSetup() {
 
 	this.pc = int(this.number(0x06))
 
-	this.stack = NewStack(1024)
-	this.callStack = NewStack(1024)
-
 	n := uint16(this.memory[this.dictionaryStart]) + this.dictionaryStart + 1
 	this.wordSeparators = []byte(this.memory[this.dictionaryStart+1 : n])
 	this.dictionaryEntryLength = this.memory[n]
 	this.dictionaryLength = this.number(int(n + 1))
 
-	//log.Printf("Loaded version %d story file from %s", this.version, this.story_file)
-	//log.Printf("dynamic_end: 0x%x, static_end: 0x%x, high_start: 0x%x", this.memoryDynamicEnd, this.memoryStaticEnd, this.memoryHighStart)
-	//log.Printf("dictionaryStart: 0x%x, dictionaryEntryLength: %d, objectTableStart: 0x%x, globalVariableStart: 0x%x, abbreviationStart; 0x%x",
-	//	this.dictionaryStart, this.dictionaryEntryLength, this.objectTableStart, this.globalVariableStart, this.abbreviationStart)
-	//log.Printf("pc: 0x%x", this.pc)
+	this.unicode = this.readUnicodeTable()
+	alphabets := storyAlphabets(this.memory)
+	this.alphabets = &alphabets
+}
+
+// The interpreter number and version given to stories, which they may use
+// to work around interpreters' quirks.
+const INTERPRETER_NUMBER = 6 // IBM PC, which makes no promises about the screen
+const INTERPRETER_VERSION = 'G'
+
+// Tells the story about the interpreter and its screen, from version 4. The
+// screen is as wide as a terminal and never needs to page.
+func (this *ZMachine) writeInterpreterHeader() {
+	if this.version < 4 {
+		return
+	}
+	this.memory[0x1E] = INTERPRETER_NUMBER
+	this.memory[0x1F] = INTERPRETER_VERSION
+	this.memory[0x20] = 255 // Lines
+	this.memory[0x21] = 80  // Characters
+	if this.version >= 5 {
+		this.setNumber(0x22, 80)  // Width in units
+		this.setNumber(0x24, 255) // Height in units
+		this.memory[0x26] = 1     // Font width
+		this.memory[0x27] = 1     // Font height
+	}
 }
 
 func (this *ZMachine) mainLoop() {
 	for this.running {
-		this.executeCycle()
+		select {
+		case routine := <-this.soundFinished:
+			this.callInterrupt(routine)
+		default:
+			this.executeCycle()
+		}
 	}
 }
 
@@ -135,6 +256,36 @@ func (this *ZMachine) Run() {
 	}
 }
 
+// How much recent output to remember for save previews.
+const outputTailSize = 1024
+
+// Sends s to the output channel.
+func (this *ZMachine) print(s string) {
+	// Output to memory changes the story, so it happens even while replaying.
+	if len(this.memoryStreams) > 0 {
+		this.printToTable(s)
+		return
+	}
+	if this.upperWindow {
+		// Only a text sink can tell the upper window's text from the rest.
+		if this.textSink != nil && !this.quiet {
+			this.textSink.Text(StyledRun{s, this.Style(), 1})
+		}
+		return
+	}
+	switch {
+	case this.quiet:
+	case this.textSink != nil:
+		this.textSink.Text(StyledRun{s, this.Style(), 0})
+	default:
+		this.output <- s
+	}
+	this.outputTail = append(this.outputTail, s...)
+	if len(this.outputTail) > outputTailSize {
+		this.outputTail = this.outputTail[len(this.outputTail)-outputTailSize:]
+	}
+}
+
 func (this *ZMachine) number(address int) uint16 {
 	if address > int(this.memoryHighEnd)-1 {
 		//panic("Attempt to retrieve data from past the end of high memory")
@@ -153,8 +304,29 @@ func (this *ZMachine) setNumber(address int, number uint16) {
 	this.memory[address+1] = low
 }
 
+// Converts a packed routine address into a byte address.
 func (this *ZMachine) unpackAddress(address uint16) int {
-	return 2 * int(address)
+	return unpackRoutineAddress(address, this.version, 8*int(this.number(0x28)))
+}
+
+// Converts a packed string address into a byte address. Only versions 6 and 7
+// keep strings apart from routines.
+func (this *ZMachine) unpackStringAddress(address uint16) int {
+	return unpackRoutineAddress(address, this.version, 8*int(this.number(0x2A)))
+}
+
+// Converts a packed routine address into a byte address.
+func unpackRoutineAddress(packed uint16, version byte, routineOffset int) int {
+	switch {
+	case version <= 3:
+		return 2 * int(packed)
+	case version <= 5:
+		return 4 * int(packed)
+	case version <= 7:
+		return 4*int(packed) + routineOffset
+	default:
+		return 8 * int(packed)
+	}
 }
 
 func (this *ZMachine) zString(address int, wordAddress bool) ZString {
@@ -165,84 +337,51 @@ func (this *ZMachine) zString(address int, wordAddress bool) ZString {
 }
 
 func (this *ZMachine) executeCycle() {
-	opcode := this.memory[this.pc]
-	var format OpcodeFormat
-	operandCount := 0
-	var operandTypes []OperandType
-	reallyVariable := false
-
-	if opcode&0xC0 == 0xC0 {
-		format = OPCODE_FORMAT_VARIABLE
-		if opcode&0x20 == 0 {
-			operandCount = 2
-		} else {
-			reallyVariable = true
-		}
-		opcode &= 0x1F
-	} else if opcode&0x80 == 0x80 {
-		format = OPCODE_FORMAT_SHORT
-		if opcode&0x30 == 0x30 {
-			operandCount = 0
+	if this.profiler != nil {
+		this.profiler.instruction(this)
+	}
+	instruction, err := decode(this.memory, this.pc, this.version, this.tracer != nil)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	operands := make([]uint16, len(instruction.Operands))
+	for i, t := range instruction.OperandTypes {
+		if t == OPERAND_TYPE_VAR {
+			operands[i] = this.getVariable(byte(instruction.Operands[i]))
 		} else {
-			operandCount = 1
-			switch {
-			case opcode&0x30 == 0x00:
-				operandTypes = []OperandType{OPERAND_TYPE_LARGE}
-			case opcode&0x10 == 0x10:
-				operandTypes = []OperandType{OPERAND_TYPE_SMALL}
-			case opcode&0x20 == 0x20:
-				operandTypes = []OperandType{OPERAND_TYPE_VAR}
-			default:
-				panic("Nonsense in executeCycle")
-			}
-		}
-		opcode &= 0x0F
-	} else {
-		format = OPCODE_FORMAT_LONG
-		operandCount = 2
-		operandTypes = []OperandType{OPERAND_TYPE_SMALL, OPERAND_TYPE_SMALL}
-		if opcode&0x40 == 0x40 {
-			operandTypes[0] = OPERAND_TYPE_VAR
+			operands[i] = instruction.Operands[i]
 		}
-		if opcode&0x20 == 0x20 {
-			operandTypes[1] = OPERAND_TYPE_VAR
-		}
-		opcode &= 0x1F
 	}
 
-	if format == OPCODE_FORMAT_VARIABLE {
-		this.pc++
-		bits := this.memory[this.pc]
-		operandTypes = make([]OperandType, 0, 4)
-		for i := uint(0); i < 4; i++ {
-			now := OperandType((bits >> ((3 - i) * 2)) & 0x03)
-			if now != OPERAND_TYPE_OMITTED {
-				operandTypes = append(operandTypes, now)
-			} else {
-				break
-			}
-		}
-		operandCount = len(operandTypes)
-	}
-
-	operands := make([]uint16, operandCount)
-	for i, t := range operandTypes {
-		if t == OPERAND_TYPE_LARGE {
-			operands[i] = this.number(this.pc + 1)
-			this.pc += 2
-		} else if t == OPERAND_TYPE_SMALL {
-			this.pc++
-			operands[i] = uint16(this.memory[this.pc])
-		} else if t == OPERAND_TYPE_VAR {
-			this.pc++
-			operands[i] = this.getVariable(this.memory[this.pc])
+	// Interrupts run whole instructions in the middle of this one, so remember
+	// whichever event they interrupted.
+	outer := this.traceEvent
+	if this.tracer != nil {
+		this.traceEvent = &TraceEvent{
+			PC:          instruction.Address,
+			Routine:     this.currentRoutine(),
+			Depth:       len(this.routines) - 1,
+			Instruction: instruction,
+			Operands:    operands,
 		}
 	}
 
-	if reallyVariable {
-		impvop[opcode](this, operands...)
-	} else {
-		switch operandCount {
+	// The opcodes read their own store, branch and text data, from just after the operands.
+	this.pc = instruction.operandsEnd - 1
+
+	switch {
+	case instruction.Count == OPERAND_COUNT_VAR:
+		impvop[instruction.Opcode](this, operands...)
+	case instruction.Count == OPERAND_COUNT_EXT:
+		implementation, ok := impextop[instruction.Opcode]
+		if !ok {
+			panic(fmt.Sprintf("Unsupported opcode %s", instruction.Name))
+		}
+		implementation(this, operands...)
+	default:
+		opcode := instruction.Opcode
+		switch len(operands) {
 		case 0:
 			imp0op[opcode](this)
 		case 1:
@@ -260,6 +399,19 @@ func (this *ZMachine) executeCycle() {
 
 	this.pc++
 	this.opcodesExecuted++
+
+	if event := this.traceEvent; event != nil && this.tracer != nil {
+		this.tracer.Trace(event)
+	}
+	this.traceEvent = outer
+}
+
+// The address of the routine being executed, or 0 if it isn't known.
+func (this *ZMachine) currentRoutine() int {
+	if len(this.routines) == 0 {
+		return 0
+	}
+	return this.routines[len(this.routines)-1]
 }
 
 func (this *ZMachine) getVariable(variable byte) uint16 {
@@ -284,15 +436,30 @@ func (this *ZMachine) setVariable(variable byte, value uint16) {
 }
 
 func (this *ZMachine) store(value uint16) {
+	if this.traceEvent != nil {
+		this.traceEvent.Stored = true
+		this.traceEvent.StoredValue = value
+	}
 	this.pc++
 	this.setVariable(this.memory[this.pc], value)
 }
 
+// Returns 1 for true and 0 for false, as opcodes store them.
+func boolValue(value bool) uint16 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
 func (this *ZMachine) branch(result bool) {
 	this.pc++
 	branch := this.memory[this.pc]
 	required := branch&0x80 == 0x80
 	target := int(branch & 0x3F)
+	if this.traceEvent != nil {
+		this.traceEvent.Branched = result == required
+	}
 
 	// If the second bit is set, target is two bytes (actually 14 bits - one was taken for
 	// required and one for this flag), so we need to get the next byte.
@@ -321,13 +488,135 @@ func (this *ZMachine) branch(result bool) {
 	}
 }
 
+// Set in a call frame's flags when the routine's result is to be thrown away,
+// as Quetzal marks it.
+const frameDiscardsResult = 0x10
+
+// Implements the call opcodes which store the routine's result. Calling
+// address 0 does nothing and returns 0.
+func (this *ZMachine) callStoring(args []uint16) {
+	if args[0] == 0 {
+		this.store(0)
+		return
+	}
+	this.pc++
+	this.callRoutine(args[0], args[1:], this.memory[this.pc], this.pc)
+}
+
+// Implements the call opcodes which throw away the routine's result.
+func (this *ZMachine) callDiscarding(args []uint16) {
+	if args[0] == 0 {
+		return
+	}
+	this.callRoutine(args[0], args[1:], 0, this.pc)
+	frame := this.callStack.Size() - 5
+	this.callStack.Set(frame, this.callStack.Look(frame)|frameDiscardsResult)
+}
+
+// Returns how many arguments the running routine was given.
+func (this *ZMachine) argumentCount() int {
+	if this.callStack.Size() == 0 {
+		return 0
+	}
+	count := 0
+	for mask := this.callStack.Look(this.callStack.Size()-5) >> 8; mask != 0; mask >>= 1 {
+		count++
+	}
+	return count
+}
+
+// Calls the routine at the packed address with the given arguments. When it returns,
+// its result is stored in resultVariable and execution continues from the
+// instruction after returnAddress.
+func (this *ZMachine) callRoutine(address uint16, args []uint16, resultVariable byte, returnAddress int) {
+	routine := this.unpackAddress(address)
+	varcount := this.memory[routine]
+	if varcount > 15 {
+		panic("Calling address without a routine")
+	}
+	if len(args) > int(varcount) {
+		args = args[:varcount]
+	}
+
+	// Store information so we can get back here.
+	this.callStack.Push(uint16((1<<uint(len(args)))-1)<<8 | uint16(varcount)) // Arguments and flags, as save files give them
+	this.callStack.Push(uint16(resultVariable))                               // The variable in which to store the return value
+	this.callStack.Push(uint16(returnAddress >> 16))                          // The location to return to (minus one, actually)...
+	this.callStack.Push(uint16(returnAddress & 0xFFFF))                       // ...split over two words
+	this.callStack.Push(uint16(this.stack.Size()))                            // Where to truncate the call stack on returning
+
+	// Push the arguments to the routine we're calling onto the stack.
+	// Any arguments not provided are filled with the destination's declared
+	// defaults, which from version 5 are always zero and aren't in the routine.
+	for i := byte(0); i < varcount; i++ {
+		if i < byte(len(args)) {
+			this.stack.Push(args[i])
+		} else if this.version >= 5 {
+			this.stack.Push(0)
+		} else {
+			this.stack.Push(this.number(int(routine) + 2*int(i) + 1))
+		}
+	}
+
+	this.routines = append(this.routines, routine)
+	if this.profiler != nil {
+		this.profiler.enter(routine)
+	}
+
+	// Jump to the target routine (which starts varcount words after the given address)
+	if this.version >= 5 {
+		this.pc = routine
+	} else {
+		this.pc = routine + int(varcount)*2
+	}
+}
+
+// Runs the routine at the packed address to completion in the middle of the
+// current instruction, returning its result. Used for interrupts, which the game
+// expects to happen without disturbing whatever it was doing.
+func (this *ZMachine) callInterrupt(address uint16, args ...uint16) uint16 {
+	if address == 0 {
+		return 0
+	}
+
+	depth := this.callStack.Size()
+	this.callRoutine(address, args, 0, this.pc-1)
+	this.pc++ // There's no executeCycle to step onto the routine's first instruction
+	for this.running && this.callStack.Size() > depth {
+		this.executeCycle()
+	}
+	if !this.running {
+		return 0
+	}
+	return this.stack.Pop()
+}
+
 // Used to return from a Z-Code routine, placing value in the appropriate location.
 func (this *ZMachine) returnFromRoutine(value uint16) {
+	retVar, flags := this.leaveRoutine()
+	if flags&frameDiscardsResult == 0 {
+		if this.traceEvent != nil {
+			this.traceEvent.Stored = true
+			this.traceEvent.StoredValue = value
+		}
+		this.setVariable(retVar, value)
+	}
+}
+
+// Removes the running routine's call frame, returning to its caller, and gives
+// back where the caller wanted its result.
+func (this *ZMachine) leaveRoutine() (retVar byte, flags uint16) {
 	stackTop := this.callStack.Pop()           // The top of the stack after returning
 	this.pc = int(this.callStack.Pop())        // The program counter after returning...
 	this.pc |= int(this.callStack.Pop()) << 16 // ... second byte
-	retVar := this.callStack.Pop()             // The variable the caller wants the return value placed in
-	this.callStack.Pop()                       // A useless value
+	retVar = byte(this.callStack.Pop())        // The variable the caller wants the return value placed in
+	flags = this.callStack.Pop() & 0xFF        // The local count, and whether the result is wanted
 	this.stack.Truncate(uint(stackTop))
-	this.setVariable(byte(retVar), value)
+	if len(this.routines) > 1 {
+		this.routines = this.routines[:len(this.routines)-1]
+	}
+	if this.profiler != nil {
+		this.profiler.leave()
+	}
+	return retVar, flags
 }
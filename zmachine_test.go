@@ -0,0 +1,133 @@
+package zmachine
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Where testStory puts each of the story's tables.
+const (
+	testGlobals       = 0x040
+	testAbbreviations = 0x220
+	testObjects       = 0x2E0
+	testDictionary    = 0x400 // Static memory starts here
+	testRoutines      = 0x500 // High memory starts here, with the main routine
+)
+
+// Builds a story of the given version with empty tables, whose main routine at
+// testRoutines has no locals and quits. Tests write their own code, objects
+// and words over it before starting a machine.
+func testStory(version byte) []byte {
+	story := make([]byte, 0x800)
+	story[0] = version
+	put := func(address int, value int) {
+		story[address], story[address+1] = byte(value>>8), byte(value)
+	}
+	put(0x02, 1)                 // Release
+	copy(story[0x12:], "010101") // Serial
+	put(0x04, testRoutines)
+	put(0x06, testRoutines+1)
+	put(0x08, testDictionary)
+	put(0x0A, testObjects)
+	put(0x0C, testGlobals)
+	put(0x0E, testDictionary)
+	put(0x18, testAbbreviations)
+
+	// No word separators and no words.
+	story[testDictionary+1] = 7
+	if version >= 4 {
+		story[testDictionary+1] = 9
+	}
+
+	story[testRoutines+1] = 0xBA // quit
+	return story
+}
+
+// Writes the story to a file and starts a machine for it, with buffered
+// channels for input, output and errors.
+func testMachine(t *testing.T, story []byte) *ZMachine {
+	file := filepath.Join(t.TempDir(), "story")
+	if err := ioutil.WriteFile(file, story, 0644); err != nil {
+		t.Fatal(err)
+	}
+	machine := New(file, make(chan string, 16), make(chan string, 64), make(chan error, 4))
+	if err := machine.LoadStory(); err != nil {
+		t.Fatal(err)
+	}
+	machine.CompleteSetup()
+	return &machine
+}
+
+// Runs the machine until the story quits.
+func runTestMachine(machine *ZMachine) {
+	machine.running = true
+	machine.mainLoop()
+}
+
+// An object for addTestObjects.
+type testObject struct {
+	name                   string
+	parent, sibling, child int
+	attributes             []int
+	properties             []testProperty // Highest numbered first, as they're stored
+}
+
+type testProperty struct {
+	number int
+	data   []byte
+}
+
+// Writes objects, numbered from 1, into a story from testStory, with their
+// property tables after them.
+func addTestObjects(story []byte, objects ...testObject) {
+	version := story[0]
+	entry, entryLength, attributeBytes := testObjects+62, 9, 4
+	if version >= 4 {
+		entry, entryLength, attributeBytes = testObjects+126, 14, 6
+	}
+	table := entry + len(objects)*entryLength
+	for _, object := range objects {
+		for _, attribute := range object.attributes {
+			story[entry+attribute/8] |= 0x80 >> uint(attribute%8)
+		}
+		relatives := entry + attributeBytes
+		for i, relative := range []int{object.parent, object.sibling, object.child} {
+			if version >= 4 {
+				story[relatives+2*i], story[relatives+2*i+1] = byte(relative>>8), byte(relative)
+			} else {
+				story[relatives+i] = byte(relative)
+			}
+		}
+		story[entry+entryLength-2], story[entry+entryLength-1] = byte(table>>8), byte(table)
+
+		name := encodeTestText(object.name)
+		story[table] = byte(len(name) / 2)
+		table += 1 + copy(story[table+1:], name)
+		for _, property := range object.properties {
+			size := len(property.data)
+			switch {
+			case version <= 3:
+				story[table] = byte(32*(size-1) + property.number)
+			case size == 1:
+				story[table] = byte(property.number)
+			case size == 2:
+				story[table] = 0x40 | byte(property.number)
+			default:
+				story[table] = 0x80 | byte(property.number)
+				table++
+				story[table] = 0x80 | byte(size)
+			}
+			table++
+			table += copy(story[table:], property.data)
+		}
+		table++ // The properties end with a zero
+		entry += entryLength
+	}
+}
+
+// Encodes lower case text as a Z-string of whole words.
+func encodeTestText(text string) []byte {
+	zscii := ZSCIIString{[]byte(text), nil}
+	return zscii.ZString((len(text) + 2) / 3 * 2)
+}
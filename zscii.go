@@ -40,91 +40,198 @@ func (this *ZSCIIString) Size() int {
 }
 
 func (this *ZSCIIString) String() string {
-	s := make([]rune, len(this.bytes))
-	for i, char := range this.bytes {
+	var characters []rune
+	if this.z != nil {
+		characters = this.z.characterTable()
+	} else {
+		characters = extraCharacters[:]
+	}
+	s := make([]rune, 0, len(this.bytes))
+	for _, char := range this.bytes {
 		switch {
+		case char == 0:
+			// ZSCII 0 prints nothing.
 		case char >= 32 && char <= 126:
-			s[i] = rune(char)
-		case char >= 155 && char <= 251:
-			s[i] = extraCharacters[char-155]
+			s = append(s, rune(char))
+		case char >= 155 && int(char)-155 < len(characters):
+			s = append(s, characters[char-155])
 		case char == 13 || char == 10:
-			s[i] = '\n'
+			s = append(s, '\n')
+		default:
+			s = append(s, '?')
 		}
 	}
 	return string(s)
 }
 
+// Encodes the string as a dictionary word of size bytes.
 func (this *ZSCIIString) ZString(size int) []byte {
-	zcharLimit := size / 2 * 3
-	zchars := make([]byte, zcharLimit)
+	version := byte(3)
+	if this.z != nil {
+		version = this.z.version
+	}
+	return encodeZSCII(this.bytes, version, this.z.alphabetTable(), size)
+}
 
-	i := 0
-	for _, v := range this.bytes {
-		z := zcharFromZSCIIChar(v)
-		if i+len(z) > zcharLimit {
-			break
-		}
-		zchars[i] = z[0]
-		i++
-		if len(z) == 2 {
-			zchars[i] = z[1]
-			i++
+// Encodes text as the story would, in its version and alphabets. If length
+// isn't 0, the result is cut short or padded to that many bytes, as the
+// dictionary's words are; otherwise it holds the whole text. Abbreviations are
+// never used.
+func EncodeText(story []byte, text string, length int) []byte {
+	machine := textMachine(story, story[0])
+	return encodeZSCII(zsciiFromString(text, machine.characterTable()), machine.version, machine.alphabetTable(), length)
+}
+
+// Packs the Z-characters for ZSCII text three to a word, with the end bit on
+// the last, as described for EncodeText. A sequence for one character may be
+// cut off part way, as Inform cuts off dictionary words.
+func encodeZSCII(zscii []byte, version byte, alphabets *[3][26]byte, length int) []byte {
+	var zchars []byte
+	for _, char := range zscii {
+		zchars = append(zchars, zcharsFromZSCII(char, version, alphabets)...)
+	}
+	limit := length / 2 * 3
+	if length == 0 {
+		limit = (len(zchars) + 2) / 3 * 3
+		if limit == 0 {
+			limit = 3
 		}
 	}
-
-	for ; i < zcharLimit; i++ {
-		zchars[i] = 5
+	if len(zchars) > limit {
+		zchars = zchars[:limit]
+	}
+	// Shifts pad out the last word.
+	for len(zchars) < limit {
+		zchars = append(zchars, 5)
 	}
 
-	words := make([]byte, size)
-	for i, j := 0, 0; i < zcharLimit && j < len(words); i, j = i+3, j+2 {
-		word := uint16(0)
-		if i >= zcharLimit-3 {
+	words := make([]byte, limit/3*2)
+	for i := 0; i < limit; i += 3 {
+		word := uint16(zchars[i])<<10 | uint16(zchars[i+1])<<5 | uint16(zchars[i+2])
+		if i+3 == limit {
 			word |= 0x8000 // End of string flag.
 		}
+		words[i/3*2] = byte(word >> 8)
+		words[i/3*2+1] = byte(word)
+	}
+	return words
+}
 
-		word |= uint16(zchars[i]) << 10
-		word |= uint16(zchars[i+1]) << 5
-		word |= uint16(zchars[i+2])
-
-		high := byte(word >> 8)
-		low := byte(word)
+// Returns the Z-characters for a ZSCII character: one from A0, a shift and one
+// from A1 or A2, or the ZSCII code itself after the escape in A2. From version
+// 3, 4 and 5 shift to A1 and A2 for one character. Earlier, 4 and 5 lock the
+// shift and 2 and 3 are the single shifts, which are all that's needed to
+// write anything, so the locks are never used.
+func zcharsFromZSCII(char byte, version byte, alphabets *[3][26]byte) []byte {
+	toA1, toA2 := byte(4), byte(5)
+	if version <= 2 {
+		toA1, toA2 = 2, 3
+	}
+	switch {
+	case char == ' ':
+		return []byte{0}
+	case (char == '\n' || char == 13) && version == 1:
+		return []byte{1}
+	case char == '\n' || char == 13:
+		return []byte{toA2, 7}
+	}
+	for alphabet := range alphabets {
+		for i, c := range alphabets[alphabet] {
+			// A2 starts with the escape, then from version 2 the newline.
+			if c != char || alphabet == 2 && (i == 0 || i == 1 && version >= 2) {
+				continue
+			}
+			switch alphabet {
+			case 0:
+				return []byte{byte(i + 6)}
+			case 1:
+				return []byte{toA1, byte(i + 6)}
+			default:
+				return []byte{toA2, byte(i + 6)}
+			}
+		}
+	}
+	// Anything else is given by its ZSCII code, in two halves.
+	return []byte{toA2, 6, char >> 5, char & 0x1F}
+}
 
-		words[j] = high
-		words[j+1] = low
+// Returns the Unicode characters of ZSCII codes from 155: the story's own
+// translation table, from version 5, or the default.
+func (this *ZMachine) characterTable() []rune {
+	if this.unicode != nil {
+		return this.unicode
 	}
+	return extraCharacters[:]
+}
 
-	return words
+// Reads the Unicode translation table given by the header extension, if the
+// story has one.
+func (this *ZMachine) readUnicodeTable() []rune {
+	extension := int(this.number(0x36))
+	if this.version < 5 || extension == 0 || extension+8 > len(this.memory) || this.number(extension) < 3 {
+		return nil
+	}
+	table := int(this.number(extension + 6))
+	if table == 0 || table >= len(this.memory) {
+		return nil
+	}
+	count := int(this.memory[table])
+	if count > 97 || table+1+2*count > len(this.memory) {
+		return nil
+	}
+	characters := make([]rune, count)
+	for i := range characters {
+		characters[i] = rune(this.number(table + 1 + 2*i))
+	}
+	return characters
 }
 
-func zcharFromZSCIIChar(char byte) []byte {
-	specialCases := map[byte]byte{
-		'\n': 1,
-		'.':  12,
-		',':  13,
-		'!':  14,
-		'?':  15,
-		'_':  16,
-		'#':  17,
-		'\'': 18,
-		'"':  19,
-		'/':  20,
-		'\\': 21,
-		'-':  22,
-		':':  23,
-		'(':  24,
-		')':  25,
+// Converts text to ZSCII, as the player might type it, using characters as
+// the codes from 155. Characters which ZSCII lacks are spelt without accents
+// where possible, and otherwise become question marks.
+func zsciiFromString(s string, characters []rune) []byte {
+	zscii := make([]byte, 0, len(s))
+	for _, r := range s {
+		if char, ok := zsciiFromRune(r, characters); ok {
+			zscii = append(zscii, char)
+			continue
+		}
+		fallback, ok := unaccented[r]
+		if !ok {
+			fallback = "?"
+		}
+		for _, r := range fallback {
+			char, _ := zsciiFromRune(r, characters)
+			zscii = append(zscii, char)
+		}
 	}
+	return zscii
+}
 
+func zsciiFromRune(r rune, characters []rune) (byte, bool) {
 	switch {
-	case char >= 'a' && char <= 'z':
-		return []byte{char - 'a' + 6}
-	case char >= 'A' && char <= 'Z':
-		return []byte{4, char - 'A' + 6}
-	case char == ' ':
-		return []byte{0}
-	case char >= '0' && char <= '9':
-		return []byte{5, char - '0' + 8}
+	case r >= 32 && r <= 126:
+		return byte(r), true
+	case r == '\n':
+		return 13, true
 	}
-	return []byte{5, specialCases[char] + 6}
+	for i, char := range characters {
+		if char == r {
+			return byte(155 + i), true
+		}
+	}
+	return '?', false
+}
+
+// Plain spellings of the default extra characters, for stories whose tables
+// leave them out.
+var unaccented = map[rune]string{
+	'ä': "a", 'ö': "o", 'ü': "u", 'Ä': "A", 'Ö': "O", 'Ü': "U", 'ß': "ss", '«': "\"", '»': "\"",
+	'ë': "e", 'ï': "i", 'ÿ': "y", 'Ë': "E", 'Ï': "I", 'á': "a", 'é': "e", 'í': "i", 'ó': "o",
+	'ú': "u", 'ý': "y", 'Á': "A", 'É': "E", 'Í': "I", 'Ó': "O", 'Ú': "U", 'Ý': "Y", 'à': "a",
+	'è': "e", 'ì': "i", 'ò': "o", 'ù': "u", 'À': "A", 'È': "E", 'Ì': "I", 'Ò': "O", 'Ù': "U",
+	'â': "a", 'ê': "e", 'î': "i", 'ô': "o", 'û': "u", 'Â': "A", 'Ê': "E", 'Î': "I", 'Ô': "O",
+	'Û': "U", 'å': "a", 'Å': "A", 'ø': "o", 'Ø': "O", 'ã': "a", 'ñ': "n", 'õ': "o", 'Ã': "A",
+	'Ñ': "N", 'Õ': "O", 'æ': "ae", 'Æ': "AE", 'ç': "c", 'Ç': "C", 'þ': "th", 'ð': "dh", 'Þ': "Th",
+	'Ð': "Dh", '£': "L", 'œ': "oe", 'Œ': "OE", '¡': "!", '¿': "?",
 }
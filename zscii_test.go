@@ -0,0 +1,134 @@
+package zmachine
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Splits an encoded Z-string into its Z-characters.
+func zcharsOf(encoded []byte) []byte {
+	var zchars []byte
+	for i := 0; i+1 < len(encoded); i += 2 {
+		word := int(encoded[i])<<8 | int(encoded[i+1])
+		zchars = append(zchars, byte(word>>10&0x1F), byte(word>>5&0x1F), byte(word&0x1F))
+	}
+	return zchars
+}
+
+// Returns a version 5 story whose alphabet table at 0x360 has A0 backwards,
+// digits in A1 and lower case letters in A2.
+func alphabetStory() []byte {
+	story := testStory(5)
+	story[0x34], story[0x35] = 0x03, 0x60
+	copy(story[0x360:], "zyxwvutsrqponmlkjihgfedcba")
+	copy(story[0x37A:], "0123456789ABCDEFGHIJKLMNOP")
+	copy(story[0x394:], "??abcdefghijklmnopqrstuvwx")
+	return story
+}
+
+func TestStoryAlphabets(t *testing.T) {
+	machine := testMachine(t, alphabetStory())
+	for _, test := range []struct {
+		text   string
+		zchars []byte
+	}{
+		{"za", []byte{6, 31}},
+		{"7B", []byte{4, 13, 4, 17}},
+		{"Q\n", []byte{5, 6, 2, 17, 5, 7}}, // Escaped, as no alphabet has it
+	} {
+		// Encoded strings are padded with 5s to whole words.
+		padded := append([]byte{}, test.zchars...)
+		for len(padded)%3 != 0 {
+			padded = append(padded, 5)
+		}
+		zscii := ZSCIIString{[]byte(test.text), machine}
+		encoded := zscii.ZString(len(padded) / 3 * 2)
+		if zchars := zcharsOf(encoded); !bytes.Equal(zchars, padded) {
+			t.Errorf("encoded %q as %v, want %v", test.text, zchars, padded)
+		}
+		zstring := ZString{test.zchars, machine}
+		if decoded := zstring.ZSCIIString(); string(decoded.bytes) != test.text {
+			t.Errorf("decoded %v as %q", test.zchars, decoded.bytes)
+		}
+	}
+
+	// The alphabet table's first two characters of A2 can't be replaced.
+	if alphabets := machine.alphabetTable(); alphabets[2][0] != ' ' || alphabets[2][1] != '\n' {
+		t.Errorf("A2 starts %q", alphabets[2][:2])
+	}
+}
+
+func TestDefaultAlphabets(t *testing.T) {
+	// Only version 5 stories may have their own alphabets.
+	story := alphabetStory()
+	story[0] = 3
+	machine := testMachine(t, story)
+	zscii := ZSCIIString{[]byte("a0"), machine}
+	if zchars := zcharsOf(zscii.ZString(2)); !bytes.Equal(zchars, []byte{6, 5, 8}) {
+		t.Errorf("version 3 encoded as %v", zchars)
+	}
+
+	// Version 1 has no newline in A2, but has '<', and shifts from one
+	// alphabet to the next.
+	zstring := ZString{[]byte{3, 7, 3, 27}, &ZMachine{version: 1}}
+	if decoded := zstring.ZSCIIString(); string(decoded.bytes) != "0<" {
+		t.Errorf("version 1 decoded %q", decoded.bytes)
+	}
+}
+
+func TestEncodeTextRoundTrip(t *testing.T) {
+	for _, version := range []byte{1, 2, 3, 5} {
+		for _, text := range []string{"", "a", "Hello, World!\n", "<1 café> ¿Qué?", "x_y-z/2(3)"} {
+			story := testStory(version)
+			encoded := EncodeText(story, text, 0)
+			if len(encoded) == 0 || len(encoded)%2 != 0 || encoded[len(encoded)-2]&0x80 == 0 {
+				t.Errorf("version %d encoded %q as %v", version, text, encoded)
+				continue
+			}
+			copy(story[0x360:], encoded)
+			if decoded, err := decodeText(story, 0x360, version); err != nil || decoded != text {
+				t.Errorf("version %d decoded %q as %q, %v", version, text, decoded, err)
+			}
+		}
+	}
+}
+
+func TestEncodeTextEscapes(t *testing.T) {
+	for _, test := range []struct {
+		version byte
+		text    string
+		zchars  []byte
+	}{
+		// Characters in no alphabet are given in ten bits after the escape.
+		{3, "é", []byte{5, 6, 5, 10, 5, 5}}, // ZSCII 170
+		{3, "<", []byte{5, 6, 1, 28, 5, 5}},
+		{1, "<", []byte{3, 27, 5}},
+		{3, "A\n", []byte{4, 6, 5, 7, 5, 5}},
+		{2, "A\n", []byte{2, 6, 3, 7, 5, 5}},
+		{1, "A\n", []byte{2, 6, 1}},
+	} {
+		encoded := EncodeText(testStory(test.version), test.text, 0)
+		if zchars := zcharsOf(encoded); !bytes.Equal(zchars, test.zchars) {
+			t.Errorf("version %d encoded %q as %v, want %v", test.version, test.text, zchars, test.zchars)
+		}
+	}
+
+	// Dictionary words are cut off, even part way through an escape.
+	if zchars := zcharsOf(EncodeText(testStory(3), "abcdeé", 4)); !bytes.Equal(zchars, []byte{6, 7, 8, 9, 10, 5}) {
+		t.Errorf("cut off to %v", zchars)
+	}
+}
+
+func TestEncodeTextOpcode(t *testing.T) {
+	story := testStory(5)
+	copy(story[0x3C0:], "xhello")
+	copy(story[testRoutines+1:], []byte{
+		0xFC, 0x14, 0x03, 0xC0, 0x05, 0x01, 0x03, 0xE0, // encode_text 0x3C0 5 1 0x3E0
+		0xBA, // quit
+	})
+	machine := testMachine(t, story)
+	runTestMachine(machine)
+	if coded, want := machine.memory[0x3E0:0x3E6], EncodeText(story, "hello", 6); !bytes.Equal(coded, want) {
+		t.Errorf("encoded %v, want %v", coded, want)
+	}
+}
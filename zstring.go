@@ -34,21 +34,41 @@ func (this *ZString) Size() int {
 	return len(this.chars)
 }
 
-func (this *ZString) toZSCII(expand bool) ZSCIIString {
-	zscii := make([]byte, 0)
-	alphabet := 0
-	last_alphabet := 0
-	temporary := false
-
+// The alphabets A0, A1 and A2, from which Z-characters 6 to 31 are taken. In A2,
+// the first is the escape to a ten-bit ZSCII character, shown as a space.
+func defaultAlphabets(version byte) [3][26]byte {
 	a0 := [26]byte{'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z'}
 	a1 := [26]byte{'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O', 'P', 'Q', 'R', 'S', 'T', 'U', 'V', 'W', 'X', 'Y', 'Z'}
 	var a2 [26]byte
-	if this.z.version == 1 {
+	if version == 1 {
 		a2 = [26]byte{' ', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '.', ',', '!', '?', '_', '#', '\'', '"', '/', '\\', '<', '-', ':', '(', ')'}
 	} else {
 		a2 = [26]byte{' ', '\n', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '.', ',', '!', '?', '_', '#', '\'', '"', '/', '\\', '-', ':', '(', ')'}
 	}
-	alphabets := [3][26]byte{a0, a1, a2}
+	return [3][26]byte{a0, a1, a2}
+}
+
+// Returns the alphabets the story uses: its own, or the defaults for its
+// version. A nil machine has those of the later versions.
+func (this *ZMachine) alphabetTable() *[3][26]byte {
+	if this == nil {
+		alphabets := defaultAlphabets(3)
+		return &alphabets
+	}
+	if this.alphabets == nil {
+		alphabets := defaultAlphabets(this.version)
+		return &alphabets
+	}
+	return this.alphabets
+}
+
+func (this *ZString) toZSCII(expand bool) ZSCIIString {
+	zscii := make([]byte, 0)
+	alphabet := 0
+	last_alphabet := 0
+	temporary := false
+
+	alphabets := this.z.alphabetTable()
 
 	for i := 0; i < len(this.chars); i++ {
 		zchar := this.chars[i]